@@ -0,0 +1,13 @@
+module main
+
+go 1.27
+
+require pqcca v0.0.0
+
+require (
+	github.com/cloudflare/circl v1.6.3 // indirect
+	golang.org/x/crypto v0.45.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
+
+replace pqcca => ./pqcca
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"pqcca"
+)
+
+var (
+	mode      = flag.String("mode", "root", "root, issue or verify")
+	alg       = flag.String("alg", "ML-DSA-65", "key to generate: ML-DSA-44, ML-DSA-65, ML-DSA-87 or an SLH-DSA parameter set like SLH-DSA-SHA2-128s")
+	profile   = flag.String("profile", "", "root, intermediate, server, client, kem or a JSON profile file (default root for --mode=root, server for --mode=issue)")
+	caCert    = flag.String("ca-cert", "root-ca.crt", "issue: CA certificate")
+	caKey     = flag.String("ca-key", "root-ca.key", "issue: CA private key")
+	cn        = flag.String("cn", "", "subject CommonName")
+	org       = flag.String("org", "", "subject Organization")
+	dnsNames  = flag.String("dns", "", "comma separated DNS SANs")
+	ips       = flag.String("ip", "", "comma separated IP SANs")
+	emails    = flag.String("email", "", "comma separated email SANs")
+	uris      = flag.String("uri", "", "comma separated URI SANs")
+	pub       = flag.String("pub", "", "issue: subject's PUBLIC KEY PEM (eg an ML-KEM key), a new key is generated if empty")
+	out       = flag.String("out", "", "certificate to write")
+	keyOut    = flag.String("key-out", "", "private key to write when one is generated")
+	serial    = flag.String("serial", "", "decimal serial number, random if empty")
+	notBefore = flag.String("not-before", "", "RFC3339 start of validity, now if empty")
+	cert      = flag.String("cert", "server.crt", "verify: certificate to check")
+	chain     = flag.String("chain", "", "verify: comma separated intermediates, leaf's issuer first")
+	root      = flag.String("root", "root-ca.crt", "verify: trusted root")
+)
+
+func main() {
+	flag.Parse()
+
+	switch *mode {
+	case "root":
+		selfSign()
+	case "issue":
+		issue()
+	case "verify":
+		verify()
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func selfSign() {
+	p := loadProfile("root")
+	req := request()
+
+	log.Printf("======= generate %s CA key ========", *alg)
+	signer, err := pqcca.GenerateKey(*alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ca, err := pqcca.SelfSign(signer, p, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeKey(signer, "root-ca.key")
+	writeCertificate(ca.Certificate, "root-ca.crt")
+}
+
+func issue() {
+	p := loadProfile("server")
+	req := request()
+
+	log.Printf("======= load CA %s ========", *caCert)
+	ca, err := pqcca.NewCA(readCertificate(*caCert), readKey(*caKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var signer crypto.Signer
+	if *pub != "" {
+		b, err := os.ReadFile(*pub)
+		if err != nil {
+			log.Fatalf("can't read public key %v", err)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			log.Fatalf("no PUBLIC KEY in %s", *pub)
+		}
+		// passed through as is so keys pqcca can't parse, like ML-KEM, can be certified
+		req.PublicKeyInfo = block.Bytes
+	} else {
+		log.Printf("======= generate %s key ========", *alg)
+		signer, err = pqcca.GenerateKey(*alg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.PublicKey = signer.Public()
+	}
+
+	c, err := ca.Issue(p, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if signer != nil {
+		writeKey(signer, "server.key")
+	}
+	writeCertificate(c, "server.crt")
+}
+
+func verify() {
+	leaf := readCertificate(*cert)
+	var intermediates []*x509.Certificate
+	if *chain != "" {
+		for f := range strings.SplitSeq(*chain, ",") {
+			intermediates = append(intermediates, readCertificate(f))
+		}
+	}
+	r := readCertificate(*root)
+
+	log.Printf("======= verify %s ========", leaf.Subject)
+	if err := pqcca.VerifyChain(leaf, intermediates, r, time.Now()); err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range append(append([]*x509.Certificate{leaf}, intermediates...), r) {
+		fmt.Printf("  %s (%s)\n", c.Subject, pqcca.SignatureAlgorithm(c))
+	}
+	fmt.Println("chain verified")
+}
+
+func loadProfile(def string) pqcca.Profile {
+	name := *profile
+	if name == "" {
+		name = def
+	}
+	if p, ok := pqcca.Profiles[name]; ok {
+		return p
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		log.Fatalf("unknown profile %q: %v", name, err)
+	}
+	p, err := pqcca.ParseProfile(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return *p
+}
+
+func request() pqcca.Request {
+	req := pqcca.Request{
+		Subject: pkix.Name{CommonName: *cn},
+	}
+	if *org != "" {
+		req.Subject.Organization = []string{*org}
+	}
+	req.DNSNames = split(*dnsNames)
+	req.EmailAddresses = split(*emails)
+	for _, s := range split(*ips) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Fatalf("invalid IP address %q", s)
+		}
+		req.IPAddresses = append(req.IPAddresses, ip)
+	}
+	for _, s := range split(*uris) {
+		u, err := url.Parse(s)
+		if err != nil {
+			log.Fatalf("invalid URI %q: %v", s, err)
+		}
+		req.URIs = append(req.URIs, u)
+	}
+	if *serial != "" {
+		n, ok := new(big.Int).SetString(*serial, 10)
+		if !ok || n.Sign() <= 0 {
+			log.Fatalf("invalid serial number %q", *serial)
+		}
+		req.SerialNumber = n
+	}
+	if *notBefore != "" {
+		t, err := time.Parse(time.RFC3339, *notBefore)
+		if err != nil {
+			log.Fatalf("invalid not-before %v", err)
+		}
+		req.NotBefore = t
+	}
+	return req
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func readCertificate(path string) *x509.Certificate {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("can't read certificate %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		log.Fatalf("no CERTIFICATE in %s", path)
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("can't parse certificate %v", err)
+	}
+	return c
+}
+
+func readKey(path string) crypto.Signer {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("can't read key %v", err)
+	}
+	k, err := pqcca.ParsePrivateKey(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return k
+}
+
+func writeKey(k crypto.Signer, def string) {
+	path := *keyOut
+	if path == "" {
+		path = def
+	}
+	b, err := pqcca.MarshalPrivateKey(k)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		log.Fatalf("can't write key %v", err)
+	}
+	log.Printf("wrote %s", path)
+}
+
+func writeCertificate(c *x509.Certificate, def string) {
+	path := *out
+	if path == "" {
+		path = def
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		log.Fatalf("can't write certificate %v", err)
+	}
+	log.Printf("wrote %s: serial %s, valid until %s", path, c.SerialNumber, c.NotAfter.Format(time.RFC3339))
+}
@@ -0,0 +1,397 @@
+// Package pqcca is a small certificate authority for ML-DSA and SLH-DSA keys.
+//
+// It self-signs roots and issues intermediate and end entity certificates from a Profile, with the CA
+// key behind any crypto.Signer: a software key from GenerateKey, a TPM or a KMS.  Certificates are
+// built and signed here since crypto/x509 can't sign with SLH-DSA or issue for keys it can't marshal,
+// like ML-KEM, so issuance doesn't depend on openssl.  RSA and ECDSA CAs work too, so classical
+// hierarchies can certify ML-KEM keys with KEMProfile.
+//
+// It is its own module so the ML-KEM and TPM samples issue through the same code.
+package pqcca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Request is what the subject asks for.
+type Request struct {
+	Subject pkix.Name
+	// RawSubject is a DER Name used instead of Subject, so the certificate carries exactly the bytes a
+	// signed or MACed request covered
+	RawSubject []byte
+	// PublicKey is the subject's key, for a self-signed root it's ignored in favour of the CA's key
+	PublicKey crypto.PublicKey
+	// PublicKeyInfo is a DER SubjectPublicKeyInfo used instead of PublicKey, for keys that can't be
+	// marshaled here such as TPM ML-KEM keys
+	PublicKeyInfo  []byte
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// SerialNumber is random 128 bits if nil
+	SerialNumber *big.Int
+	// NotBefore is now if zero
+	NotBefore time.Time
+}
+
+// CA is a CA certificate and its key.
+type CA struct {
+	Certificate *x509.Certificate
+	Signer      crypto.Signer
+}
+
+// NewCA pairs a CA certificate with its key, making sure they match and that the certificate may sign.
+func NewCA(cert *x509.Certificate, signer crypto.Signer) (*CA, error) {
+	spki, err := MarshalPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(spki, cert.RawSubjectPublicKeyInfo) {
+		return nil, fmt.Errorf("pqcca: CA key does not match the certificate")
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("pqcca: %s is not a CA certificate", cert.Subject)
+	}
+	return &CA{Certificate: cert, Signer: signer}, nil
+}
+
+// SelfSign creates a root with signer's key.
+func SelfSign(signer crypto.Signer, profile Profile, req Request) (*CA, error) {
+	if !profile.IsCA {
+		return nil, fmt.Errorf("pqcca: a root needs a CA profile")
+	}
+	spki, err := MarshalPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	subject, err := req.subject()
+	if err != nil {
+		return nil, err
+	}
+	// a root's authority key identifier is its own, RFC 5280 4.2.1.1 allows leaving it out
+	profile.AuthorityKeyID = false
+	der, err := create(signer, subject, nil, profile, req, spki)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: issued certificate does not parse %v", err)
+	}
+	if err := CheckSignature(cert, cert); err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: cert, Signer: signer}, nil
+}
+
+// Issue signs a certificate for req with the CA's key.
+func (ca *CA) Issue(profile Profile, req Request) (*x509.Certificate, error) {
+	spki := req.PublicKeyInfo
+	if spki == nil {
+		if req.PublicKey == nil {
+			return nil, fmt.Errorf("pqcca: request has no public key")
+		}
+		var err error
+		if spki, err = MarshalPublicKey(req.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	if profile.IsCA && ca.Certificate.MaxPathLenZero {
+		return nil, fmt.Errorf("pqcca: %s can't issue CA certificates", ca.Certificate.Subject)
+	}
+	if profile.IsCA && ca.Certificate.MaxPathLen > 0 && (profile.MaxPathLen < 0 || profile.MaxPathLen >= ca.Certificate.MaxPathLen) {
+		// keep the new CA inside its issuer's path length
+		profile.MaxPathLen = ca.Certificate.MaxPathLen - 1
+	}
+	subject, err := req.subject()
+	if err != nil {
+		return nil, err
+	}
+	der, err := create(ca.Signer, subject, ca.Certificate, profile, req, spki)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: issued certificate does not parse %v", err)
+	}
+	if err := CheckSignature(cert, ca.Certificate); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// subject returns RawSubject, or Subject marshaled if it's empty.
+func (req *Request) subject() ([]byte, error) {
+	if len(req.RawSubject) != 0 {
+		var rdns pkix.RDNSequence
+		if rest, err := asn1.Unmarshal(req.RawSubject, &rdns); err != nil || len(rest) != 0 {
+			return nil, fmt.Errorf("pqcca: can't parse subject")
+		}
+		return req.RawSubject, nil
+	}
+	subject, err := asn1.Marshal(req.Subject.ToRDNSequence())
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't marshal subject %v", err)
+	}
+	return subject, nil
+}
+
+type tbsCertificate struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm algorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           validity
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+	Extensions         []pkix.Extension `asn1:"optional,explicit,tag:3"`
+}
+
+type validity struct {
+	NotBefore, NotAfter time.Time
+}
+
+type certificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm algorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+const (
+	certificateVersion3 = 2
+	subjectKeyIdLength  = 20
+	serialNumberBits    = 128
+)
+
+// create builds and signs the certificate, parent is nil for a self-signed one.
+func create(signer crypto.Signer, subject []byte, parent *x509.Certificate, profile Profile, req Request, spki []byte) ([]byte, error) {
+	if err := profile.check(); err != nil {
+		return nil, err
+	}
+	sigAlg, hash, err := signatureAlgorithm(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	var info subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(spki, &info); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("pqcca: can't parse subject public key")
+	}
+
+	serial := req.SerialNumber
+	if serial == nil {
+		serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialNumberBits))
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't generate serial number %v", err)
+		}
+	}
+	notBefore := req.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	notBefore = notBefore.UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(profile.Validity)
+
+	issuer := subject
+	var authorityKeyID []byte
+	if parent != nil {
+		issuer = parent.RawSubject
+		authorityKeyID = parent.SubjectKeyId
+		if notAfter.After(parent.NotAfter) {
+			// don't outlive the issuer
+			notAfter = parent.NotAfter
+		}
+	}
+
+	exts, err := extensions(profile, req, subject, info.PublicKey.Bytes, authorityKeyID)
+	if err != nil {
+		return nil, err
+	}
+	tbs, err := asn1.Marshal(tbsCertificate{
+		Version:            certificateVersion3,
+		SerialNumber:       serial,
+		SignatureAlgorithm: sigAlg,
+		Issuer:             asn1.RawValue{FullBytes: issuer},
+		Validity:           validity{NotBefore: notBefore, NotAfter: notAfter},
+		Subject:            asn1.RawValue{FullBytes: subject},
+		PublicKey:          asn1.RawValue{FullBytes: spki},
+		Extensions:         exts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't marshal TBSCertificate %v", err)
+	}
+	// pure ML-DSA and SLH-DSA sign the message itself with an empty context, RSA and ECDSA its hash
+	signed := tbs
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		signed = h.Sum(nil)
+	}
+	sig, err := signer.Sign(rand.Reader, signed, hash)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't sign certificate %v", err)
+	}
+	der, err := asn1.Marshal(certificate{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't marshal certificate %v", err)
+	}
+	return der, nil
+}
+
+var (
+	oidExtensionSubjectKeyId     = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionSubjectAltName   = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+	oidExtensionAuthorityKeyId   = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:             {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageTimeStamping:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+const (
+	generalNameEmail = 1
+	generalNameDNS   = 2
+	generalNameURI   = 6
+	generalNameIP    = 7
+)
+
+type basicConstraints struct {
+	IsCA       bool `asn1:"optional"`
+	MaxPathLen int  `asn1:"optional,default:-1"`
+}
+
+// extensions returns the extensions of profile in the order crypto/x509 writes them.
+func extensions(profile Profile, req Request, subject, publicKey, authorityKeyID []byte) ([]pkix.Extension, error) {
+	var exts []pkix.Extension
+	if profile.KeyUsage != 0 {
+		ku, err := asn1.Marshal(keyUsageBits(profile.KeyUsage))
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't marshal keyUsage %v", err)
+		}
+		exts = append(exts, pkix.Extension{Id: oidExtensionKeyUsage, Critical: true, Value: ku})
+	}
+	if len(profile.ExtKeyUsage) > 0 {
+		var oids []asn1.ObjectIdentifier
+		for _, u := range profile.ExtKeyUsage {
+			oid, ok := extKeyUsageOIDs[u]
+			if !ok {
+				return nil, fmt.Errorf("pqcca: unsupported extended key usage %v", u)
+			}
+			oids = append(oids, oid)
+		}
+		eku, err := asn1.Marshal(oids)
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't marshal extKeyUsage %v", err)
+		}
+		exts = append(exts, pkix.Extension{Id: oidExtensionExtendedKeyUsage, Value: eku})
+	}
+
+	bc := basicConstraints{IsCA: profile.IsCA, MaxPathLen: -1}
+	if profile.IsCA {
+		bc.MaxPathLen = profile.MaxPathLen
+	}
+	bcExt, err := asn1.Marshal(bc)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't marshal basicConstraints %v", err)
+	}
+	exts = append(exts, pkix.Extension{Id: oidExtensionBasicConstraints, Critical: true, Value: bcExt})
+
+	if profile.SubjectKeyID {
+		ski, err := asn1.Marshal(SubjectKeyID(publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't marshal subjectKeyIdentifier %v", err)
+		}
+		exts = append(exts, pkix.Extension{Id: oidExtensionSubjectKeyId, Value: ski})
+	}
+	if profile.AuthorityKeyID && len(authorityKeyID) > 0 {
+		aki, err := asn1.Marshal(struct {
+			ID []byte `asn1:"optional,tag:0"`
+		}{authorityKeyID})
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't marshal authorityKeyIdentifier %v", err)
+		}
+		exts = append(exts, pkix.Extension{Id: oidExtensionAuthorityKeyId, Value: aki})
+	}
+
+	if san, ok, err := SubjectAltName(req, subject); err != nil {
+		return nil, err
+	} else if ok {
+		exts = append(exts, san)
+	}
+	return exts, nil
+}
+
+// SubjectAltName returns the subjectAltName extension for the names of req, ok is false if it has none.
+// subject is the DER Name the extension goes with.
+func SubjectAltName(req Request, subject []byte) (ext pkix.Extension, ok bool, err error) {
+	var names []asn1.RawValue
+	for _, e := range req.EmailAddresses {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: generalNameEmail, Bytes: []byte(e)})
+	}
+	for _, n := range req.DNSNames {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: generalNameDNS, Bytes: []byte(n)})
+	}
+	for _, u := range req.URIs {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: generalNameURI, Bytes: []byte(u.String())})
+	}
+	for _, ip := range req.IPAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: generalNameIP, Bytes: ip})
+	}
+	if len(names) == 0 {
+		return pkix.Extension{}, false, nil
+	}
+	san, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, false, fmt.Errorf("pqcca: can't marshal subjectAltName %v", err)
+	}
+	// the SAN is critical when it's the only name, RFC 5280 4.2.1.6; an empty Name is SEQUENCE {}
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Critical: bytes.Equal(subject, []byte{0x30, 0x00}), Value: san}, true, nil
+}
+
+// SubjectKeyID is the key identifier of a subjectPublicKey: the first 160 bits of its SHA-256, RFC 7093
+// method 1.
+func SubjectKeyID(publicKey []byte) []byte {
+	h := sha256.Sum256(publicKey)
+	return h[:subjectKeyIdLength]
+}
+
+// keyUsageBits is the KeyUsage BIT STRING, bit 0 (digitalSignature) is the most significant bit of the
+// first byte and trailing zero bits are dropped.
+func keyUsageBits(ku x509.KeyUsage) asn1.BitString {
+	var b [2]byte
+	b[0] = bits.Reverse8(byte(ku))
+	b[1] = bits.Reverse8(byte(ku >> 8))
+	n := 16
+	for n > 0 && b[(n-1)/8]&(0x80>>((n-1)%8)) == 0 {
+		n--
+	}
+	return asn1.BitString{Bytes: b[:(n+7)/8], BitLength: n}
+}
@@ -0,0 +1,201 @@
+package pqcca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testAlgorithms = []string{"ML-DSA-44", "ML-DSA-65", "ML-DSA-87", "SLH-DSA-SHA2-128f"}
+
+type testChain struct {
+	root, intermediate *CA
+	leaf               *x509.Certificate
+}
+
+func generateKey(t *testing.T, alg string) crypto.Signer {
+	t.Helper()
+	k, err := GenerateKey(alg)
+	if err != nil {
+		t.Fatalf("GenerateKey(%s) = %v", alg, err)
+	}
+	return k
+}
+
+// issueChain issues root -> intermediate -> server leaf, all with alg keys.
+func issueChain(t *testing.T, alg string) testChain {
+	t.Helper()
+	root, err := SelfSign(generateKey(t, alg), RootProfile, Request{
+		Subject: pkix.Name{CommonName: alg + " root"},
+	})
+	if err != nil {
+		t.Fatalf("SelfSign() = %v", err)
+	}
+	intermediateKey := generateKey(t, alg)
+	intermediateCert, err := root.Issue(IntermediateProfile, Request{
+		Subject:   pkix.Name{CommonName: alg + " intermediate"},
+		PublicKey: intermediateKey.Public(),
+	})
+	if err != nil {
+		t.Fatalf("Issue(intermediate) = %v", err)
+	}
+	intermediate, err := NewCA(intermediateCert, intermediateKey)
+	if err != nil {
+		t.Fatalf("NewCA() = %v", err)
+	}
+	leaf, err := intermediate.Issue(ServerProfile, Request{
+		Subject:   pkix.Name{CommonName: "server.example.com"},
+		PublicKey: generateKey(t, alg).Public(),
+		DNSNames:  []string{"server.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Issue(server) = %v", err)
+	}
+	return testChain{root: root, intermediate: intermediate, leaf: leaf}
+}
+
+func TestIssueChain(t *testing.T) {
+	for _, alg := range testAlgorithms {
+		t.Run(alg, func(t *testing.T) {
+			c := issueChain(t, alg)
+			root, intermediate, leaf := c.root.Certificate, c.intermediate.Certificate, c.leaf
+			if err := VerifyChain(leaf, []*x509.Certificate{intermediate}, root, time.Now()); err != nil {
+				t.Fatalf("VerifyChain() = %v", err)
+			}
+
+			// basicConstraints and path length
+			if !root.BasicConstraintsValid || !root.IsCA || root.MaxPathLen != -1 {
+				t.Errorf("root: cA %t, pathLen %d, want a CA without pathLenConstraint", root.IsCA, root.MaxPathLen)
+			}
+			if !intermediate.BasicConstraintsValid || !intermediate.IsCA || intermediate.MaxPathLen != 0 || !intermediate.MaxPathLenZero {
+				t.Errorf("intermediate: cA %t, pathLen %d, want a CA with pathLenConstraint 0", intermediate.IsCA, intermediate.MaxPathLen)
+			}
+			if !leaf.BasicConstraintsValid || leaf.IsCA {
+				t.Errorf("leaf: cA %t, want an end entity", leaf.IsCA)
+			}
+			if _, err := c.intermediate.Issue(IntermediateProfile, Request{
+				Subject:   pkix.Name{CommonName: alg + " sub CA"},
+				PublicKey: generateKey(t, alg).Public(),
+			}); err == nil {
+				t.Errorf("intermediate with pathLenConstraint 0 issued a CA certificate")
+			}
+
+			// key usages
+			for _, cert := range []*x509.Certificate{root, intermediate} {
+				if cert.KeyUsage != x509.KeyUsageCertSign|x509.KeyUsageCRLSign || len(cert.ExtKeyUsage) != 0 {
+					t.Errorf("%s: key usage %b, ext key usage %v", cert.Subject, cert.KeyUsage, cert.ExtKeyUsage)
+				}
+			}
+			if leaf.KeyUsage != x509.KeyUsageDigitalSignature || !slices.Equal(leaf.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+				t.Errorf("leaf: key usage %b, ext key usage %v", leaf.KeyUsage, leaf.ExtKeyUsage)
+			}
+			if !slices.Equal(leaf.DNSNames, []string{"server.example.com"}) {
+				t.Errorf("leaf: DNSNames = %v", leaf.DNSNames)
+			}
+
+			// key identifiers
+			for _, cert := range []*x509.Certificate{root, intermediate, leaf} {
+				if len(cert.SubjectKeyId) != 20 {
+					t.Errorf("%s: subject key identifier %x", cert.Subject, cert.SubjectKeyId)
+				}
+			}
+			if len(root.AuthorityKeyId) != 0 {
+				t.Errorf("root: authority key identifier %x", root.AuthorityKeyId)
+			}
+			if !bytes.Equal(intermediate.AuthorityKeyId, root.SubjectKeyId) {
+				t.Errorf("intermediate: authority key identifier %x, want %x", intermediate.AuthorityKeyId, root.SubjectKeyId)
+			}
+			if !bytes.Equal(leaf.AuthorityKeyId, intermediate.SubjectKeyId) {
+				t.Errorf("leaf: authority key identifier %x, want %x", leaf.AuthorityKeyId, intermediate.SubjectKeyId)
+			}
+		})
+	}
+}
+
+// TestVerifyChainWrongIssuer checks that a leaf doesn't chain through an intermediate with the same name
+// but another key, and that a chain doesn't verify to a root with the same name but another key.
+func TestVerifyChainWrongIssuer(t *testing.T) {
+	for _, alg := range testAlgorithms {
+		t.Run(alg, func(t *testing.T) {
+			c := issueChain(t, alg)
+
+			otherKey := generateKey(t, alg)
+			otherCert, err := c.root.Issue(IntermediateProfile, Request{
+				Subject:   c.intermediate.Certificate.Subject,
+				PublicKey: otherKey.Public(),
+			})
+			if err != nil {
+				t.Fatalf("Issue(intermediate) = %v", err)
+			}
+			if !bytes.Equal(otherCert.RawSubject, c.intermediate.Certificate.RawSubject) {
+				t.Fatalf("intermediates have different subjects")
+			}
+			otherRoot, err := SelfSign(generateKey(t, alg), RootProfile, Request{
+				Subject: c.root.Certificate.Subject,
+			})
+			if err != nil {
+				t.Fatalf("SelfSign() = %v", err)
+			}
+			unrelatedRoot, err := SelfSign(generateKey(t, alg), RootProfile, Request{
+				Subject: pkix.Name{CommonName: alg + " other root"},
+			})
+			if err != nil {
+				t.Fatalf("SelfSign() = %v", err)
+			}
+
+			for _, tc := range []struct {
+				name         string
+				intermediate *x509.Certificate
+				root         *x509.Certificate
+			}{
+				{"other intermediate key", otherCert, c.root.Certificate},
+				{"other root key", c.intermediate.Certificate, otherRoot.Certificate},
+				{"other root name", c.intermediate.Certificate, unrelatedRoot.Certificate},
+			} {
+				if err := VerifyChain(c.leaf, []*x509.Certificate{tc.intermediate}, tc.root, time.Now()); err == nil {
+					t.Errorf("%s: VerifyChain() succeeded", tc.name)
+				}
+			}
+			if err := CheckSignature(c.leaf, otherCert); err == nil {
+				t.Errorf("CheckSignature() with the other intermediate succeeded")
+			}
+		})
+	}
+}
+
+// TestIssueRawSubject checks that RawSubject is copied as is, even where marshaling Subject would encode
+// it differently.
+func TestIssueRawSubject(t *testing.T) {
+	c := issueChain(t, "ML-DSA-44")
+	// CN=kem as a UTF8String, Subject.ToRDNSequence would use a PrintableString
+	rawSubject, err := asn1.Marshal(pkix.RDNSequence{{{
+		Type:  asn1.ObjectIdentifier{2, 5, 4, 3},
+		Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: []byte("kem")},
+	}}})
+	if err != nil {
+		t.Fatalf("asn1.Marshal() = %v", err)
+	}
+	cert, err := c.intermediate.Issue(ClientProfile, Request{
+		Subject:    pkix.Name{CommonName: "ignored"},
+		RawSubject: rawSubject,
+		PublicKey:  generateKey(t, "ML-DSA-44").Public(),
+	})
+	if err != nil {
+		t.Fatalf("Issue() = %v", err)
+	}
+	if !bytes.Equal(cert.RawSubject, rawSubject) {
+		t.Fatalf("RawSubject = %x, want %x", cert.RawSubject, rawSubject)
+	}
+
+	if _, err := c.intermediate.Issue(ClientProfile, Request{
+		RawSubject: append(rawSubject, 0),
+		PublicKey:  generateKey(t, "ML-DSA-44").Public(),
+	}); err == nil {
+		t.Fatalf("Issue() with trailing data after the subject succeeded")
+	}
+}
@@ -0,0 +1,10 @@
+module pqcca
+
+go 1.27
+
+require github.com/cloudflare/circl v1.6.3
+
+require (
+	golang.org/x/crypto v0.30.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
@@ -0,0 +1,249 @@
+package pqcca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/circl/sign/slhdsa"
+)
+
+var (
+	oidMLDSA44 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 17}
+	oidMLDSA65 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 18}
+	oidMLDSA87 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 19}
+
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+
+	// RSA signature algorithms have NULL parameters, RFC 4055 5
+	asn1Null = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+// slhdsaOIDs are the RFC 9909 identifiers of the SLH-DSA parameter sets, used for both the key and the
+// signature algorithm.
+var slhdsaOIDs = map[slhdsa.ID]asn1.ObjectIdentifier{
+	slhdsa.SHA2_128s:  {2, 16, 840, 1, 101, 3, 4, 3, 20},
+	slhdsa.SHA2_128f:  {2, 16, 840, 1, 101, 3, 4, 3, 21},
+	slhdsa.SHA2_192s:  {2, 16, 840, 1, 101, 3, 4, 3, 22},
+	slhdsa.SHA2_192f:  {2, 16, 840, 1, 101, 3, 4, 3, 23},
+	slhdsa.SHA2_256s:  {2, 16, 840, 1, 101, 3, 4, 3, 24},
+	slhdsa.SHA2_256f:  {2, 16, 840, 1, 101, 3, 4, 3, 25},
+	slhdsa.SHAKE_128s: {2, 16, 840, 1, 101, 3, 4, 3, 26},
+	slhdsa.SHAKE_128f: {2, 16, 840, 1, 101, 3, 4, 3, 27},
+	slhdsa.SHAKE_192s: {2, 16, 840, 1, 101, 3, 4, 3, 28},
+	slhdsa.SHAKE_192f: {2, 16, 840, 1, 101, 3, 4, 3, 29},
+	slhdsa.SHAKE_256s: {2, 16, 840, 1, 101, 3, 4, 3, 30},
+	slhdsa.SHAKE_256f: {2, 16, 840, 1, 101, 3, 4, 3, 31},
+}
+
+func slhdsaID(oid asn1.ObjectIdentifier) (slhdsa.ID, bool) {
+	for id, o := range slhdsaOIDs {
+		if o.Equal(oid) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// subjectPublicKeyInfo is the SubjectPublicKeyInfo of RFC 5280, ML-DSA and SLH-DSA keys have no
+// algorithm parameters.
+type subjectPublicKeyInfo struct {
+	Algorithm algorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// pkcs8 is a PrivateKeyInfo without attributes.
+type pkcs8 struct {
+	Version    int
+	Algo       algorithmIdentifier
+	PrivateKey []byte
+}
+
+// GenerateKey generates a software key for alg, one of ML-DSA-44, ML-DSA-65, ML-DSA-87 or an
+// SLH-DSA parameter set name such as SLH-DSA-SHA2-128s.  Names are case insensitive.
+func GenerateKey(alg string) (crypto.Signer, error) {
+	switch strings.ToUpper(alg) {
+	case "ML-DSA-44":
+		return mldsa.GenerateKey(mldsa.MLDSA44())
+	case "ML-DSA-65":
+		return mldsa.GenerateKey(mldsa.MLDSA65())
+	case "ML-DSA-87":
+		return mldsa.GenerateKey(mldsa.MLDSA87())
+	}
+	id, err := slhdsa.IDByName(alg)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: unsupported algorithm %q", alg)
+	}
+	_, sk, err := slhdsa.GenerateKey(rand.Reader, id)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't generate %s key %v", id, err)
+	}
+	return &sk, nil
+}
+
+// MarshalPublicKey returns the DER SubjectPublicKeyInfo of an ML-DSA or SLH-DSA public key, or of
+// anything x509.MarshalPKIXPublicKey takes.
+func MarshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	var id slhdsa.ID
+	var raw []byte
+	switch k := pub.(type) {
+	case slhdsa.PublicKey:
+		id, raw = k.ID, slhdsaPublicBytes(&k)
+	case *slhdsa.PublicKey:
+		id, raw = k.ID, slhdsaPublicBytes(k)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't marshal public key %v", err)
+		}
+		return der, nil
+	}
+	oid, ok := slhdsaOIDs[id]
+	if !ok || raw == nil {
+		return nil, fmt.Errorf("pqcca: unsupported SLH-DSA parameter set %v", id)
+	}
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: algorithmIdentifier{Algorithm: oid},
+		PublicKey: asn1.BitString{Bytes: raw, BitLength: len(raw) * 8},
+	})
+}
+
+func slhdsaPublicBytes(k *slhdsa.PublicKey) []byte {
+	b, err := k.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// ParsePublicKey parses a DER SubjectPublicKeyInfo holding an ML-DSA or SLH-DSA key, anything else is
+// left to x509.ParsePKIXPublicKey.
+func ParsePublicKey(der []byte) (crypto.PublicKey, error) {
+	var info subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("pqcca: can't parse SubjectPublicKeyInfo")
+	}
+	id, ok := slhdsaID(info.Algorithm.Algorithm)
+	if !ok {
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("pqcca: can't parse public key %v", err)
+		}
+		return pub, nil
+	}
+	pub := &slhdsa.PublicKey{ID: id}
+	if err := pub.UnmarshalBinary(info.PublicKey.Bytes); err != nil {
+		return nil, fmt.Errorf("pqcca: can't parse %s public key %v", id, err)
+	}
+	return pub, nil
+}
+
+// MarshalPrivateKey returns a PKCS#8 "PRIVATE KEY" PEM: the seed only form for ML-DSA and the raw
+// private key in the OCTET STRING for SLH-DSA, as RFC 9909 and openssl write it.
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	var der []byte
+	var err error
+	switch k := key.(type) {
+	case *mldsa.PrivateKey:
+		der, err = x509.MarshalPKCS8PrivateKey(k)
+	case *slhdsa.PrivateKey:
+		oid, ok := slhdsaOIDs[k.ID]
+		if !ok {
+			return nil, fmt.Errorf("pqcca: unsupported SLH-DSA parameter set %v", k.ID)
+		}
+		var raw []byte
+		if raw, err = k.MarshalBinary(); err == nil {
+			der, err = asn1.Marshal(pkcs8{
+				Algo:       algorithmIdentifier{Algorithm: oid},
+				PrivateKey: raw,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("pqcca: can't marshal a %T, only software ML-DSA and SLH-DSA keys", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't marshal private key %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey parses the output of MarshalPrivateKey, or an openssl seed only or bare-seed key.
+func ParsePrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("pqcca: no PRIVATE KEY PEM block found")
+	}
+	var p pkcs8
+	if _, err := asn1.Unmarshal(block.Bytes, &p); err != nil {
+		return nil, fmt.Errorf("pqcca: can't unmarshal PKCS#8 %v", err)
+	}
+	if id, ok := slhdsaID(p.Algo.Algorithm); ok {
+		sk := &slhdsa.PrivateKey{ID: id}
+		if err := sk.UnmarshalBinary(p.PrivateKey); err != nil {
+			return nil, fmt.Errorf("pqcca: can't parse %s private key %v", id, err)
+		}
+		return sk, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pqcca: can't parse private key %v", err)
+	}
+	sk, ok := k.(*mldsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("pqcca: unsupported private key %T", k)
+	}
+	return sk, nil
+}
+
+// signatureAlgorithm returns the AlgorithmIdentifier of signatures made by pub and the hash to sign
+// with.  ML-DSA and SLH-DSA use the key's OID with no parameters and sign the message itself, the hash
+// is zero.  RSA and ECDSA CAs get the algorithm crypto/x509 would pick.
+func signatureAlgorithm(pub crypto.PublicKey) (algorithmIdentifier, crypto.Hash, error) {
+	switch k := pub.(type) {
+	case *mldsa.PublicKey:
+		switch k.Parameters() {
+		case mldsa.MLDSA44():
+			return algorithmIdentifier{Algorithm: oidMLDSA44}, 0, nil
+		case mldsa.MLDSA65():
+			return algorithmIdentifier{Algorithm: oidMLDSA65}, 0, nil
+		case mldsa.MLDSA87():
+			return algorithmIdentifier{Algorithm: oidMLDSA87}, 0, nil
+		}
+	case slhdsa.PublicKey:
+		if oid, ok := slhdsaOIDs[k.ID]; ok {
+			return algorithmIdentifier{Algorithm: oid}, 0, nil
+		}
+	case *slhdsa.PublicKey:
+		if oid, ok := slhdsaOIDs[k.ID]; ok {
+			return algorithmIdentifier{Algorithm: oid}, 0, nil
+		}
+	case *rsa.PublicKey:
+		return algorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1Null}, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return algorithmIdentifier{Algorithm: oidECDSAWithSHA256}, crypto.SHA256, nil
+		case elliptic.P384():
+			return algorithmIdentifier{Algorithm: oidECDSAWithSHA384}, crypto.SHA384, nil
+		case elliptic.P521():
+			return algorithmIdentifier{Algorithm: oidECDSAWithSHA512}, crypto.SHA512, nil
+		}
+	}
+	return algorithmIdentifier{}, 0, fmt.Errorf("pqcca: CA key must be ML-DSA, SLH-DSA, RSA or ECDSA, got %T", pub)
+}
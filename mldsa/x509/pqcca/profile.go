@@ -0,0 +1,184 @@
+package pqcca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Profile is what a certificate is for: its lifetime and the extensions that follow from its role.
+// The subject, SANs and serial number come with the Request.
+type Profile struct {
+	// Validity is the lifetime of the certificate from its NotBefore
+	Validity time.Duration
+	// IsCA sets cA in basicConstraints, the extension is in every certificate
+	IsCA bool
+	// MaxPathLen is the pathLenConstraint of a CA, -1 for none
+	MaxPathLen int
+	KeyUsage   x509.KeyUsage
+	// ExtKeyUsage is left out if empty
+	ExtKeyUsage []x509.ExtKeyUsage
+	// SubjectKeyID and AuthorityKeyID add those extensions, the key identifier is the first 160 bits of
+	// the SHA-256 of the subjectPublicKey (RFC 7093 method 1)
+	SubjectKeyID   bool
+	AuthorityKeyID bool
+}
+
+var (
+	// RootProfile is a self-signed root that can sign any number of intermediates.
+	RootProfile = Profile{
+		Validity:     10 * 365 * 24 * time.Hour,
+		IsCA:         true,
+		MaxPathLen:   -1,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyID: true,
+	}
+	// IntermediateProfile is an issuing CA that can only sign end entities.
+	IntermediateProfile = Profile{
+		Validity:       5 * 365 * 24 * time.Hour,
+		IsCA:           true,
+		MaxPathLen:     0,
+		KeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyID:   true,
+		AuthorityKeyID: true,
+	}
+	// ServerProfile is a TLS server certificate.
+	ServerProfile = Profile{
+		Validity:       365 * 24 * time.Hour,
+		MaxPathLen:     -1,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		SubjectKeyID:   true,
+		AuthorityKeyID: true,
+	}
+	// ClientProfile is a TLS client certificate.
+	ClientProfile = Profile{
+		Validity:       365 * 24 * time.Hour,
+		MaxPathLen:     -1,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		SubjectKeyID:   true,
+		AuthorityKeyID: true,
+	}
+	// KEMProfile is an end entity with an ML-KEM key, which can only be used for key establishment.
+	KEMProfile = Profile{
+		Validity:       365 * 24 * time.Hour,
+		MaxPathLen:     -1,
+		KeyUsage:       x509.KeyUsageKeyEncipherment,
+		SubjectKeyID:   true,
+		AuthorityKeyID: true,
+	}
+)
+
+// Profiles are the predefined profiles by name.
+var Profiles = map[string]Profile{
+	"root":         RootProfile,
+	"intermediate": IntermediateProfile,
+	"server":       ServerProfile,
+	"client":       ClientProfile,
+	"kem":          KEMProfile,
+}
+
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"keyCertSign":       x509.KeyUsageCertSign,
+	"cRLSign":           x509.KeyUsageCRLSign,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// profileJSON is the file form of a Profile, with RFC 5280 names for the key usages
+//
+//	{
+//	  "validity": "8760h",
+//	  "isCA": false,
+//	  "maxPathLen": -1,
+//	  "keyUsage": ["digitalSignature"],
+//	  "extKeyUsage": ["serverAuth", "clientAuth"],
+//	  "subjectKeyId": true,
+//	  "authorityKeyId": true
+//	}
+type profileJSON struct {
+	Validity       string   `json:"validity"`
+	IsCA           bool     `json:"isCA"`
+	MaxPathLen     *int     `json:"maxPathLen"`
+	KeyUsage       []string `json:"keyUsage"`
+	ExtKeyUsage    []string `json:"extKeyUsage"`
+	SubjectKeyID   bool     `json:"subjectKeyId"`
+	AuthorityKeyID bool     `json:"authorityKeyId"`
+}
+
+// ParseProfile parses a JSON profile, see profileJSON.  A missing maxPathLen means none.
+func ParseProfile(b []byte) (*Profile, error) {
+	var j profileJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, fmt.Errorf("pqcca: can't parse profile %v", err)
+	}
+	validity, err := time.ParseDuration(j.Validity)
+	if err != nil || validity <= 0 {
+		return nil, fmt.Errorf("pqcca: invalid validity %q", j.Validity)
+	}
+	p := &Profile{
+		Validity:       validity,
+		IsCA:           j.IsCA,
+		MaxPathLen:     -1,
+		SubjectKeyID:   j.SubjectKeyID,
+		AuthorityKeyID: j.AuthorityKeyID,
+	}
+	if j.MaxPathLen != nil {
+		p.MaxPathLen = *j.MaxPathLen
+	}
+	for _, n := range j.KeyUsage {
+		ku, ok := keyUsageNames[n]
+		if !ok {
+			return nil, fmt.Errorf("pqcca: unknown key usage %q", n)
+		}
+		p.KeyUsage |= ku
+	}
+	for _, n := range j.ExtKeyUsage {
+		eku, ok := extKeyUsageNames[n]
+		if !ok {
+			return nil, fmt.Errorf("pqcca: unknown extended key usage %q", n)
+		}
+		p.ExtKeyUsage = append(p.ExtKeyUsage, eku)
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// check rejects profiles RFC 5280 doesn't allow.
+func (p *Profile) check() error {
+	if p.Validity <= 0 {
+		return fmt.Errorf("pqcca: profile has no validity")
+	}
+	if p.IsCA && p.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("pqcca: a CA profile needs keyCertSign")
+	}
+	if !p.IsCA && p.KeyUsage&x509.KeyUsageCertSign != 0 {
+		return fmt.Errorf("pqcca: keyCertSign needs a CA profile")
+	}
+	if !p.IsCA && p.MaxPathLen >= 0 {
+		return fmt.Errorf("pqcca: only a CA profile can have maxPathLen")
+	}
+	if p.IsCA && !p.SubjectKeyID {
+		return fmt.Errorf("pqcca: a CA profile needs subjectKeyId")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package pqcca
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/circl/sign/slhdsa"
+)
+
+// CheckSignature verifies cert's signature with parent's key.  crypto/x509 checks ML-DSA but doesn't
+// know SLH-DSA, so both are done here; RSA and ECDSA are left to crypto/x509.
+func CheckSignature(cert, parent *x509.Certificate) error {
+	var c certificate
+	if _, err := asn1.Unmarshal(cert.Raw, &c); err != nil {
+		return fmt.Errorf("pqcca: can't parse certificate %v", err)
+	}
+	pub, err := ParsePublicKey(parent.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return err
+	}
+	want, hash, err := signatureAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+	if hash != 0 {
+		if err := parent.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+			return fmt.Errorf("pqcca: signature of %s does not verify %v", cert.Subject, err)
+		}
+		return nil
+	}
+	if !c.SignatureAlgorithm.Algorithm.Equal(want.Algorithm) {
+		return fmt.Errorf("pqcca: signature algorithm %v does not match the issuer key %v", c.SignatureAlgorithm.Algorithm, want.Algorithm)
+	}
+	switch k := pub.(type) {
+	case *mldsa.PublicKey:
+		if err := mldsa.Verify(k, cert.RawTBSCertificate, cert.Signature, nil); err != nil {
+			return fmt.Errorf("pqcca: signature of %s does not verify %v", cert.Subject, err)
+		}
+	case *slhdsa.PublicKey:
+		if !slhdsa.Verify(k, slhdsa.NewMessage(cert.RawTBSCertificate), cert.Signature, nil) {
+			return fmt.Errorf("pqcca: signature of %s does not verify", cert.Subject)
+		}
+	default:
+		return fmt.Errorf("pqcca: unsupported issuer key %T", pub)
+	}
+	return nil
+}
+
+// SignatureAlgorithm names the algorithm cert is signed with, including the SLH-DSA parameter sets
+// crypto/x509 reports as unknown.
+func SignatureAlgorithm(cert *x509.Certificate) string {
+	if cert.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		return cert.SignatureAlgorithm.String()
+	}
+	var c certificate
+	if _, err := asn1.Unmarshal(cert.Raw, &c); err == nil {
+		if id, ok := slhdsaID(c.SignatureAlgorithm.Algorithm); ok {
+			return id.String()
+		}
+		return c.SignatureAlgorithm.Algorithm.String()
+	}
+	return cert.SignatureAlgorithm.String()
+}
+
+// VerifyChain checks that leaf chains to root through intermediates, given leaf first: every signature,
+// issuer and subject names, the issuers' basicConstraints, keyCertSign and pathLenConstraint, and that
+// every certificate is valid at now.  The root is trusted as given, only its self-signature is checked.
+//
+// It doesn't do name constraints, policies or revocation; use crypto/x509 Verify for ML-DSA chains that
+// need those.
+func VerifyChain(leaf *x509.Certificate, intermediates []*x509.Certificate, root *x509.Certificate, now time.Time) error {
+	if err := CheckSignature(root, root); err != nil {
+		return err
+	}
+	chain := append([]*x509.Certificate{leaf}, intermediates...)
+	chain = append(chain, root)
+	for i, cert := range chain {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return fmt.Errorf("pqcca: %s is not valid at %s", cert.Subject, now.Format(time.RFC3339))
+		}
+		if i == len(chain)-1 {
+			break
+		}
+		parent := chain[i+1]
+		if !bytes.Equal(cert.RawIssuer, parent.RawSubject) {
+			return fmt.Errorf("pqcca: %s was not issued by %s", cert.Subject, parent.Subject)
+		}
+		if !parent.BasicConstraintsValid || !parent.IsCA {
+			return fmt.Errorf("pqcca: issuer %s is not a CA", parent.Subject)
+		}
+		if parent.KeyUsage != 0 && parent.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return fmt.Errorf("pqcca: issuer %s can't sign certificates", parent.Subject)
+		}
+		// chain[1:i+1] are the CAs below parent
+		if (parent.MaxPathLen > 0 || parent.MaxPathLenZero) && i > parent.MaxPathLen {
+			return fmt.Errorf("pqcca: path length constraint of %s exceeded", parent.Subject)
+		}
+		if err := CheckSignature(cert, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,5 +1,15 @@
 module main
 
-go 1.25.1
+go 1.27
 
-require golang.org/x/crypto v0.46.0
+require (
+	github.com/cloudflare/circl v1.6.3
+	pqcca v0.0.0
+)
+
+require (
+	golang.org/x/crypto v0.30.0 // indirect
+	golang.org/x/sys v0.39.0 // indirect
+)
+
+replace pqcca => ../../mldsa/x509/pqcca
@@ -0,0 +1,235 @@
+// Package kemcert issues and reads x509 certificates for ML-KEM keys on a stock Go toolchain.
+//
+// crypto/x509 can neither marshal nor parse ML-KEM public keys.  MarshalPKIXPublicKey encodes the key
+// for pqcca, which builds the certificate with KEMProfile and signs it with any crypto.Signer: RSA,
+// ECDSA, ML-DSA or SLH-DSA.  ParsePublicKey pulls the encapsulation key back out of the
+// SubjectPublicKeyInfo x509.ParseCertificate leaves unparsed.
+//
+// A KEM key can't sign a CSR, so CertificateRequest is unsigned and an Issuer only certifies a key after
+// the requester decapsulated a challenge to it, see pop.go.
+//
+// The certificates follow draft-ietf-lamps-kyber-certificates: the key has no algorithm parameters and
+// the only key usage is keyEncipherment.
+package kemcert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/mlkem"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem512"
+)
+
+// ParameterSet is an ML-KEM parameter set.
+type ParameterSet int
+
+const (
+	MLKEM512  ParameterSet = 512
+	MLKEM768  ParameterSet = 768
+	MLKEM1024 ParameterSet = 1024
+)
+
+var (
+	oidMLKEM512  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 1}
+	oidMLKEM768  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 2}
+	oidMLKEM1024 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 3}
+)
+
+func (p ParameterSet) String() string {
+	return fmt.Sprintf("ML-KEM-%d", int(p))
+}
+
+func (p ParameterSet) oid() (asn1.ObjectIdentifier, error) {
+	switch p {
+	case MLKEM512:
+		return oidMLKEM512, nil
+	case MLKEM768:
+		return oidMLKEM768, nil
+	case MLKEM1024:
+		return oidMLKEM1024, nil
+	}
+	return nil, fmt.Errorf("kemcert: unsupported parameter set %d", int(p))
+}
+
+// encapsulationKeySize is the size of the encoded encapsulation key of p, FIPS 203 table 3.
+func (p ParameterSet) encapsulationKeySize() int {
+	switch p {
+	case MLKEM512:
+		return mlkem512.PublicKeySize
+	case MLKEM768:
+		return mlkem.EncapsulationKeySize768
+	case MLKEM1024:
+		return mlkem.EncapsulationKeySize1024
+	}
+	return 0
+}
+
+// PublicKey is an ML-KEM encapsulation key.
+type PublicKey struct {
+	ParameterSet ParameterSet
+	// EncapsulationKey is the encoded key, the subjectPublicKey of the certificate
+	EncapsulationKey []byte
+}
+
+// NewPublicKey checks ek is an encoded encapsulation key of ps.
+func NewPublicKey(ps ParameterSet, ek []byte) (*PublicKey, error) {
+	if _, err := ps.oid(); err != nil {
+		return nil, err
+	}
+	if len(ek) != ps.encapsulationKeySize() {
+		return nil, fmt.Errorf("kemcert: %s encapsulation key is %d bytes, got %d", ps, ps.encapsulationKeySize(), len(ek))
+	}
+	return &PublicKey{ParameterSet: ps, EncapsulationKey: bytes.Clone(ek)}, nil
+}
+
+// NewPublicKeyFromEncapsulator returns the key of ek, an mlkem.EncapsulationKey768, 1024 or an
+// EncapsulationKey512.  The parameter set follows from the size of the key.
+func NewPublicKeyFromEncapsulator(ek crypto.Encapsulator) (*PublicKey, error) {
+	b := ek.Bytes()
+	for _, ps := range []ParameterSet{MLKEM512, MLKEM768, MLKEM1024} {
+		if len(b) == ps.encapsulationKeySize() {
+			return NewPublicKey(ps, b)
+		}
+	}
+	return nil, fmt.Errorf("kemcert: not an ML-KEM encapsulation key, %d bytes", len(b))
+}
+
+// Encapsulator returns k as a crypto.Encapsulator.
+func (k *PublicKey) Encapsulator() (crypto.Encapsulator, error) {
+	switch k.ParameterSet {
+	case MLKEM512:
+		return NewEncapsulationKey512(k.EncapsulationKey)
+	case MLKEM768:
+		ek, err := mlkem.NewEncapsulationKey768(k.EncapsulationKey)
+		if err != nil {
+			return nil, fmt.Errorf("kemcert: invalid encapsulation key %v", err)
+		}
+		return ek, nil
+	case MLKEM1024:
+		ek, err := mlkem.NewEncapsulationKey1024(k.EncapsulationKey)
+		if err != nil {
+			return nil, fmt.Errorf("kemcert: invalid encapsulation key %v", err)
+		}
+		return ek, nil
+	}
+	return nil, fmt.Errorf("kemcert: unsupported parameter set %d", int(k.ParameterSet))
+}
+
+// Encapsulate returns a shared key and the ciphertext to send to the holder of the decapsulation key.
+func (k *PublicKey) Encapsulate() (sharedKey, ciphertext []byte, err error) {
+	ek, err := k.Encapsulator()
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedKey, ciphertext = ek.Encapsulate()
+	return sharedKey, ciphertext, nil
+}
+
+//	SubjectPublicKeyInfo  ::=  SEQUENCE  {
+//	     algorithm            AlgorithmIdentifier,
+//	     subjectPublicKey     BIT STRING  }
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// MarshalPKIXPublicKey returns the DER SubjectPublicKeyInfo of k, the form of an openssl "PUBLIC KEY" PEM.
+func MarshalPKIXPublicKey(k *PublicKey) ([]byte, error) {
+	oid, err := k.ParameterSet.oid()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.EncapsulationKey) != k.ParameterSet.encapsulationKeySize() {
+		return nil, fmt.Errorf("kemcert: %s encapsulation key is %d bytes, got %d", k.ParameterSet, k.ParameterSet.encapsulationKeySize(), len(k.EncapsulationKey))
+	}
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oid},
+		PublicKey: asn1.BitString{Bytes: k.EncapsulationKey, BitLength: len(k.EncapsulationKey) * 8},
+	})
+}
+
+// ParsePKIXPublicKey parses a DER SubjectPublicKeyInfo holding an ML-KEM key.
+func ParsePKIXPublicKey(der []byte) (*PublicKey, error) {
+	var info subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("kemcert: can't parse SubjectPublicKeyInfo %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("kemcert: trailing data after SubjectPublicKeyInfo")
+	}
+	// the parameters MUST be absent
+	if len(info.Algorithm.Parameters.FullBytes) != 0 {
+		return nil, fmt.Errorf("kemcert: ML-KEM key has algorithm parameters")
+	}
+	var ps ParameterSet
+	switch alg := info.Algorithm.Algorithm; {
+	case alg.Equal(oidMLKEM512):
+		ps = MLKEM512
+	case alg.Equal(oidMLKEM768):
+		ps = MLKEM768
+	case alg.Equal(oidMLKEM1024):
+		ps = MLKEM1024
+	default:
+		return nil, fmt.Errorf("kemcert: not an ML-KEM public key %v", alg)
+	}
+	if info.PublicKey.BitLength != len(info.PublicKey.Bytes)*8 {
+		return nil, fmt.Errorf("kemcert: subjectPublicKey is not a whole number of bytes")
+	}
+	return NewPublicKey(ps, info.PublicKey.Bytes)
+}
+
+// ParsePublicKey returns the ML-KEM key of a certificate.  x509.ParseCertificate parses the rest of it
+// and leaves PublicKey nil with an UnknownPublicKeyAlgorithm.
+func ParsePublicKey(cert *x509.Certificate) (*PublicKey, error) {
+	if cert.KeyUsage != x509.KeyUsageKeyEncipherment {
+		return nil, fmt.Errorf("kemcert: an ML-KEM certificate must have keyEncipherment as its only key usage")
+	}
+	return ParsePKIXPublicKey(cert.RawSubjectPublicKeyInfo)
+}
+
+const (
+	generalNameEmail = 1
+	generalNameDNS   = 2
+	generalNameURI   = 6
+	generalNameIP    = 7
+)
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// parseSAN is the inverse of pqcca.SubjectAltName, other kinds of GeneralName are rejected.
+func parseSAN(der []byte) (dnsNames, emailAddresses []string, ipAddresses []net.IP, uris []*url.URL, err error) {
+	var names []asn1.RawValue
+	if rest, err := asn1.Unmarshal(der, &names); err != nil || len(rest) != 0 {
+		return nil, nil, nil, nil, fmt.Errorf("kemcert: can't parse subjectAltName")
+	}
+	for _, n := range names {
+		if n.Class != asn1.ClassContextSpecific {
+			return nil, nil, nil, nil, fmt.Errorf("kemcert: invalid subjectAltName")
+		}
+		switch n.Tag {
+		case generalNameEmail:
+			emailAddresses = append(emailAddresses, string(n.Bytes))
+		case generalNameDNS:
+			dnsNames = append(dnsNames, string(n.Bytes))
+		case generalNameURI:
+			u, err := url.Parse(string(n.Bytes))
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("kemcert: invalid URI in subjectAltName %v", err)
+			}
+			uris = append(uris, u)
+		case generalNameIP:
+			if len(n.Bytes) != net.IPv4len && len(n.Bytes) != net.IPv6len {
+				return nil, nil, nil, nil, fmt.Errorf("kemcert: invalid IP address in subjectAltName")
+			}
+			ipAddresses = append(ipAddresses, net.IP(n.Bytes))
+		default:
+			return nil, nil, nil, nil, fmt.Errorf("kemcert: unsupported subjectAltName type %d", n.Tag)
+		}
+	}
+	return dnsNames, emailAddresses, ipAddresses, uris, nil
+}
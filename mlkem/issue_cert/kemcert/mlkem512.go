@@ -0,0 +1,81 @@
+package kemcert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem512"
+)
+
+// DecapsulationKey512 is an ML-KEM-512 private key, which crypto/mlkem doesn't have.  Like
+// mlkem.DecapsulationKey768 it's a crypto.Decapsulator.
+type DecapsulationKey512 struct {
+	sk *mlkem512.PrivateKey
+	ek *EncapsulationKey512
+}
+
+// EncapsulationKey512 is an ML-KEM-512 public key, a crypto.Encapsulator.
+type EncapsulationKey512 struct {
+	pk *mlkem512.PublicKey
+}
+
+// GenerateKey512 generates an ML-KEM-512 key.
+func GenerateKey512() (*DecapsulationKey512, error) {
+	seed := make([]byte, mlkem512.KeySeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("kemcert: can't generate key %v", err)
+	}
+	return NewDecapsulationKey512(seed)
+}
+
+// NewDecapsulationKey512 expands the 64 byte seed (d || z) of an ML-KEM-512 key.
+func NewDecapsulationKey512(seed []byte) (*DecapsulationKey512, error) {
+	if len(seed) != mlkem512.KeySeedSize {
+		return nil, fmt.Errorf("kemcert: ML-KEM-512 seed is %d bytes, got %d", mlkem512.KeySeedSize, len(seed))
+	}
+	pk, sk := mlkem512.NewKeyFromSeed(seed)
+	return &DecapsulationKey512{sk: sk, ek: &EncapsulationKey512{pk: pk}}, nil
+}
+
+func (k *DecapsulationKey512) Encapsulator() crypto.Encapsulator {
+	return k.ek
+}
+
+func (k *DecapsulationKey512) EncapsulationKey() *EncapsulationKey512 {
+	return k.ek
+}
+
+func (k *DecapsulationKey512) Decapsulate(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) != mlkem512.CiphertextSize {
+		return nil, fmt.Errorf("kemcert: ML-KEM-512 ciphertext is %d bytes, got %d", mlkem512.CiphertextSize, len(ciphertext))
+	}
+	sharedKey := make([]byte, mlkem512.SharedKeySize)
+	k.sk.DecapsulateTo(sharedKey, ciphertext)
+	return sharedKey, nil
+}
+
+// NewEncapsulationKey512 parses an encoded ML-KEM-512 public key.
+func NewEncapsulationKey512(b []byte) (*EncapsulationKey512, error) {
+	pk, err := mlkem512.Scheme().UnmarshalBinaryPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("kemcert: invalid encapsulation key %v", err)
+	}
+	return &EncapsulationKey512{pk: pk.(*mlkem512.PublicKey)}, nil
+}
+
+func (k *EncapsulationKey512) Bytes() []byte {
+	b := make([]byte, mlkem512.PublicKeySize)
+	k.pk.Pack(b)
+	return b
+}
+
+func (k *EncapsulationKey512) Encapsulate() (sharedKey, ciphertext []byte) {
+	seed := make([]byte, mlkem512.EncapsulationSeedSize)
+	// crypto/rand.Read doesn't return errors
+	rand.Read(seed)
+	sharedKey = make([]byte, mlkem512.SharedKeySize)
+	ciphertext = make([]byte, mlkem512.CiphertextSize)
+	k.pk.EncapsulateTo(ciphertext, sharedKey, seed)
+	return sharedKey, ciphertext
+}
@@ -0,0 +1,220 @@
+package kemcert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"pqcca"
+)
+
+// Proof of possession for ML-KEM certificate requests.
+//
+//  1. the requester sends a CertificateRequest
+//  2. Issuer.Challenge encapsulates to the requested key and returns the ciphertext and a nonce
+//  3. the requester decapsulates and answers with Respond: an HMAC of the request under a key derived
+//     from the shared secret
+//  4. Issuer.Issue checks the response against the shared secret it kept and only then has pqcca sign
+//     the certificate with KEMProfile
+//
+// Only the holder of the decapsulation key can derive the shared secret, and the HMAC covers the whole
+// request so it can't be changed after the challenge.  A challenge can be answered once, before it
+// expires.
+
+const (
+	// DefaultChallengeTTL is how long a challenge can be answered.
+	DefaultChallengeTTL = 5 * time.Minute
+	// DefaultMaxPending is how many challenges can wait for an answer at once.
+	DefaultMaxPending  = 1024
+	challengeNonceSize = 32
+	popKeySize         = 32
+)
+
+const popInfo = "kemcert proof of possession v1"
+
+// Challenge is sent to the requester.
+type Challenge struct {
+	// Nonce identifies the challenge and salts the key derivation
+	Nonce []byte
+	// Ciphertext is encapsulated to the requested key
+	Ciphertext []byte
+}
+
+// Response is the requester's answer to a Challenge.
+type Response struct {
+	Nonce []byte
+	MAC   []byte
+}
+
+type pendingChallenge struct {
+	request   []byte
+	sharedKey []byte
+	expires   time.Time
+}
+
+// Issuer is a CA that certifies ML-KEM keys only after the requester proved it holds them.
+type Issuer struct {
+	CA *pqcca.CA
+	// Validity of issued certificates, the one of pqcca.KEMProfile if zero
+	Validity time.Duration
+	// ChallengeTTL is how long a challenge can be answered, DefaultChallengeTTL if zero
+	ChallengeTTL time.Duration
+	// MaxPending limits the unanswered challenges, DefaultMaxPending if zero.  Anyone can ask for a
+	// challenge, this bounds the memory they hold.
+	MaxPending int
+
+	mu      sync.Mutex
+	pending map[string]pendingChallenge
+}
+
+// NewIssuer returns an Issuer for ca.
+func NewIssuer(ca *pqcca.CA) *Issuer {
+	return &Issuer{
+		CA:      ca,
+		pending: map[string]pendingChallenge{},
+	}
+}
+
+// popKey derives the HMAC key of the response from the shared secret of the challenge.
+func popKey(sharedKey, nonce []byte) ([]byte, error) {
+	k, err := hkdf.Key(sha256.New, sharedKey, nonce, popInfo, popKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("kemcert: can't derive proof of possession key %v", err)
+	}
+	return k, nil
+}
+
+func popMAC(sharedKey, nonce, request []byte) ([]byte, error) {
+	k, err := popKey(sharedKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, k)
+	h.Write(request)
+	return h.Sum(nil), nil
+}
+
+// Challenge encapsulates a fresh shared secret to the key of req and remembers it until the response
+// comes back or the challenge expires.  It fails while MaxPending challenges are outstanding.
+func (ca *Issuer) Challenge(req *CertificateRequest) (*Challenge, error) {
+	sharedKey, ciphertext, err := req.PublicKey.Encapsulate()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("kemcert: can't generate nonce %v", err)
+	}
+	ttl := ca.ChallengeTTL
+	if ttl == 0 {
+		ttl = DefaultChallengeTTL
+	}
+	maxPending := ca.MaxPending
+	if maxPending == 0 {
+		maxPending = DefaultMaxPending
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.expire()
+	if ca.pending == nil {
+		ca.pending = map[string]pendingChallenge{}
+	}
+	if len(ca.pending) >= maxPending {
+		return nil, fmt.Errorf("kemcert: too many pending challenges")
+	}
+	ca.pending[string(nonce)] = pendingChallenge{
+		request:   req.Raw,
+		sharedKey: sharedKey,
+		expires:   time.Now().Add(ttl),
+	}
+	return &Challenge{Nonce: nonce, Ciphertext: ciphertext}, nil
+}
+
+// expire drops challenges nobody answered in time, ca.mu must be held.
+func (ca *Issuer) expire() {
+	now := time.Now()
+	for k, p := range ca.pending {
+		if now.After(p.expires) {
+			delete(ca.pending, k)
+		}
+	}
+}
+
+// Respond proves possession of the key of the request: it decapsulates the challenge with dk and MACs
+// the request with the result.  dk is an mlkem.DecapsulationKey768, 1024, a DecapsulationKey512 or a
+// key in hardware.
+func Respond(request []byte, ch *Challenge, dk crypto.Decapsulator) (*Response, error) {
+	req, err := ParseCertificateRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	// don't answer a challenge for someone else's key
+	pub, err := NewPublicKeyFromEncapsulator(dk.Encapsulator())
+	if err != nil {
+		return nil, err
+	}
+	if pub.ParameterSet != req.PublicKey.ParameterSet || !bytes.Equal(pub.EncapsulationKey, req.PublicKey.EncapsulationKey) {
+		return nil, fmt.Errorf("kemcert: decapsulation key does not match the request")
+	}
+	sharedKey, err := dk.Decapsulate(ch.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("kemcert: can't decapsulate challenge %v", err)
+	}
+	mac, err := popMAC(sharedKey, ch.Nonce, request)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Nonce: ch.Nonce, MAC: mac}, nil
+}
+
+// Issue checks the response to the challenge for req and, if it proves possession, returns the DER
+// certificate.  The challenge is used up whether or not the response is right.
+func (ca *Issuer) Issue(req *CertificateRequest, resp *Response) ([]byte, error) {
+	ca.mu.Lock()
+	p, ok := ca.pending[string(resp.Nonce)]
+	delete(ca.pending, string(resp.Nonce))
+	ca.mu.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		return nil, fmt.Errorf("kemcert: unknown or expired challenge")
+	}
+	if !bytes.Equal(p.request, req.Raw) {
+		return nil, fmt.Errorf("kemcert: request does not match the challenge")
+	}
+	want, err := popMAC(p.sharedKey, resp.Nonce, req.Raw)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(want, resp.MAC) {
+		return nil, fmt.Errorf("kemcert: proof of possession failed")
+	}
+
+	profile := pqcca.KEMProfile
+	if ca.Validity != 0 {
+		profile.Validity = ca.Validity
+	}
+	spki, err := MarshalPKIXPublicKey(req.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	// the subject bytes the MAC covered, not a re-encoding of the parsed Name
+	cert, err := ca.CA.Issue(profile, pqcca.Request{
+		Subject:        req.Subject,
+		RawSubject:     req.RawSubject,
+		PublicKeyInfo:  spki,
+		DNSNames:       req.DNSNames,
+		EmailAddresses: req.EmailAddresses,
+		IPAddresses:    req.IPAddresses,
+		URIs:           req.URIs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert.Raw, nil
+}
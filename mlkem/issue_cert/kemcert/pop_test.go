@@ -0,0 +1,181 @@
+package kemcert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"pqcca"
+)
+
+func newIssuer(t *testing.T) *Issuer {
+	t.Helper()
+	k, err := pqcca.GenerateKey("ML-DSA-44")
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	ca, err := pqcca.SelfSign(k, pqcca.RootProfile, pqcca.Request{
+		Subject: pkix.Name{CommonName: "kemcert test root"},
+	})
+	if err != nil {
+		t.Fatalf("SelfSign() = %v", err)
+	}
+	return NewIssuer(ca)
+}
+
+func newRequest(t *testing.T, pub *PublicKey, name string) (*CertificateRequest, []byte) {
+	t.Helper()
+	der, err := CreateCertificateRequest(&x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, pub)
+	if err != nil {
+		t.Fatalf("CreateCertificateRequest() = %v", err)
+	}
+	req, err := ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("ParseCertificateRequest() = %v", err)
+	}
+	return req, der
+}
+
+func TestProofOfPossession(t *testing.T) {
+	dk, pub := newPublicKey(t)
+	otherDK, _ := newPublicKey(t)
+	req, der := newRequest(t, pub, "kem.example.com")
+	// the same key, another name
+	changedReq, _ := newRequest(t, pub, "evil.example.com")
+
+	ca := newIssuer(t)
+	ch, err := ca.Challenge(req)
+	if err != nil {
+		t.Fatalf("Challenge() = %v", err)
+	}
+	resp, err := Respond(der, ch, dk)
+	if err != nil {
+		t.Fatalf("Respond() = %v", err)
+	}
+	certDER, err := ca.Issue(req, resp)
+	if err != nil {
+		t.Fatalf("Issue() = %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate() = %v", err)
+	}
+	if err := pqcca.CheckSignature(cert, ca.CA.Certificate); err != nil {
+		t.Fatalf("CheckSignature() = %v", err)
+	}
+	certPub, err := ParsePublicKey(cert)
+	if err != nil {
+		t.Fatalf("ParsePublicKey() = %v", err)
+	}
+	if !bytes.Equal(certPub.EncapsulationKey, pub.EncapsulationKey) {
+		t.Errorf("certified key = %x, want %x", certPub.EncapsulationKey, pub.EncapsulationKey)
+	}
+	if !bytes.Equal(cert.RawSubject, req.RawSubject) {
+		t.Errorf("RawSubject = %x, want %x", cert.RawSubject, req.RawSubject)
+	}
+	if _, err := ca.Issue(req, resp); err == nil || !strings.Contains(err.Error(), "unknown or expired challenge") {
+		t.Errorf("Issue() with a replayed nonce = %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		ttl     time.Duration
+		req     *CertificateRequest
+		edit    func(*Response)
+		wantErr string
+	}{
+		{name: "wrong mac", req: req, edit: func(r *Response) { r.MAC[0] ^= 1 }, wantErr: "proof of possession failed"},
+		{name: "unknown nonce", req: req, edit: func(r *Response) { r.Nonce[0] ^= 1 }, wantErr: "unknown or expired challenge"},
+		{name: "expired challenge", ttl: time.Nanosecond, req: req, wantErr: "unknown or expired challenge"},
+		{name: "request changed after the challenge", req: changedReq, wantErr: "request does not match the challenge"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ca := newIssuer(t)
+			ca.ChallengeTTL = tc.ttl
+			ch, err := ca.Challenge(req)
+			if err != nil {
+				t.Fatalf("Challenge() = %v", err)
+			}
+			resp, err := Respond(der, ch, dk)
+			if err != nil {
+				t.Fatalf("Respond() = %v", err)
+			}
+			if tc.edit != nil {
+				resp.Nonce, resp.MAC = bytes.Clone(resp.Nonce), bytes.Clone(resp.MAC)
+				tc.edit(resp)
+			}
+			if tc.ttl != 0 {
+				time.Sleep(10 * tc.ttl)
+			}
+			_, err = ca.Issue(tc.req, resp)
+			if err == nil {
+				t.Fatalf("Issue() succeeded")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Issue() = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("other decapsulation key", func(t *testing.T) {
+		ch, err := ca.Challenge(req)
+		if err != nil {
+			t.Fatalf("Challenge() = %v", err)
+		}
+		if _, err := Respond(der, ch, otherDK); err == nil || !strings.Contains(err.Error(), "does not match the request") {
+			t.Fatalf("Respond() = %v", err)
+		}
+	})
+}
+
+// TestMaxPending checks unanswered challenges are capped, and that answered or expired ones make room.
+func TestMaxPending(t *testing.T) {
+	dk, pub := newPublicKey(t)
+	req, der := newRequest(t, pub, "kem.example.com")
+	ca := newIssuer(t)
+	ca.MaxPending = 2
+
+	var chs []*Challenge
+	for range ca.MaxPending {
+		ch, err := ca.Challenge(req)
+		if err != nil {
+			t.Fatalf("Challenge() = %v", err)
+		}
+		chs = append(chs, ch)
+	}
+	if _, err := ca.Challenge(req); err == nil || !strings.Contains(err.Error(), "too many pending challenges") {
+		t.Fatalf("Challenge() with %d pending = %v", ca.MaxPending, err)
+	}
+
+	resp, err := Respond(der, chs[0], dk)
+	if err != nil {
+		t.Fatalf("Respond() = %v", err)
+	}
+	if _, err := ca.Issue(req, resp); err != nil {
+		t.Fatalf("Issue() = %v", err)
+	}
+	if _, err := ca.Challenge(req); err != nil {
+		t.Fatalf("Challenge() after an answer = %v", err)
+	}
+
+	ca.ChallengeTTL = time.Nanosecond
+	if _, err := ca.Challenge(req); err == nil {
+		t.Fatalf("Challenge() with %d pending succeeded", ca.MaxPending)
+	}
+	ca.mu.Lock()
+	for nonce, p := range ca.pending {
+		p.expires = time.Now()
+		ca.pending[nonce] = p
+	}
+	ca.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	if _, err := ca.Challenge(req); err != nil {
+		t.Fatalf("Challenge() after expiry = %v", err)
+	}
+}
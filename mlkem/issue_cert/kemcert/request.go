@@ -0,0 +1,115 @@
+package kemcert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+
+	"pqcca"
+)
+
+// CertificateRequestPEMType is the PEM type of a marshaled CertificateRequest.
+const CertificateRequestPEMType = "ML-KEM CERTIFICATE REQUEST"
+
+// certificationRequest is the unsigned request for an ML-KEM certificate.  A KEM key can't sign a PKCS#10
+// CertificationRequest so possession is proven to the Issuer by decapsulating a challenge instead.
+//
+//	KEMCertificationRequest ::= SEQUENCE {
+//	     version        INTEGER { v1(0) },
+//	     subject        Name,
+//	     subjectPKInfo  SubjectPublicKeyInfo,
+//	     extensions [0] EXPLICIT Extensions OPTIONAL }
+type certificationRequest struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Extensions []pkix.Extension `asn1:"optional,explicit,tag:0"`
+}
+
+// CertificateRequest is a parsed request for an ML-KEM certificate.
+type CertificateRequest struct {
+	// Raw is the DER request, the transcript the proof of possession covers
+	Raw []byte
+	// RawSubject is the DER subject as it appears in Raw
+	RawSubject []byte
+
+	Subject        pkix.Name
+	PublicKey      *PublicKey
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// CreateCertificateRequest returns a DER request for pub with the Subject and SANs of template, the
+// counterpart of x509.CreateCertificateRequest.  It isn't signed.
+func CreateCertificateRequest(template *x509.CertificateRequest, pub *PublicKey) ([]byte, error) {
+	spki, err := MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := asn1.Marshal(template.Subject.ToRDNSequence())
+	if err != nil {
+		return nil, fmt.Errorf("kemcert: can't marshal subject %v", err)
+	}
+	var exts []pkix.Extension
+	if san, ok, err := pqcca.SubjectAltName(pqcca.Request{
+		DNSNames:       template.DNSNames,
+		EmailAddresses: template.EmailAddresses,
+		IPAddresses:    template.IPAddresses,
+		URIs:           template.URIs,
+	}, subject); err != nil {
+		return nil, err
+	} else if ok {
+		exts = append(exts, san)
+	}
+	der, err := asn1.Marshal(certificationRequest{
+		Subject:    asn1.RawValue{FullBytes: subject},
+		PublicKey:  asn1.RawValue{FullBytes: spki},
+		Extensions: exts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kemcert: can't marshal certificate request %v", err)
+	}
+	return der, nil
+}
+
+// ParseCertificateRequest parses a DER request from CreateCertificateRequest.
+func ParseCertificateRequest(der []byte) (*CertificateRequest, error) {
+	var r certificationRequest
+	if rest, err := asn1.Unmarshal(der, &r); err != nil {
+		return nil, fmt.Errorf("kemcert: can't parse certificate request %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("kemcert: trailing data after certificate request")
+	}
+	if r.Version != 0 {
+		return nil, fmt.Errorf("kemcert: unsupported certificate request version %d", r.Version)
+	}
+	var rdns pkix.RDNSequence
+	if rest, err := asn1.Unmarshal(r.Subject.FullBytes, &rdns); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("kemcert: can't parse subject")
+	}
+	pub, err := ParsePKIXPublicKey(r.PublicKey.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	req := &CertificateRequest{Raw: der, RawSubject: r.Subject.FullBytes, PublicKey: pub}
+	req.Subject.FillFromRDNSequence(&rdns)
+	seen := map[string]bool{}
+	for _, ext := range r.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			return nil, fmt.Errorf("kemcert: unsupported extension %v in certificate request", ext.Id)
+		}
+		if seen[ext.Id.String()] {
+			return nil, fmt.Errorf("kemcert: duplicate extension %v in certificate request", ext.Id)
+		}
+		seen[ext.Id.String()] = true
+		if req.DNSNames, req.EmailAddresses, req.IPAddresses, req.URIs, err = parseSAN(ext.Value); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
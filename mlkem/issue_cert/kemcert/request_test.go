@@ -0,0 +1,63 @@
+package kemcert
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"slices"
+	"testing"
+)
+
+func newPublicKey(t *testing.T) (*mlkem.DecapsulationKey768, *PublicKey) {
+	t.Helper()
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatalf("GenerateKey768() = %v", err)
+	}
+	pub, err := NewPublicKeyFromEncapsulator(dk.Encapsulator())
+	if err != nil {
+		t.Fatalf("NewPublicKeyFromEncapsulator() = %v", err)
+	}
+	return dk, pub
+}
+
+func TestParseCertificateRequest(t *testing.T) {
+	_, pub := newPublicKey(t)
+	der, err := CreateCertificateRequest(&x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "kem.example.com"},
+		DNSNames: []string{"kem.example.com"},
+	}, pub)
+	if err != nil {
+		t.Fatalf("CreateCertificateRequest() = %v", err)
+	}
+	req, err := ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("ParseCertificateRequest() = %v", err)
+	}
+	var r certificationRequest
+	if _, err := asn1.Unmarshal(der, &r); err != nil {
+		t.Fatalf("asn1.Unmarshal() = %v", err)
+	}
+	if !bytes.Equal(req.RawSubject, r.Subject.FullBytes) {
+		t.Errorf("RawSubject = %x, want %x", req.RawSubject, r.Subject.FullBytes)
+	}
+	if req.Subject.CommonName != "kem.example.com" || !slices.Equal(req.DNSNames, []string{"kem.example.com"}) {
+		t.Errorf("Subject, DNSNames = %v, %v", req.Subject, req.DNSNames)
+	}
+
+	// a second subjectAltName must not replace the first
+	other, err := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte("evil.example.com")}})
+	if err != nil {
+		t.Fatalf("asn1.Marshal() = %v", err)
+	}
+	r.Extensions = append(r.Extensions, pkix.Extension{Id: oidExtensionSubjectAltName, Value: other})
+	dup, err := asn1.Marshal(r)
+	if err != nil {
+		t.Fatalf("asn1.Marshal() = %v", err)
+	}
+	if _, err := ParseCertificateRequest(dup); err == nil {
+		t.Fatalf("ParseCertificateRequest() accepted two subjectAltName extensions")
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/mldsa"
 	"crypto/mlkem"
 	"crypto/rand"
-	"crypto/rsa"
-
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
@@ -13,15 +16,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math/big"
 	"os"
-	"time"
-)
 
-const ()
+	"main/kemcert"
+	"pqcca"
+)
 
 var (
-	mlkem758OID = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 2}
+	caType  = flag.String("ca", "rsa", "CA key: rsa (the embedded CA), ecdsa or mldsa (a new self-signed CA)")
+	keyType = flag.String("keyType", "mlkem768", "mlkem512, mlkem768 (the embedded key) or mlkem1024 (a new key)")
+	out     = flag.String("out", "issued.pem", "certificate to write")
 )
 
 //	PrivateKeyInfo ::= SEQUENCE {
@@ -29,36 +33,11 @@ var (
 //	  privateKeyAlgorithm       PrivateKeyAlgorithmIdentifier,
 //	  privateKey                PrivateKey,
 //	  attributes           [0]  IMPLICIT Attributes OPTIONAL }
-//
-// Version ::= INTEGER
-// PrivateKeyAlgorithmIdentifier ::= AlgorithmIdentifier
-// PrivateKey ::= OCTET STRING
-// Attributes ::= SET OF Attribute
 type PrivateKeyInfo struct {
 	Version             int
 	PrivateKeyAlgorithm pkix.AlgorithmIdentifier
-	PrivateKey          []byte      `asn1:""`                            // The actual key data, an OCTET STRING
-	Attributes          []Attribute `asn1:"optional,tag:0,implicit,set"` // Optional attributes
-}
-
-//	Attribute ::= SEQUENCE {
-//	  attrType OBJECT IDENTIFIER,
-//	  attrValues SET OF AttributeValue }
-//
-// AttributeValue ::= ANY
-type Attribute struct {
-	Type asn1.ObjectIdentifier
-	// This should be a SET OF ANY, but Go's asn1 parser can't handle slices of
-	// RawValues. Use value() to get an AnySet of the value.
-	RawValue []asn1.RawValue `asn1:"set"`
-}
-
-//	SubjectPublicKeyInfo  ::=  SEQUENCE  {
-//	     algorithm            AlgorithmIdentifier,
-//	     subjectPublicKey     BIT STRING  }
-type SubjectPublicKeyInfo struct {
-	Algorithm pkix.AlgorithmIdentifier
-	PublicKey asn1.BitString
+	PrivateKey          []byte
+	Attributes          []asn1.RawValue `asn1:"optional,tag:0,implicit,set"`
 }
 
 var (
@@ -154,145 +133,188 @@ func main() {
 
 	flag.Parse()
 
-	pubPEMblock, rest := pem.Decode([]byte(kemPublic))
-	if len(rest) != 0 {
-		fmt.Printf("trailing data found during pemDecode")
-		return
-	}
-	//var pkixa pkixPubKey
-	var pkixa x509.MLKEMPublicKeyInfo
-	if rest, err := asn1.Unmarshal(pubPEMblock.Bytes, &pkixa); err != nil {
-		panic(err)
-	} else if len(rest) != 0 {
-		fmt.Printf("rest not nil")
-		return
-	}
-
-	var cipherText []byte
-	var kemSharedSecret []byte
-	if pkixa.Algorithm.Algorithm.Equal(mlkem758OID) {
-		ek, err := mlkem.NewEncapsulationKey768(pkixa.PublicKey.Bytes)
+	// the requester's key, only its holder can answer the CA's challenge
+	var dk crypto.Decapsulator
+	switch *keyType {
+	case "mlkem512":
+		k, err := kemcert.GenerateKey512()
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
+		}
+		dk = k
+	case "mlkem768":
+		privPEMblock, _ := pem.Decode([]byte(kemPrivate))
+		var prkix PrivateKeyInfo
+		if _, err := asn1.Unmarshal(privPEMblock.Bytes, &prkix); err != nil {
+			log.Fatalf("can't parse private key %v", err)
 		}
-		kemSharedSecret, cipherText = ek.Encapsulate()
-	}
-
-	fmt.Printf("SharedSecret: kemShared (%s) \n", base64.StdEncoding.EncodeToString(kemSharedSecret))
-
-	/// ********************************************
-
-	privPEMblock, rest := pem.Decode([]byte(kemPrivate))
-	if len(rest) != 0 {
-		fmt.Printf("trailing data found during pemDecode")
-		return
-	}
-	var prkix PrivateKeyInfo
-	if rest, err := asn1.Unmarshal(privPEMblock.Bytes, &prkix); err != nil {
-		panic(err)
-	} else if len(rest) != 0 {
-		fmt.Printf("rest not nil")
-		return
-	}
-
-	if prkix.PrivateKeyAlgorithm.Algorithm.Equal(mlkem758OID) {
 		// openssl pkey -provparam ml-kem.output_formats=bare-seed  -in  priv-ml-kem-768.pem -out bare-seed.pem
-		dk, err := mlkem.NewDecapsulationKey768(prkix.PrivateKey)
+		k, err := mlkem.NewDecapsulationKey768(prkix.PrivateKey)
 		if err != nil {
-			panic(err)
+			log.Fatalf("can't parse private key %v", err)
 		}
-
-		sharedKey, err := dk.Decapsulate(cipherText)
+		dk = k
+	case "mlkem1024":
+		k, err := mlkem.GenerateKey1024()
 		if err != nil {
-			panic(err)
+			log.Fatalf("can't generate key %v", err)
 		}
-		fmt.Printf("SharedSecret: kemShared (%s) \n", base64.StdEncoding.EncodeToString(sharedKey))
+		dk = k
+	default:
+		log.Fatalf("unknown keyType %q", *keyType)
 	}
-
-	block, _ := pem.Decode([]byte(caPublicCert))
-	CAcert, err := x509.ParseCertificate(block.Bytes)
+	pub, err := kemcert.NewPublicKeyFromEncapsulator(dk.Encapsulator())
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *keyType == "mlkem768" {
+		// the embedded public key is the one of the embedded seed
+		pubPEMblock, _ := pem.Decode([]byte(kemPublic))
+		embedded, err := kemcert.ParsePKIXPublicKey(pubPEMblock.Bytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Equal(embedded.EncapsulationKey, pub.EncapsulationKey) {
+			log.Fatalf("embedded public key does not match the private key")
+		}
+	}
 
-	fmt.Printf("%s\n", CAcert.Issuer)
+	ca := loadCA()
+	fmt.Printf("CA %s\n", ca.Certificate.Subject)
+	issuer := kemcert.NewIssuer(ca)
 
-	rkblock, _ := pem.Decode([]byte(caPrivate))
+	// ******************** requester: an unsigned request
 
-	priv, err := x509.ParsePKCS8PrivateKey(rkblock.Bytes)
-	if err != nil {
-		log.Fatalf("Unable to get read private ocsp key: %v", err)
-	}
-
-	var csrtemplate = x509.CertificateRequest{
+	log.Printf("======= %s certificate request ========", pub.ParameterSet)
+	csrtemplate := x509.CertificateRequest{
 		Subject: pkix.Name{
 			Organization:       []string{"Acme Co"},
 			OrganizationalUnit: []string{"Enterprise"},
 			Locality:           []string{"Mountain View"},
 			Province:           []string{"California"},
 			Country:            []string{"US"},
-			CommonName:         "mytpm",
+			CommonName:         "mycn",
 		},
-		DNSNames:  []string{"mytpm"},
-		PublicKey: &pkixa,
+		DNSNames: []string{"mysni"},
+	}
+	csrBytes, err := kemcert.CreateCertificateRequest(&csrtemplate, pub)
+	if err != nil {
+		log.Fatalf("Failed to create CSR: %s", err)
 	}
+	log.Printf("CSR \n%s", pem.EncodeToMemory(&pem.Block{Type: kemcert.CertificateRequestPEMType, Bytes: csrBytes}))
 
-	// csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &csrtemplate, nkp)
-	// if err != nil {
-	// 	log.Fatalf("Failed to create CSR: %s", err)
-	// }
-	// pemcsr := pem.EncodeToMemory(
-	// 	&pem.Block{
-	// 		Type:  "CERTIFICATE REQUEST",
-	// 		Bytes: csrBytes,
-	// 	},
-	// )
-	// log.Printf("CSR \n%s\n", string(pemcsr))
+	// ******************** CA: challenge the requested key
 
-	log.Printf("Creating public x509")
+	req, err := kemcert.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	challenge, err := issuer.Challenge(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("======= challenge nonce %s ========", base64.StdEncoding.EncodeToString(challenge.Nonce))
+
+	// someone with just the public key can only guess
+	forged := &kemcert.Response{Nonce: challenge.Nonce, MAC: make([]byte, 32)}
+	if _, err := issuer.Issue(req, forged); err == nil {
+		log.Fatalf("certificate issued without proof of possession")
+	} else {
+		log.Printf("forged response rejected: %v", err)
+	}
 
-	var notBefore time.Time
-	notBefore = time.Now()
+	// a challenge is single use so the forgery burnt that one
+	challenge, err = issuer.Challenge(req)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	notAfter := notBefore.Add(time.Hour * 24 * 365)
+	// ******************** requester: decapsulate and answer
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	resp, err := kemcert.Respond(csrBytes, challenge, dk)
 	if err != nil {
-		log.Fatalf("Failed to generate serial number: %s", err)
+		log.Fatal(err)
 	}
 
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization:       []string{"Acme Co"},
-			OrganizationalUnit: []string{"Enterprise"},
-			Locality:           []string{"Mountain View"},
-			Province:           []string{"California"},
-			Country:            []string{"US"},
-			CommonName:         "mycn",
-		},
-		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		DNSNames:              []string{"mysni"},
-		KeyUsage:              x509.KeyUsage(x509.KeyUsageKeyEncipherment),
-		ExtKeyUsage:           []x509.ExtKeyUsage{},
-		BasicConstraintsValid: true,
-		IsCA:                  false,
-	}
+	// ******************** CA: check the answer and issue
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, CAcert, csrtemplate.PublicKey, priv.(*rsa.PrivateKey))
+	derBytes, err := issuer.Issue(req, resp)
 	if err != nil {
 		log.Fatalf("Failed to create certificate: %s", err)
 	}
-	certOut, err := os.Create("issued.pem")
-	if err != nil {
+	if err := os.WriteFile(*out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0644); err != nil {
 		log.Fatalf("Failed writing to file %v", err)
 	}
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		log.Fatalf("Failed to write data: %s", err)
+	log.Printf("wrote %s\n", *out)
+
+	/// ********************************************
+
+	// the sender only has the certificate
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		log.Fatalf("can't parse certificate %v", err)
+	}
+	if err := cert.CheckSignatureFrom(ca.Certificate); err != nil {
+		log.Fatalf("certificate does not verify %v", err)
+	}
+	certKey, err := kemcert.ParsePublicKey(cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kemSharedSecret, cipherText, err := certKey.Encapsulate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("SharedSecret: kemShared (%s) \n", base64.StdEncoding.EncodeToString(kemSharedSecret))
+
+	sharedKey, err := dk.Decapsulate(cipherText)
+	if err != nil {
+		log.Fatalf("can't decapsulate %v", err)
+	}
+	fmt.Printf("SharedSecret: kemShared (%s) \n", base64.StdEncoding.EncodeToString(sharedKey))
+	if !bytes.Equal(kemSharedSecret, sharedKey) {
+		log.Fatalf("shared secrets don't match")
+	}
+}
+
+// loadCA returns the embedded RSA CA or a new self-signed ECDSA or ML-DSA one.
+func loadCA() *pqcca.CA {
+	if *caType == "rsa" {
+		block, _ := pem.Decode([]byte(caPublicCert))
+		CAcert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rkblock, _ := pem.Decode([]byte(caPrivate))
+		priv, err := x509.ParsePKCS8PrivateKey(rkblock.Bytes)
+		if err != nil {
+			log.Fatalf("Unable to read CA private key: %v", err)
+		}
+		ca, err := pqcca.NewCA(CAcert, priv.(crypto.Signer))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return ca
 	}
-	certOut.Close()
-	log.Printf("wrote issued.pem\n")
 
+	var signer crypto.Signer
+	var err error
+	switch *caType {
+	case "ecdsa":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "mldsa":
+		signer, err = mldsa.GenerateKey(mldsa.MLDSA65())
+	default:
+		log.Fatalf("unknown ca %q", *caType)
+	}
+	if err != nil {
+		log.Fatalf("can't generate CA key %v", err)
+	}
+	ca, err := pqcca.SelfSign(signer, pqcca.RootProfile, pqcca.Request{
+		Subject: pkix.Name{Organization: []string{"Google"}, OrganizationalUnit: []string{"Enterprise"}, CommonName: "Single Root CA"},
+	})
+	if err != nil {
+		log.Fatalf("can't create CA certificate %v", err)
+	}
+	return ca
 }
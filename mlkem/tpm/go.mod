@@ -3,6 +3,7 @@ module main
 go 1.25.0
 
 require (
+	github.com/cloudflare/circl v1.6.3
 	github.com/google/go-tpm v0.9.8
 	github.com/salrashid123/tpmrand v1.2.2
 )
@@ -10,5 +11,6 @@ require (
 require (
 	github.com/cenkalti/backoff/v4 v4.2.1 // indirect
 	github.com/google/go-tpm-tools v0.4.7 // indirect
+	golang.org/x/crypto v0.34.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 )
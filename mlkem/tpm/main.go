@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/hkdf"
 	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/pem"
 	"flag"
@@ -14,7 +18,9 @@ import (
 	"net"
 	"os"
 	"slices"
+	"strings"
 
+	"github.com/cloudflare/circl/kem/mlkem/mlkem512"
 	"github.com/google/go-tpm/tpmutil"
 	tpmrand "github.com/salrashid123/tpmrand"
 )
@@ -24,7 +30,8 @@ const ()
 var (
 	private = flag.String("private", "/tmp/private.pem", "PrivateKey")
 	public  = flag.String("public", "/tmp/public.pem", "PublicKey")
-	keyType = flag.String("keyType", "mlkem768", "KeyType must be mlkem768 or mlkem1024")
+	keyType = flag.String("keyType", "mlkem768", "KeyType must be mlkem512, mlkem768 or mlkem1024")
+	entropy = flag.String("entropy", "crypto/rand,tpm", "comma separated sources mixed into the seed: crypto/rand and/or tpm")
 )
 
 var (
@@ -91,6 +98,60 @@ func OpenTPM(path string) (io.ReadWriteCloser, error) {
 	}
 }
 
+// oidDescription is id-at-description, the PKCS#8 attribute the entropy sources are recorded in as
+// "Entropy-Sources: crypto/rand,tpm", the same as tpmpqc.AddEntropySources in the tpm/ module.  A PEM
+// header would stop openssl from reading the key.
+var oidDescription = asn1.ObjectIdentifier{2, 5, 4, 13}
+
+// mixSeed is the first block of tpmpqc.EntropyMixer in the tpm/ module, which this module can't
+// import: it reads 32 bytes from every source, each prefixed with the uint16 length of the source's
+// name and the name, extracts with the salt "tpmpqc entropy mixer v1" and expands with the joined
+// names followed by the uint64 block counter 1.  The seed is unpredictable as long as any one source is.
+func mixSeed(names []string, sources []io.Reader, size int) ([]byte, error) {
+	if size > 255*sha256.Size {
+		return nil, fmt.Errorf("seed of %d bytes is longer than one block", size)
+	}
+	var ikm []byte
+	input := make([]byte, 32)
+	for i, r := range sources {
+		if _, err := io.ReadFull(r, input); err != nil {
+			return nil, fmt.Errorf("entropy source %s failed: %v", names[i], err)
+		}
+		ikm = binary.BigEndian.AppendUint16(ikm, uint16(len(names[i])))
+		ikm = append(ikm, names[i]...)
+		ikm = append(ikm, input...)
+	}
+	info := binary.BigEndian.AppendUint64([]byte(strings.Join(names, ",")), 1)
+	return hkdf.Key(sha256.New, ikm, []byte("tpmpqc entropy mixer v1"), string(info), size)
+}
+
+// newKey derives the decapsulation key of keyType from seed and returns it with its encapsulation key.
+func newKey(seed []byte) (oid asn1.ObjectIdentifier, dk []byte, ek []byte, err error) {
+	switch *keyType {
+	case "mlkem512":
+		// crypto/mlkem has no ML-KEM-512, the private key is the seed like crypto/mlkem's Bytes()
+		pk, _ := mlkem512.NewKeyFromSeed(seed)
+		b, err := pk.MarshalBinary()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return mlkem512_OID, seed, b, nil
+	case "mlkem768":
+		k, err := mlkem.NewDecapsulationKey768(seed)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return mlkem768_OID, k.Bytes(), k.EncapsulationKey().Bytes(), nil
+	case "mlkem1024":
+		k, err := mlkem.NewDecapsulationKey1024(seed)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return mlkem1024_OID, k.Bytes(), k.EncapsulationKey().Bytes(), nil
+	}
+	return nil, nil, nil, fmt.Errorf("unknown keyType %q", *keyType)
+}
+
 func main() {
 	flag.Parse()
 
@@ -111,17 +172,32 @@ func main() {
 	// 	log.Fatalf("failed to create get random seed: %v", err)
 	// }
 
-	// C) generate a key using a TPM as the rand source
-	rwc, err := OpenTPM(*tpmPath)
-	if err != nil {
-		fmt.Printf("Unable to open TPM at %s", *tpmPath)
+	// C) generate a key mixing crypto/rand and the TPM's RNG
+	names := strings.Split(*entropy, ",")
+	var sources []io.Reader
+	for _, name := range names {
+		switch name {
+		case "crypto/rand":
+			sources = append(sources, rand.Reader)
+		case "tpm":
+			rwc, err := OpenTPM(*tpmPath)
+			if err != nil {
+				log.Fatalf("Unable to open TPM at %s: %v", *tpmPath, err)
+			}
+			defer rwc.Close()
+
+			r, err := tpmrand.NewTPMRand(&tpmrand.Reader{
+				TpmDevice: rwc,
+			})
+			if err != nil {
+				log.Fatalf("failed to create TPM rand reader: %v", err)
+			}
+			sources = append(sources, r)
+		default:
+			log.Fatalf("unknown entropy source %q", name)
+		}
 	}
-	defer rwc.Close()
-
-	r, err := tpmrand.NewTPMRand(&tpmrand.Reader{
-		TpmDevice: rwc,
-	})
-	_, err = r.Read(externalSeed) // Fill it with random data
+	externalSeed, err := mixSeed(names, sources, mlkem.SeedSize)
 	if err != nil {
 		log.Fatalf("failed to create get random seed: %v", err)
 	}
@@ -135,21 +211,34 @@ func main() {
 	// }
 
 	// now create the key
-	nk, err := mlkem.NewDecapsulationKey768(externalSeed)
+	keyOID, dkBytes, ekBytes, err := newKey(externalSeed)
 	if err != nil {
 		log.Fatalf("failed to create decapsulation key from seed: %v", err)
 	}
 
 	fmt.Println("ML-KEM key pair successfully derived from external seed.")
-	fmt.Printf("Decapsulation Key (seed) size: %d bytes\n", len(nk.Bytes()))
-	fmt.Printf("Encapsulation Key size: %d bytes\n", len(nk.EncapsulationKey().Bytes()))
+	fmt.Printf("Decapsulation Key (seed) size: %d bytes\n", len(dkBytes))
+	fmt.Printf("Encapsulation Key size: %d bytes\n", len(ekBytes))
 
 	privateKey := PrivateKeyInfo{
 		Version: 0,
 		PrivateKeyAlgorithm: pkix.AlgorithmIdentifier{
-			Algorithm: mlkem768_OID,
+			Algorithm: keyOID,
+		},
+		PrivateKey: dkBytes,
+	}
+	description, err := asn1.MarshalWithParams("Entropy-Sources: "+*entropy, "utf8")
+	if err != nil {
+		fmt.Printf("error marshalling entropy sources %v", err)
+		os.Exit(1)
+	}
+	privateKey.Attributes = []Attribute{
+		{
+			Type: oidDescription,
+			RawValue: []asn1.RawValue{
+				{FullBytes: description},
+			},
 		},
-		PrivateKey: nk.Bytes(),
 	}
 	pkb, err := asn1.Marshal(privateKey)
 	if err != nil {
@@ -163,15 +252,13 @@ func main() {
 	privteKeyBytes = pem.EncodeToMemory(privateKeyBlock)
 
 	// encode public key
-
-	nk.EncapsulationKey().Bytes()
 	publicKey := SubjectPublicKeyInfo{
 		Algorithm: pkix.AlgorithmIdentifier{
-			Algorithm: mlkem768_OID,
+			Algorithm: keyOID,
 		},
 		PublicKey: asn1.BitString{
-			BitLength: len(nk.EncapsulationKey().Bytes()),
-			Bytes:     nk.EncapsulationKey().Bytes(),
+			BitLength: len(ekBytes) * 8,
+			Bytes:     ekBytes,
 		},
 	}
 	ppkb, err := asn1.Marshal(publicKey)
@@ -223,7 +310,18 @@ func main() {
 
 	var cipherText []byte
 	var kemSharedSecret []byte
-	if pkix.Algorithm.Algorithm.Equal(mlkem768_OID) {
+	if pkix.Algorithm.Algorithm.Equal(mlkem512_OID) {
+		fmt.Println("Found MLKEM512 in public key")
+
+		ek, err := mlkem512.Scheme().UnmarshalBinaryPublicKey(pkix.PublicKey.Bytes)
+		if err != nil {
+			panic(err)
+		}
+		cipherText, kemSharedSecret, err = mlkem512.Scheme().Encapsulate(ek)
+		if err != nil {
+			panic(err)
+		}
+	} else if pkix.Algorithm.Algorithm.Equal(mlkem768_OID) {
 		fmt.Println("Found MLKEM758 in public key")
 
 		ek, err := mlkem.NewEncapsulationKey768(pkix.PublicKey.Bytes)
@@ -231,6 +329,14 @@ func main() {
 			panic(err)
 		}
 		kemSharedSecret, cipherText = ek.Encapsulate()
+	} else if pkix.Algorithm.Algorithm.Equal(mlkem1024_OID) {
+		fmt.Println("Found MLKEM1024 in public key")
+
+		ek, err := mlkem.NewEncapsulationKey1024(pkix.PublicKey.Bytes)
+		if err != nil {
+			panic(err)
+		}
+		kemSharedSecret, cipherText = ek.Encapsulate()
 	}
 
 	fmt.Printf("sharedSecret %s \n", base64.StdEncoding.EncodeToString(kemSharedSecret))
@@ -254,7 +360,16 @@ func main() {
 		fmt.Printf("rest not nil")
 	}
 
-	if rprkix.PrivateKeyAlgorithm.Algorithm.Equal(mlkem768_OID) {
+	if rprkix.PrivateKeyAlgorithm.Algorithm.Equal(mlkem512_OID) {
+		fmt.Println("Found MLKEM512 in private key")
+
+		_, dk := mlkem512.NewKeyFromSeed(rprkix.PrivateKey)
+		sharedKey, err := mlkem512.Scheme().Decapsulate(dk, cipherText)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("recovered shared secret: kemShared %s \n", base64.StdEncoding.EncodeToString(sharedKey))
+	} else if rprkix.PrivateKeyAlgorithm.Algorithm.Equal(mlkem768_OID) {
 		fmt.Println("Found MLKEM758 in private key")
 
 		dk, err := mlkem.NewDecapsulationKey768(rprkix.PrivateKey)
@@ -262,6 +377,19 @@ func main() {
 			panic(err)
 		}
 
+		sharedKey, err := dk.Decapsulate(cipherText)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("recovered shared secret: kemShared %s \n", base64.StdEncoding.EncodeToString(sharedKey))
+	} else if rprkix.PrivateKeyAlgorithm.Algorithm.Equal(mlkem1024_OID) {
+		fmt.Println("Found MLKEM1024 in private key")
+
+		dk, err := mlkem.NewDecapsulationKey1024(rprkix.PrivateKey)
+		if err != nil {
+			panic(err)
+		}
+
 		sharedKey, err := dk.Decapsulate(cipherText)
 		if err != nil {
 			panic(err)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	pcrList      = flag.String("pcrs", "0,23", "comma separated sha256 PCRs to quote")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	var pcrs []uint
+	for _, s := range strings.Split(*pcrList, ",") {
+		i, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil {
+			log.Fatalf("can't parse pcr %q: %v", s, err)
+		}
+		pcrs = append(pcrs, uint(i))
+	}
+	// the quoted digest covers the PCRs in ascending order
+	slices.Sort(pcrs)
+	pcrs = slices.Compact(pcrs)
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	log.Printf("======= create attestation key ========")
+	ak, err := tpmpqc.CreateAttestationKey(rwr, parent, tpm2.TPMMLDSA65)
+	if err != nil {
+		log.Fatalf("can't create attestation key %v", err)
+	}
+	defer ak.Close()
+
+	// the verifier needs the AK's public area to check it is a restricted TPM key; how it comes to trust
+	// it (an EK certificate, enrollment) is out of scope here
+	akPublic := ak.TPMPublic()
+
+	log.Printf("======= quote ========")
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("can't create nonce %v", err)
+	}
+	quote, err := ak.Quote(pcrs, nonce)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var pcrValues [][]byte
+	for _, pcr := range pcrs {
+		pcrReadRsp, err := tpm2.PCRRead{
+			PCRSelectionIn: tpm2.TPMLPCRSelection{
+				PCRSelections: []tpm2.TPMSPCRSelection{
+					{
+						Hash:      tpm2.TPMAlgSHA256,
+						PCRSelect: tpm2.PCClientCompatible.PCRs(pcr),
+					},
+				},
+			},
+		}.Execute(rwr)
+		if err != nil {
+			log.Fatalf("can't read pcr %d: %v", pcr, err)
+		}
+		if len(pcrReadRsp.PCRValues.Digests) != 1 {
+			log.Fatalf("pcr %d not returned by the TPM", pcr)
+		}
+		log.Printf("PCR %d %x", pcr, pcrReadRsp.PCRValues.Digests[0].Buffer)
+		pcrValues = append(pcrValues, pcrReadRsp.PCRValues.Digests[0].Buffer)
+	}
+
+	q, err := tpmpqc.VerifyQuote(akPublic, quote, nonce, pcrs, pcrValues)
+	if err != nil {
+		log.Fatalf("quote does not verify %v", err)
+	}
+	fmt.Printf("Quote verified, PCR digest %x\n", q.PCRDigest.Buffer)
+
+	log.Printf("======= certify mlkem key ========")
+	k, err := tpmpqc.CreateKEMKey(rwr, parent, tpm2.TPMMLKEM768, nil)
+	if err != nil {
+		log.Fatalf("can't create mlkem %v", err)
+	}
+	defer k.Close()
+
+	nonce = make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("can't create nonce %v", err)
+	}
+	certify, err := ak.Certify(k.Handle(), nonce)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	name, err := tpmpqc.VerifyCertify(akPublic, certify, nonce, k.Public)
+	if err != nil {
+		log.Fatalf("certification does not verify %v", err)
+	}
+	fmt.Printf("Certified mlkem key name %x\n", name.Buffer)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/mldsa"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"main/tpmpqc"
+	"main/tpmrm"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	workers      = flag.Int("workers", 8, "goroutines signing and decapsulating at the same time")
+	iterations   = flag.Int("iterations", 10, "sign and decapsulate calls per goroutine")
+	maxObjects   = flag.Int("max-objects", 0, "transient objects the resource manager keeps loaded (0: ask the TPM)")
+	maxSessions  = flag.Int("max-sessions", 0, "sessions the resource manager keeps loaded (0: ask the TPM)")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	// every command below, from any goroutine, goes through the resource manager
+	rm, err := tpmrm.New(transport.FromReadWriter(rwc), tpmrm.Config{
+		MaxObjects:  *maxObjects,
+		MaxSessions: *maxSessions,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rm.Close()
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rm, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	log.Printf("======= create keys ========")
+	sk, err := tpmpqc.CreateSigningKey(rm, parent, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		log.Fatalf("can't create mldsa %v", err)
+	}
+	defer sk.Close()
+	pub, err := sk.PublicKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	kk, err := tpmpqc.CreateKEMKey(rm, parent, tpm2.TPMMLKEM768, nil)
+	if err != nil {
+		log.Fatalf("can't create mlkem %v", err)
+	}
+	defer kk.Close()
+	ek := kk.Encapsulator()
+	if ek == nil {
+		log.Fatalf("can't read encapsulation key")
+	}
+
+	log.Printf("======= %d workers x %d iterations ========", *workers, *iterations)
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, *workers)
+	for w := range *workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range *iterations {
+				message := []byte(fmt.Sprintf("worker %d message %d", w, i))
+				sig, err := sk.Sign(nil, message, crypto.Hash(0))
+				if err != nil {
+					errs <- fmt.Errorf("worker %d: %v", w, err)
+					return
+				}
+				if err := mldsa.Verify(pub, message, sig, &mldsa.Options{}); err != nil {
+					errs <- fmt.Errorf("worker %d: signature does not verify %v", w, err)
+					return
+				}
+
+				sharedSecret, ciphertext := ek.Encapsulate()
+				ss, err := kk.Decapsulate(ciphertext)
+				if err != nil {
+					errs <- fmt.Errorf("worker %d: %v", w, err)
+					return
+				}
+				if !bytes.Equal(ss, sharedSecret) {
+					errs <- fmt.Errorf("worker %d: shared secrets don't match", w)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		log.Fatal(err)
+	}
+	n := *workers * *iterations
+	fmt.Printf("%d signatures and %d decapsulations in %v\n", n, n, time.Since(start).Round(time.Millisecond))
+}
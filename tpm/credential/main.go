@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the AK parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the AK parent (optional, overrides --srk)")
+	ekParameter  = flag.Int("mlkem-parameter-set", 1024, "ML-KEM EK parameter set: 768 or 1024")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	ps, err := tpmpqc.MLKEMParameterSet(*ekParameter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= create ML-KEM-%d EK ========", *ekParameter)
+	ek, err := tpmpqc.CreateMLKEMEK(rwr, ps)
+	if err != nil {
+		log.Fatalf("can't create EK %v", err)
+	}
+	defer ek.Close()
+	log.Printf("EK name %x", ek.Handle().Name.Buffer)
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	log.Printf("======= create attestation key ========")
+	ak, err := tpmpqc.CreateAttestationKey(rwr, parent, tpm2.TPMMLDSA65)
+	if err != nil {
+		log.Fatalf("can't create attestation key %v", err)
+	}
+	defer ak.Close()
+	akName := ak.Handle().Name
+	log.Printf("AK name %x", akName.Buffer)
+
+	// the enrollment server only sees the EK public and the AK name, it doesn't need a TPM
+	log.Printf("======= make credential ========")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("can't create secret %v", err)
+	}
+	idObject, encSecret, err := tpmpqc.MakeCredential(ek.Public, akName, secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("credential blob %d bytes, encrypted secret %d bytes", len(idObject), len(encSecret))
+
+	log.Printf("======= activate credential ========")
+	got, err := ek.ActivateCredential(ak, idObject, encSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(got, secret) {
+		log.Fatalf("activated credential doesn't match")
+	}
+	fmt.Printf("Activated credential %x\n", got)
+
+	// a credential made for another name must not be released for the AK
+	log.Printf("======= activate credential for another key ========")
+	idObject, encSecret, err = tpmpqc.MakeCredential(ek.Public, ek.Handle().Name, secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := ek.ActivateCredential(ak, idObject, encSecret); err == nil {
+		log.Fatalf("credential for another name activated")
+	} else {
+		log.Printf("credential for another name rejected: %v", err)
+	}
+}
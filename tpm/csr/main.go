@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"main/tpmpqc"
+	"pqcca"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	keyType      = flag.String("type", "mldsa", "mldsa or mlkem")
+	commonName   = flag.String("cn", "mytpm", "subject CommonName and dNSName of the request")
+	caCertFile   = flag.String("ca-cert", "ca.crt", "CA certificate, created with --ca-key if it does not exist")
+	caKeyFile    = flag.String("ca-key", "ca.pem", "ML-DSA PKCS#8 key of the CA, created if it does not exist")
+	csrFile      = flag.String("csr", "csr.pem", "where to write the certificate request")
+	certFile     = flag.String("out", "issued.pem", "where to write the issued certificate")
+	keyFile      = flag.String("keyfile", "private.pem", "TSS2 PRIVATE KEY file for the new key")
+	evidence     = flag.Bool("evidence", false, "use a PKCS#10 request with a draft-ietf-lamps-csr-attestation evidence attribute, always on for mlkem")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	caCert, caKey := readCA()
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	parentRef := tpm2.TPMRHOwner
+	if *parentHandle != 0 {
+		parentRef = tpm2.TPMHandle(*parentHandle)
+	}
+
+	subject := pkix.Name{
+		Organization:       []string{"Acme Co"},
+		OrganizationalUnit: []string{"Enterprise"},
+		Locality:           []string{"Mountain View"},
+		Province:           []string{"California"},
+		Country:            []string{"US"},
+		CommonName:         *commonName,
+	}
+	dnsNames := []string{*commonName}
+
+	notBefore := time.Now()
+	template := &x509.Certificate{
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(time.Hour * 24 * 365),
+	}
+
+	var tk *tpmpqc.TPMKey
+	var der []byte
+	// a KEM can't sign its request, the evidence is the only proof of possession
+	if *evidence || *keyType == "mlkem" {
+		tk, der = issueAttested(rwr, parent, parentRef, caCert, caKey, subject, dnsNames, template)
+	} else {
+		switch *keyType {
+		case "mldsa":
+			k, err := tpmpqc.CreateSigningKey(rwr, parent, tpm2.TPMMLDSA65, nil)
+			if err != nil {
+				log.Fatalf("can't create mldsa %v", err)
+			}
+			defer k.Close()
+			tk, err = k.TPMKey(parentRef, *srkType)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("======= create CSR ========")
+			csrDER, err := tpmpqc.CreateCertificateRequest(k, &x509.CertificateRequest{
+				Subject:  subject,
+				DNSNames: dnsNames,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			writePEM(*csrFile, "CERTIFICATE REQUEST", csrDER)
+
+			log.Printf("======= CA: issue certificate ========")
+			csr, err := x509.ParseCertificateRequest(csrDER)
+			if err != nil {
+				log.Fatalf("can't parse CSR %v", err)
+			}
+			if err := csr.CheckSignature(); err != nil {
+				log.Fatalf("CSR signature does not verify %v", err)
+			}
+			template.SerialNumber = serialNumber()
+			template.Subject = csr.Subject
+			template.DNSNames = csr.DNSNames
+			template.KeyUsage = x509.KeyUsageDigitalSignature
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+			der, err = x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+			if err != nil {
+				log.Fatalf("can't create certificate %v", err)
+			}
+		default:
+			log.Fatalf("unknown key type %q", *keyType)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Fatalf("can't parse issued certificate %v", err)
+	}
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		log.Fatalf("issued certificate does not verify %v", err)
+	}
+	writePEM(*certFile, "CERTIFICATE", der)
+	log.Printf("issued %s for %s", *certFile, cert.Subject)
+
+	pemBytes, err := tk.EncodePEM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyFile, pemBytes, 0600); err != nil {
+		log.Fatalf("can't write key file %v", err)
+	}
+	fmt.Printf("%s\n", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// issueAttested runs the draft-ietf-lamps-csr-attestation flow: the CA certifies an attestation key and
+// hands out a nonce, the request carries a TPM2_Certify statement over the new key and the CA checks it
+// before issuing.
+func issueAttested(rwr transport.TPM, parent tpm2.NamedHandle, parentRef tpm2.TPMHandle, caCert *x509.Certificate, caKey *mldsa.PrivateKey, subject pkix.Name, dnsNames []string, template *x509.Certificate) (*tpmpqc.TPMKey, []byte) {
+	ak, err := tpmpqc.CreateAttestationKey(rwr, parent, tpm2.TPMMLDSA65)
+	if err != nil {
+		log.Fatalf("can't create attestation key %v", err)
+	}
+	defer ak.Close()
+	akPub, err := ak.PublicKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= CA: certify attestation key ========")
+	// AK certificates come from their own CA so an issued end-entity certificate can't pass for one.  A real
+	// CA would only certify the AK after checking it against the TPM's EK; here it trusts the AK
+	akCAKey, err := mldsa.GenerateKey(mldsa.MLDSA65())
+	if err != nil {
+		log.Fatalf("can't generate AK CA key %v", err)
+	}
+	akCATemplate := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization: []string{"Acme Co"},
+			CommonName:   "Attestation Key CA",
+		},
+		NotBefore:             template.NotBefore,
+		NotAfter:              template.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	akCADER, err := x509.CreateCertificate(rand.Reader, akCATemplate, akCATemplate, akCAKey.Public(), akCAKey)
+	if err != nil {
+		log.Fatalf("can't create AK CA certificate %v", err)
+	}
+	akCACert, err := x509.ParseCertificate(akCADER)
+	if err != nil {
+		log.Fatalf("can't parse AK CA certificate %v", err)
+	}
+	akDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization: []string{"Acme Co"},
+			CommonName:   *commonName + " attestation key",
+		},
+		NotBefore:          template.NotBefore,
+		NotAfter:           template.NotAfter,
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{tpmpqc.OIDExtKeyUsageAttestationKey},
+	}, akCACert, akPub, akCAKey)
+	if err != nil {
+		log.Fatalf("can't certify attestation key %v", err)
+	}
+	akCert, err := x509.ParseCertificate(akDER)
+	if err != nil {
+		log.Fatalf("can't parse attestation key certificate %v", err)
+	}
+	// the public area the CA saw when it enrolled the AK
+	akPublic := ak.TPMPublic()
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("can't create nonce %v", err)
+	}
+
+	log.Printf("======= create attested CSR ========")
+	csrTemplate := &x509.CertificateRequest{
+		Subject:  subject,
+		DNSNames: dnsNames,
+	}
+	var tk *tpmpqc.TPMKey
+	var csrDER []byte
+	switch *keyType {
+	case "mldsa":
+		k, err := tpmpqc.CreateSigningKey(rwr, parent, tpm2.TPMMLDSA65, nil)
+		if err != nil {
+			log.Fatalf("can't create mldsa %v", err)
+		}
+		defer k.Close()
+		tk, err = k.TPMKey(parentRef, *srkType)
+		if err != nil {
+			log.Fatal(err)
+		}
+		csrDER, err = k.CreateAttestedCertificateRequest(csrTemplate, ak, nonce, []*x509.Certificate{akCert})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "mlkem":
+		k, err := tpmpqc.CreateKEMKey(rwr, parent, tpm2.TPMMLKEM768, nil)
+		if err != nil {
+			log.Fatalf("can't create mlkem %v", err)
+		}
+		defer k.Close()
+		tk, err = k.TPMKey(parentRef, *srkType)
+		if err != nil {
+			log.Fatal(err)
+		}
+		csrDER, err = k.CreateAttestedCertificateRequest(csrTemplate, ak, nonce, []*x509.Certificate{akCert})
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown key type %q", *keyType)
+	}
+	writePEM(*csrFile, "CERTIFICATE REQUEST", csrDER)
+
+	log.Printf("======= CA: verify evidence and issue certificate ========")
+	akRoots := x509.NewCertPool()
+	akRoots.AddCert(akCACert)
+	req, err := tpmpqc.VerifyAttestedCertificateRequest(csrDER, akRoots, nil, nonce, func(c *x509.Certificate) (tpm2.TPM2BPublic, error) {
+		if !c.Equal(akCert) {
+			return tpm2.TPM2BPublic{}, fmt.Errorf("unknown attestation key %s", c.Subject)
+		}
+		return akPublic, nil
+	})
+	if err != nil {
+		log.Fatalf("evidence does not verify %v", err)
+	}
+	log.Printf("certified key name %x", req.Name.Buffer)
+
+	template.SerialNumber = serialNumber()
+	// the subject bytes the evidence covered, not a re-encoding of the parsed Name
+	template.RawSubject = req.RawSubject
+	template.Subject = req.Subject
+	template.DNSNames = req.DNSNames
+	var der []byte
+	switch req.KeyType {
+	case tpm2.TPMAlgMLDSA:
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		der, err = x509.CreateCertificate(rand.Reader, template, caCert, req.PublicKey, caKey)
+	case tpm2.TPMAlgMLKEM:
+		der, err = issueKEM(caCert, caKey, template, req.RawSubjectPublicKeyInfo)
+	}
+	if err != nil {
+		log.Fatalf("can't create certificate %v", err)
+	}
+	return tk, der
+}
+
+// issueKEM certifies an ML-KEM SubjectPublicKeyInfo with pqcca's kem profile, crypto/x509 can't marshal
+// ML-KEM keys.
+func issueKEM(caCert *x509.Certificate, caKey *mldsa.PrivateKey, template *x509.Certificate, spki []byte) ([]byte, error) {
+	ca, err := pqcca.NewCA(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.Issue(pqcca.KEMProfile, pqcca.Request{
+		Subject:       template.Subject,
+		RawSubject:    template.RawSubject,
+		PublicKeyInfo: spki,
+		DNSNames:      template.DNSNames,
+		SerialNumber:  template.SerialNumber,
+		NotBefore:     template.NotBefore,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert.Raw, nil
+}
+
+func serialNumber() *big.Int {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		log.Fatalf("Failed to generate serial number: %s", err)
+	}
+	return serialNumber
+}
+
+func writePEM(file, typ string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0644); err != nil {
+		log.Fatalf("can't write %s %v", file, err)
+	}
+	log.Printf("wrote %s", file)
+}
+
+// readCA loads the local CA or creates a self-signed ML-DSA-65 one.
+func readCA() (*x509.Certificate, *mldsa.PrivateKey) {
+	b, err := os.ReadFile(*caKeyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		sk, err := mldsa.GenerateKey(mldsa.MLDSA65())
+		if err != nil {
+			log.Fatalf("can't generate CA key %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			log.Fatalf("can't marshal CA key %v", err)
+		}
+		if err := os.WriteFile(*caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			log.Fatalf("can't write CA key %v", err)
+		}
+
+		notBefore := time.Now()
+		template := &x509.Certificate{
+			SerialNumber: serialNumber(),
+			Subject: pkix.Name{
+				Organization:       []string{"Acme Co"},
+				OrganizationalUnit: []string{"Enterprise"},
+				CommonName:         "Single Root CA",
+			},
+			NotBefore:             notBefore,
+			NotAfter:              notBefore.Add(time.Hour * 24 * 365 * 10),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, template, sk.Public(), sk)
+		if err != nil {
+			log.Fatalf("can't create CA certificate %v", err)
+		}
+		writePEM(*caCertFile, "CERTIFICATE", certDER)
+		log.Printf("wrote new CA key %s", *caKeyFile)
+		cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			log.Fatalf("can't parse CA certificate %v", err)
+		}
+		return cert, sk
+	}
+	if err != nil {
+		log.Fatalf("can't read CA key %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		log.Fatalf("no PEM block in %s", *caKeyFile)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		log.Fatalf("can't parse CA key %v", err)
+	}
+	sk, ok := k.(*mldsa.PrivateKey)
+	if !ok {
+		log.Fatalf("CA key is not ML-DSA")
+	}
+
+	cb, err := os.ReadFile(*caCertFile)
+	if err != nil {
+		log.Fatalf("can't read CA certificate %v", err)
+	}
+	block, _ = pem.Decode(cb)
+	if block == nil {
+		log.Fatalf("no PEM block in %s", *caCertFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("can't parse CA certificate %v", err)
+	}
+	return cert, sk
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode         = flag.String("mode", "export-parent", "export-parent (destination), create (source), duplicate (source) or import (destination)")
+	keyType      = flag.String("type", "mldsa", "mldsa or mlkem")
+	parameterSet = flag.Int("parameter-set", 0, "ML-DSA 44/65/87 or ML-KEM 512/768/1024 (defaults to 65 or 768)")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	newParent    = flag.String("new-parent", "new_parent.pub", "TPM2B_PUBLIC of the destination storage key")
+	keyFile      = flag.String("keyfile", "private.pem", "TSS2 PRIVATE KEY file")
+	bundleFile   = flag.String("bundle", "duplicate.bin", "duplication bundle")
+	dataToSign   = flag.String("datatosign", "foo", "data to sign")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	switch *mode {
+	case "export-parent":
+		exportParent(rwr, parent)
+	case "create":
+		createKey(rwr, parent)
+	case "duplicate":
+		duplicateKey(rwr, parent)
+	case "import":
+		importKey(rwr, parent)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+// exportParent writes the public area of the destination SRK for the source TPM.
+func exportParent(rwr transport.TPM, parent tpm2.NamedHandle) {
+	pub, err := tpm2.ReadPublic{
+		ObjectHandle: parent.Handle,
+	}.Execute(rwr)
+	if err != nil {
+		log.Fatalf("can't read parent public %v", err)
+	}
+	if err := os.WriteFile(*newParent, tpm2.Marshal(pub.OutPublic), 0644); err != nil {
+		log.Fatalf("can't write new parent %v", err)
+	}
+	log.Printf("wrote %s, parent name %x", *newParent, parent.Name.Buffer)
+}
+
+func readNewParent() tpm2.TPM2BPublic {
+	b, err := os.ReadFile(*newParent)
+	if err != nil {
+		log.Fatalf("can't read new parent %v", err)
+	}
+	pub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](b)
+	if err != nil {
+		log.Fatalf("can't unmarshal new parent %v", err)
+	}
+	return *pub
+}
+
+func parentRef() tpm2.TPMHandle {
+	if *parentHandle != 0 {
+		return tpm2.TPMHandle(*parentHandle)
+	}
+	return tpm2.TPMRHOwner
+}
+
+func writeKeyFile(tk *tpmpqc.TPMKey) {
+	pemBytes, err := tk.EncodePEM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyFile, pemBytes, 0600); err != nil {
+		log.Fatalf("can't write key file %v", err)
+	}
+	log.Printf("wrote %s", *keyFile)
+}
+
+// createKey creates a key on the source TPM which can only be duplicated to --new-parent.
+func createKey(rwr transport.TPM, parent tpm2.NamedHandle) {
+	np := readNewParent()
+
+	var tk *tpmpqc.TPMKey
+	switch *keyType {
+	case "mldsa":
+		if *parameterSet == 0 {
+			*parameterSet = 65
+		}
+		ps, err := tpmpqc.MLDSAParameterSet(*parameterSet)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := tpmpqc.CreateDuplicableSigningKey(rwr, parent, ps, np)
+		if err != nil {
+			log.Fatalf("can't create mldsa %v", err)
+		}
+		defer k.Close()
+		if tk, err = k.TPMKey(parentRef(), *srkType); err != nil {
+			log.Fatal(err)
+		}
+	case "mlkem":
+		if *parameterSet == 0 {
+			*parameterSet = 768
+		}
+		ps, err := tpmpqc.MLKEMParameterSet(*parameterSet)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := tpmpqc.CreateDuplicableKEMKey(rwr, parent, ps, np)
+		if err != nil {
+			log.Fatalf("can't create mlkem %v", err)
+		}
+		defer k.Close()
+		if tk, err = k.TPMKey(parentRef(), *srkType); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown key type %q", *keyType)
+	}
+	writeKeyFile(tk)
+}
+
+// duplicateKey wraps the key from --keyfile for --new-parent and writes the bundle.
+func duplicateKey(rwr transport.TPM, parent tpm2.NamedHandle) {
+	pemBytes, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("can't read key file %v", err)
+	}
+	tk, err := tpmpqc.DecodeTPMKey(pemBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alg, err := tk.KeyType()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= duplicate ========")
+	var bundle *tpmpqc.DuplicationBundle
+	switch alg {
+	case tpm2.TPMAlgMLDSA:
+		k, err := tpmpqc.LoadSigningKeyFromTPMKey(rwr, parent, tk, nil)
+		if err != nil {
+			log.Fatalf("can't load mldsa %v", err)
+		}
+		defer k.Close()
+		bundle, err = k.Duplicate(readNewParent())
+		if err != nil {
+			log.Fatal(err)
+		}
+	case tpm2.TPMAlgMLKEM:
+		k, err := tpmpqc.LoadKEMKeyFromTPMKey(rwr, parent, tk, nil)
+		if err != nil {
+			log.Fatalf("can't load mlkem %v", err)
+		}
+		defer k.Close()
+		bundle, err = k.Duplicate(readNewParent())
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unsupported key type %v", alg)
+	}
+	if err := os.WriteFile(*bundleFile, bundle.Marshal(), 0600); err != nil {
+		log.Fatalf("can't write bundle %v", err)
+	}
+	log.Printf("wrote %s", *bundleFile)
+}
+
+// importKey imports the bundle under the destination SRK, writes a key file and uses the key once.
+func importKey(rwr transport.TPM, parent tpm2.NamedHandle) {
+	b, err := os.ReadFile(*bundleFile)
+	if err != nil {
+		log.Fatalf("can't read bundle %v", err)
+	}
+	bundle, err := tpmpqc.UnmarshalDuplicationBundle(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= import ========")
+	public, private, err := tpmpqc.ImportDuplicate(rwr, parent, bundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tk, err := tpmpqc.NewTPMKey(public, private, parentRef(), *srkType, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeKeyFile(tk)
+
+	alg, err := tk.KeyType()
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch alg {
+	case tpm2.TPMAlgMLDSA:
+		k, err := tpmpqc.LoadSigningKey(rwr, parent, public, private)
+		if err != nil {
+			log.Fatalf("can't load mldsa %v", err)
+		}
+		defer k.Close()
+
+		log.Printf("======= sign ========")
+		sig, err := k.Sign(nil, []byte(*dataToSign), &mldsa.Options{})
+		if err != nil {
+			log.Fatalf("can't sign %v", err)
+		}
+		fmt.Printf("Signature : %s\n", base64.StdEncoding.EncodeToString(sig))
+		pub, err := k.PublicKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mldsa.Verify(pub, []byte(*dataToSign), sig, &mldsa.Options{}); err != nil {
+			log.Fatalf("error verifying %v", err)
+		}
+		fmt.Println("Verified signature using standard go")
+	case tpm2.TPMAlgMLKEM:
+		k, err := tpmpqc.LoadKEMKey(rwr, parent, public, private)
+		if err != nil {
+			log.Fatalf("can't load mlkem %v", err)
+		}
+		defer k.Close()
+
+		ek := k.Encapsulator()
+		if ek == nil {
+			log.Fatalf("can't read encapsulation key")
+		}
+		sharedSecret, ciphertext := ek.Encapsulate()
+		fmt.Printf("SharedSecret %s\n", base64.StdEncoding.EncodeToString(sharedSecret))
+
+		log.Printf("======= decapsulate ========")
+		dsharedSecret, err := k.Decapsulate(ciphertext)
+		if err != nil {
+			log.Fatalf("can't decapsulate %v", err)
+		}
+		fmt.Printf("SharedSecret from decapsulation %s\n", base64.StdEncoding.EncodeToString(dsharedSecret))
+		if !bytes.Equal(sharedSecret, dsharedSecret) {
+			log.Fatalf("shared secrets don't match")
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package faketpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha3"
+	"encoding/binary"
+	"slices"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// TPM_GENERATED_VALUE, restricted keys don't sign messages that start with it
+var tpmGenerated = []byte{0xff, 'T', 'C', 'G'}
+
+func startup(_ *TPM, _ *call, _ tpm2.Startup) (*tpm2.StartupResponse, error) {
+	return &tpm2.StartupResponse{}, nil
+}
+
+// maxRandom is the size of the largest digest, a TPM returns at most that many bytes from GetRandom.
+const maxRandom = 64
+
+func getRandom(_ *TPM, _ *call, cmd tpm2.GetRandom) (*tpm2.GetRandomResponse, error) {
+	b := make([]byte, min(int(cmd.BytesRequested), maxRandom))
+	rand.Read(b)
+	return &tpm2.GetRandomResponse{
+		RandomBytes: tpm2.TPM2BDigest{
+			Buffer: b,
+		},
+	}, nil
+}
+
+var algorithms = []tpm2.TPMSAlgProperty{
+	{Alg: tpm2.TPMAlgRSA, AlgProperties: tpm2.TPMAAlgorithm{Asymmetric: true, Object: true}},
+	{Alg: tpm2.TPMAlgAES, AlgProperties: tpm2.TPMAAlgorithm{Symmetric: true}},
+	{Alg: tpm2.TPMAlgSHA256, AlgProperties: tpm2.TPMAAlgorithm{Hash: true}},
+	{Alg: tpm2.TPMAlgSHA384, AlgProperties: tpm2.TPMAAlgorithm{Hash: true}},
+	{Alg: tpm2.TPMAlgSHA512, AlgProperties: tpm2.TPMAAlgorithm{Hash: true}},
+	{Alg: tpm2.TPMAlgNull, AlgProperties: tpm2.TPMAAlgorithm{}},
+	{Alg: tpm2.TPMAlgECC, AlgProperties: tpm2.TPMAAlgorithm{Asymmetric: true, Object: true}},
+	{Alg: tpm2.TPMAlgCFB, AlgProperties: tpm2.TPMAAlgorithm{Symmetric: true, Encrypting: true}},
+	{Alg: tpm2.TPMAlgMLKEM, AlgProperties: tpm2.TPMAAlgorithm{Asymmetric: true, Object: true, Encrypting: true}},
+	{Alg: tpm2.TPMAlgMLDSA, AlgProperties: tpm2.TPMAAlgorithm{Asymmetric: true, Object: true, Signing: true}},
+}
+
+// firstFrom returns up to count entries of list starting at the first one whose key is >= from, and
+// whether there are more.
+func firstFrom[T any](list []T, key func(T) uint32, from, count uint32) ([]T, bool) {
+	i := 0
+	for i < len(list) && key(list[i]) < from {
+		i++
+	}
+	list = list[i:]
+	if uint32(len(list)) > count {
+		return list[:count], true
+	}
+	return list, false
+}
+
+func getCapability(t *TPM, _ *call, cmd tpm2.GetCapability) (*tpm2.GetCapabilityResponse, error) {
+	rsp := &tpm2.GetCapabilityResponse{
+		CapabilityData: tpm2.TPMSCapabilityData{
+			Capability: cmd.Capability,
+		},
+	}
+	switch cmd.Capability {
+	case tpm2.TPMCapAlgs:
+		algs, more := firstFrom(algorithms, func(a tpm2.TPMSAlgProperty) uint32 { return uint32(a.Alg) }, cmd.Property, cmd.PropertyCount)
+		rsp.MoreData = more
+		rsp.CapabilityData.Data = tpm2.NewTPMUCapabilities(tpm2.TPMCapAlgs, &tpm2.TPMLAlgProperty{AlgProperties: algs})
+	case tpm2.TPMCapCommands:
+		var ccs []tpm2.TPMACC
+		for cc, c := range commands {
+			ccs = append(ccs, tpm2.TPMACC{
+				CommandIndex: uint16(cc),
+				CHandles:     uint8(c.handles),
+				RHandle:      c.rHandle,
+			})
+		}
+		slices.SortFunc(ccs, func(a, b tpm2.TPMACC) int { return int(a.CommandIndex) - int(b.CommandIndex) })
+		ccs, more := firstFrom(ccs, func(a tpm2.TPMACC) uint32 { return uint32(a.CommandIndex) }, cmd.Property, cmd.PropertyCount)
+		rsp.MoreData = more
+		rsp.CapabilityData.Data = tpm2.NewTPMUCapabilities(tpm2.TPMCapCommands, &tpm2.TPMLCCA{CommandAttributes: ccs})
+	case tpm2.TPMCapTPMProperties:
+		props := []tpm2.TPMSTaggedProperty{
+			{Property: tpm2.TPMPTFamilyIndicator, Value: binary.BigEndian.Uint32([]byte("2.0\x00"))},
+			{Property: tpm2.TPMPTManufacturer, Value: binary.BigEndian.Uint32([]byte("FAKE"))},
+			{Property: tpm2.TPMPTInputBuffer, Value: inputBuffer},
+		}
+		if t.transientObjects > 0 {
+			props = append(props, tpm2.TPMSTaggedProperty{Property: tpm2.TPMPTHRTransientMin, Value: uint32(t.transientObjects)})
+		}
+		if t.loadedSessions > 0 {
+			props = append(props, tpm2.TPMSTaggedProperty{Property: tpm2.TPMPTHRLoadedMin, Value: uint32(t.loadedSessions)})
+		}
+		props = append(props,
+			tpm2.TPMSTaggedProperty{Property: tpm2.TPMPTNVIndexMax, Value: nvIndexMax},
+			tpm2.TPMSTaggedProperty{Property: tpm2.TPMPTNVBufferMax, Value: nvBufferMax},
+			tpm2.TPMSTaggedProperty{Property: tpm2.TPMPTMLParameterSet, Value: binary.BigEndian.Uint32(tpm2.Marshal(t.parameterSets))},
+		)
+		props, more := firstFrom(props, func(p tpm2.TPMSTaggedProperty) uint32 { return uint32(p.Property) }, cmd.Property, cmd.PropertyCount)
+		rsp.MoreData = more
+		rsp.CapabilityData.Data = tpm2.NewTPMUCapabilities(tpm2.TPMCapTPMProperties, &tpm2.TPMLTaggedTPMProperty{TPMProperty: props})
+	default:
+		return nil, tpm2.TPMRCValue
+	}
+	return rsp, nil
+}
+
+func sensitiveAuth(s tpm2.TPM2BSensitiveCreate) []byte {
+	if s.Sensitive == nil {
+		return nil
+	}
+	return s.Sensitive.UserAuth.Buffer
+}
+
+func createPrimary(t *TPM, c *call, cmd tpm2.CreatePrimary) (*tpm2.CreatePrimaryResponse, error) {
+	template, err := cmd.InPublic.Contents()
+	if err != nil {
+		return nil, tpm2.TPMRCSize
+	}
+	o, err := t.primary(c.handles[0], template, sensitiveAuth(cmd.InSensitive))
+	if err != nil {
+		return nil, err
+	}
+	h, err := t.addObject(o)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.CreatePrimaryResponse{
+		ObjectHandle: h,
+		OutPublic:    tpm2.New2B(o.public),
+		CreationTicket: tpm2.TPMTTKCreation{
+			Tag:       tpm2.TPMSTCreation,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+		Name: o.name,
+	}, nil
+}
+
+func create(t *TPM, c *call, cmd tpm2.Create) (*tpm2.CreateResponse, error) {
+	parent, err := t.parent(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	template, err := cmd.InPublic.Contents()
+	if err != nil {
+		return nil, tpm2.TPMRCSize
+	}
+	if err := t.checkTemplate(template); err != nil {
+		return nil, err
+	}
+	seed := make([]byte, seedSize(template.Type))
+	rand.Read(seed)
+	o, err := newObject(template, seed, parent.hierarchy, sensitiveAuth(cmd.InSensitive))
+	if err != nil {
+		return nil, err
+	}
+	private, err := parent.wrap(o)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.CreateResponse{
+		OutPrivate: tpm2.TPM2BPrivate{
+			Buffer: private,
+		},
+		OutPublic: tpm2.New2B(o.public),
+		CreationTicket: tpm2.TPMTTKCreation{
+			Tag:       tpm2.TPMSTCreation,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}, nil
+}
+
+func load(t *TPM, c *call, cmd tpm2.Load) (*tpm2.LoadResponse, error) {
+	parent, err := t.parent(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	pub, err := cmd.InPublic.Contents()
+	if err != nil {
+		return nil, tpm2.TPMRCSize
+	}
+	if err := t.checkTemplate(pub); err != nil {
+		return nil, err
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	auth, seed, err := parent.unwrap(cmd.InPrivate.Buffer, name.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	o, err := newObject(pub, seed, parent.hierarchy, auth)
+	if err != nil {
+		return nil, err
+	}
+	// the public key has to match the seed
+	if !slices.Equal(o.name.Buffer, name.Buffer) {
+		return nil, tpm2.TPMRCBinding
+	}
+	h, err := t.addObject(o)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.LoadResponse{
+		ObjectHandle: h,
+		Name:         o.name,
+	}, nil
+}
+
+func readPublic(t *TPM, c *call, _ tpm2.ReadPublic) (*tpm2.ReadPublicResponse, error) {
+	o, err := t.object(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.ReadPublicResponse{
+		OutPublic:     tpm2.New2B(o.public),
+		Name:          o.name,
+		QualifiedName: o.name,
+	}, nil
+}
+
+// kemKey returns an unrestricted ML-KEM decryption key.
+func (t *TPM) kemKey(h tpm2.TPMHandle) (*object, error) {
+	o, err := t.object(h)
+	if err != nil {
+		return nil, err
+	}
+	if o.public.Type != tpm2.TPMAlgMLKEM {
+		return nil, tpm2.TPMRCKey
+	}
+	if o.public.ObjectAttributes.Restricted {
+		return nil, tpm2.TPMRCAttributes
+	}
+	return o, nil
+}
+
+func encapsulate(t *TPM, c *call, _ tpm2.Encapsulate) (*tpm2.EncapsulateResponse, error) {
+	o, err := t.kemKey(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	ss, ct, err := o.encapsulate()
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.EncapsulateResponse{
+		SharedSecret: tpm2.TPM2BSharedSecret{Buffer: ss},
+		CipherText:   tpm2.TPM2BKEMCipherText{Buffer: ct},
+	}, nil
+}
+
+func decapsulate(t *TPM, c *call, cmd tpm2.Decapsulate) (*tpm2.DecapsulateResponse, error) {
+	o, err := t.kemKey(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	ss, err := o.decapsulate(cmd.CipherText.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.DecapsulateResponse{
+		SharedSecret: tpm2.TPM2BSharedSecret{Buffer: ss},
+	}, nil
+}
+
+// sequence is a sign or verify sequence object.  Sign sequences absorb the message into mu like a TPM
+// would, so their state stays small; verify sequences buffer the message until the sequence completes.
+// The key is remembered by name since it may be flushed and loaded again at another handle in between.
+type sequence struct {
+	keyName []byte
+	verify  bool
+	auth    []byte
+	context []byte
+	// mu is SHAKE256(tr || 0 || len(ctx) || ctx || message so far), FIPS 204 algorithm 2.  head keeps
+	// the first bytes of the message for the TPM_GENERATED_VALUE check.
+	mu   *sha3.SHAKE
+	head []byte
+	// message is only used by verify sequences
+	message []byte
+}
+
+func (s *sequence) update(b []byte) {
+	if s.mu == nil {
+		s.message = append(s.message, b...)
+		return
+	}
+	if n := len(tpmGenerated) - len(s.head); n > 0 {
+		s.head = append(s.head, b[:min(n, len(b))]...)
+	}
+	s.mu.Write(b)
+}
+
+// signingKey returns an ML-DSA signing key.
+func (t *TPM) signingKey(h tpm2.TPMHandle) (*object, error) {
+	o, err := t.object(h)
+	if err != nil {
+		return nil, err
+	}
+	if o.public.Type != tpm2.TPMAlgMLDSA {
+		return nil, tpm2.TPMRCKey
+	}
+	return o, nil
+}
+
+func (t *TPM) startSequence(key tpm2.TPMHandle, verify bool, auth, context []byte) (tpm2.TPMHandle, error) {
+	o, err := t.signingKey(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(context) > 255 {
+		return 0, tpm2.TPMRCSize
+	}
+	if err := t.objectSlot(); err != nil {
+		return 0, err
+	}
+	s := &sequence{
+		keyName: o.name.Buffer,
+		verify:  verify,
+		auth:    auth,
+		context: context,
+	}
+	if !verify {
+		sk, err := o.mldsaKey()
+		if err != nil {
+			return 0, err
+		}
+		tr := make([]byte, 64)
+		h := sha3.NewSHAKE256()
+		h.Write(sk.PublicKey().Bytes())
+		h.Read(tr)
+		s.mu = sha3.NewSHAKE256()
+		s.mu.Write(tr)
+		s.mu.Write([]byte{0, byte(len(context))})
+		s.mu.Write(context)
+	}
+	h := t.nextObject
+	t.nextObject++
+	t.sequences[h] = s
+	return h, nil
+}
+
+func signSequenceStart(t *TPM, c *call, cmd tpm2.SignSequenceStart) (*tpm2.SignSequenceStartResponse, error) {
+	h, err := t.startSequence(c.handles[0], false, cmd.Auth.Buffer, cmd.Context.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.SignSequenceStartResponse{
+		SequenceHandle: h,
+	}, nil
+}
+
+func verifySequenceStart(t *TPM, c *call, cmd tpm2.VerifySequenceStart) (*tpm2.VerifySequenceStartResponse, error) {
+	h, err := t.startSequence(c.handles[0], true, cmd.Auth.Buffer, cmd.Context.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.VerifySequenceStartResponse{
+		SequenceHandle: h,
+	}, nil
+}
+
+func sequenceUpdate(t *TPM, c *call, cmd tpm2.SequenceUpdate) (*tpm2.SequenceUpdateResponse, error) {
+	s, ok := t.sequences[c.handles[0]]
+	if !ok {
+		return nil, tpm2.TPMRCHandle
+	}
+	if len(cmd.Buffer.Buffer) > inputBuffer {
+		return nil, tpm2.TPMRCSize
+	}
+	s.update(cmd.Buffer.Buffer)
+	return &tpm2.SequenceUpdateResponse{}, nil
+}
+
+// completeSequence returns the sequence at handles[0] and its key at handles[1], and flushes the sequence.
+func (t *TPM) completeSequence(c *call, verify bool) (*sequence, *object, error) {
+	s, ok := t.sequences[c.handles[0]]
+	if !ok || s.verify != verify {
+		return nil, nil, tpm2.TPMRCHandle
+	}
+	if !slices.Equal(s.keyName, t.name(c.handles[1])) {
+		return nil, nil, tpm2.TPMRCKey
+	}
+	o, err := t.signingKey(c.handles[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(t.sequences, c.handles[0])
+	return s, o, nil
+}
+
+func mldsaSignature(sig []byte) tpm2.TPMTSignature {
+	return tpm2.TPMTSignature{
+		SigAlg: tpm2.TPMAlgMLDSA,
+		Signature: tpm2.NewTPMUSignature(
+			tpm2.TPMAlgMLDSA,
+			&tpm2.TPM2BSignatureMLDSA{
+				Buffer: sig,
+			},
+		),
+	}
+}
+
+func signSequenceComplete(t *TPM, c *call, cmd tpm2.SignSequenceComplete) (*tpm2.SignSequenceCompleteResponse, error) {
+	if len(cmd.Buffer.Buffer) > inputBuffer {
+		return nil, tpm2.TPMRCSize
+	}
+	s, o, err := t.completeSequence(c, false)
+	if err != nil {
+		return nil, err
+	}
+	s.update(cmd.Buffer.Buffer)
+	if o.public.ObjectAttributes.Restricted && slices.Equal(s.head, tpmGenerated) {
+		return nil, tpm2.TPMRCValue
+	}
+	sk, err := o.mldsaKey()
+	if err != nil {
+		return nil, err
+	}
+	mu := make([]byte, crypto.MLDSAMu.Size())
+	s.mu.Read(mu)
+	sig, err := sk.Sign(nil, mu, crypto.MLDSAMu)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.SignSequenceCompleteResponse{
+		Signature: mldsaSignature(sig),
+	}, nil
+}
+
+func verifySequenceComplete(t *TPM, c *call, cmd tpm2.VerifySequenceComplete) (*tpm2.VerifySequenceCompleteResponse, error) {
+	s, o, err := t.completeSequence(c, true)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Signature.SigAlg != tpm2.TPMAlgMLDSA {
+		return nil, tpm2.TPMRCScheme
+	}
+	sig, err := cmd.Signature.Signature.MLDSA()
+	if err != nil {
+		return nil, tpm2.TPMRCScheme
+	}
+	sk, err := o.mldsaKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := mldsa.Verify(sk.PublicKey(), s.message, sig.Buffer, &mldsa.Options{Context: string(s.context)}); err != nil {
+		return nil, tpm2.TPMRCSignature
+	}
+	return &tpm2.VerifySequenceCompleteResponse{
+		Validation: t.verifiedTicket(o, s.message),
+	}, nil
+}
+
+// verifiedTicket is HMAC(proof, TPM_ST_VERIFIED || H(message) || keyName), or the null ticket for keys
+// in the null hierarchy.
+func (t *TPM) verifiedTicket(o *object, message []byte) tpm2.TPMTTKVerified {
+	if o.hierarchy == tpm2.TPMRHNull {
+		return tpm2.TPMTTKVerified{
+			Tag:       tpm2.TPMSTVerified,
+			Hierarchy: tpm2.TPMRHNull,
+		}
+	}
+	proof := tpm2.KDFa(crypto.SHA256, t.seed, "PROOF", binary.BigEndian.AppendUint32(nil, uint32(o.hierarchy)), nil, 256)
+	digest := sha256.Sum256(message)
+	mac := hmac.New(sha256.New, proof)
+	binary.Write(mac, binary.BigEndian, uint16(tpm2.TPMSTVerified))
+	mac.Write(digest[:])
+	mac.Write(o.name.Buffer)
+	return tpm2.TPMTTKVerified{
+		Tag:       tpm2.TPMSTVerified,
+		Hierarchy: o.hierarchy,
+		Digest: tpm2.TPM2BDigest{
+			Buffer: mac.Sum(nil),
+		},
+	}
+}
+
+// signDigest signs an external mu.  The key needs allowExternalMu.
+func signDigest(t *TPM, c *call, cmd tpm2.SignDigest) (*tpm2.SignDigestResponse, error) {
+	o, err := t.signingKey(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	p, _ := o.mldsaParameters()
+	if !p.AllowExternalMu {
+		return nil, tpm2.TPMRCAttributes
+	}
+	if len(cmd.Digest.Buffer) != crypto.MLDSAMu.Size() {
+		return nil, tpm2.TPMRCSize
+	}
+	sk, err := o.mldsaKey()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := sk.Sign(nil, cmd.Digest.Buffer, crypto.MLDSAMu)
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.SignDigestResponse{
+		Signature: mldsaSignature(sig),
+	}, nil
+}
+
+// hmacCommand computes an HMAC with a keyed hash key, the seed of an HMAC object is its key.
+// decodeHmac decodes the TPM2_HMAC parameters; the command's handle is a concrete AuthHandle, which
+// tpm2.UnmarshalCommand can't fill in.
+func decodeHmac(_ int, params []byte) (tpm2.Hmac, error) {
+	r := bytes.NewReader(params)
+	buffer, err := read2B(r)
+	if err != nil {
+		return tpm2.Hmac{}, err
+	}
+	var alg tpm2.TPMIAlgHash
+	if err := binary.Read(r, binary.BigEndian, &alg); err != nil {
+		return tpm2.Hmac{}, err
+	}
+	return tpm2.Hmac{
+		Buffer: tpm2.TPM2BMaxBuffer{
+			Buffer: buffer,
+		},
+		HashAlg: alg,
+	}, nil
+}
+
+func hmacCommand(t *TPM, c *call, cmd tpm2.Hmac) (*tpm2.HmacResponse, error) {
+	o, err := t.object(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	if o.public.Type != tpm2.TPMAlgKeyedHash || !o.public.ObjectAttributes.SignEncrypt {
+		return nil, tpm2.TPMRCKey
+	}
+	p, err := o.public.Parameters.KeyedHashDetail()
+	if err != nil {
+		return nil, tpm2.TPMRCKey
+	}
+	scheme, err := p.Scheme.Details.HMAC()
+	if err != nil {
+		return nil, tpm2.TPMRCScheme
+	}
+	alg := cmd.HashAlg
+	if alg == tpm2.TPMAlgNull {
+		alg = scheme.HashAlg
+	} else if alg != scheme.HashAlg {
+		return nil, tpm2.TPMRCValue
+	}
+	ha, err := alg.Hash()
+	if err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	if len(cmd.Buffer.Buffer) > inputBuffer {
+		return nil, tpm2.TPMRCSize
+	}
+	mac := hmac.New(ha.New, o.seed)
+	mac.Write(cmd.Buffer.Buffer)
+	return &tpm2.HmacResponse{
+		OutHMAC: tpm2.TPM2BDigest{
+			Buffer: mac.Sum(nil),
+		},
+	}, nil
+}
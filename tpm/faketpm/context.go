@@ -0,0 +1,218 @@
+package faketpm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha3"
+	"encoding/binary"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// context blob types
+const (
+	contextObject   byte = 'o'
+	contextSequence byte = 's'
+	contextSession  byte = 'S'
+)
+
+// sessionSlot returns TPM_RC_SESSION_MEMORY if Config.LoadedSessions sessions are loaded.  Saved sessions
+// don't count.
+func (t *TPM) sessionSlot() error {
+	if t.loadedSessions == 0 {
+		return nil
+	}
+	loaded := 0
+	for _, s := range t.sessions {
+		if !s.saved {
+			loaded++
+		}
+	}
+	if loaded >= t.loadedSessions {
+		return tpm2.TPMRCSessionMemory
+	}
+	return nil
+}
+
+func decodeContextSave(_ int, _ []byte) (tpm2.ContextSave, error) {
+	return tpm2.ContextSave{}, nil
+}
+
+// contextAEAD seals context blobs with the context key, which is derived from the seed so contexts
+// can be loaded by another instance with the same seed, like a TPM after a process restart.  The
+// sequence number, saved handle and hierarchy are authenticated with the blob.
+//
+//	contextBlob = nonce || AES-256-GCM(contextKey, nonce, state, sequence || savedHandle || hierarchy)
+func (t *TPM) contextAEAD(ctx *tpm2.TPMSContext) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(t.contextKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad := binary.BigEndian.AppendUint64(nil, ctx.Sequence)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(ctx.SavedHandle))
+	ad = binary.BigEndian.AppendUint32(ad, uint32(ctx.Hierarchy))
+	return aead, ad, nil
+}
+
+func write2B(b *bytes.Buffer, v []byte) {
+	binary.Write(b, binary.BigEndian, uint16(len(v)))
+	b.Write(v)
+}
+
+// contextSave saves objects and sequences as encrypted blobs, the TPM forgets nothing until FlushContext.
+// A saved session stays at its handle but is unloaded until the context is loaded again, once.
+func contextSave(t *TPM, c *call, _ tpm2.ContextSave) (*tpm2.ContextSaveResponse, error) {
+	h := c.handles[0]
+	t.contextSequence++
+	ctx := tpm2.TPMSContext{
+		Sequence:  t.contextSequence,
+		Hierarchy: tpm2.TPMRHNull,
+	}
+	var state bytes.Buffer
+	if o, ok := t.objects[h]; ok {
+		ctx.SavedHandle = tpm2.TPMIDHSavedTransient
+		ctx.Hierarchy = o.hierarchy
+		state.WriteByte(contextObject)
+		write2B(&state, tpm2.Marshal(o.public))
+		write2B(&state, o.name.Buffer)
+		write2B(&state, o.auth)
+		write2B(&state, o.seed)
+		write2B(&state, o.storage)
+	} else if s, ok := t.sequences[h]; ok {
+		ctx.SavedHandle = tpm2.TPMIDHSavedSequence
+		state.WriteByte(contextSequence)
+		if s.verify {
+			state.WriteByte(1)
+		} else {
+			state.WriteByte(0)
+		}
+		write2B(&state, s.keyName)
+		write2B(&state, s.auth)
+		write2B(&state, s.context)
+		var mu []byte
+		if s.mu != nil {
+			var err error
+			if mu, err = s.mu.MarshalBinary(); err != nil {
+				return nil, err
+			}
+		}
+		write2B(&state, mu)
+		write2B(&state, s.head)
+		binary.Write(&state, binary.BigEndian, uint32(len(s.message)))
+		state.Write(s.message)
+	} else if s, ok := t.sessions[h]; ok && !s.saved {
+		ctx.SavedHandle = h
+		state.WriteByte(contextSession)
+		s.saved = true
+		s.contextSequence = ctx.Sequence
+	} else {
+		return nil, tpm2.TPMRCHandle
+	}
+	aead, ad, err := t.contextAEAD(&ctx)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	ctx.ContextBlob.Buffer = aead.Seal(nonce, nonce, state.Bytes(), ad)
+	return &tpm2.ContextSaveResponse{
+		Context: ctx,
+	}, nil
+}
+
+func contextLoad(t *TPM, _ *call, cmd tpm2.ContextLoad) (*tpm2.ContextLoadResponse, error) {
+	ctx := cmd.Context
+	aead, ad, err := t.contextAEAD(&ctx)
+	if err != nil {
+		return nil, err
+	}
+	blob := ctx.ContextBlob.Buffer
+	if len(blob) < aead.NonceSize() {
+		return nil, tpm2.TPMRCSize
+	}
+	state, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], ad)
+	if err != nil || len(state) == 0 {
+		return nil, tpm2.TPMRCIntegrity
+	}
+	r := bytes.NewReader(state[1:])
+	var h tpm2.TPMHandle
+	switch state[0] {
+	case contextObject:
+		o := &object{
+			hierarchy: ctx.Hierarchy,
+		}
+		public, err := read2B(r)
+		if err != nil {
+			return nil, tpm2.TPMRCSize
+		}
+		pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](public)
+		if err != nil {
+			return nil, tpm2.TPMRCSize
+		}
+		o.public = *pub
+		for _, f := range []*[]byte{&o.name.Buffer, &o.auth, &o.seed, &o.storage} {
+			if *f, err = read2B(r); err != nil {
+				return nil, tpm2.TPMRCSize
+			}
+		}
+		if len(o.storage) == 0 {
+			o.storage = nil
+		}
+		if h, err = t.addObject(o); err != nil {
+			return nil, err
+		}
+	case contextSequence:
+		verify, err := r.ReadByte()
+		if err != nil {
+			return nil, tpm2.TPMRCSize
+		}
+		s := &sequence{
+			verify: verify == 1,
+		}
+		var mu []byte
+		for _, f := range []*[]byte{&s.keyName, &s.auth, &s.context, &mu, &s.head} {
+			if *f, err = read2B(r); err != nil {
+				return nil, tpm2.TPMRCSize
+			}
+		}
+		if len(mu) > 0 {
+			s.mu = sha3.NewSHAKE256()
+			if err := s.mu.UnmarshalBinary(mu); err != nil {
+				return nil, tpm2.TPMRCSize
+			}
+		}
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil || int(n) != r.Len() {
+			return nil, tpm2.TPMRCSize
+		}
+		s.message = state[len(state)-r.Len():]
+		if err := t.objectSlot(); err != nil {
+			return nil, err
+		}
+		h = t.nextObject
+		t.nextObject++
+		t.sequences[h] = s
+	case contextSession:
+		h = ctx.SavedHandle
+		s, ok := t.sessions[h]
+		// a session context can only be loaded once, Part 1 30.4
+		if !ok || !s.saved || s.contextSequence != ctx.Sequence {
+			return nil, tpm2.TPMRCHandle
+		}
+		if err := t.sessionSlot(); err != nil {
+			return nil, err
+		}
+		s.saved = false
+	default:
+		return nil, tpm2.TPMRCIntegrity
+	}
+	return &tpm2.ContextLoadResponse{
+		LoadedHandle: h,
+	}, nil
+}
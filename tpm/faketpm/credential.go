@@ -0,0 +1,82 @@
+package faketpm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// activateCredential recovers a credential made for an ML-KEM EK, Part 1 24.
+//
+// The secret is the ML-KEM ciphertext and the seed is KDFa(nameAlg, sharedKey, "IDENTITY", ciphertext, ek),
+// the labeled encapsulation of the go-tpm patch.  Only ML-KEM keys are supported as keyHandle.
+func activateCredential(t *TPM, c *call, cmd tpm2.ActivateCredential) (*tpm2.ActivateCredentialResponse, error) {
+	activate, err := t.object(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.object(c.handles[1])
+	if err != nil {
+		return nil, err
+	}
+	if key.public.Type != tpm2.TPMAlgMLKEM || !key.isStorageParent() {
+		return nil, tpm2.TPMRCKey
+	}
+	ha, err := key.public.NameAlg.Hash()
+	if err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	sharedKey, err := key.decapsulate(cmd.Secret.Buffer)
+	if err != nil {
+		return nil, tpm2.TPMRCValue
+	}
+	ek, err := key.public.Unique.KEM()
+	if err != nil {
+		return nil, tpm2.TPMRCKey
+	}
+	seed := tpm2.KDFa(ha, sharedKey, "IDENTITY", cmd.Secret.Buffer, ek.Buffer, ha.Size()*8)
+
+	// TPMS_ID_OBJECT: integrityHMAC || encIdentity
+	r := bytes.NewReader(cmd.CredentialBlob.Buffer)
+	integrity, err := read2B(r)
+	if err != nil {
+		return nil, tpm2.TPMRCSize
+	}
+	encIdentity := cmd.CredentialBlob.Buffer[len(cmd.CredentialBlob.Buffer)-r.Len():]
+
+	mac := hmac.New(ha.New, tpm2.KDFa(ha, seed, "INTEGRITY", nil, nil, ha.Size()*8))
+	mac.Write(encIdentity)
+	mac.Write(activate.name.Buffer)
+	if !hmac.Equal(mac.Sum(nil), integrity) {
+		return nil, tpm2.TPMRCIntegrity
+	}
+
+	p, err := key.public.Parameters.MLKEMDetail()
+	if err != nil {
+		return nil, tpm2.TPMRCKey
+	}
+	bits, err := p.Symmetric.KeyBits.AES()
+	if err != nil {
+		return nil, tpm2.TPMRCSymmetric
+	}
+	block, err := aes.NewCipher(tpm2.KDFa(ha, seed, "STORAGE", activate.name.Buffer, nil, int(*bits)))
+	if err != nil {
+		return nil, tpm2.TPMRCSymmetric
+	}
+	identity := make([]byte, len(encIdentity))
+	cipher.NewCFBDecrypter(block, make([]byte, block.BlockSize())).XORKeyStream(identity, encIdentity)
+
+	// the decrypted TPM2B_DIGEST has to use up the whole encIdentity
+	if len(identity) < 2 || int(binary.BigEndian.Uint16(identity))+2 != len(identity) {
+		return nil, tpm2.TPMRCSize
+	}
+	return &tpm2.ActivateCredentialResponse{
+		CertInfo: tpm2.TPM2BDigest{
+			Buffer: identity[2:],
+		},
+	}, nil
+}
@@ -0,0 +1,204 @@
+package faketpm
+
+import (
+	"github.com/google/go-tpm/tpm2"
+)
+
+const (
+	// TPM_PT_NV_INDEX_MAX and TPM_PT_NV_BUFFER_MAX, the values of swtpm
+	nvIndexMax  = 2048
+	nvBufferMax = 1024
+
+	firstNVIndex = 0x01000000
+)
+
+// nvIndex is an ordinary NV index.  Counter, bit field, extend and PIN indices aren't implemented.
+type nvIndex struct {
+	public tpm2.TPMSNVPublic
+	auth   []byte
+	data   []byte
+}
+
+func (n *nvIndex) name() []byte {
+	name, err := tpm2.NVName(&n.public)
+	if err != nil {
+		return nil
+	}
+	return name.Buffer
+}
+
+func (t *TPM) nvIndex(h tpm2.TPMHandle) (*nvIndex, error) {
+	n, ok := t.nv[h]
+	if !ok {
+		return nil, tpm2.TPMRCHandle
+	}
+	return n, nil
+}
+
+// nvAccess checks that the authorization of a read or write is allowed by the index attributes: the
+// owner needs ownerRead/ownerWrite, the index itself authRead/authWrite with a password or HMAC
+// session and policyRead/policyWrite with a policy session.
+func (t *TPM) nvAccess(c *call, owner, auth, policy bool) error {
+	switch c.authHandles[0] {
+	case tpm2.TPMRHOwner:
+		if !owner {
+			return tpm2.TPMRCNVAuthorization
+		}
+	case c.handles[1]:
+		s, ok := t.sessions[c.auths[0].handle]
+		if ok && s.policyDigest != nil {
+			if !policy {
+				return tpm2.TPMRCNVAuthorization
+			}
+		} else if !auth {
+			return tpm2.TPMRCNVAuthorization
+		}
+	default:
+		return tpm2.TPMRCNVAuthorization
+	}
+	return nil
+}
+
+func nvDefineSpace(t *TPM, c *call, cmd tpm2.NVDefineSpace) (*tpm2.NVDefineSpaceResponse, error) {
+	if c.handles[0] != tpm2.TPMRHOwner {
+		return nil, tpm2.TPMRCHierarchy
+	}
+	public, err := cmd.PublicInfo.Contents()
+	if err != nil {
+		return nil, tpm2.TPMRCSize
+	}
+	a := public.Attributes
+	if public.NVIndex>>24 != firstNVIndex>>24 || a.NT != tpm2.TPMNTOrdinary || a.PPWrite || a.PPRead || a.PlatformCreate {
+		return nil, tpm2.TPMRCAttributes
+	}
+	if !a.OwnerWrite && !a.AuthWrite && !a.PolicyWrite || !a.OwnerRead && !a.AuthRead && !a.PolicyRead {
+		return nil, tpm2.TPMRCAttributes
+	}
+	if a.Written || a.WriteLocked || a.ReadLocked {
+		return nil, tpm2.TPMRCAttributes
+	}
+	if public.DataSize > nvIndexMax {
+		return nil, tpm2.TPMRCSize
+	}
+	if _, ok := t.nv[public.NVIndex]; ok {
+		return nil, tpm2.TPMRCNVDefined
+	}
+	t.nv[public.NVIndex] = &nvIndex{
+		public: *public,
+		auth:   cmd.Auth.Buffer,
+		data:   make([]byte, public.DataSize),
+	}
+	return &tpm2.NVDefineSpaceResponse{}, nil
+}
+
+func nvUndefineSpace(t *TPM, c *call, _ tpm2.NVUndefineSpace) (*tpm2.NVUndefineSpaceResponse, error) {
+	if c.handles[0] != tpm2.TPMRHOwner {
+		return nil, tpm2.TPMRCHierarchy
+	}
+	n, err := t.nvIndex(c.handles[1])
+	if err != nil {
+		return nil, err
+	}
+	if n.public.Attributes.PolicyDelete {
+		return nil, tpm2.TPMRCAttributes
+	}
+	delete(t.nv, c.handles[1])
+	return &tpm2.NVUndefineSpaceResponse{}, nil
+}
+
+func nvReadPublic(t *TPM, c *call, _ tpm2.NVReadPublic) (*tpm2.NVReadPublicResponse, error) {
+	n, err := t.nvIndex(c.handles[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tpm2.NVReadPublicResponse{
+		NVPublic: tpm2.New2B(n.public),
+		NVName: tpm2.TPM2BName{
+			Buffer: n.name(),
+		},
+	}, nil
+}
+
+func nvWrite(t *TPM, c *call, cmd tpm2.NVWrite) (*tpm2.NVWriteResponse, error) {
+	n, err := t.nvIndex(c.handles[1])
+	if err != nil {
+		return nil, err
+	}
+	a := n.public.Attributes
+	if err := t.nvAccess(c, a.OwnerWrite, a.AuthWrite, a.PolicyWrite); err != nil {
+		return nil, err
+	}
+	if a.WriteLocked {
+		return nil, tpm2.TPMRCNVLocked
+	}
+	data := cmd.Data.Buffer
+	if len(data) > nvBufferMax {
+		return nil, tpm2.TPMRCValue
+	}
+	if int(cmd.Offset)+len(data) > len(n.data) {
+		return nil, tpm2.TPMRCNVRange
+	}
+	if a.WriteAll && (cmd.Offset != 0 || len(data) != len(n.data)) {
+		return nil, tpm2.TPMRCNVRange
+	}
+	copy(n.data[cmd.Offset:], data)
+	n.public.Attributes.Written = true
+	return &tpm2.NVWriteResponse{}, nil
+}
+
+func nvRead(t *TPM, c *call, cmd tpm2.NVRead) (*tpm2.NVReadResponse, error) {
+	n, err := t.nvIndex(c.handles[1])
+	if err != nil {
+		return nil, err
+	}
+	a := n.public.Attributes
+	if err := t.nvAccess(c, a.OwnerRead, a.AuthRead, a.PolicyRead); err != nil {
+		return nil, err
+	}
+	if !a.Written {
+		return nil, tpm2.TPMRCNVUninitialized
+	}
+	if cmd.Size > nvBufferMax {
+		return nil, tpm2.TPMRCValue
+	}
+	if int(cmd.Offset)+int(cmd.Size) > len(n.data) {
+		return nil, tpm2.TPMRCNVRange
+	}
+	return &tpm2.NVReadResponse{
+		Data: tpm2.TPM2BMaxNVBuffer{
+			Buffer: n.data[cmd.Offset : cmd.Offset+cmd.Size],
+		},
+	}, nil
+}
+
+// evictControl makes a transient object persistent at persistentHandle, or removes a persistent
+// object.  Persistent objects live as long as the fake TPM.
+func evictControl(t *TPM, c *call, cmd tpm2.EvictControl) (*tpm2.EvictControlResponse, error) {
+	if c.handles[0] != tpm2.TPMRHOwner {
+		return nil, tpm2.TPMRCHierarchy
+	}
+	h := c.handles[1]
+	o, err := t.object(h)
+	if err != nil {
+		return nil, err
+	}
+	if isPersistent(h) {
+		if h != cmd.PersistentHandle {
+			return nil, tpm2.TPMRCHandle
+		}
+		delete(t.objects, h)
+		return &tpm2.EvictControlResponse{}, nil
+	}
+	if !isPersistent(cmd.PersistentHandle) || o.hierarchy != tpm2.TPMRHOwner {
+		return nil, tpm2.TPMRCHierarchy
+	}
+	if _, ok := t.objects[cmd.PersistentHandle]; ok {
+		return nil, tpm2.TPMRCNVDefined
+	}
+	t.objects[cmd.PersistentHandle] = o
+	return &tpm2.EvictControlResponse{}, nil
+}
+
+func isPersistent(h tpm2.TPMHandle) bool {
+	return h>>24 == 0x81
+}
@@ -0,0 +1,520 @@
+package faketpm
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/mldsa"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem512"
+	"github.com/google/go-tpm/tpm2"
+)
+
+// object is a loaded key.  ML-KEM and ML-DSA keys are kept as their FIPS 203/204 seeds.
+type object struct {
+	public    tpm2.TPMTPublic
+	name      tpm2.TPM2BName
+	hierarchy tpm2.TPMHandle
+	auth      []byte
+	seed      []byte
+	// storage is the AES-256-GCM key that wraps the blobs of children; only set for storage parents
+	storage []byte
+}
+
+// seed sizes, FIPS 203 (d || z) and FIPS 204 (xi), and the size of HMAC keys
+const (
+	mlkemSeedSize = 64
+	mldsaSeedSize = 32
+	hmacKeySize   = 32
+	storageSize   = 32
+)
+
+func (o *object) isStorageParent() bool {
+	a := o.public.ObjectAttributes
+	return a.Restricted && a.Decrypt && !a.SignEncrypt
+}
+
+func (o *object) mlkemParameterSet() (tpm2.TPMMLKEMParameter, bool) {
+	if o.public.Type != tpm2.TPMAlgMLKEM {
+		return 0, false
+	}
+	p, err := o.public.Parameters.MLKEMDetail()
+	if err != nil {
+		return 0, false
+	}
+	return tpm2.TPMMLKEMParameter(p.ParameterSet), true
+}
+
+func (o *object) mldsaParameters() (*tpm2.TPMSMLDSAParms, bool) {
+	if o.public.Type != tpm2.TPMAlgMLDSA {
+		return nil, false
+	}
+	p, err := o.public.Parameters.MLDSADetail()
+	if err != nil {
+		return nil, false
+	}
+	return p, true
+}
+
+// mldsaKey rebuilds the ML-DSA private key from the seed.
+func (o *object) mldsaKey() (*mldsa.PrivateKey, error) {
+	p, ok := o.mldsaParameters()
+	if !ok {
+		return nil, tpm2.TPMRCKey
+	}
+	params, err := mldsaParams(tpm2.TPMMLDSAParameter(p.ParameterSet))
+	if err != nil {
+		return nil, err
+	}
+	return mldsa.NewPrivateKey(params, o.seed)
+}
+
+func mldsaParams(ps tpm2.TPMMLDSAParameter) (mldsa.Parameters, error) {
+	switch ps {
+	case tpm2.TPMMLDSA44:
+		return mldsa.MLDSA44(), nil
+	case tpm2.TPMMLDSA65:
+		return mldsa.MLDSA65(), nil
+	case tpm2.TPMMLDSA87:
+		return mldsa.MLDSA87(), nil
+	}
+	return mldsa.Parameters{}, tpm2.TPMRCValue
+}
+
+// mlkemPublic returns the encapsulation key for the seed.
+func mlkemPublic(ps tpm2.TPMMLKEMParameter, seed []byte) ([]byte, error) {
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		pk, _ := mlkem512.Scheme().DeriveKeyPair(seed)
+		return pk.MarshalBinary()
+	case tpm2.TPMMLKEM768:
+		dk, err := mlkem.NewDecapsulationKey768(seed)
+		if err != nil {
+			return nil, err
+		}
+		return dk.EncapsulationKey().Bytes(), nil
+	case tpm2.TPMMLKEM1024:
+		dk, err := mlkem.NewDecapsulationKey1024(seed)
+		if err != nil {
+			return nil, err
+		}
+		return dk.EncapsulationKey().Bytes(), nil
+	}
+	return nil, tpm2.TPMRCValue
+}
+
+// encapsulate returns (sharedKey, ciphertext) for the encapsulation key in the public area.
+func (o *object) encapsulate() ([]byte, []byte, error) {
+	ps, ok := o.mlkemParameterSet()
+	if !ok {
+		return nil, nil, tpm2.TPMRCKey
+	}
+	ek, err := o.public.Unique.KEM()
+	if err != nil {
+		return nil, nil, tpm2.TPMRCKey
+	}
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		pk, err := mlkem512.Scheme().UnmarshalBinaryPublicKey(ek.Buffer)
+		if err != nil {
+			return nil, nil, tpm2.TPMRCKey
+		}
+		ct, ss, err := mlkem512.Scheme().Encapsulate(pk)
+		return ss, ct, err
+	case tpm2.TPMMLKEM768:
+		pk, err := mlkem.NewEncapsulationKey768(ek.Buffer)
+		if err != nil {
+			return nil, nil, tpm2.TPMRCKey
+		}
+		ss, ct := pk.Encapsulate()
+		return ss, ct, nil
+	case tpm2.TPMMLKEM1024:
+		pk, err := mlkem.NewEncapsulationKey1024(ek.Buffer)
+		if err != nil {
+			return nil, nil, tpm2.TPMRCKey
+		}
+		ss, ct := pk.Encapsulate()
+		return ss, ct, nil
+	}
+	return nil, nil, tpm2.TPMRCValue
+}
+
+// decapsulate returns the shared key for ciphertext.
+func (o *object) decapsulate(ciphertext []byte) ([]byte, error) {
+	ps, ok := o.mlkemParameterSet()
+	if !ok {
+		return nil, tpm2.TPMRCKey
+	}
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		_, sk := mlkem512.Scheme().DeriveKeyPair(o.seed)
+		if len(ciphertext) != mlkem512.CiphertextSize {
+			return nil, tpm2.TPMRCSize
+		}
+		return mlkem512.Scheme().Decapsulate(sk, ciphertext)
+	case tpm2.TPMMLKEM768:
+		dk, err := mlkem.NewDecapsulationKey768(o.seed)
+		if err != nil {
+			return nil, err
+		}
+		if len(ciphertext) != mlkem.CiphertextSize768 {
+			return nil, tpm2.TPMRCSize
+		}
+		return dk.Decapsulate(ciphertext)
+	case tpm2.TPMMLKEM1024:
+		dk, err := mlkem.NewDecapsulationKey1024(o.seed)
+		if err != nil {
+			return nil, err
+		}
+		if len(ciphertext) != mlkem.CiphertextSize1024 {
+			return nil, tpm2.TPMRCSize
+		}
+		return dk.Decapsulate(ciphertext)
+	}
+	return nil, tpm2.TPMRCValue
+}
+
+// mlkemEnabled reports whether TPMA_ML_PARAMETER_SET enables ps.
+func (t *TPM) mlkemEnabled(ps tpm2.TPMMLKEMParameter) bool {
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		return t.parameterSets.MLKEM512
+	case tpm2.TPMMLKEM768:
+		return t.parameterSets.MLKEM768
+	case tpm2.TPMMLKEM1024:
+		return t.parameterSets.MLKEM1024
+	}
+	return false
+}
+
+// mldsaEnabled reports whether TPMA_ML_PARAMETER_SET enables ps.
+func (t *TPM) mldsaEnabled(ps tpm2.TPMMLDSAParameter) bool {
+	switch ps {
+	case tpm2.TPMMLDSA44:
+		return t.parameterSets.MLDSA44
+	case tpm2.TPMMLDSA65:
+		return t.parameterSets.MLDSA65
+	case tpm2.TPMMLDSA87:
+		return t.parameterSets.MLDSA87
+	}
+	return false
+}
+
+// checkTemplate checks the attributes and parameter set of an ML-KEM or ML-DSA template against the
+// enabled parameter sets.  The only other keys are HMAC keys.
+func (t *TPM) checkTemplate(pub *tpm2.TPMTPublic) error {
+	a := pub.ObjectAttributes
+	switch pub.Type {
+	case tpm2.TPMAlgMLKEM:
+		p, err := pub.Parameters.MLKEMDetail()
+		if err != nil {
+			return tpm2.TPMRCType
+		}
+		if !a.Decrypt || a.SignEncrypt {
+			return tpm2.TPMRCAttributes
+		}
+		if a.Restricted != (p.Symmetric.Algorithm != tpm2.TPMAlgNull) {
+			return tpm2.TPMRCSymmetric
+		}
+		if !t.mlkemEnabled(tpm2.TPMMLKEMParameter(p.ParameterSet)) {
+			return tpm2.TPMRCValue
+		}
+	case tpm2.TPMAlgMLDSA:
+		p, err := pub.Parameters.MLDSADetail()
+		if err != nil {
+			return tpm2.TPMRCType
+		}
+		if !a.SignEncrypt || a.Decrypt {
+			return tpm2.TPMRCAttributes
+		}
+		if !t.mldsaEnabled(tpm2.TPMMLDSAParameter(p.ParameterSet)) {
+			return tpm2.TPMRCValue
+		}
+		if p.AllowExternalMu && (!t.parameterSets.ExtMu || a.Restricted) {
+			return tpm2.TPMRCAttributes
+		}
+	case tpm2.TPMAlgKeyedHash:
+		p, err := pub.Parameters.KeyedHashDetail()
+		if err != nil {
+			return tpm2.TPMRCType
+		}
+		if p.Scheme.Scheme != tpm2.TPMAlgHMAC {
+			return tpm2.TPMRCScheme
+		}
+		if !a.SignEncrypt || a.Decrypt || a.Restricted || !a.SensitiveDataOrigin {
+			return tpm2.TPMRCAttributes
+		}
+	default:
+		return tpm2.TPMRCType
+	}
+	return nil
+}
+
+// newObject fills in the unique field of the template from seed.
+func newObject(template *tpm2.TPMTPublic, seed []byte, hierarchy tpm2.TPMHandle, auth []byte) (*object, error) {
+	pub := *template
+	switch pub.Type {
+	case tpm2.TPMAlgMLKEM:
+		p, _ := pub.Parameters.MLKEMDetail()
+		ek, err := mlkemPublic(tpm2.TPMMLKEMParameter(p.ParameterSet), seed)
+		if err != nil {
+			return nil, err
+		}
+		pub.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgMLKEM, &tpm2.TPM2BData{Buffer: ek})
+	case tpm2.TPMAlgMLDSA:
+		p, _ := pub.Parameters.MLDSADetail()
+		params, err := mldsaParams(tpm2.TPMMLDSAParameter(p.ParameterSet))
+		if err != nil {
+			return nil, err
+		}
+		sk, err := mldsa.NewPrivateKey(params, seed)
+		if err != nil {
+			return nil, err
+		}
+		pub.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgMLDSA, &tpm2.TPM2BData{Buffer: sk.PublicKey().Bytes()})
+	case tpm2.TPMAlgKeyedHash:
+		// the seed is the HMAC key, unique is H(seedValue || key) with seedValue derived from it
+		h, err := pub.NameAlg.Hash()
+		if err != nil {
+			return nil, tpm2.TPMRCHash
+		}
+		u := h.New()
+		u.Write(tpm2.KDFa(crypto.SHA256, seed, "OBFUSCATE", nil, nil, h.Size()*8))
+		u.Write(seed)
+		pub.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgKeyedHash, &tpm2.TPM2BDigest{Buffer: u.Sum(nil)})
+	default:
+		return nil, tpm2.TPMRCType
+	}
+	name, err := tpm2.ObjectName(&pub)
+	if err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	o := &object{
+		public:    pub,
+		name:      *name,
+		hierarchy: hierarchy,
+		auth:      auth,
+		seed:      seed,
+	}
+	if o.isStorageParent() {
+		o.storage = tpm2.KDFa(crypto.SHA256, seed, "STORAGE", nil, nil, storageSize*8)
+	}
+	return o, nil
+}
+
+func seedSize(alg tpm2.TPMAlgID) int {
+	switch alg {
+	case tpm2.TPMAlgMLKEM:
+		return mlkemSeedSize
+	case tpm2.TPMAlgKeyedHash:
+		return hmacKeySize
+	}
+	return mldsaSeedSize
+}
+
+// hierarchySeed returns the primary seed of a hierarchy.  The null hierarchy gets a new seed with
+// every instance.
+func (t *TPM) hierarchySeed(h tpm2.TPMHandle) ([]byte, error) {
+	switch h {
+	case tpm2.TPMRHNull:
+		return t.nullSeed, nil
+	case tpm2.TPMRHOwner, tpm2.TPMRHEndorsement, tpm2.TPMRHPlatform:
+		return tpm2.KDFa(crypto.SHA256, t.seed, "HIERARCHY", binary.BigEndian.AppendUint32(nil, uint32(h)), nil, 256), nil
+	}
+	return nil, tpm2.TPMRCHierarchy
+}
+
+// primary derives a primary key from the hierarchy seed and the template.  Like a TPM, the same
+// template gives the same key; RSA keys are generated once and cached instead.
+func (t *TPM) primary(hierarchy tpm2.TPMHandle, template *tpm2.TPMTPublic, auth []byte) (*object, error) {
+	hseed, err := t.hierarchySeed(hierarchy)
+	if err != nil {
+		return nil, err
+	}
+	tb := tpm2.Marshal(template)
+	switch template.Type {
+	case tpm2.TPMAlgMLKEM, tpm2.TPMAlgMLDSA, tpm2.TPMAlgKeyedHash:
+		if err := t.checkTemplate(template); err != nil {
+			return nil, err
+		}
+		seed := tpm2.KDFa(crypto.SHA256, hseed, "PRIMARY", tb, nil, seedSize(template.Type)*8)
+		return newObject(template, seed, hierarchy, auth)
+	case tpm2.TPMAlgECC:
+		return eccPrimary(template, hseed, tb, hierarchy, auth)
+	case tpm2.TPMAlgRSA:
+		cacheKey := string(binary.BigEndian.AppendUint32(nil, uint32(hierarchy))) + string(tb)
+		if o, ok := t.rsaPrimaries[cacheKey]; ok {
+			c := *o
+			c.auth = auth
+			return &c, nil
+		}
+		o, err := rsaPrimary(template, hseed, tb, hierarchy, auth)
+		if err != nil {
+			return nil, err
+		}
+		t.rsaPrimaries[cacheKey] = o
+		return o, nil
+	}
+	return nil, tpm2.TPMRCType
+}
+
+func eccPrimary(template *tpm2.TPMTPublic, hseed, tb []byte, hierarchy tpm2.TPMHandle, auth []byte) (*object, error) {
+	p, err := template.Parameters.ECCDetail()
+	if err != nil {
+		return nil, tpm2.TPMRCType
+	}
+	var curve ecdh.Curve
+	var size int
+	switch p.CurveID {
+	case tpm2.TPMECCNistP256:
+		curve, size = ecdh.P256(), 32
+	case tpm2.TPMECCNistP384:
+		curve, size = ecdh.P384(), 48
+	default:
+		return nil, tpm2.TPMRCCurve
+	}
+	// retry until the scalar is in range
+	var sk *ecdh.PrivateKey
+	for i := uint32(0); sk == nil; i++ {
+		d := tpm2.KDFa(crypto.SHA256, hseed, "ECC", tb, binary.BigEndian.AppendUint32(nil, i), size*8)
+		sk, _ = curve.NewPrivateKey(d)
+	}
+	point := sk.PublicKey().Bytes()[1:]
+	pub := *template
+	pub.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{
+		X: tpm2.TPM2BECCParameter{Buffer: point[:size]},
+		Y: tpm2.TPM2BECCParameter{Buffer: point[size:]},
+	})
+	return storagePrimary(&pub, hseed, tb, hierarchy, auth)
+}
+
+func rsaPrimary(template *tpm2.TPMTPublic, hseed, tb []byte, hierarchy tpm2.TPMHandle, auth []byte) (*object, error) {
+	p, err := template.Parameters.RSADetail()
+	if err != nil {
+		return nil, tpm2.TPMRCType
+	}
+	sk, err := rsa.GenerateKey(rand.Reader, int(p.KeyBits))
+	if err != nil {
+		return nil, tpm2.TPMRCKeySize
+	}
+	pub := *template
+	pub.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgRSA, &tpm2.TPM2BPublicKeyRSA{Buffer: sk.N.Bytes()})
+	return storagePrimary(&pub, hseed, tb, hierarchy, auth)
+}
+
+// storagePrimary is an RSA or ECC primary.  Only their public area is used, as the parent of PQC keys.
+func storagePrimary(pub *tpm2.TPMTPublic, hseed, tb []byte, hierarchy tpm2.TPMHandle, auth []byte) (*object, error) {
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	o := &object{
+		public:    *pub,
+		name:      *name,
+		hierarchy: hierarchy,
+		auth:      auth,
+	}
+	if o.isStorageParent() {
+		o.storage = tpm2.KDFa(crypto.SHA256, hseed, "STORAGE", tb, nil, storageSize*8)
+	}
+	return o, nil
+}
+
+// wrap seals the auth value and seed of a child under the parent storage key, bound to the child name.
+//
+//	private = nonce || AES-256-GCM(storage, nonce, len(auth) || auth || seed, name)
+func (parent *object) wrap(child *object) ([]byte, error) {
+	aead, err := storageAEAD(parent.storage)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sensitive := binary.BigEndian.AppendUint16(nil, uint16(len(child.auth)))
+	sensitive = append(sensitive, child.auth...)
+	sensitive = append(sensitive, child.seed...)
+	return aead.Seal(nonce, nonce, sensitive, child.name.Buffer), nil
+}
+
+// unwrap reverses wrap and returns the auth value and seed.
+func (parent *object) unwrap(private []byte, name []byte) ([]byte, []byte, error) {
+	aead, err := storageAEAD(parent.storage)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(private) < aead.NonceSize() {
+		return nil, nil, tpm2.TPMRCSize
+	}
+	sensitive, err := aead.Open(nil, private[:aead.NonceSize()], private[aead.NonceSize():], name)
+	if err != nil {
+		return nil, nil, tpm2.TPMRCIntegrity
+	}
+	if len(sensitive) < 2 {
+		return nil, nil, tpm2.TPMRCIntegrity
+	}
+	n := int(binary.BigEndian.Uint16(sensitive))
+	if len(sensitive) < 2+n {
+		return nil, nil, tpm2.TPMRCIntegrity
+	}
+	return sensitive[2 : 2+n], sensitive[2+n:], nil
+}
+
+func storageAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (t *TPM) addObject(o *object) (tpm2.TPMHandle, error) {
+	if err := t.objectSlot(); err != nil {
+		return 0, err
+	}
+	h := t.nextObject
+	t.nextObject++
+	t.objects[h] = o
+	return h, nil
+}
+
+// objectSlot returns TPM_RC_OBJECT_MEMORY if Config.TransientObjects objects and sequences are loaded.
+// Persistent objects don't count.
+func (t *TPM) objectSlot() error {
+	if t.transientObjects == 0 {
+		return nil
+	}
+	loaded := len(t.sequences)
+	for h := range t.objects {
+		if !isPersistent(h) {
+			loaded++
+		}
+	}
+	if loaded >= t.transientObjects {
+		return tpm2.TPMRCObjectMemory
+	}
+	return nil
+}
+
+func (t *TPM) object(h tpm2.TPMHandle) (*object, error) {
+	o, ok := t.objects[h]
+	if !ok {
+		return nil, tpm2.TPMRCHandle
+	}
+	return o, nil
+}
+
+func (t *TPM) parent(h tpm2.TPMHandle) (*object, error) {
+	o, err := t.object(h)
+	if err != nil {
+		return nil, err
+	}
+	if o.storage == nil {
+		return nil, tpm2.TPMRCType
+	}
+	return o, nil
+}
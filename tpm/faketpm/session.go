@@ -0,0 +1,288 @@
+package faketpm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// session is an unsalted, unbound HMAC or policy session.  Its session key is empty so the HMAC key is
+// just the auth value of the entity, or empty for policy sessions.
+type session struct {
+	hash     tpm2.TPMIAlgHash
+	nonceTPM []byte
+	// policyDigest is nil for HMAC sessions
+	policyDigest []byte
+	// saved is set by ContextSave; the session keeps its handle but can't be used until ContextLoad.
+	// contextSequence is the sequence number of the one context that loads it again.
+	saved           bool
+	contextSequence uint64
+}
+
+func startAuthSession(t *TPM, c *call, cmd tpm2.StartAuthSession) (*tpm2.StartAuthSessionResponse, error) {
+	if c.handles[0] != tpm2.TPMRHNull || len(cmd.EncryptedSalt.Buffer) > 0 {
+		// salted sessions aren't implemented
+		return nil, tpm2.TPMRCValue
+	}
+	if c.handles[1] != tpm2.TPMRHNull {
+		return nil, tpm2.TPMRCValue
+	}
+	if cmd.SessionType != tpm2.TPMSEHMAC && cmd.SessionType != tpm2.TPMSEPolicy {
+		return nil, tpm2.TPMRCValue
+	}
+	if cmd.Symmetric.Algorithm != tpm2.TPMAlgNull {
+		return nil, tpm2.TPMRCSymmetric
+	}
+	ha, err := cmd.AuthHash.Hash()
+	if err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	if len(cmd.NonceCaller.Buffer) < 16 || len(cmd.NonceCaller.Buffer) > ha.Size() {
+		return nil, tpm2.TPMRCSize
+	}
+	if err := t.sessionSlot(); err != nil {
+		return nil, err
+	}
+	s := &session{
+		hash:     cmd.AuthHash,
+		nonceTPM: make([]byte, len(cmd.NonceCaller.Buffer)),
+	}
+	rand.Read(s.nonceTPM)
+	if cmd.SessionType == tpm2.TPMSEPolicy {
+		s.policyDigest = make([]byte, ha.Size())
+	}
+	h := t.nextSession
+	t.nextSession++
+	t.sessions[h] = s
+	return &tpm2.StartAuthSessionResponse{
+		SessionHandle: h,
+		NonceTPM: tpm2.TPM2BNonce{
+			Buffer: s.nonceTPM,
+		},
+	}, nil
+}
+
+func flushContext(t *TPM, c *call, _ tpm2.FlushContext) (*tpm2.FlushContextResponse, error) {
+	h := c.handles[0]
+	switch {
+	case t.objects[h] != nil:
+		delete(t.objects, h)
+	case t.sequences[h] != nil:
+		delete(t.sequences, h)
+	case t.sessions[h] != nil:
+		delete(t.sessions, h)
+	default:
+		return nil, tpm2.TPMRCHandle
+	}
+	return &tpm2.FlushContextResponse{}, nil
+}
+
+// authValue returns the auth value of an authorized handle.  Hierarchies have the empty auth.
+func (t *TPM) authValue(h tpm2.TPMHandle) ([]byte, bool) {
+	if o, ok := t.objects[h]; ok {
+		return o.auth, true
+	}
+	if s, ok := t.sequences[h]; ok {
+		return s.auth, true
+	}
+	if n, ok := t.nv[h]; ok {
+		return n.auth, true
+	}
+	switch h {
+	case tpm2.TPMRHOwner, tpm2.TPMRHEndorsement, tpm2.TPMRHPlatform, tpm2.TPMRHNull:
+		return nil, true
+	}
+	return nil, false
+}
+
+// authPolicy returns the authPolicy of an object or NV index.  Hierarchies and sequences have none.
+func (t *TPM) authPolicy(h tpm2.TPMHandle) []byte {
+	if o, ok := t.objects[h]; ok && len(o.public.AuthPolicy.Buffer) > 0 {
+		return o.public.AuthPolicy.Buffer
+	}
+	if n, ok := t.nv[h]; ok && len(n.public.AuthPolicy.Buffer) > 0 {
+		return n.public.AuthPolicy.Buffer
+	}
+	return nil
+}
+
+// name returns the name of a handle for cpHash.  Sequence objects have the empty name.
+func (t *TPM) name(h tpm2.TPMHandle) []byte {
+	if o, ok := t.objects[h]; ok {
+		return o.name.Buffer
+	}
+	if _, ok := t.sequences[h]; ok {
+		return nil
+	}
+	if n, ok := t.nv[h]; ok {
+		return n.name()
+	}
+	return binary.BigEndian.AppendUint32(nil, uint32(h))
+}
+
+// checkAuths checks the password and HMAC authorizations of the command.  Sessions past the
+// authorized handles authorize nothing and use the empty auth value.
+func (t *TPM) checkAuths(c *call) tpm2.TPMRC {
+	if len(c.auths) < len(c.authHandles) {
+		return tpm2.TPMRCAuthMissing
+	}
+	for i, a := range c.auths {
+		sessionRC := tpm2.TPMRC(0x800 + (i+1)<<8)
+		var auth []byte
+		if i < len(c.authHandles) {
+			var ok bool
+			auth, ok = t.authValue(c.authHandles[i])
+			if !ok {
+				return tpm2.TPMRCHandle
+			}
+		}
+		if a.attrs&(sessionEncrypt|sessionDecrypt) != 0 {
+			return tpm2.TPMRCAttributes + sessionRC
+		}
+		if a.handle == tpm2.TPMRSPW {
+			if !hmac.Equal(trimAuth(a.hmac), trimAuth(auth)) {
+				return tpm2.TPMRCAuthFail + sessionRC
+			}
+			continue
+		}
+		s, ok := t.sessions[a.handle]
+		if !ok {
+			return tpm2.TPMRCValue + sessionRC
+		}
+		if s.saved {
+			return tpm2.TPMRCReferenceS0 + tpm2.TPMRC(i)
+		}
+		if s.policyDigest != nil {
+			// PolicyAuthValue isn't implemented so the HMAC key is always empty
+			if i >= len(c.authHandles) || !bytes.Equal(t.authPolicy(c.authHandles[i]), s.policyDigest) {
+				return tpm2.TPMRCPolicyFail + sessionRC
+			}
+			auth = nil
+		}
+		var cp bytes.Buffer
+		binary.Write(&cp, binary.BigEndian, uint32(c.cc))
+		for _, h := range c.handles {
+			cp.Write(t.name(h))
+		}
+		cp.Write(c.params)
+		mac, err := sessionHMAC(s.hash, auth, cp.Bytes(), a.nonceCaller, s.nonceTPM, a.attrs)
+		if err != nil {
+			return tpm2.TPMRCHash
+		}
+		if !hmac.Equal(mac, a.hmac) {
+			return tpm2.TPMRCAuthFail + sessionRC
+		}
+	}
+	return tpm2.TPMRCSuccess
+}
+
+// authResponses rolls nonceTPM, computes the response HMACs and flushes sessions without continueSession.
+func (t *TPM) authResponses(c *call, rpPreimage []byte) []byte {
+	var out bytes.Buffer
+	for i, a := range c.auths {
+		if a.handle == tpm2.TPMRSPW {
+			// password sessions always continue
+			out.Write([]byte{0, 0, sessionContinue, 0, 0})
+			continue
+		}
+		s := t.sessions[a.handle]
+		rand.Read(s.nonceTPM)
+		var auth []byte
+		if i < len(c.authHandles) && s.policyDigest == nil {
+			auth, _ = t.authValue(c.authHandles[i])
+		}
+		if s.policyDigest != nil {
+			// a policy session starts over after authorizing a command
+			clear(s.policyDigest)
+		}
+		mac, _ := sessionHMAC(s.hash, auth, rpPreimage, s.nonceTPM, a.nonceCaller, a.attrs)
+		binary.Write(&out, binary.BigEndian, uint16(len(s.nonceTPM)))
+		out.Write(s.nonceTPM)
+		out.WriteByte(a.attrs)
+		binary.Write(&out, binary.BigEndian, uint16(len(mac)))
+		out.Write(mac)
+		if a.attrs&sessionContinue == 0 {
+			delete(t.sessions, a.handle)
+		}
+	}
+	return out.Bytes()
+}
+
+// sessionHMAC is HMAC(authValue, H(pHashPreimage) || nonceNewer || nonceOlder || sessionAttributes), Part 1 19.6.
+func sessionHMAC(alg tpm2.TPMIAlgHash, auth, pHashPreimage, nonceNewer, nonceOlder []byte, attrs byte) ([]byte, error) {
+	ha, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	h := ha.New()
+	h.Write(pHashPreimage)
+	mac := hmac.New(ha.New, trimAuth(auth))
+	mac.Write(h.Sum(nil))
+	mac.Write(nonceNewer)
+	mac.Write(nonceOlder)
+	mac.Write([]byte{attrs})
+	return mac.Sum(nil), nil
+}
+
+// trimAuth removes trailing zeros from an auth value, Part 1 19.6.5
+func trimAuth(auth []byte) []byte {
+	for len(auth) > 0 && auth[len(auth)-1] == 0 {
+		auth = auth[:len(auth)-1]
+	}
+	return auth
+}
+
+// policyUpdate extends the policy digest of s, Part 3 23.2.3
+//
+//	policyDigest = H(H(policyDigest || cc || arg2) || arg3)
+func (s *session) policyUpdate(cc tpm2.TPMCC, arg2, arg3 []byte) error {
+	ha, err := s.hash.Hash()
+	if err != nil {
+		return err
+	}
+	h := ha.New()
+	h.Write(s.policyDigest)
+	binary.Write(h, binary.BigEndian, uint32(cc))
+	h.Write(arg2)
+	s.policyDigest = h.Sum(s.policyDigest[:0])
+	h.Reset()
+	h.Write(s.policyDigest)
+	h.Write(arg3)
+	s.policyDigest = h.Sum(s.policyDigest[:0])
+	return nil
+}
+
+// policySession returns the policy session at h.
+func (t *TPM) policySession(h tpm2.TPMHandle) (*session, error) {
+	s, ok := t.sessions[h]
+	if !ok || s.saved || s.policyDigest == nil {
+		return nil, tpm2.TPMRCHandle
+	}
+	return s, nil
+}
+
+// policySecret only supports policies without expiration, so the ticket is always the NULL ticket.
+func policySecret(t *TPM, c *call, cmd tpm2.PolicySecret) (*tpm2.PolicySecretResponse, error) {
+	s, err := t.policySession(c.handles[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(cmd.NonceTPM.Buffer) > 0 && !bytes.Equal(cmd.NonceTPM.Buffer, s.nonceTPM) {
+		return nil, tpm2.TPMRCNonce
+	}
+	if cmd.Expiration != 0 || len(cmd.CPHashA.Buffer) > 0 {
+		return nil, tpm2.TPMRCValue
+	}
+	if err := s.policyUpdate(tpm2.TPMCCPolicySecret, t.name(c.handles[0]), cmd.PolicyRef.Buffer); err != nil {
+		return nil, tpm2.TPMRCHash
+	}
+	return &tpm2.PolicySecretResponse{
+		PolicyTicket: tpm2.TPMTTKAuth{
+			Tag:       tpm2.TPMSTAuthSecret,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}, nil
+}
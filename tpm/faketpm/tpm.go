@@ -0,0 +1,478 @@
+// Package faketpm is an in-process stand-in for a TPM that implements the PQC commands of the
+// TPM 2.0 Library 1.85 on top of crypto/mlkem and crypto/mldsa.
+//
+// It speaks the TPM wire protocol over an io.ReadWriteCloser so it can be used anywhere a socket to
+// swtpm or a /dev/tpmrm0 handle is, eg
+//
+//	rwr := transport.FromReadWriter(faketpm.New())
+//
+// Only what the samples in this repo use is implemented: CreatePrimary (RSA/ECC storage keys, ML-KEM,
+// ML-DSA and HMAC), Create and Load of ML-KEM, ML-DSA and HMAC keys, ReadPublic, Encapsulate,
+// Decapsulate, the sign and verify sequences, SignDigest, HMAC, ActivateCredential with ML-KEM EKs,
+// unsalted HMAC and password sessions, policy sessions with PolicySecret only, ContextSave, ContextLoad,
+// FlushContext, EvictControl, ordinary NV indices, GetRandom and GetCapability.  Anything else returns
+// TPM_RC_COMMAND_CODE.  It's not a TPM: nothing survives the process, there are no PCRs, no auth roles
+// and no parameter encryption.
+package faketpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// DefaultParameterSets enables every ML-KEM and ML-DSA parameter set.  ExtMu is off since
+// TPM2_VerifyDigestSignature isn't implemented; set it to allow ML-DSA keys with allowExternalMu and TPM2_SignDigest.
+var DefaultParameterSets = tpm2.TPMAMLParameterSet{
+	MLKEM512:  true,
+	MLKEM768:  true,
+	MLKEM1024: true,
+	MLDSA44:   true,
+	MLDSA65:   true,
+	MLDSA87:   true,
+}
+
+const (
+	// TPM_PT_INPUT_BUFFER
+	inputBuffer = 1024
+
+	firstTransient = 0x80000000
+	firstSession   = 0x02000000
+
+	tagNoSessions = 0x8001
+	tagSessions   = 0x8002
+	headerSize    = 10
+)
+
+// Config sets up the fake TPM.
+type Config struct {
+	// ParameterSets is reported as TPM_PT_ML_PARAMETER_SETS and limits the keys that can be created.
+	ParameterSets tpm2.TPMAMLParameterSet
+	// Seed derives the primary keys of the owner, endorsement and platform hierarchies and the keys that
+	// protect child key blobs.  Two instances with the same seed can load each other's blobs.  If it's
+	// empty a random seed is used, so blobs only load in the same instance.
+	Seed []byte
+	// TransientObjects and LoadedSessions limit the objects (including sequences) and sessions that can be
+	// loaded at once, like the few slots of a real TPM.  They are reported as TPM_PT_HR_TRANSIENT_MIN and
+	// TPM_PT_HR_LOADED_MIN.  Zero means no limit.
+	TransientObjects int
+	LoadedSessions   int
+}
+
+// TPM is the fake TPM.  Write sends a command and Read returns its response.
+type TPM struct {
+	mu sync.Mutex
+
+	parameterSets tpm2.TPMAMLParameterSet
+	seed          []byte
+	nullSeed      []byte
+
+	objects   map[tpm2.TPMHandle]*object
+	sequences map[tpm2.TPMHandle]*sequence
+	sessions  map[tpm2.TPMHandle]*session
+	nv        map[tpm2.TPMHandle]*nvIndex
+	// RSA primaries can't be derived from the seed so they are cached by hierarchy and template
+	rsaPrimaries map[string]*object
+
+	nextObject  tpm2.TPMHandle
+	nextSession tpm2.TPMHandle
+
+	transientObjects int
+	loadedSessions   int
+	// contextKey protects the context blobs of ContextSave
+	contextKey      []byte
+	contextSequence uint64
+
+	rsp    []byte
+	closed bool
+}
+
+var _ io.ReadWriteCloser = (*TPM)(nil)
+
+// New returns a fake TPM with DefaultParameterSets and a random seed.
+func New() *TPM {
+	return NewWithConfig(Config{
+		ParameterSets: DefaultParameterSets,
+	})
+}
+
+// NewWithConfig returns a fake TPM set up with cfg.
+func NewWithConfig(cfg Config) *TPM {
+	seed := cfg.Seed
+	if len(seed) == 0 {
+		seed = make([]byte, 32)
+		rand.Read(seed)
+	}
+	nullSeed := make([]byte, 32)
+	rand.Read(nullSeed)
+	return &TPM{
+		parameterSets: cfg.ParameterSets,
+		seed:          seed,
+		nullSeed:      nullSeed,
+		objects:       map[tpm2.TPMHandle]*object{},
+		sequences:     map[tpm2.TPMHandle]*sequence{},
+		sessions:      map[tpm2.TPMHandle]*session{},
+		nv:            map[tpm2.TPMHandle]*nvIndex{},
+		rsaPrimaries:  map[string]*object{},
+		nextObject:    firstTransient,
+		nextSession:   firstSession,
+
+		transientObjects: cfg.TransientObjects,
+		loadedSessions:   cfg.LoadedSessions,
+		contextKey:       tpm2.KDFa(crypto.SHA256, seed, "CONTEXT", nil, nil, 256),
+	}
+}
+
+// Write runs a single command.  The response is returned by the following Reads.
+func (t *TPM) Write(cmd []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+	t.rsp = t.execute(cmd)
+	return len(cmd), nil
+}
+
+// Read returns the response to the last command.
+func (t *TPM) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+	if len(t.rsp) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, t.rsp)
+	t.rsp = t.rsp[n:]
+	return n, nil
+}
+
+// Close drops all keys and sessions.
+func (t *TPM) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.objects = nil
+	t.sequences = nil
+	t.sessions = nil
+	return nil
+}
+
+// call is a parsed command.
+type call struct {
+	cc          tpm2.TPMCC
+	handles     []tpm2.TPMHandle
+	authHandles []tpm2.TPMHandle
+	auths       []authCommand
+	params      []byte
+}
+
+type authCommand struct {
+	handle      tpm2.TPMHandle
+	nonceCaller []byte
+	attrs       byte
+	hmac        []byte
+}
+
+// TPMA_SESSION
+const (
+	sessionContinue byte = 0x01
+	sessionDecrypt  byte = 0x20
+	sessionEncrypt  byte = 0x40
+)
+
+var errShort = errors.New("short buffer")
+
+func (t *TPM) execute(cmd []byte) []byte {
+	if len(cmd) < headerSize {
+		return errorResponse(tpm2.TPMRCCommandSize)
+	}
+	tag := binary.BigEndian.Uint16(cmd[0:2])
+	size := binary.BigEndian.Uint32(cmd[2:6])
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(cmd[6:10]))
+	if int(size) != len(cmd) {
+		return errorResponse(tpm2.TPMRCCommandSize)
+	}
+	if tag != tagNoSessions && tag != tagSessions {
+		return errorResponse(tpm2.TPMRCTag)
+	}
+	c, ok := commands[cc]
+	if !ok {
+		return errorResponse(tpm2.TPMRCCommandCode)
+	}
+
+	r := bytes.NewReader(cmd[headerSize:])
+	in := &call{
+		cc: cc,
+	}
+	for i := 0; i < c.handles; i++ {
+		var h uint32
+		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+			return errorResponse(tpm2.TPMRCCommandSize)
+		}
+		in.handles = append(in.handles, tpm2.TPMHandle(h))
+		if c.auth[i] {
+			in.authHandles = append(in.authHandles, tpm2.TPMHandle(h))
+		}
+	}
+	if tag == tagSessions {
+		auths, err := readAuthArea(r)
+		if err != nil {
+			return errorResponse(tpm2.TPMRCAuthSize)
+		}
+		in.auths = auths
+	} else if len(in.authHandles) > 0 {
+		return errorResponse(tpm2.TPMRCAuthMissing)
+	}
+	in.params = cmd[len(cmd)-r.Len():]
+
+	if rc := t.checkAuths(in); rc != tpm2.TPMRCSuccess {
+		return errorResponse(rc)
+	}
+
+	rspHandle, rpPreimage, err := c.run(t, in)
+	if err != nil {
+		var rc tpm2.TPMRC
+		if !errors.As(err, &rc) {
+			rc = tpm2.TPMRCFailure
+		}
+		return errorResponse(rc)
+	}
+	// rc || cc || parameters
+	params := rpPreimage[8:]
+
+	var body bytes.Buffer
+	if c.rHandle {
+		binary.Write(&body, binary.BigEndian, uint32(rspHandle))
+	}
+	if tag == tagSessions {
+		binary.Write(&body, binary.BigEndian, uint32(len(params)))
+		body.Write(params)
+		body.Write(t.authResponses(in, rpPreimage))
+	} else {
+		body.Write(params)
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, tag)
+	binary.Write(&out, binary.BigEndian, uint32(headerSize+body.Len()))
+	binary.Write(&out, binary.BigEndian, uint32(tpm2.TPMRCSuccess))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+func errorResponse(rc tpm2.TPMRC) []byte {
+	out := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(out[0:2], tagNoSessions)
+	binary.BigEndian.PutUint32(out[2:6], headerSize)
+	binary.BigEndian.PutUint32(out[6:10], uint32(rc))
+	return out
+}
+
+func readAuthArea(r *bytes.Reader) ([]authCommand, error) {
+	var authSize uint32
+	if err := binary.Read(r, binary.BigEndian, &authSize); err != nil {
+		return nil, err
+	}
+	if int(authSize) > r.Len() {
+		return nil, errShort
+	}
+	area := make([]byte, authSize)
+	r.Read(area)
+	ar := bytes.NewReader(area)
+	var auths []authCommand
+	for ar.Len() > 0 {
+		var a authCommand
+		var h uint32
+		if err := binary.Read(ar, binary.BigEndian, &h); err != nil {
+			return nil, err
+		}
+		a.handle = tpm2.TPMHandle(h)
+		var err error
+		if a.nonceCaller, err = read2B(ar); err != nil {
+			return nil, err
+		}
+		if a.attrs, err = ar.ReadByte(); err != nil {
+			return nil, err
+		}
+		if a.hmac, err = read2B(ar); err != nil {
+			return nil, err
+		}
+		auths = append(auths, a)
+	}
+	return auths, nil
+}
+
+func read2B(r *bytes.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if int(size) > r.Len() {
+		return nil, errShort
+	}
+	b := make([]byte, size)
+	r.Read(b)
+	return b, nil
+}
+
+// command is an entry of the command table.  The handle layout comes from the gotpm tags of the go-tpm structs.
+type command struct {
+	handles int
+	auth    []bool
+	rHandle bool
+	// run returns the response handle and the rpHash preimage, rc || cc || parameters
+	run func(t *TPM, c *call) (tpm2.TPMHandle, []byte, error)
+}
+
+var commands = map[tpm2.TPMCC]command{}
+
+// register adds f to the command table under C's command code.  The parameters are unmarshalled with
+// tpm2.UnmarshalCommand.
+func register[C tpm2.Command[R, *R], R any](f func(t *TPM, c *call, cmd C) (*R, error)) {
+	registerWith(unmarshalCommand[C], f)
+}
+
+// registerWith adds f to the command table with its own parameter decoder.
+func registerWith[C tpm2.Command[R, *R], R any](decode func(names int, params []byte) (C, error), f func(t *TPM, c *call, cmd C) (*R, error)) {
+	var zero C
+	var rsp R
+	c := command{}
+	var names int
+	ct := reflect.TypeOf(zero)
+	for i := range ct.NumField() {
+		tag := ct.Field(i).Tag.Get("gotpm")
+		if !strings.Contains(tag, "handle") {
+			break
+		}
+		c.handles++
+		c.auth = append(c.auth, strings.Contains(tag, "auth"))
+		if !strings.Contains(tag, "anon") {
+			names++
+		}
+	}
+	rt := reflect.TypeOf(rsp)
+	c.rHandle = rt.NumField() > 0 && strings.Contains(rt.Field(0).Tag.Get("gotpm"), "handle")
+
+	c.run = func(t *TPM, in *call) (tpm2.TPMHandle, []byte, error) {
+		cmd, err := decode(names, in.params)
+		if err != nil {
+			return 0, nil, tpm2.TPMRCSize
+		}
+		rsp, err := f(t, in, cmd)
+		if err != nil {
+			return 0, nil, err
+		}
+		out, err := tpm2.MarshalResponse(cmd, rsp)
+		if err != nil {
+			return 0, nil, err
+		}
+		var h tpm2.TPMHandle
+		if c.rHandle {
+			h = tpm2.TPMHandle(reflect.ValueOf(rsp).Elem().Field(0).Uint())
+		}
+		return h, out, nil
+	}
+	commands[zero.Command()] = c
+}
+
+// unmarshalCommand decodes the parameters with tpm2.UnmarshalCommand, which takes the cpHash preimage.  The
+// names are those of TPM_RH_NULL, the handlers use call.handles instead.
+func unmarshalCommand[C tpm2.Command[R, *R], R any](names int, params []byte) (C, error) {
+	var zero C
+	var preimage bytes.Buffer
+	binary.Write(&preimage, binary.BigEndian, uint32(zero.Command()))
+	for range names {
+		binary.Write(&preimage, binary.BigEndian, uint32(tpm2.TPMRHNull))
+	}
+	preimage.Write(params)
+	return tpm2.UnmarshalCommand[C](preimage.Bytes())
+}
+
+// createParams decodes inSensitive and inPublic of TPM2_Create and TPM2_CreatePrimary; go-tpm can't
+// unmarshal TPM2B_SENSITIVE_CREATE.  Only the auth value of inSensitive is kept.
+func createParams(params []byte) (tpm2.TPM2BSensitiveCreate, tpm2.TPM2BPublic, error) {
+	r := bytes.NewReader(params)
+	sensitive, err := read2B(r)
+	if err != nil {
+		return tpm2.TPM2BSensitiveCreate{}, tpm2.TPM2BPublic{}, err
+	}
+	userAuth, err := read2B(bytes.NewReader(sensitive))
+	if err != nil {
+		return tpm2.TPM2BSensitiveCreate{}, tpm2.TPM2BPublic{}, err
+	}
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](params[len(params)-r.Len():])
+	if err != nil {
+		return tpm2.TPM2BSensitiveCreate{}, tpm2.TPM2BPublic{}, err
+	}
+	return tpm2.TPM2BSensitiveCreate{
+		Sensitive: &tpm2.TPMSSensitiveCreate{
+			UserAuth: tpm2.TPM2BAuth{
+				Buffer: userAuth,
+			},
+		},
+	}, *public, nil
+}
+
+func decodeCreatePrimary(_ int, params []byte) (tpm2.CreatePrimary, error) {
+	sensitive, public, err := createParams(params)
+	return tpm2.CreatePrimary{
+		InSensitive: sensitive,
+		InPublic:    public,
+	}, err
+}
+
+func decodeCreate(_ int, params []byte) (tpm2.Create, error) {
+	sensitive, public, err := createParams(params)
+	return tpm2.Create{
+		InSensitive: sensitive,
+		InPublic:    public,
+	}, err
+}
+
+func init() {
+	register(startup)
+	register(getCapability)
+	register(getRandom)
+	register(startAuthSession)
+	register(flushContext)
+	registerWith(decodeCreatePrimary, createPrimary)
+	registerWith(decodeCreate, create)
+	register(load)
+	register(readPublic)
+	register(encapsulate)
+	register(decapsulate)
+	register(signSequenceStart)
+	register(verifySequenceStart)
+	register(sequenceUpdate)
+	register(signSequenceComplete)
+	register(verifySequenceComplete)
+	register(signDigest)
+	registerWith(decodeHmac, hmacCommand)
+	register(policySecret)
+	register(activateCredential)
+	registerWith(decodeContextSave, contextSave)
+	register(contextLoad)
+	register(nvDefineSpace)
+	register(nvUndefineSpace)
+	register(nvReadPublic)
+	register(nvWrite)
+	register(nvRead)
+	register(evictControl)
+
+	// go-tpm sends saveHandle as a parameter but it's in the handle area, Part 3 28.2
+	c := commands[tpm2.TPMCCContextSave]
+	c.handles, c.auth = 1, []bool{false}
+	commands[tpm2.TPMCCContextSave] = c
+}
@@ -1,62 +1,34 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"slices"
+	"os"
 	"strconv"
 
-	"github.com/google/go-tpm/tpm2"
-	"github.com/google/go-tpm/tpm2/transport"
-	"github.com/google/go-tpm/tpmutil"
-)
+	"main/tpmpqc"
 
-const (
-	maxInputBuffer = 1024
+	"github.com/google/go-tpm/tpm2/transport"
 )
 
 var (
-	tpmPath = flag.String("tpm-path", "127.0.0.1:2321", "Path to the TPM device (character device or a Unix socket).")
+	tpmPath  = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	jsonMode = flag.Bool("json", false, "print the capabilities as JSON on stdout")
 )
 
-const (
-	TPM_MLKEM_512_ENABLED uint32 = 1 << iota
-	TPM_MLKEM_768_ENABLED
-	TPM_MLKEM_1024_ENABLED
-	TPM_MLDSA_44_ENABLED
-	TPM_MLDSA_65_ENABLED
-	TPM_MLDSA_87_ENABLED
-	TPM_MLDSA_ALLOW_EXTERNAL_MU
-)
-
-type TPMA_ML_PARAMETER_SET struct {
-	ID        uint32
-	BitFields uint32 // Acts as storage for multiple bit booleans
-}
-
-func (u *TPMA_ML_PARAMETER_SET) HasFlag(flag uint32) bool {
-	return (u.BitFields & flag) != 0
-}
-
-var TPMDEVICES = []string{"/dev/tpm0", "/dev/tpmrm0"}
-
-func OpenTPM(path string) (io.ReadWriteCloser, error) {
-	if slices.Contains(TPMDEVICES, path) {
-		return tpmutil.OpenTPM(path)
-	} else {
-		return net.Dial("tcp", path)
-	}
-}
-
 func main() {
 	flag.Parse()
 
+	if *jsonMode {
+		// keep stdout clean for the json document
+		log.SetOutput(os.Stderr)
+	}
+
 	log.Println("======= Init  ========")
 
-	rwc, err := OpenTPM(*tpmPath)
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
 	if err != nil {
 		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
 	}
@@ -66,26 +38,6 @@ func main() {
 
 	rwr := transport.FromReadWriter(rwc)
 
-	// first try to read what the max MLDSA buffer and set it as maxInputBuffer variable
-	// 11.3.4 MAX_MLDSA_SIG_SIZE  pg 186 https://trustedcomputinggroup.org/wp-content/uploads/Trusted-Platform-Module-2.0-Library-Part-2-Structures_Version-185_pub.pdf
-	getCmd := tpm2.GetCapability{
-		Capability:    tpm2.TPMCapTPMProperties,
-		Property:      uint32(tpm2.TPMPTInputBuffer),
-		PropertyCount: 1,
-	}
-	getRsp, err := getCmd.Execute(rwr)
-	if err != nil {
-		log.Fatalf("can't get capabilities %v", err)
-	}
-
-	tp, err := getRsp.CapabilityData.Data.TPMProperties()
-	if err != nil {
-		log.Fatalf("can't read capabilities%v", err)
-	}
-
-	blockSize := int(tp.TPMProperty[0].Value)
-	log.Printf("TPM Max buffer %d", blockSize)
-
 	// 8.13 TPMA_ML_PARAMETER_SET
 	// This Table 47 attribute is used to report the supported ML-KEM and ML-DSA parameter sets, as well as
 	// support for allowExternalMu. This structure may be read using TPM2_GetCapability(capability ==
@@ -102,37 +54,37 @@ func main() {
 
 	//Bits:          111111
 	//Padded Bits:   00000000000000000000000000111111
-
-	getCmdParam := tpm2.GetCapability{
-		Capability:    tpm2.TPMCapTPMProperties,
-		Property:      uint32(tpm2.TPMPTMLParameterSet),
-		PropertyCount: 1,
-	}
-	getRspParam, err := getCmdParam.Execute(rwr)
+	caps, err := tpmpqc.ReadCapabilities(rwr)
 	if err != nil {
-		log.Fatalf("can't get capabilities %v", err)
+		log.Fatalf("can't read capabilities %v", err)
 	}
 
-	tparam, err := getRspParam.CapabilityData.Data.TPMProperties()
-	if err != nil {
-		log.Fatalf("can't read capabilities%v", err)
+	if *jsonMode {
+		b, err := json.MarshalIndent(caps, "", "  ")
+		if err != nil {
+			log.Fatalf("can't marshal capabilities %v", err)
+		}
+		fmt.Println(string(b))
+		return
 	}
 
-	bitStr := strconv.FormatUint(uint64(tparam.TPMProperty[0].Value), 2)
+	// 11.3.4 MAX_MLDSA_SIG_SIZE  pg 186 https://trustedcomputinggroup.org/wp-content/uploads/Trusted-Platform-Module-2.0-Library-Part-2-Structures_Version-185_pub.pdf
+	log.Printf("TPM Max buffer %d", caps.InputBuffer)
+	log.Printf("Max MLDSA signature size %d", caps.MaxMLDSASignatureSize)
 
-	// Format with leading zeros to show all 32 bits
-	paddedStr := fmt.Sprintf("%032b", tparam.TPMProperty[0].Value)
-	log.Println("TPMPTMLParameterSet Bits:         ", bitStr)    // Bits:
-	log.Println("TPMPTMLParameterSet Padded Bits:  ", paddedStr) // Output:
+	log.Println("TPMPTMLParameterSet Bits:         ", strconv.FormatUint(uint64(caps.RawParameterSets), 2))
+	log.Println("TPMPTMLParameterSet Padded Bits:  ", fmt.Sprintf("%032b", caps.RawParameterSets))
 
-	f := TPMA_ML_PARAMETER_SET{BitFields: tparam.TPMProperty[0].Value}
+	f := caps.ParameterSets
+	log.Printf("TPM_MLKEM_512_ENABLED %t\n", f.MLKEM512)
+	log.Printf("TPM_MLKEM_768_ENABLED %t\n", f.MLKEM768)
+	log.Printf("TPM_MLKEM_1024_ENABLED %t\n", f.MLKEM1024)
+	log.Printf("TPM_MLDSA_44_ENABLED %t\n", f.MLDSA44)
+	log.Printf("TPM_MLDSA_65_ENABLED %t\n", f.MLDSA65)
+	log.Printf("TPM_MLDSA_87_ENABLED %t\n", f.MLDSA87)
 
-	log.Printf("TPM_MLKEM_512_ENABLED %t\n", f.HasFlag(TPM_MLKEM_512_ENABLED))
-	log.Printf("TPM_MLKEM_768_ENABLED %t\n", f.HasFlag(TPM_MLKEM_768_ENABLED))
-	log.Printf("TPM_MLKEM_1024_ENABLED %t\n", f.HasFlag(TPM_MLKEM_1024_ENABLED))
-	log.Printf("TPM_MLDSA_44_ENABLED %t\n", f.HasFlag(TPM_MLDSA_44_ENABLED))
-	log.Printf("TPM_MLDSA_65_ENABLED %t\n", f.HasFlag(TPM_MLDSA_65_ENABLED))
-	log.Printf("TPM_MLDSA_87_ENABLED %t\n", f.HasFlag(TPM_MLDSA_87_ENABLED))
+	log.Printf("TPM_MLDSA_ALLOW_EXTERNAL_MU %t\n", caps.ExternalMu)
 
-	log.Printf("TPM_MLDSA_ALLOW_EXTERNAL_MU %t\n", f.HasFlag(TPM_MLDSA_ALLOW_EXTERNAL_MU))
+	log.Printf("Algorithms %v", caps.Algorithms)
+	log.Printf("Commands %v", caps.Commands)
 }
@@ -1,10 +1,12 @@
 module main
 
-go 1.26.2
+go 1.27
 
 require (
+	github.com/cloudflare/circl v1.6.3
 	github.com/google/go-tpm v0.9.8
 	github.com/google/go-tpm-tools v0.4.9
+	pqcca v0.0.0
 )
 
 require (
@@ -13,3 +15,5 @@ require (
 )
 
 replace github.com/google/go-tpm => ./go-tpm
+
+replace pqcca => ../mldsa/x509/pqcca
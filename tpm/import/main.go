@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath          = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode             = flag.String("mode", "import", "import or loadexternal")
+	keyPEM           = flag.String("key", "private.pem", "seed format PKCS#8 ML-DSA or ML-KEM private key")
+	srkType          = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle     = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	persistentHandle = flag.Uint("persistent-handle", 0, "persistent handle for the imported key (optional, eg 0x81010003)")
+	keyFile          = flag.String("keyfile", "imported.pem", "TSS2 PRIVATE KEY file for the imported key")
+	dataToSign       = flag.String("datatosign", "foo", "data to sign")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	b, err := os.ReadFile(*keyPEM)
+	if err != nil {
+		log.Fatalf("can't read key %v", err)
+	}
+	e, err := tpmpqc.ParseExternalKey(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("======= key type %v parameter set %d ========", e.Type, e.ParameterSet)
+	if len(e.EntropySources) > 0 {
+		log.Printf("seed was mixed from %s", strings.Join(e.EntropySources, ", "))
+	}
+
+	switch *mode {
+	case "import":
+		importKey(rwr, e)
+	case "loadexternal":
+		loadExternal(rwr, e)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func importKey(rwr transport.TPM, e *tpmpqc.ExternalKey) {
+	log.Printf("======= createPrimary ========")
+
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	parentRef := tpm2.TPMRHOwner
+	if *parentHandle != 0 {
+		parentRef = tpm2.TPMHandle(*parentHandle)
+	}
+
+	log.Printf("======= import ========")
+	var tk *tpmpqc.TPMKey
+	var persist func(tpm2.TPMHandle) error
+	switch e.Type {
+	case tpm2.TPMAlgMLDSA:
+		k, err := tpmpqc.ImportSigningKey(rwr, parent, e, nil)
+		if err != nil {
+			log.Fatalf("can't import mldsa %v", err)
+		}
+		defer k.Close()
+		if tk, err = k.TPMKey(parentRef, *srkType); err != nil {
+			log.Fatal(err)
+		}
+		persist = k.Persist
+		sign(k, e)
+	case tpm2.TPMAlgMLKEM:
+		k, err := tpmpqc.ImportKEMKey(rwr, parent, e, nil)
+		if err != nil {
+			log.Fatalf("can't import mlkem %v", err)
+		}
+		defer k.Close()
+		if tk, err = k.TPMKey(parentRef, *srkType); err != nil {
+			log.Fatal(err)
+		}
+		persist = k.Persist
+		decapsulate(k)
+	}
+
+	pemBytes, err := tk.EncodePEM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyFile, pemBytes, 0600); err != nil {
+		log.Fatalf("can't write key file %v", err)
+	}
+	log.Printf("wrote %s", *keyFile)
+
+	if *persistentHandle != 0 {
+		if err := persist(tpm2.TPMHandle(*persistentHandle)); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("======= persisted at %#x ========", *persistentHandle)
+	}
+}
+
+func loadExternal(rwr transport.TPM, e *tpmpqc.ExternalKey) {
+	log.Printf("======= loadExternal ========")
+	switch e.Type {
+	case tpm2.TPMAlgMLDSA:
+		k, err := tpmpqc.LoadExternalSigningKey(rwr, e)
+		if err != nil {
+			log.Fatalf("can't load mldsa %v", err)
+		}
+		defer k.Close()
+		sign(k, e)
+	case tpm2.TPMAlgMLKEM:
+		k, err := tpmpqc.LoadExternalKEMKey(rwr, e)
+		if err != nil {
+			log.Fatalf("can't load mlkem %v", err)
+		}
+		defer k.Close()
+		decapsulate(k)
+	}
+}
+
+func sign(k *tpmpqc.SigningKey, e *tpmpqc.ExternalKey) {
+	log.Printf("======= sign ========")
+	sig, err := k.Sign(nil, []byte(*dataToSign), &mldsa.Options{})
+	if err != nil {
+		log.Fatalf("can't sign %v", err)
+	}
+	fmt.Printf("Signature : %s\n", base64.StdEncoding.EncodeToString(sig))
+
+	// verify with the public key derived from the original seed, not the one the TPM returns
+	pub, err := k.PublicKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(pub.Bytes(), e.PublicKey) {
+		log.Fatalf("TPM public key does not match the imported key")
+	}
+	if err := mldsa.Verify(pub, []byte(*dataToSign), sig, &mldsa.Options{}); err != nil {
+		log.Fatalf("error verifying %v", err)
+	}
+	fmt.Println("Verified signature using standard go")
+}
+
+func decapsulate(k *tpmpqc.KEMKey) {
+	ek := k.Encapsulator()
+	if ek == nil {
+		log.Fatalf("can't read encapsulation key")
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+	fmt.Printf("SharedSecret %s\n", base64.StdEncoding.EncodeToString(sharedSecret))
+
+	log.Printf("======= decapsulate ========")
+	dsharedSecret, err := k.Decapsulate(ciphertext)
+	if err != nil {
+		log.Fatalf("can't decapsulate %v", err)
+	}
+	fmt.Printf("SharedSecret from decapsulation %s\n", base64.StdEncoding.EncodeToString(dsharedSecret))
+	if !bytes.Equal(sharedSecret, dsharedSecret) {
+		log.Fatalf("shared secrets don't match")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath          = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode             = flag.String("mode", "create", "create or decapsulate")
+	parameterSet     = flag.Int("parameter-set", 768, "ML-KEM parameter set: 512, 768 or 1024")
+	srkType          = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle     = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	persistentHandle = flag.Uint("persistent-handle", 0, "persistent handle for the mlkem key (optional, eg 0x81010002)")
+	publicFile       = flag.String("public", "key.pub", "TPM2B_PUBLIC blob of the mlkem key")
+	privateFile      = flag.String("private", "key.priv", "TPM2B_PRIVATE blob of the mlkem key")
+	pemFile          = flag.String("pem", "public.pem", "PKIX encapsulation key")
+	cipherTextFile   = flag.String("ciphertext", "ciphertext.bin", "ciphertext to decapsulate")
+	saltType         = flag.String("salt", "srk", "salt key for the encrypted decapsulate session: none, srk, ek or mlkem")
+	saltNameFile     = flag.String("salt-name", "salt.name", "name of the srk or mlkem salt key, written by create and checked by decapsulate")
+	ekCertFile       = flag.String("ek-cert", "ek.crt", "--salt=ek: EK certificate of the TPM")
+	ekRootsFile      = flag.String("ek-roots", "ek_roots.pem", "--salt=ek: TPM manufacturer CA certificates the EK certificate must chain to")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	switch *mode {
+	case "create":
+		createKey(rwr)
+	case "decapsulate":
+		decapsulate(rwr)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func createKey(rwr transport.TPM) {
+	log.Printf("======= createPrimary ========")
+
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	ps, err := tpmpqc.MLKEMParameterSet(*parameterSet)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= create ML-KEM-%d key ========", *parameterSet)
+	k, err := tpmpqc.CreateKEMKey(rwr, parent, ps, nil)
+	if err != nil {
+		log.Fatalf("can't create mlkem %v", err)
+	}
+	defer k.Close()
+
+	if err := k.SaveFiles(*publicFile, *privateFile); err != nil {
+		log.Fatalf("can't save key %v", err)
+	}
+	log.Printf("wrote key blobs to %s and %s", *publicFile, *privateFile)
+
+	b, err := k.MarshalPKIXPublicKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pstr := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: b,
+	})
+	if err := os.WriteFile(*pemFile, pstr, 0644); err != nil {
+		log.Fatalf("can't write public key %v", err)
+	}
+	fmt.Printf("%s\n", pstr)
+
+	if *persistentHandle != 0 {
+		if err := k.Persist(tpm2.TPMHandle(*persistentHandle)); err != nil {
+			log.Fatalf("can't persist key %v", err)
+		}
+		log.Printf("persisted key at %#x", *persistentHandle)
+	}
+
+	// record the salt key's name now so decapsulate can tell the TPM's key from one an interposer returns
+	var saltName tpm2.TPM2BName
+	switch *saltType {
+	case "srk":
+		saltName = parent.Name
+	case "mlkem":
+		saltName = k.Handle().Name
+	}
+	if len(saltName.Buffer) != 0 {
+		if err := os.WriteFile(*saltNameFile, []byte(hex.EncodeToString(saltName.Buffer)), 0644); err != nil {
+			log.Fatalf("can't write salt name %v", err)
+		}
+		log.Printf("wrote salt key name to %s", *saltNameFile)
+	}
+
+	// encapsulate to the key so the next run has something to decapsulate
+	ek := k.Encapsulator()
+	if ek == nil {
+		log.Fatalf("can't read encapsulation key")
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+	if err := os.WriteFile(*cipherTextFile, ciphertext, 0644); err != nil {
+		log.Fatalf("can't write ciphertext %v", err)
+	}
+	fmt.Printf("SharedSecret %s\n", base64.StdEncoding.EncodeToString(sharedSecret))
+}
+
+func decapsulate(rwr transport.TPM) {
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	var k *tpmpqc.KEMKey
+	if *persistentHandle != 0 {
+		log.Printf("======= open persistent key %#x ========", *persistentHandle)
+		k, err = tpmpqc.OpenPersistentKEMKey(rwr, tpm2.TPMHandle(*persistentHandle))
+		if err != nil {
+			log.Fatalf("can't open key %v", err)
+		}
+	} else {
+		log.Printf("======= load key blobs ========")
+		k, err = tpmpqc.LoadKEMKeyFiles(rwr, parent, *publicFile, *privateFile)
+		if err != nil {
+			log.Fatalf("can't load key %v", err)
+		}
+	}
+	defer k.Close()
+
+	salt, closeSalt := sessionSalt(rwr, parent, k)
+	defer closeSalt()
+	k.Salt = salt
+
+	ciphertext, err := os.ReadFile(*cipherTextFile)
+	if err != nil {
+		log.Fatalf("can't read ciphertext %v", err)
+	}
+
+	fmt.Println("Decapsulate")
+	sharedSecret, err := k.Decapsulate(ciphertext)
+	if err != nil {
+		log.Fatalf("can't decapsulate %v", err)
+	}
+	fmt.Printf("SharedSecret from decapsulation %s\n", base64.StdEncoding.EncodeToString(sharedSecret))
+}
+
+// sessionSalt returns the key selected by --salt for the salted, response encrypted decapsulate session.
+// The srk and mlkem salts must have the name create recorded, the ek salt must match a certificate that
+// chains to --ek-roots.
+func sessionSalt(rwr transport.TPM, parent tpm2.NamedHandle, k *tpmpqc.KEMKey) (*tpmpqc.SessionSalt, func() error) {
+	noop := func() error { return nil }
+	switch *saltType {
+	case "none":
+		log.Printf("decapsulating without session encryption, the shared secret crosses the bus in the clear")
+		return nil, noop
+	case "srk":
+		salt, err := tpmpqc.NewSessionSalt(rwr, parent.Handle, readSaltName())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return salt, noop
+	case "ek":
+		salt, closer, err := tpmpqc.EKSessionSalt(rwr, readEKCert())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return salt, closer
+	case "mlkem":
+		// the key salts its own session
+		salt, err := k.SessionSalt(readSaltName())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := salt.Check(rwr); err != nil {
+			log.Fatalf("TPM does not accept ML-KEM salt keys, use --salt=srk: %v", err)
+		}
+		return salt, noop
+	}
+	log.Fatalf("unknown salt %q", *saltType)
+	return nil, nil
+}
+
+func readSaltName() tpm2.TPM2BName {
+	b, err := os.ReadFile(*saltNameFile)
+	if err != nil {
+		log.Fatalf("can't read salt name %v", err)
+	}
+	name, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		log.Fatalf("can't decode salt name %v", err)
+	}
+	return tpm2.TPM2BName{
+		Buffer: name,
+	}
+}
+
+// readEKCert reads the EK certificate, PEM or DER, and verifies it against the manufacturer roots.
+func readEKCert() *x509.Certificate {
+	b, err := os.ReadFile(*ekCertFile)
+	if err != nil {
+		log.Fatalf("can't read EK certificate %v", err)
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		log.Fatalf("can't parse EK certificate %v", err)
+	}
+	roots, err := os.ReadFile(*ekRootsFile)
+	if err != nil {
+		log.Fatalf("can't read EK roots %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(roots) {
+		log.Fatalf("no certificates in %s", *ekRootsFile)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		log.Fatalf("can't verify EK certificate %v", err)
+	}
+	return cert
+}
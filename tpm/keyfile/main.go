@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode         = flag.String("mode", "create", "create or load")
+	keyType      = flag.String("type", "mldsa", "mldsa or mlkem")
+	parameterSet = flag.Int("parameter-set", 0, "ML-DSA 44/65/87 or ML-KEM 512/768/1024 (defaults to 65 or 768)")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	keyFile      = flag.String("keyfile", "private.pem", "TSS2 PRIVATE KEY file")
+	dataToSign   = flag.String("datatosign", "foo", "data to sign")
+	policyType   = flag.String("policy", "", "optional key policy: pcr or password")
+	pcrList      = flag.String("pcrs", "23", "comma separated sha256 PCRs for the pcr policy")
+	password     = flag.String("password", "", "key auth value for the password policy")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	switch *mode {
+	case "create":
+		createKey(rwr)
+	case "load":
+		loadKey(rwr)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func createKey(rwr transport.TPM) {
+	log.Printf("======= createPrimary ========")
+
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	// the key file records the parent so the loader knows which SRK to recreate
+	parentRef := tpm2.TPMRHOwner
+	if *parentHandle != 0 {
+		parentRef = tpm2.TPMHandle(*parentHandle)
+	}
+
+	policy, err := keyPolicy(rwr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tk *tpmpqc.TPMKey
+	switch *keyType {
+	case "mldsa":
+		if *parameterSet == 0 {
+			*parameterSet = 65
+		}
+		ps, err := tpmpqc.MLDSAParameterSet(*parameterSet)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := tpmpqc.CreateSigningKey(rwr, parent, ps, policy)
+		if err != nil {
+			log.Fatalf("can't create mldsa %v", err)
+		}
+		defer k.Close()
+		tk, err = k.TPMKey(parentRef, *srkType)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "mlkem":
+		if *parameterSet == 0 {
+			*parameterSet = 768
+		}
+		ps, err := tpmpqc.MLKEMParameterSet(*parameterSet)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := tpmpqc.CreateKEMKey(rwr, parent, ps, policy)
+		if err != nil {
+			log.Fatalf("can't create mlkem %v", err)
+		}
+		defer k.Close()
+		tk, err = k.TPMKey(parentRef, *srkType)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown key type %q", *keyType)
+	}
+
+	pemBytes, err := tk.EncodePEM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyFile, pemBytes, 0600); err != nil {
+		log.Fatalf("can't write key file %v", err)
+	}
+	fmt.Printf("%s\n", pemBytes)
+}
+
+// keyPolicy builds the policy selected by --policy, or nil for a plain key.
+func keyPolicy(rwr transport.TPM) (*tpmpqc.KeyPolicy, error) {
+	if *policyType == "" {
+		return nil, nil
+	}
+	var pcrs []uint
+	for _, s := range strings.Split(*pcrList, ",") {
+		i, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse pcr %q: %v", s, err)
+		}
+		pcrs = append(pcrs, uint(i))
+	}
+
+	switch *policyType {
+	case tpmpqc.PolicyTypePassword:
+		return &tpmpqc.KeyPolicy{
+			Type:     tpmpqc.PolicyTypePassword,
+			Password: []byte(*password),
+		}, nil
+	case tpmpqc.PolicyTypePCR:
+		return tpmpqc.NewPCRPolicy(rwr, pcrs)
+	case tpmpqc.PolicyTypePCROrPassword:
+		// checked before the key is created, see tpmpqc.KeyPolicy.TPMPolicies
+		return nil, fmt.Errorf("%s keys can't be written to a TSS2 key file", *policyType)
+	}
+	return nil, fmt.Errorf("unknown policy %q", *policyType)
+}
+
+func loadKey(rwr transport.TPM) {
+	pemBytes, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("can't read key file %v", err)
+	}
+	tk, err := tpmpqc.DecodeTPMKey(pemBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= parent %#x ========", tk.Parent)
+	parent, closeParent, err := tk.ParentHandle(rwr)
+	if err != nil {
+		log.Fatalf("can't get parent %v", err)
+	}
+	defer closeParent()
+
+	alg, err := tk.KeyType()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch alg {
+	case tpm2.TPMAlgMLDSA:
+		k, err := tpmpqc.LoadSigningKeyFromTPMKey(rwr, parent, tk, []byte(*password))
+		if err != nil {
+			log.Fatalf("can't load mldsa %v", err)
+		}
+		defer k.Close()
+
+		// keys created on a TPM with TPM_MLDSA_ALLOW_EXTERNAL_MU use SignDigest over mu, others a sign sequence
+		log.Printf("======= sign (allowExternalMu %t) ========", k.AllowsExternalMu())
+		sig, err := k.Sign(nil, []byte(*dataToSign), &mldsa.Options{})
+		if err != nil {
+			log.Fatalf("can't sign %v", err)
+		}
+		fmt.Printf("Signature : %s\n", base64.StdEncoding.EncodeToString(sig))
+
+		pub, err := k.PublicKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mldsa.Verify(pub, []byte(*dataToSign), sig, &mldsa.Options{}); err != nil {
+			log.Fatalf("error verifying %v", err)
+		}
+		fmt.Println("Verified signature using standard go")
+
+		if err := k.Verify([]byte(*dataToSign), sig, &mldsa.Options{}); err != nil {
+			log.Fatalf("error verifying with TPM %v", err)
+		}
+		fmt.Println("Verified signature using TPM")
+	case tpm2.TPMAlgMLKEM:
+		k, err := tpmpqc.LoadKEMKeyFromTPMKey(rwr, parent, tk, []byte(*password))
+		if err != nil {
+			log.Fatalf("can't load mlkem %v", err)
+		}
+		defer k.Close()
+
+		ek := k.Encapsulator()
+		if ek == nil {
+			log.Fatalf("can't read encapsulation key")
+		}
+		sharedSecret, ciphertext := ek.Encapsulate()
+		fmt.Printf("SharedSecret %s\n", base64.StdEncoding.EncodeToString(sharedSecret))
+
+		log.Printf("======= decapsulate ========")
+		dsharedSecret, err := k.Decapsulate(ciphertext)
+		if err != nil {
+			log.Fatalf("can't decapsulate %v", err)
+		}
+		fmt.Printf("SharedSecret from decapsulation %s\n", base64.StdEncoding.EncodeToString(dsharedSecret))
+		if !bytes.Equal(sharedSecret, dsharedSecret) {
+			log.Fatalf("shared secrets don't match")
+		}
+	default:
+		log.Fatalf("unsupported key type %v", alg)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"main/tpmpqc"
+
+	"github.com/cloudflare/circl/sign/slhdsa"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath    = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode       = flag.String("mode", "keygen", "keygen, or sign with an SLH-DSA key")
+	entropy    = flag.String("entropy", "crypto/rand,tpm", "comma separated entropy sources: crypto/rand, tpm, file:/path (eg file:/dev/hwrng)")
+	keyType    = flag.String("keyType", "mlkem768", "keygen: mlkem512, mlkem768, mlkem1024, mldsa44, mldsa65, mldsa87 or slhdsa-sha2-128s")
+	keyPEM     = flag.String("key", "private.pem", "seed format PKCS#8 private key")
+	dataToSign = flag.String("datatosign", "foo", "sign: data to sign")
+	context    = flag.String("context", "", "sign: signature context string")
+)
+
+var oidSLHDSASHA2128s = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 20}
+
+// pkcs8 is a PrivateKeyInfo without attributes
+type pkcs8 struct {
+	Version    int
+	Algo       pkixAlgorithm
+	PrivateKey []byte
+}
+
+type pkixAlgorithm struct {
+	Algorithm asn1.ObjectIdentifier
+}
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	sources, err := tpmpqc.ParseEntropySources(rwr, *entropy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := tpmpqc.NewEntropyMixer(sources...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+	log.Printf("======= entropy from %s ========", strings.Join(m.Sources(), ", "))
+
+	switch *mode {
+	case "keygen":
+		keygen(m)
+	case "sign":
+		sign(m)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func keygen(m *tpmpqc.EntropyMixer) {
+	var alg tpm2.TPMAlgID
+	var ps uint16
+	switch *keyType {
+	case "mlkem512":
+		alg, ps = tpm2.TPMAlgMLKEM, uint16(tpm2.TPMMLKEM512)
+	case "mlkem768":
+		alg, ps = tpm2.TPMAlgMLKEM, uint16(tpm2.TPMMLKEM768)
+	case "mlkem1024":
+		alg, ps = tpm2.TPMAlgMLKEM, uint16(tpm2.TPMMLKEM1024)
+	case "mldsa44":
+		alg, ps = tpm2.TPMAlgMLDSA, uint16(tpm2.TPMMLDSA44)
+	case "mldsa65":
+		alg, ps = tpm2.TPMAlgMLDSA, uint16(tpm2.TPMMLDSA65)
+	case "mldsa87":
+		alg, ps = tpm2.TPMAlgMLDSA, uint16(tpm2.TPMMLDSA87)
+	case "slhdsa-sha2-128s":
+		keygenSLHDSA(m)
+		return
+	default:
+		log.Fatalf("unknown keyType %q", *keyType)
+	}
+
+	log.Printf("======= generate %s ========", *keyType)
+	e, err := tpmpqc.GenerateExternalKey(m, alg, ps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := e.MarshalPEM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*keyPEM, b, 0600); err != nil {
+		log.Fatalf("can't write key %v", err)
+	}
+	fmt.Printf("wrote %s, public key %d bytes\n", *keyPEM, len(e.PublicKey))
+}
+
+// keygenSLHDSA writes the SLH-DSA key in the PKCS#8 form of slhdsa/main.go, the private key bytes in
+// the OCTET STRING.
+func keygenSLHDSA(m *tpmpqc.EntropyMixer) {
+	log.Printf("======= generate %s ========", *keyType)
+	_, sk, err := slhdsa.GenerateKey(m, slhdsa.SHA2_128s)
+	if err != nil {
+		log.Fatalf("can't generate slhdsa key %v", err)
+	}
+	raw, err := sk.MarshalBinary()
+	if err != nil {
+		log.Fatalf("can't marshal slhdsa key %v", err)
+	}
+	der, err := asn1.Marshal(pkcs8{
+		Algo:       pkixAlgorithm{Algorithm: oidSLHDSASHA2128s},
+		PrivateKey: raw,
+	})
+	if err != nil {
+		log.Fatalf("can't marshal PKCS#8 %v", err)
+	}
+	der, err = tpmpqc.AddEntropySources(der, m.Sources())
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})
+	if err := os.WriteFile(*keyPEM, b, 0600); err != nil {
+		log.Fatalf("can't write key %v", err)
+	}
+	fmt.Printf("wrote %s\n", *keyPEM)
+}
+
+func sign(m *tpmpqc.EntropyMixer) {
+	b, err := os.ReadFile(*keyPEM)
+	if err != nil {
+		log.Fatalf("can't read key %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		log.Fatalf("no PRIVATE KEY in %s", *keyPEM)
+	}
+	sources, err := tpmpqc.PKCS8EntropySources(block.Bytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sources) > 0 {
+		log.Printf("key seed was mixed from %s", strings.Join(sources, ", "))
+	}
+	var p pkcs8
+	if _, err := asn1.Unmarshal(block.Bytes, &p); err != nil {
+		log.Fatalf("can't unmarshal PKCS#8 %v", err)
+	}
+	// crypto/mldsa hedges with its own DRBG and ignores the reader it's given, so only SLH-DSA signs
+	// with randomness from the mixer
+	if !p.Algo.Algorithm.Equal(oidSLHDSASHA2128s) {
+		log.Fatalf("can't sign with %v, only SLH-DSA keys take opt_rand from the mixer", p.Algo.Algorithm)
+	}
+	data := []byte(*dataToSign)
+
+	sk := slhdsa.PrivateKey{ID: slhdsa.SHA2_128s}
+	if err := sk.UnmarshalBinary(p.PrivateKey); err != nil {
+		log.Fatalf("can't parse slhdsa key %v", err)
+	}
+	// the hedged variant: opt_rand comes from the mixer
+	log.Printf("======= sign SLH-DSA, opt_rand from the mixer ========")
+	sig, err := slhdsa.SignRandomized(&sk, m, slhdsa.NewMessage(data), []byte(*context))
+	if err != nil {
+		log.Fatalf("can't sign %v", err)
+	}
+	log.Printf("Signature %s", base64.StdEncoding.EncodeToString(sig))
+	pub := sk.PublicKey()
+	if !slhdsa.Verify(&pub, slhdsa.NewMessage(data), sig, []byte(*context)) {
+		log.Fatalf("signature does not verify")
+	}
+	fmt.Println("signature verified")
+}
@@ -9,16 +9,14 @@ import (
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"slices"
 
 	"crypto/mldsa"
 
+	"main/tpmpqc"
+
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpm2/transport"
-	"github.com/google/go-tpm/tpmutil"
 )
 
 const (
@@ -26,7 +24,7 @@ const (
 )
 
 var (
-	tpmPath    = flag.String("tpm-path", "127.0.0.1:2321", "Path to the TPM device (character device or a Unix socket).")
+	tpmPath    = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
 	dataToSign = flag.String("datatosign", "foobarbarbarbar", "data to sign")
 )
 
@@ -75,22 +73,12 @@ type SubjectPublicKeyInfo struct {
 	PublicKey asn1.BitString
 }
 
-var TPMDEVICES = []string{"/dev/tpm0", "/dev/tpmrm0"}
-
-func OpenTPM(path string) (io.ReadWriteCloser, error) {
-	if slices.Contains(TPMDEVICES, path) {
-		return tpmutil.OpenTPM(path)
-	} else {
-		return net.Dial("tcp", path)
-	}
-}
-
 func main() {
 	flag.Parse()
 
 	log.Println("======= Init  ========")
 
-	rwc, err := OpenTPM(*tpmPath)
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
 	if err != nil {
 		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
 	}
@@ -317,7 +305,7 @@ func main() {
 		log.Fatalf("can't get signature %v", err)
 	}
 
-	fmt.Printf("Signature : %s\n", base64.StdEncoding.EncodeToString(s.Signature.Buffer))
+	fmt.Printf("Signature : %s\n", base64.StdEncoding.EncodeToString(s.Buffer))
 	fmt.Println()
 
 	//  ***************** verify
@@ -327,7 +315,7 @@ func main() {
 		fmt.Printf("error signing %v", err)
 		return
 	}
-	err = mldsa.Verify(mldsaKeyPub, []byte(*dataToSign), s.Signature.Buffer, &mldsa.Options{
+	err = mldsa.Verify(mldsaKeyPub, []byte(*dataToSign), s.Buffer, &mldsa.Options{
 		Context: "",
 	})
 	if err != nil {
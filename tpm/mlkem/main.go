@@ -1,28 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"crypto/mlkem"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"slices"
+	"os"
+
+	"main/tpmpqc"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpm2/transport"
-	"github.com/google/go-tpm/tpmutil"
 )
 
 const ()
 
 var (
-	tpmPath    = flag.String("tpm-path", "127.0.0.1:2321", "Path to the TPM device (character device or a Unix socket).")
+	tpmPath    = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
 	dataToSign = flag.String("datatosign", "foo", "data to sign")
+	saltName   = flag.String("salt-name", "salt.name", "name of the SRK that salts the decapsulate session, recorded on the first run and checked after")
 )
 var (
 	mlkem758OID = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 2}
@@ -65,22 +67,12 @@ type SubjectPublicKeyInfo struct {
 	PublicKey asn1.BitString
 }
 
-var TPMDEVICES = []string{"/dev/tpm0", "/dev/tpmrm0"}
-
-func OpenTPM(path string) (io.ReadWriteCloser, error) {
-	if slices.Contains(TPMDEVICES, path) {
-		return tpmutil.OpenTPM(path)
-	} else {
-		return net.Dial("tcp", path)
-	}
-}
-
 func main() {
 	flag.Parse()
 
 	log.Println("======= Init  ========")
 
-	rwc, err := OpenTPM(*tpmPath)
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
 	if err != nil {
 		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
 	}
@@ -247,10 +239,36 @@ func main() {
 	///  now decapsulate
 	fmt.Println()
 	fmt.Println("Decapsulate")
+	// the shared secret is the first response parameter: use a session salted with the SRK and
+	// encrypt the response so it does not cross the TPM bus or socket in the clear
+	srkPub, err := primaryKey.OutPublic.Contents()
+	if err != nil {
+		log.Fatalf("can't read primary %v", err)
+	}
+	srkName, err := tpm2.ObjectName(srkPub)
+	if err != nil {
+		log.Fatalf("can't compute primary name %v", err)
+	}
+	if b, err := os.ReadFile(*saltName); err == nil {
+		if string(bytes.TrimSpace(b)) != hex.EncodeToString(srkName.Buffer) {
+			log.Fatalf("SRK name %x is not the one recorded in %s", srkName.Buffer, *saltName)
+		}
+	} else if os.IsNotExist(err) {
+		if err := os.WriteFile(*saltName, []byte(hex.EncodeToString(srkName.Buffer)), 0644); err != nil {
+			log.Fatalf("can't write salt name %v", err)
+		}
+		log.Printf("recorded SRK name in %s", *saltName)
+	} else {
+		log.Fatalf("can't read salt name %v", err)
+	}
 	dcapResp, err := tpm2.Decapsulate{
-		KeyHandle: tpm2.NamedHandle{
+		KeyHandle: tpm2.AuthHandle{
 			Handle: mlkemKey.ObjectHandle,
 			Name:   mlkemKey.Name,
+			Auth: tpm2.HMAC(tpm2.TPMAlgSHA256, 16,
+				tpm2.Auth(nil),
+				tpm2.Salted(primaryKey.ObjectHandle, *srkPub),
+				tpm2.AESEncryption(128, tpm2.EncryptOut)),
 		},
 		// CipherText:  r.CipherText,
 		CipherText: tpm2.TPM2BKEMCipherText{
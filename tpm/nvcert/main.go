@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath          = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode             = flag.String("mode", "provision", "provision, tls or delete")
+	srkType          = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle     = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	persistentHandle = flag.Uint("persistent-handle", 0x81010003, "persistent handle of the ML-DSA key")
+	nvIndex          = flag.Uint("nv-index", 0x01000100, "first NV index of the certificate")
+	nvSize           = flag.Int("nv-size", tpmpqc.MLDSA87CertificateSize, "bytes to reserve for the certificate")
+	password         = flag.String("password", "", "auth value of the NV indices (optional)")
+	parameterSet     = flag.Int("parameter-set", 87, "ML-DSA parameter set of the key: 44, 65 or 87")
+	commonName       = flag.String("cn", "mytpm", "subject CommonName and dNSName of the certificate")
+	caCertFile       = flag.String("ca-cert", "ca.crt", "provision: where to write the CA certificate, tls: the root to verify with")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	var auth *tpmpqc.NVAuth
+	if *password != "" {
+		auth = &tpmpqc.NVAuth{
+			Password: []byte(*password),
+		}
+	}
+	keyHandle := tpm2.TPMHandle(*persistentHandle)
+	certIndex := tpm2.TPMHandle(*nvIndex)
+
+	switch *mode {
+	case "provision":
+		roots := provision(rwr, keyHandle, certIndex, auth)
+		handshake(rwr, keyHandle, certIndex, auth, roots)
+	case "tls":
+		b, err := os.ReadFile(*caCertFile)
+		if err != nil {
+			log.Fatalf("can't read CA certificate %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			log.Fatalf("no certificates in %s", *caCertFile)
+		}
+		handshake(rwr, keyHandle, certIndex, auth, roots)
+	case "delete":
+		if err := tpmpqc.UndefineNVCertificate(rwr, certIndex, *nvSize); err != nil {
+			log.Fatal(err)
+		}
+		k, err := tpmpqc.OpenPersistentSigningKey(rwr, keyHandle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = tpm2.EvictControl{
+			Auth:             tpm2.TPMRHOwner,
+			ObjectHandle:     k.Handle(),
+			PersistentHandle: keyHandle,
+		}.Execute(rwr)
+		if err != nil {
+			log.Fatalf("can't evict key %v", err)
+		}
+		fmt.Printf("removed NV index %#x and key %#x\n", certIndex, keyHandle)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+// provision creates a persistent ML-DSA key, has a throwaway ML-DSA-87 CA issue its certificate and
+// stores the certificate in NV.
+func provision(rwr transport.TPM, keyHandle, certIndex tpm2.TPMHandle, auth *tpmpqc.NVAuth) *x509.CertPool {
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	ps, err := tpmpqc.MLDSAParameterSet(*parameterSet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("======= create ML-DSA-%d key at %#x ========", *parameterSet, keyHandle)
+	k, err := tpmpqc.CreateSigningKey(rwr, parent, ps, nil)
+	if err != nil {
+		log.Fatalf("can't create mldsa %v", err)
+	}
+	if err := k.Persist(keyHandle); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= CA: issue certificate ========")
+	caKey, err := mldsa.GenerateKey(mldsa.MLDSA87())
+	if err != nil {
+		log.Fatalf("can't generate CA key %v", err)
+	}
+	notBefore := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization: []string{"Acme Co"},
+			CommonName:   "Device Root CA",
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(time.Hour * 24 * 365 * 10),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		log.Fatalf("can't create CA certificate %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		log.Fatalf("can't parse CA certificate %v", err)
+	}
+	if err := os.WriteFile(*caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		log.Fatalf("can't write CA certificate %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization: []string{"Acme Co"},
+			CommonName:   *commonName,
+		},
+		DNSNames:    []string{*commonName},
+		NotBefore:   notBefore,
+		NotAfter:    notBefore.Add(time.Hour * 24 * 365),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, k.Public(), caKey)
+	if err != nil {
+		log.Fatalf("can't create certificate %v", err)
+	}
+
+	log.Printf("======= write %d byte certificate to NV ========", len(der))
+	n, err := tpmpqc.DefineNVCertificate(rwr, certIndex, max(*nvSize, len(der)), auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("defined %d NV indices from %#x", n, certIndex)
+	if err := tpmpqc.WriteNVCertificate(rwr, certIndex, der, auth); err != nil {
+		log.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	return roots
+}
+
+// handshake serves a TLS connection with the key and NV certificate and connects to it over a pipe.
+func handshake(rwr transport.TPM, keyHandle, certIndex tpm2.TPMHandle, auth *tpmpqc.NVAuth, roots *x509.CertPool) {
+	log.Printf("======= load certificate from NV ========")
+	cert, err := tpmpqc.LoadTLSCertificate(rwr, keyHandle, certIndex, auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %s issued by %s", cert.Leaf.Subject, cert.Leaf.Issuer)
+
+	log.Printf("======= TLS handshake ========")
+	c, s := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		server := tls.Server(s, &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+		})
+		errs <- server.Handshake()
+	}()
+	client := tls.Client(c, &tls.Config{
+		RootCAs:    roots,
+		ServerName: *commonName,
+	})
+	if err := client.Handshake(); err != nil {
+		log.Fatalf("client handshake failed %v", err)
+	}
+	if err := <-errs; err != nil {
+		log.Fatalf("server handshake failed %v", err)
+	}
+	state := client.ConnectionState()
+	client.Close()
+	fmt.Printf("TLS %s handshake with %s, signed by the TPM key at %#x\n", tls.VersionName(state.Version), state.PeerCertificates[0].Subject, keyHandle)
+}
+
+func serialNumber() *big.Int {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		log.Fatalf("Failed to generate serial number: %s", err)
+	}
+	return serialNumber
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode         = flag.String("mode", "signed", "signed (PolicySigned) or authorize (PolicyAuthorize)")
+	approverKey  = flag.String("approver-key", "approver.pem", "ML-DSA PKCS#8 key of the approver, created if it does not exist")
+	policyRef    = flag.String("policy-ref", "", "optional policyRef")
+	pcrList      = flag.String("pcrs", "23", "comma separated sha256 PCRs for the approved policy in authorize mode")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	// the approver would normally be remote (another machine, a KMS); here it is a local ML-DSA key
+	approver := readApprover()
+
+	log.Printf("======= load approver public key ========")
+	authKey, closeAuthKey, err := tpmpqc.LoadVerificationKey(rwr, approver.PublicKey())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeAuthKey()
+	log.Printf("approver name %x", authKey.Name.Buffer)
+
+	ref := []byte(*policyRef)
+
+	var policy *tpmpqc.KeyPolicy
+	switch *mode {
+	case "signed":
+		d, err := tpmpqc.PolicySignedDigest(authKey.Name, ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policy = &tpmpqc.KeyPolicy{
+			Type:       tpmpqc.PolicyTypeDigest,
+			AuthPolicy: d,
+			// called for every use of the key with a message containing the session's nonceTPM
+			AuthSession: tpmpqc.PolicySignedSession(authKey, ref, func(message []byte) ([]byte, error) {
+				log.Printf("approver signing %s", base64.StdEncoding.EncodeToString(message))
+				return approver.Sign(nil, message, &mldsa.Options{})
+			}),
+		}
+	case "authorize":
+		d, err := tpmpqc.PolicyAuthorizeDigest(authKey.Name, ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// the approver signs a PCR policy; it could later sign a different one without recreating the key
+		var pcrs []uint
+		for _, s := range strings.Split(*pcrList, ",") {
+			i, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+			if err != nil {
+				log.Fatalf("can't parse pcr %q: %v", s, err)
+			}
+			pcrs = append(pcrs, uint(i))
+		}
+		pcrPolicy, err := tpmpqc.NewPCRPolicy(rwr, pcrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		approvedPolicy, err := pcrPolicy.Digest()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sig, err := tpmpqc.SignApprovedPolicy(approver, approvedPolicy.Buffer, ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("approved policy %x", approvedPolicy.Buffer)
+
+		policy = &tpmpqc.KeyPolicy{
+			Type:        tpmpqc.PolicyTypeDigest,
+			AuthPolicy:  d,
+			AuthSession: tpmpqc.PolicyAuthorizeSession(authKey, ref, approvedPolicy.Buffer, sig, pcrPolicy.Callback()),
+		}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	k, err := tpmpqc.CreateKEMKey(rwr, parent, tpm2.TPMMLKEM768, policy)
+	if err != nil {
+		log.Fatalf("can't create mlkem %v", err)
+	}
+	defer k.Close()
+
+	ek := k.Encapsulator()
+	if ek == nil {
+		log.Fatalf("can't read encapsulation key")
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+	fmt.Printf("SharedSecret %s\n", base64.StdEncoding.EncodeToString(sharedSecret))
+
+	log.Printf("======= decapsulate ========")
+	dsharedSecret, err := k.Decapsulate(ciphertext)
+	if err != nil {
+		log.Fatalf("can't decapsulate %v", err)
+	}
+	fmt.Printf("SharedSecret from decapsulation %s\n", base64.StdEncoding.EncodeToString(dsharedSecret))
+	if !bytes.Equal(sharedSecret, dsharedSecret) {
+		log.Fatalf("shared secrets don't match")
+	}
+}
+
+func readApprover() *mldsa.PrivateKey {
+	b, err := os.ReadFile(*approverKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		sk, err := mldsa.GenerateKey(mldsa.MLDSA65())
+		if err != nil {
+			log.Fatalf("can't generate approver key %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			log.Fatalf("can't marshal approver key %v", err)
+		}
+		if err := os.WriteFile(*approverKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			log.Fatalf("can't write approver key %v", err)
+		}
+		log.Printf("wrote new approver key %s", *approverKey)
+		return sk
+	}
+	if err != nil {
+		log.Fatalf("can't read approver key %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		log.Fatalf("no PEM block in %s", *approverKey)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		log.Fatalf("can't parse approver key %v", err)
+	}
+	sk, ok := k.(*mldsa.PrivateKey)
+	if !ok {
+		log.Fatalf("approver key is not ML-DSA")
+	}
+	return sk
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath          = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode             = flag.String("mode", "seal", "seal or unseal")
+	srkType          = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle     = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	persistentHandle = flag.Uint("persistent-handle", 0, "persistent handle of the mlkem key (optional)")
+	pemFile          = flag.String("pem", "public.pem", "PKIX encapsulation key of the TPM mlkem key to seal to")
+	publicFile       = flag.String("public", "key.pub", "TPM2B_PUBLIC blob of the mlkem key")
+	privateFile      = flag.String("private", "key.priv", "TPM2B_PRIVATE blob of the mlkem key")
+	usePublic        = flag.Bool("use-public", false, "seal: take the key and its name from --public instead of --pem")
+	secretFile       = flag.String("secret", "secret.txt", "seal: file to seal")
+	sealedFile       = flag.String("sealed", "sealed.pem", "sealed secret")
+	unsealedFile     = flag.String("unsealed", "unsealed.txt", "unseal: file to write the secret to")
+	saltType         = flag.String("salt", "srk", "unseal: salt key for the encrypted decapsulate session: none or srk")
+	saltNameFile     = flag.String("salt-name", "salt.name", "unseal: name of the srk recorded when the mlkem key was created, see kem --salt-name")
+)
+
+func main() {
+	flag.Parse()
+
+	switch *mode {
+	case "seal":
+		seal()
+	case "unseal":
+		unseal()
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+// seal runs without a TPM, only the public key of the target TPM is needed.
+func seal() {
+	log.Println("======= read public key ========")
+	var pub *tpmpqc.KEMPublicKey
+	var name tpm2.TPM2BName
+	if *usePublic {
+		b, err := os.ReadFile(*publicFile)
+		if err != nil {
+			log.Fatalf("can't read public %v", err)
+		}
+		public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](b)
+		if err != nil {
+			log.Fatalf("can't unmarshal public %v", err)
+		}
+		pub, name, err = tpmpqc.KEMPublicKeyFromPublic(*public)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		b, err := os.ReadFile(*pemFile)
+		if err != nil {
+			log.Fatalf("can't read public key %v", err)
+		}
+		pub, err = tpmpqc.ParseKEMPublicKey(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name, err = pub.Name()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("sealing to key name %x", name.Buffer)
+
+	plaintext, err := os.ReadFile(*secretFile)
+	if err != nil {
+		log.Fatalf("can't read %s %v", *secretFile, err)
+	}
+
+	log.Println("======= seal ========")
+	s, err := tpmpqc.Seal(pub, name, plaintext)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := s.EncodePEM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*sealedFile, b, 0644); err != nil {
+		log.Fatalf("can't write sealed secret %v", err)
+	}
+	fmt.Printf("%s\n", b)
+}
+
+func unseal() {
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	b, err := os.ReadFile(*sealedFile)
+	if err != nil {
+		log.Fatalf("can't read sealed secret %v", err)
+	}
+	s, err := tpmpqc.DecodeSealedSecret(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	var k *tpmpqc.KEMKey
+	if *persistentHandle != 0 {
+		log.Printf("======= open persistent key %#x ========", *persistentHandle)
+		k, err = tpmpqc.OpenPersistentKEMKey(rwr, tpm2.TPMHandle(*persistentHandle))
+		if err != nil {
+			log.Fatalf("can't open key %v", err)
+		}
+	} else {
+		log.Printf("======= load key blobs ========")
+		k, err = tpmpqc.LoadKEMKeyFiles(rwr, parent, *publicFile, *privateFile)
+		if err != nil {
+			log.Fatalf("can't load key %v", err)
+		}
+	}
+	defer k.Close()
+
+	switch *saltType {
+	case "none":
+		log.Printf("decapsulating without session encryption, the shared secret crosses the bus in the clear")
+	case "srk":
+		b, err := os.ReadFile(*saltNameFile)
+		if err != nil {
+			log.Fatalf("can't read salt name %v", err)
+		}
+		name, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+		if err != nil {
+			log.Fatalf("can't decode salt name %v", err)
+		}
+		k.Salt, err = tpmpqc.NewSessionSalt(rwr, parent.Handle, tpm2.TPM2BName{
+			Buffer: name,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown salt %q", *saltType)
+	}
+
+	log.Println("======= unseal ========")
+	plaintext, err := k.Unseal(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*unsealedFile, plaintext, 0600); err != nil {
+		log.Fatalf("can't write %s %v", *unsealedFile, err)
+	}
+	log.Printf("wrote %d bytes to %s", len(plaintext), *unsealedFile)
+}
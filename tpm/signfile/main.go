@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/mldsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath      = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode         = flag.String("mode", "sign", "create or sign")
+	parameterSet = flag.Int("parameter-set", 65, "ML-DSA parameter set: 44, 65 or 87")
+	srkType      = flag.String("srk", tpmpqc.SRKTypeECC, "SRK template for the parent: rsa, ecc or mlkem")
+	parentHandle = flag.Uint("parent-handle", 0, "persistent handle of the parent (optional, overrides --srk)")
+	publicFile   = flag.String("public", "key.pub", "TPM2B_PUBLIC blob of the mldsa key")
+	privateFile  = flag.String("private", "key.priv", "TPM2B_PRIVATE blob of the mldsa key")
+	inFile       = flag.String("in", "firmware.bin", "sign: file to sign")
+	stateFile    = flag.String("state", "firmware.bin.state", "sign: checkpoint file, resumed from if it exists")
+	outFile      = flag.String("out", "firmware.bin.sig", "sign: signature file")
+	context      = flag.String("context", "", "sign: ML-DSA context string")
+	checkpoint   = flag.Int64("checkpoint", 64<<20, "sign: bytes between checkpoints")
+	stopAfter    = flag.Int64("stop-after", 0, "sign: exit after this many bytes to simulate a crash (0: don't)")
+	verifyLimit  = flag.Int64("verify-limit", 64<<20, "sign: verify the signature in software if the file isn't larger")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	log.Printf("======= createPrimary ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, *srkType, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+
+	switch *mode {
+	case "create":
+		create(rwr, parent)
+	case "sign":
+		sign(rwr, parent)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func create(rwr transport.TPM, parent tpm2.NamedHandle) {
+	ps, err := tpmpqc.MLDSAParameterSet(*parameterSet)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= create ML-DSA-%d key ========", *parameterSet)
+	k, err := tpmpqc.CreateSigningKey(rwr, parent, ps, nil)
+	if err != nil {
+		log.Fatalf("can't create mldsa %v", err)
+	}
+	defer k.Close()
+	if err := k.SaveFiles(*publicFile, *privateFile); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s and %s\n", *publicFile, *privateFile)
+}
+
+func sign(rwr transport.TPM, parent tpm2.NamedHandle) {
+	log.Printf("======= load key ========")
+	k, err := tpmpqc.LoadSigningKeyFiles(rwr, parent, *publicFile, *privateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer k.Close()
+
+	f, err := os.Open(*inFile)
+	if err != nil {
+		log.Fatalf("can't open %s %v", *inFile, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// ResumeSignStream reads the part of the file the sequence already absorbed, leaving f at Offset
+	var s *tpmpqc.SignStream
+	if state, err := os.ReadFile(*stateFile); err == nil {
+		log.Printf("======= resume from %s ========", *stateFile)
+		s, err = k.ResumeSignStream(state, f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("resuming at offset %d of %d", s.Offset(), fi.Size())
+	} else if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("======= start sign sequence ========")
+		s, err = k.NewSignStream(*context)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Fatalf("can't read state %v", err)
+	}
+	defer s.Close()
+
+	for {
+		n, err := io.CopyN(s, f, *checkpoint)
+		if err != nil && err != io.EOF {
+			log.Fatalf("can't sign %s %v", *inFile, err)
+		}
+		if n < *checkpoint {
+			break
+		}
+		state, err := s.Checkpoint()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeAtomic(*stateFile, state); err != nil {
+			log.Fatalf("can't write state %v", err)
+		}
+		log.Printf("checkpoint at offset %d", s.Offset())
+		if *stopAfter > 0 && s.Offset() >= *stopAfter {
+			log.Fatalf("stopping after %d bytes, run again to resume", s.Offset())
+		}
+	}
+
+	log.Printf("======= sign ========")
+	sig, err := s.Sign()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*outFile, sig, 0644); err != nil {
+		log.Fatalf("can't write signature %v", err)
+	}
+	if err := os.Remove(*stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("can't remove state %v", err)
+	}
+	fmt.Printf("signed %d bytes, signature %s\n", fi.Size(), *outFile)
+
+	if fi.Size() > *verifyLimit {
+		return
+	}
+	log.Printf("======= verify ========")
+	message, err := os.ReadFile(*inFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pub, err := k.PublicKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := mldsa.Verify(pub, message, sig, &mldsa.Options{Context: *context}); err != nil {
+		log.Fatalf("signature does not verify %v", err)
+	}
+	fmt.Println("signature verified")
+}
+
+// writeAtomic replaces name so a crash leaves either the old or the new state.
+func writeAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
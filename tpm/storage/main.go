@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"flag"
+	"log"
+
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	tpmPath        = flag.String("tpm-path", "127.0.0.1:2321", "TPM to use: /dev/tpmrm0, host:port, mssim://host:port, swtpm://host:port or fake")
+	mode           = flag.String("mode", "create", "create or load")
+	parentHandle   = flag.Uint("parent-handle", 0, "persistent handle of an ML-KEM storage parent (optional, overrides the mlkem SRK)")
+	kemParameter   = flag.Int("mlkem-parameter-set", 768, "ML-KEM child parameter set: 512, 768 or 1024")
+	dsaParameter   = flag.Int("mldsa-parameter-set", 65, "ML-DSA child parameter set: 44, 65 or 87")
+	kemPublicFile  = flag.String("mlkem-public", "mlkem.pub", "TPM2B_PUBLIC blob of the mlkem child")
+	kemPrivateFile = flag.String("mlkem-private", "mlkem.priv", "TPM2B_PRIVATE blob of the mlkem child")
+	dsaPublicFile  = flag.String("mldsa-public", "mldsa.pub", "TPM2B_PUBLIC blob of the mldsa child")
+	dsaPrivateFile = flag.String("mldsa-private", "mldsa.priv", "TPM2B_PRIVATE blob of the mldsa child")
+	dataToSign     = flag.String("data", "foo", "data to sign")
+)
+
+func main() {
+	flag.Parse()
+
+	log.Println("======= Init  ========")
+
+	rwc, err := tpmpqc.OpenTPM(*tpmPath)
+	if err != nil {
+		log.Fatalf("can't open TPM %q: %v", *tpmPath, err)
+	}
+	defer func() {
+		rwc.Close()
+	}()
+
+	rwr := transport.FromReadWriter(rwc)
+
+	log.Printf("======= createPrimary ML-KEM storage key ========")
+	parent, closeParent, err := tpmpqc.SRK(rwr, tpmpqc.SRKTypeMLKEM, uint32(*parentHandle))
+	if err != nil {
+		log.Fatalf("can't create primary %v", err)
+	}
+	defer closeParent()
+	log.Printf("parent name %x", parent.Name.Buffer)
+
+	switch *mode {
+	case "create":
+		createChildren(rwr, parent)
+	case "load":
+		loadChildren(rwr, parent)
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+func createChildren(rwr transport.TPM, parent tpm2.NamedHandle) {
+	kps, err := tpmpqc.MLKEMParameterSet(*kemParameter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dps, err := tpmpqc.MLDSAParameterSet(*dsaParameter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("======= create ML-KEM-%d child ========", *kemParameter)
+	kk, err := tpmpqc.CreateKEMKey(rwr, parent, kps, nil)
+	if err != nil {
+		log.Fatalf("can't create mlkem %v", err)
+	}
+	defer kk.Close()
+	if err := kk.SaveFiles(*kemPublicFile, *kemPrivateFile); err != nil {
+		log.Fatalf("can't save key %v", err)
+	}
+
+	log.Printf("======= create ML-DSA-%d child ========", *dsaParameter)
+	sk, err := tpmpqc.CreateSigningKey(rwr, parent, dps, nil)
+	if err != nil {
+		log.Fatalf("can't create mldsa %v", err)
+	}
+	defer sk.Close()
+	if err := sk.SaveFiles(*dsaPublicFile, *dsaPrivateFile); err != nil {
+		log.Fatalf("can't save key %v", err)
+	}
+
+	useChildren(kk, sk)
+}
+
+func loadChildren(rwr transport.TPM, parent tpm2.NamedHandle) {
+	log.Printf("======= load children ========")
+	kk, err := tpmpqc.LoadKEMKeyFiles(rwr, parent, *kemPublicFile, *kemPrivateFile)
+	if err != nil {
+		log.Fatalf("can't load mlkem %v", err)
+	}
+	defer kk.Close()
+	sk, err := tpmpqc.LoadSigningKeyFiles(rwr, parent, *dsaPublicFile, *dsaPrivateFile)
+	if err != nil {
+		log.Fatalf("can't load mldsa %v", err)
+	}
+	defer sk.Close()
+
+	useChildren(kk, sk)
+}
+
+// useChildren checks the loaded children work: a decapsulation and a signature.
+func useChildren(kk *tpmpqc.KEMKey, sk *tpmpqc.SigningKey) {
+	log.Printf("======= decapsulate ========")
+	ek := kk.Encapsulator()
+	if ek == nil {
+		log.Fatalf("can't read encapsulation key")
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+	ss, err := kk.Decapsulate(ciphertext)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(ss, sharedSecret) {
+		log.Fatalf("shared secrets don't match")
+	}
+	log.Printf("shared secrets match")
+
+	log.Printf("======= sign ========")
+	sig, err := sk.Sign(nil, []byte(*dataToSign), crypto.Hash(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sk.Verify([]byte(*dataToSign), sig, nil); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("signature verified")
+}
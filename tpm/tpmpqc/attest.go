@@ -0,0 +1,206 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// MLDSAAKTemplate returns the template for a restricted ML-DSA signing key.  Restricted keys only sign
+// structures the TPM generated itself (TPMS_ATTEST) so a signature can't be forged with TPM2_Sign*.
+func MLDSAAKTemplate(parameterSet tpm2.TPMMLDSAParameter) tpm2.TPMTPublic {
+	t := MLDSATemplate(parameterSet)
+	t.ObjectAttributes.Restricted = true
+	return t
+}
+
+// CreateAttestationKey creates a restricted ML-DSA key under parent and loads it.
+func CreateAttestationKey(rwr transport.TPM, parent tpm2.NamedHandle, parameterSet tpm2.TPMMLDSAParameter) (*SigningKey, error) {
+	k, err := createKey(rwr, parent, MLDSAAKTemplate(parameterSet), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
+
+// TPMPublic returns the key's TPM2B_PUBLIC.  Public is taken by crypto.Signer, and verifiers need the public
+// area, not just the ML-DSA key, to check an attestation key is restricted.
+func (k *SigningKey) TPMPublic() tpm2.TPM2BPublic {
+	return k.key.Public
+}
+
+// Attestation is a TPMS_ATTEST as returned by the TPM and its ML-DSA signature.
+type Attestation struct {
+	// Attest is the marshalled TPMS_ATTEST, the message the AK signed
+	Attest    []byte
+	Signature []byte
+}
+
+func attestation(attest tpm2.TPM2BAttest, sig tpm2.TPMTSignature) (*Attestation, error) {
+	s, err := sig.Signature.MLDSA()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get signature %v", err)
+	}
+	return &Attestation{
+		Attest:    attest.Bytes(),
+		Signature: s.Buffer,
+	}, nil
+}
+
+func (k *SigningKey) signScheme() tpm2.TPMTSigScheme {
+	// ML-DSA keys carry no scheme, the TPM uses the key's parameter set
+	return tpm2.TPMTSigScheme{
+		Scheme: tpm2.TPMAlgNull,
+	}
+}
+
+// Quote runs TPM2_Quote over the sha256 bank values of pcrs with nonce as qualifyingData.
+func (k *SigningKey) Quote(pcrs []uint, nonce []byte) (*Attestation, error) {
+	rsp, err := tpm2.Quote{
+		SignHandle: k.authHandle(),
+		QualifyingData: tpm2.TPM2BData{
+			Buffer: nonce,
+		},
+		InScheme:  k.signScheme(),
+		PCRSelect: pcrSelection(pcrs),
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't quote %v", err)
+	}
+	return attestation(rsp.Quoted, rsp.Signature)
+}
+
+// Certify runs TPM2_Certify over the loaded object with nonce as qualifyingData.  object must use an empty
+// auth value.
+func (k *SigningKey) Certify(object tpm2.NamedHandle, nonce []byte) (*Attestation, error) {
+	rsp, err := tpm2.Certify{
+		ObjectHandle: tpm2.AuthHandle{
+			Handle: object.Handle,
+			Name:   object.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		SignHandle: k.authHandle(),
+		QualifyingData: tpm2.TPM2BData{
+			Buffer: nonce,
+		},
+		InScheme: k.signScheme(),
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't certify %v", err)
+	}
+	return attestation(rsp.CertifyInfo, rsp.Signature)
+}
+
+// attestationKey checks that akPublic is a restricted, fixedTPM ML-DSA signing key and returns its public
+// key.  Only a restricted key is known to sign nothing but the TPMS_ATTEST structures the TPM generated;
+// an ordinary ML-DSA key could sign a made up one.
+func attestationKey(akPublic tpm2.TPM2BPublic) (*mldsa.PublicKey, error) {
+	pub, err := akPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read attestation key public %v", err)
+	}
+	if pub.Type != tpm2.TPMAlgMLDSA {
+		return nil, fmt.Errorf("tpmpqc: attestation key has type %v, want ML-DSA", pub.Type)
+	}
+	a := pub.ObjectAttributes
+	if !a.Restricted || !a.SignEncrypt || !a.FixedTPM {
+		return nil, fmt.Errorf("tpmpqc: attestation key is not a restricted, fixedTPM signing key")
+	}
+	return (&SigningKey{&key{public: pub}}).PublicKey()
+}
+
+// verifyAttestation checks the signature, the attestation type and the nonce.  It does not need a TPM.
+func verifyAttestation(ak *mldsa.PublicKey, a *Attestation, nonce []byte, typ tpm2.TPMST) (*tpm2.TPMSAttest, error) {
+	if err := mldsa.Verify(ak, a.Attest, a.Signature, &mldsa.Options{}); err != nil {
+		return nil, fmt.Errorf("tpmpqc: attestation signature does not verify %v", err)
+	}
+	// Unmarshal checks the TPM_GENERATED_VALUE magic
+	attest, err := tpm2.Unmarshal[tpm2.TPMSAttest](a.Attest)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal TPMS_ATTEST %v", err)
+	}
+	if attest.Type != typ {
+		return nil, fmt.Errorf("tpmpqc: unexpected attestation type %v", attest.Type)
+	}
+	if !bytes.Equal(attest.ExtraData.Buffer, nonce) {
+		return nil, fmt.Errorf("tpmpqc: nonce does not match")
+	}
+	return attest, nil
+}
+
+// VerifyQuote checks a quote made by the attestation key akPublic with nonce and returns the quoted PCR
+// digest.  The quote must cover exactly the sha256 bank PCRs pcrs.  If pcrValues is not nil it must hold
+// their values in ascending PCR order; the quoted digest is compared against them.
+//
+// akPublic is the AK's public area as the verifier knows it, eg from enrollment or credential activation;
+// it must be a restricted, fixedTPM ML-DSA key.
+func VerifyQuote(akPublic tpm2.TPM2BPublic, a *Attestation, nonce []byte, pcrs []uint, pcrValues [][]byte) (*tpm2.TPMSQuoteInfo, error) {
+	ak, err := attestationKey(akPublic)
+	if err != nil {
+		return nil, err
+	}
+	attest, err := verifyAttestation(ak, a, nonce, tpm2.TPMSTAttestQuote)
+	if err != nil {
+		return nil, err
+	}
+	q, err := attest.Attested.Quote()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read quote %v", err)
+	}
+	pcrs = normalizePCRs(pcrs)
+	if !bytes.Equal(tpm2.Marshal(q.PCRSelect), tpm2.Marshal(pcrSelection(pcrs))) {
+		return nil, fmt.Errorf("tpmpqc: quoted PCR selection does not match PCRs %v", pcrs)
+	}
+	if pcrValues != nil {
+		if len(pcrValues) != len(pcrs) {
+			return nil, fmt.Errorf("tpmpqc: got %d PCR values for %d PCRs", len(pcrValues), len(pcrs))
+		}
+		h := sha256.New()
+		for _, v := range pcrValues {
+			h.Write(v)
+		}
+		if !bytes.Equal(h.Sum(nil), q.PCRDigest.Buffer) {
+			return nil, fmt.Errorf("tpmpqc: PCR digest does not match the PCR values")
+		}
+	}
+	return q, nil
+}
+
+// VerifyCertify checks a certification made by the attestation key akPublic with nonce and returns the
+// certified object's name.  The name must match public and public must be a fixedTPM, fixedParent key
+// generated in the TPM, which proves that key lives in the same TPM as the AK and can't leave it.
+//
+// akPublic must be a restricted, fixedTPM ML-DSA key, see VerifyQuote.
+func VerifyCertify(akPublic tpm2.TPM2BPublic, a *Attestation, nonce []byte, public tpm2.TPM2BPublic) (tpm2.TPM2BName, error) {
+	ak, err := attestationKey(akPublic)
+	if err != nil {
+		return tpm2.TPM2BName{}, err
+	}
+	attest, err := verifyAttestation(ak, a, nonce, tpm2.TPMSTAttestCertify)
+	if err != nil {
+		return tpm2.TPM2BName{}, err
+	}
+	c, err := attest.Attested.Certify()
+	if err != nil {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't read certify info %v", err)
+	}
+	name, err := publicName(public)
+	if err != nil {
+		return tpm2.TPM2BName{}, err
+	}
+	if !bytes.Equal(name.Buffer, c.Name.Buffer) {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: certified name does not match the public key")
+	}
+	pub, err := public.Contents()
+	if err != nil {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	if a := pub.ObjectAttributes; !a.FixedTPM || !a.FixedParent || !a.SensitiveDataOrigin {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: certified key is not bound to the TPM")
+	}
+	return c.Name, nil
+}
@@ -0,0 +1,194 @@
+package tpmpqc
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// MLParameterSets returns the TPMA_ML_PARAMETER_SET of the TPM, read with
+// TPM2_GetCapability(TPM_CAP_TPM_PROPERTIES, TPM_PT_ML_PARAMETER_SETS).  TPMs without PQC support don't
+// report the property and no parameter sets are returned.
+//
+//	https://trustedcomputinggroup.org/wp-content/uploads/Trusted-Platform-Module-2.0-Library-Part-2-Structures_Version-185_pub.pdf  8.13
+func MLParameterSets(rwr transport.TPM) (*tpm2.TPMAMLParameterSet, error) {
+	getRsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapTPMProperties,
+		Property:      uint32(tpm2.TPMPTMLParameterSet),
+		PropertyCount: 1,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get capabilities %v", err)
+	}
+	tp, err := getRsp.CapabilityData.Data.TPMProperties()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read capabilities %v", err)
+	}
+	// the TPM returns the next property if the requested one isn't implemented
+	if len(tp.TPMProperty) == 0 || tp.TPMProperty[0].Property != tpm2.TPMPTMLParameterSet {
+		return &tpm2.TPMAMLParameterSet{}, nil
+	}
+	f, err := tpm2.Unmarshal[tpm2.TPMAMLParameterSet](binary.BigEndian.AppendUint32(nil, tp.TPMProperty[0].Value))
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read TPMA_ML_PARAMETER_SET %v", err)
+	}
+	return f, nil
+}
+
+// SupportsExternalMu reports whether the TPM allows ML-DSA keys with allowExternalMu, which is
+// required for TPM2_SignDigest and TPM2_VerifyDigestSignature.
+func SupportsExternalMu(rwr transport.TPM) (bool, error) {
+	f, err := MLParameterSets(rwr)
+	if err != nil {
+		return false, err
+	}
+	return f.ExtMu, nil
+}
+
+// Capabilities summarizes the PQC support of a TPM.
+type Capabilities struct {
+	// ParameterSets is the TPMA_ML_PARAMETER_SET of the TPM, reported as its raw value
+	ParameterSets      tpm2.TPMAMLParameterSet `json:"-"`
+	RawParameterSets   uint32                  `json:"parameter_sets"`
+	MLKEMParameterSets []int                   `json:"mlkem_parameter_sets"`
+	MLDSAParameterSets []int                   `json:"mldsa_parameter_sets"`
+	ExternalMu         bool                    `json:"external_mu"`
+	// InputBuffer is TPM_PT_INPUT_BUFFER, the largest TPM2B_MAX_BUFFER the TPM accepts
+	InputBuffer int `json:"input_buffer"`
+	// MaxMLDSASignatureSize is the signature size of the largest supported ML-DSA parameter set
+	MaxMLDSASignatureSize int `json:"max_mldsa_signature_size"`
+	// Algorithms are the PQC algorithms listed in TPM_CAP_ALGS
+	Algorithms []string `json:"algorithms"`
+	// Commands are the PQC commands listed in TPM_CAP_COMMANDS
+	Commands []string `json:"commands"`
+}
+
+// SupportsPQC reports whether the TPM can hold ML-KEM or ML-DSA keys.
+func (c *Capabilities) SupportsPQC() bool {
+	return len(c.MLKEMParameterSets) > 0 || len(c.MLDSAParameterSets) > 0
+}
+
+var pqcAlgorithms = []struct {
+	alg  tpm2.TPMAlgID
+	name string
+}{
+	{tpm2.TPMAlgMLKEM, "mlkem"},
+	{tpm2.TPMAlgMLDSA, "mldsa"},
+	{tpm2.TPMAlgHASHMLDSA, "hash_mldsa"},
+}
+
+var pqcCommands = []struct {
+	cc   tpm2.TPMCC
+	name string
+}{
+	{tpm2.TPMCCVerifySequenceComplete, "VerifySequenceComplete"},
+	{tpm2.TPMCCSignSequenceComplete, "SignSequenceComplete"},
+	{tpm2.TPMCCVerifyDigestSignature, "VerifyDigestSignature"},
+	{tpm2.TPMCCSignDigest, "SignDigest"},
+	{tpm2.TPMCCEncapsulate, "Encapsulate"},
+	{tpm2.TPMCCDecapsulate, "Decapsulate"},
+	{tpm2.TPMCCVerifySequenceStart, "VerifySequenceStart"},
+	{tpm2.TPMCCSignSequenceStart, "SignSequenceStart"},
+}
+
+// ML-DSA signature sizes, FIPS 204 Table 2
+var mldsaSignatureSizes = map[int]int{
+	44: 2420,
+	65: 3309,
+	87: 4627,
+}
+
+// ReadCapabilities probes TPM_PT_ML_PARAMETER_SETS, TPM_PT_INPUT_BUFFER, TPM_CAP_ALGS and TPM_CAP_COMMANDS.
+func ReadCapabilities(rwr transport.TPM) (*Capabilities, error) {
+	c := &Capabilities{
+		MLKEMParameterSets: []int{},
+		MLDSAParameterSets: []int{},
+		Algorithms:         []string{},
+		Commands:           []string{},
+	}
+
+	f, err := MLParameterSets(rwr)
+	if err != nil {
+		return nil, err
+	}
+	c.ParameterSets = *f
+	c.RawParameterSets = binary.BigEndian.Uint32(tpm2.Marshal(*f))
+	for _, p := range []struct {
+		enabled bool
+		size    int
+	}{{f.MLKEM512, 512}, {f.MLKEM768, 768}, {f.MLKEM1024, 1024}} {
+		if p.enabled {
+			c.MLKEMParameterSets = append(c.MLKEMParameterSets, p.size)
+		}
+	}
+	for _, p := range []struct {
+		enabled bool
+		size    int
+	}{{f.MLDSA44, 44}, {f.MLDSA65, 65}, {f.MLDSA87, 87}} {
+		if p.enabled {
+			c.MLDSAParameterSets = append(c.MLDSAParameterSets, p.size)
+			c.MaxMLDSASignatureSize = mldsaSignatureSizes[p.size]
+		}
+	}
+	c.ExternalMu = f.ExtMu
+
+	propRsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapTPMProperties,
+		Property:      uint32(tpm2.TPMPTInputBuffer),
+		PropertyCount: 1,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get capabilities %v", err)
+	}
+	props, err := propRsp.CapabilityData.Data.TPMProperties()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read capabilities %v", err)
+	}
+	if len(props.TPMProperty) > 0 && props.TPMProperty[0].Property == tpm2.TPMPTInputBuffer {
+		c.InputBuffer = int(props.TPMProperty[0].Value)
+	}
+
+	algRsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapAlgs,
+		Property:      uint32(tpm2.TPMAlgMLKEM),
+		PropertyCount: uint32(len(pqcAlgorithms)),
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get algorithms %v", err)
+	}
+	algs, err := algRsp.CapabilityData.Data.Algorithms()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read algorithms %v", err)
+	}
+	for _, a := range pqcAlgorithms {
+		for _, p := range algs.AlgProperties {
+			if p.Alg == a.alg {
+				c.Algorithms = append(c.Algorithms, a.name)
+			}
+		}
+	}
+
+	// the PQC commands are contiguous, 0x1A3 to 0x1AA
+	ccRsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapCommands,
+		Property:      uint32(pqcCommands[0].cc),
+		PropertyCount: uint32(len(pqcCommands)),
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get commands %v", err)
+	}
+	ccs, err := ccRsp.CapabilityData.Data.Command()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read commands %v", err)
+	}
+	for _, cmd := range pqcCommands {
+		for _, a := range ccs.CommandAttributes {
+			if tpm2.TPMCC(a.CommandIndex) == cmd.cc {
+				c.Commands = append(c.Commands, cmd.name)
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,48 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// CreateCertificateRequest returns a DER PKCS#10 request for the TPM ML-DSA key.  The request is
+// signed inside the TPM.
+func CreateCertificateRequest(k *SigningKey, template *x509.CertificateRequest) ([]byte, error) {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, k)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't create certificate request %v", err)
+	}
+	return csr, nil
+}
+
+// checkCertifiedKey checks that the certified public area is a key of type alg whose public key is the
+// SubjectPublicKeyInfo spki.  VerifyCertify already checked it is bound to the TPM.
+func checkCertifiedKey(public tpm2.TPM2BPublic, alg tpm2.TPMAlgID, spki []byte) error {
+	pub, err := public.Contents()
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	if pub.Type != alg {
+		return fmt.Errorf("tpmpqc: certified key has type %v, want %v", pub.Type, alg)
+	}
+	var certified []byte
+	switch alg {
+	case tpm2.TPMAlgMLKEM:
+		certified, err = (&KEMKey{&key{public: pub}}).MarshalPKIXPublicKey()
+	case tpm2.TPMAlgMLDSA:
+		certified, err = (&SigningKey{&key{public: pub}}).MarshalPKIXPublicKey()
+	default:
+		err = fmt.Errorf("tpmpqc: unsupported key type %v", alg)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certified, spki) {
+		return fmt.Errorf("tpmpqc: requested public key does not match the certified key")
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package tpmpqc
+
+import (
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+
+	"pqcca"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// CSR attestation as in draft-ietf-lamps-csr-attestation: the PKCS#10 request carries an evidence
+// attribute with a TPM2_Certify statement over the requested key and the attestation key's certificates.
+//
+//	EvidenceBundles ::= SEQUENCE SIZE (1..MAX) OF EvidenceBundle
+//	EvidenceBundle ::= SEQUENCE {
+//	  evidences SEQUENCE SIZE (1..MAX) OF EvidenceStatement,
+//	  certs     SEQUENCE SIZE (1..MAX) OF CertificateChoices OPTIONAL }
+//	EvidenceStatement ::= SEQUENCE {
+//	  type OBJECT IDENTIFIER,
+//	  stmt ANY DEFINED BY type,
+//	  hint UTF8String OPTIONAL }
+//
+// The statement is the TCG TcgAttestCertify (tcg-attest-tpm-certify, 2.23.133.20.1):
+//
+//	TcgAttestCertify ::= SEQUENCE {
+//	  tpmSAttest OCTET STRING, -- TPMS_ATTEST
+//	  signature  OCTET STRING, -- the attestation key's signature over tpmSAttest
+//	  tpmTPublic OCTET STRING OPTIONAL } -- TPMT_PUBLIC of the certified key
+//
+// The qualifyingData of the statement is sha256(nonce || CertificationRequestInfo without the evidence
+// attribute), so the statement covers the subject, the public key and the requested extensions.  ML-KEM
+// keys can't sign the request, it is signed with id-alg-noSignature and the evidence is the only proof
+// that the key exists in the TPM and the only thing binding the request to it; those requests need a
+// nonce so old evidence can't be replayed.
+
+var (
+	oidAttributeEvidence         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 59}
+	oidAttributeExtensionRequest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 14}
+	oidTcgAttestCertify          = asn1.ObjectIdentifier{2, 23, 133, 20, 1}
+	oidNoSignature               = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 6, 2}
+)
+
+// OIDExtKeyUsageAttestationKey is tcg-kp-AIKCertificate, the extended key usage of TCG attestation key
+// certificates.  VerifyAttestedCertificateRequest only accepts AK certificates with it.
+var OIDExtKeyUsageAttestationKey = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+
+type evidenceStatement struct {
+	Type asn1.ObjectIdentifier
+	Stmt asn1.RawValue
+	Hint string `asn1:"optional,utf8"`
+}
+
+type evidenceBundle struct {
+	Evidences []evidenceStatement
+	Certs     []asn1.RawValue `asn1:"optional"`
+}
+
+type tcgAttestCertify struct {
+	TPMSAttest []byte
+	Signature  []byte
+	TPMTPublic []byte `asn1:"optional"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type certificationRequestInfo struct {
+	Raw        asn1.RawContent
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+type certificationRequest struct {
+	Info               certificationRequestInfo
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+// evidenceQualifyingData returns sha256(nonce || CertificationRequestInfo), where the info has attrs, the
+// request's attributes other than the evidence.
+func evidenceQualifyingData(nonce []byte, version int, subject, spki []byte, attrs []asn1.RawValue) ([]byte, error) {
+	info, err := asn1.Marshal(certificationRequestInfo{
+		Version:    version,
+		Subject:    asn1.RawValue{FullBytes: subject},
+		PublicKey:  asn1.RawValue{FullBytes: spki},
+		Attributes: attrs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal request info %v", err)
+	}
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(info)
+	return h.Sum(nil), nil
+}
+
+// evidenceAttribute certifies object with ak and returns the evidence attribute.  chain holds the
+// attestation key's certificate followed by any intermediates.
+func evidenceAttribute(ak *SigningKey, object *key, qualifyingData []byte, chain []*x509.Certificate) (asn1.RawValue, error) {
+	a, err := ak.Certify(object.Handle(), qualifyingData)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	stmt, err := asn1.Marshal(tcgAttestCertify{
+		TPMSAttest: a.Attest,
+		Signature:  a.Signature,
+		TPMTPublic: tpm2.Marshal(object.public),
+	})
+	if err != nil {
+		return asn1.RawValue{}, fmt.Errorf("tpmpqc: can't marshal evidence %v", err)
+	}
+	var certs []asn1.RawValue
+	for _, c := range chain {
+		certs = append(certs, asn1.RawValue{FullBytes: c.Raw})
+	}
+	bundles, err := asn1.Marshal([]evidenceBundle{
+		{
+			Evidences: []evidenceStatement{
+				{
+					Type: oidTcgAttestCertify,
+					Stmt: asn1.RawValue{FullBytes: stmt},
+					Hint: "tpm",
+				},
+			},
+			Certs: certs,
+		},
+	})
+	if err != nil {
+		return asn1.RawValue{}, fmt.Errorf("tpmpqc: can't marshal evidence %v", err)
+	}
+	attr, err := asn1.Marshal(attribute{
+		Type:   oidAttributeEvidence,
+		Values: []asn1.RawValue{{FullBytes: bundles}},
+	})
+	if err != nil {
+		return asn1.RawValue{}, fmt.Errorf("tpmpqc: can't marshal evidence attribute %v", err)
+	}
+	return asn1.RawValue{FullBytes: attr}, nil
+}
+
+// createAttestedRequest builds and signs the request.  For ML-KEM keys sign is nil and the request
+// uses id-alg-noSignature.
+func createAttestedRequest(template *x509.CertificateRequest, object *key, spki []byte, sign func([]byte) ([]byte, error), ak *SigningKey, nonce []byte, chain []*x509.Certificate) ([]byte, error) {
+	subject := template.RawSubject
+	if len(subject) == 0 {
+		var err error
+		subject, err = asn1.Marshal(template.Subject.ToRDNSequence())
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't marshal subject %v", err)
+		}
+	}
+
+	var attrs []asn1.RawValue
+	if san, ok, err := pqcca.SubjectAltName(pqcca.Request{
+		DNSNames:       template.DNSNames,
+		EmailAddresses: template.EmailAddresses,
+		IPAddresses:    template.IPAddresses,
+		URIs:           template.URIs,
+	}, subject); err != nil {
+		return nil, err
+	} else if ok {
+		exts, err := asn1.Marshal([]pkix.Extension{san})
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't marshal extensions %v", err)
+		}
+		attr, err := asn1.Marshal(attribute{
+			Type:   oidAttributeExtensionRequest,
+			Values: []asn1.RawValue{{FullBytes: exts}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't marshal extension request %v", err)
+		}
+		attrs = append(attrs, asn1.RawValue{FullBytes: attr})
+	}
+	qualifyingData, err := evidenceQualifyingData(nonce, 0, subject, spki, attrs)
+	if err != nil {
+		return nil, err
+	}
+	evidence, err := evidenceAttribute(ak, object, qualifyingData, chain)
+	if err != nil {
+		return nil, err
+	}
+	attrs = append(attrs, evidence)
+
+	info, err := asn1.Marshal(certificationRequestInfo{
+		Subject:    asn1.RawValue{FullBytes: subject},
+		PublicKey:  asn1.RawValue{FullBytes: spki},
+		Attributes: attrs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal request info %v", err)
+	}
+
+	sigAlg := pkix.AlgorithmIdentifier{Algorithm: oidNoSignature}
+	var sig []byte
+	if sign != nil {
+		var pki SubjectPublicKeyInfo
+		if _, err := asn1.Unmarshal(spki, &pki); err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse public key %v", err)
+		}
+		// ML-DSA uses the same OID for the key and the signature algorithm
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: pki.Algorithm.Algorithm}
+		sig, err = sign(info)
+		if err != nil {
+			return nil, err
+		}
+	}
+	csr, err := asn1.Marshal(certificationRequest{
+		Info:               certificationRequestInfo{Raw: info},
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal request %v", err)
+	}
+	return csr, nil
+}
+
+// CreateAttestedCertificateRequest returns a DER PKCS#10 request for the ML-DSA key, signed in the TPM,
+// with a TPM2_Certify statement by ak as evidence.  nonce is the verifier's freshness nonce (may be empty),
+// akChain is the attestation key's certificate followed by any intermediates.
+func (k *SigningKey) CreateAttestedCertificateRequest(template *x509.CertificateRequest, ak *SigningKey, nonce []byte, akChain []*x509.Certificate) ([]byte, error) {
+	spki, err := k.MarshalPKIXPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	sign := func(info []byte) ([]byte, error) {
+		return k.Sign(rand.Reader, info, &mldsa.Options{})
+	}
+	return createAttestedRequest(template, k.key, spki, sign, ak, nonce, akChain)
+}
+
+// CreateAttestedCertificateRequest returns a DER PKCS#10 request for the ML-KEM key with a TPM2_Certify
+// statement by ak as evidence.  A KEM can't sign so the request uses id-alg-noSignature, and nonce, the
+// verifier's freshness nonce, is required.
+func (k *KEMKey) CreateAttestedCertificateRequest(template *x509.CertificateRequest, ak *SigningKey, nonce []byte, akChain []*x509.Certificate) ([]byte, error) {
+	if len(nonce) == 0 {
+		return nil, fmt.Errorf("tpmpqc: ML-KEM requests need a nonce")
+	}
+	spki, err := k.MarshalPKIXPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return createAttestedRequest(template, k.key, spki, nil, ak, nonce, akChain)
+}
+
+// AttestedCertificateRequest is a request whose evidence was verified by VerifyAttestedCertificateRequest.
+type AttestedCertificateRequest struct {
+	*x509.CertificateRequest
+	// KeyType is tpm2.TPMAlgMLDSA or tpm2.TPMAlgMLKEM
+	KeyType tpm2.TPMAlgID
+	// AttestationKey is the certificate of the key that signed the evidence
+	AttestationKey *x509.Certificate
+	// Name is the TPM name of the requested key
+	Name tpm2.TPM2BName
+}
+
+// VerifyAttestedCertificateRequest is the CA side check of a request made with CreateAttestedCertificateRequest.
+// It verifies the request signature (ML-DSA keys), the attestation key's certificate chain to roots, that
+// the TPM2_Certify statement covers nonce and the rest of the request and that the certified key is the
+// requested, TPM-bound key.  ML-KEM requests aren't signed and are refused without a nonce.
+//
+// roots must be a pool dedicated to the CAs that certify attestation keys, and the AK certificate must
+// have OIDExtKeyUsageAttestationKey as its only extended key usage.  TcgAttestCertify doesn't carry the
+// AK's public area, akPublic returns it for the verified AK certificate, typically from the AK's
+// enrollment, so the AK can be checked to be a restricted, fixedTPM key.
+func VerifyAttestedCertificateRequest(der []byte, roots, intermediates *x509.CertPool, nonce []byte, akPublic func(akCert *x509.Certificate) (tpm2.TPM2BPublic, error)) (*AttestedCertificateRequest, error) {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse request %v", err)
+	}
+	var req certificationRequest
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse request %v", err)
+	}
+	var pki SubjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(csr.RawSubjectPublicKeyInfo, &pki); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse public key %v", err)
+	}
+
+	var keyType tpm2.TPMAlgID
+	switch oid := pki.Algorithm.Algorithm; {
+	case oid.Equal(mlkem512OID), oid.Equal(mlkem768OID), oid.Equal(mlkem1024OID):
+		keyType = tpm2.TPMAlgMLKEM
+		if !req.SignatureAlgorithm.Algorithm.Equal(oidNoSignature) {
+			return nil, fmt.Errorf("tpmpqc: unexpected signature algorithm %v for ML-KEM", req.SignatureAlgorithm.Algorithm)
+		}
+		if len(nonce) == 0 {
+			return nil, fmt.Errorf("tpmpqc: ML-KEM requests need a nonce")
+		}
+	default:
+		if _, ok := csr.PublicKey.(*mldsa.PublicKey); !ok {
+			return nil, fmt.Errorf("tpmpqc: unsupported public key %v", oid)
+		}
+		keyType = tpm2.TPMAlgMLDSA
+		if err := csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("tpmpqc: request signature does not verify %v", err)
+		}
+	}
+
+	var bundles []evidenceBundle
+	var others []asn1.RawValue
+	found := false
+	for _, raw := range req.Info.Attributes {
+		var attr attribute
+		if _, err := asn1.Unmarshal(raw.FullBytes, &attr); err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse attribute %v", err)
+		}
+		if !attr.Type.Equal(oidAttributeEvidence) {
+			others = append(others, raw)
+			continue
+		}
+		if found || len(attr.Values) != 1 {
+			return nil, fmt.Errorf("tpmpqc: expected a single evidence attribute")
+		}
+		found = true
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &bundles); err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse evidence %v", err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("tpmpqc: request has no evidence")
+	}
+	qualifyingData, err := evidenceQualifyingData(nonce, req.Info.Version, req.Info.Subject.FullBytes, req.Info.PublicKey.FullBytes, others)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range bundles {
+		if len(b.Certs) == 0 {
+			continue
+		}
+		akCert, err := x509.ParseCertificate(b.Certs[0].FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse attestation key certificate %v", err)
+		}
+		pool := x509.NewCertPool()
+		if intermediates != nil {
+			pool = intermediates.Clone()
+		}
+		for _, c := range b.Certs[1:] {
+			ic, err := x509.ParseCertificate(c.FullBytes)
+			if err != nil {
+				return nil, fmt.Errorf("tpmpqc: can't parse intermediate certificate %v", err)
+			}
+			pool.AddCert(ic)
+		}
+		if _, err := akCert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: pool,
+			// the AK usage is checked below, crypto/x509 doesn't know tcg-kp-AIKCertificate
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return nil, fmt.Errorf("tpmpqc: attestation key certificate does not verify %v", err)
+		}
+		if len(akCert.ExtKeyUsage) != 0 || len(akCert.UnknownExtKeyUsage) != 1 || !akCert.UnknownExtKeyUsage[0].Equal(OIDExtKeyUsageAttestationKey) {
+			return nil, fmt.Errorf("tpmpqc: attestation key certificate is not an AK certificate")
+		}
+		akTPMPublic, err := akPublic(akCert)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't get attestation key public %v", err)
+		}
+		ak, err := attestationKey(akTPMPublic)
+		if err != nil {
+			return nil, err
+		}
+		if !ak.Equal(akCert.PublicKey) {
+			return nil, fmt.Errorf("tpmpqc: attestation key public does not match its certificate")
+		}
+
+		for _, e := range b.Evidences {
+			if !e.Type.Equal(oidTcgAttestCertify) {
+				continue
+			}
+			var stmt tcgAttestCertify
+			if _, err := asn1.Unmarshal(e.Stmt.FullBytes, &stmt); err != nil {
+				return nil, fmt.Errorf("tpmpqc: can't parse TcgAttestCertify %v", err)
+			}
+			pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](stmt.TPMTPublic)
+			if err != nil {
+				return nil, fmt.Errorf("tpmpqc: can't unmarshal certified public %v", err)
+			}
+			public := tpm2.New2B(*pub)
+			name, err := VerifyCertify(akTPMPublic, &Attestation{Attest: stmt.TPMSAttest, Signature: stmt.Signature}, qualifyingData, public)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkCertifiedKey(public, keyType, csr.RawSubjectPublicKeyInfo); err != nil {
+				return nil, err
+			}
+			return &AttestedCertificateRequest{
+				CertificateRequest: csr,
+				KeyType:            keyType,
+				AttestationKey:     akCert,
+				Name:               name,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("tpmpqc: no TPM certify evidence with an attestation key certificate")
+}
@@ -0,0 +1,212 @@
+package tpmpqc
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// DuplicationPolicy returns the authPolicy which only allows TPM2_Duplicate of the key to newParent
+// (TPM2_PolicyDuplicationSelect without the object name).
+func DuplicationPolicy(newParent tpm2.TPM2BPublic) (tpm2.TPM2BDigest, error) {
+	name, err := publicName(newParent)
+	if err != nil {
+		return tpm2.TPM2BDigest{}, err
+	}
+	return branchDigest(tpm2.PolicyDuplicationSelect{
+		NewParentName: name,
+		IncludeObject: false,
+	}.Update)
+}
+
+// duplicableTemplate clears fixedTPM and fixedParent and sets the duplication policy.  userWithAuth
+// stays set so the key can still be used on the source TPM with its (empty) auth value.
+func duplicableTemplate(template tpm2.TPMTPublic, newParent tpm2.TPM2BPublic) (tpm2.TPMTPublic, error) {
+	d, err := DuplicationPolicy(newParent)
+	if err != nil {
+		return tpm2.TPMTPublic{}, err
+	}
+	template.ObjectAttributes.FixedTPM = false
+	template.ObjectAttributes.FixedParent = false
+	template.AuthPolicy = d
+	return template, nil
+}
+
+// CreateDuplicableKEMKey creates an ML-KEM key under parent which can later be duplicated to newParent.
+func CreateDuplicableKEMKey(rwr transport.TPM, parent tpm2.NamedHandle, parameterSet tpm2.TPMMLKEMParameter, newParent tpm2.TPM2BPublic) (*KEMKey, error) {
+	template, err := duplicableTemplate(MLKEMTemplate(parameterSet), newParent)
+	if err != nil {
+		return nil, err
+	}
+	k, err := createKey(rwr, parent, template, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// CreateDuplicableSigningKey creates an ML-DSA key under parent which can later be duplicated to newParent.
+func CreateDuplicableSigningKey(rwr transport.TPM, parent tpm2.NamedHandle, parameterSet tpm2.TPMMLDSAParameter, newParent tpm2.TPM2BPublic) (*SigningKey, error) {
+	template, err := duplicableTemplate(MLDSATemplate(parameterSet), newParent)
+	if err != nil {
+		return nil, err
+	}
+	k, err := createKey(rwr, parent, template, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
+
+func publicName(public tpm2.TPM2BPublic) (tpm2.TPM2BName, error) {
+	pub, err := public.Contents()
+	if err != nil {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't compute name %v", err)
+	}
+	return *name, nil
+}
+
+// DuplicationBundle is the output of TPM2_Duplicate, everything the destination needs for TPM2_Import.
+type DuplicationBundle struct {
+	// NewParentName is the name of the storage key the object was wrapped for
+	NewParentName tpm2.TPM2BName
+	Public        tpm2.TPM2BPublic
+	Duplicate     tpm2.TPM2BPrivate
+	InSymSeed     tpm2.TPM2BEncryptedSecret
+}
+
+// Duplicate wraps the key for newParent, which is typically the SRK of another TPM.
+// The key must have been created with CreateDuplicableKEMKey or CreateDuplicableSigningKey for newParent.
+func (k *key) Duplicate(newParent tpm2.TPM2BPublic) (*DuplicationBundle, error) {
+	newParentName, err := publicName(newParent)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the public part of the new parent is needed
+	l, err := tpm2.LoadExternal{
+		InPublic:  newParent,
+		Hierarchy: tpm2.TPMRHNull,
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't load new parent %v", err)
+	}
+	defer func() {
+		_, _ = tpm2.FlushContext{FlushHandle: l.ObjectHandle}.Execute(k.rwr)
+	}()
+
+	sess := tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(rwr transport.TPM, handle tpm2.TPMISHPolicy, _ tpm2.TPM2BNonce) error {
+		_, err := tpm2.PolicyDuplicationSelect{
+			PolicySession: handle,
+			ObjectName:    k.name,
+			NewParentName: newParentName,
+			IncludeObject: false,
+		}.Execute(rwr)
+		return err
+	})
+
+	dup, err := tpm2.Duplicate{
+		ObjectHandle: tpm2.AuthHandle{
+			Handle: k.handle,
+			Name:   k.name,
+			Auth:   sess,
+		},
+		NewParentHandle: tpm2.NamedHandle{
+			Handle: l.ObjectHandle,
+			Name:   l.Name,
+		},
+		Symmetric: tpm2.TPMTSymDef{
+			Algorithm: tpm2.TPMAlgNull,
+		},
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't duplicate key %v", err)
+	}
+	return &DuplicationBundle{
+		NewParentName: newParentName,
+		Public:        k.Public,
+		Duplicate:     dup.Duplicate,
+		InSymSeed:     dup.OutSymSeed,
+	}, nil
+}
+
+// Marshal returns the bundle as the four concatenated TPM2B structures.
+func (b *DuplicationBundle) Marshal() []byte {
+	var out []byte
+	out = append(out, tpm2.Marshal(b.NewParentName)...)
+	out = append(out, tpm2.Marshal(b.Public)...)
+	out = append(out, tpm2.Marshal(b.Duplicate)...)
+	out = append(out, tpm2.Marshal(b.InSymSeed)...)
+	return out
+}
+
+// UnmarshalDuplicationBundle parses the output of Marshal.
+func UnmarshalDuplicationBundle(data []byte) (*DuplicationBundle, error) {
+	var parts [4][]byte
+	for i := range parts {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("tpmpqc: truncated duplication bundle")
+		}
+		n := 2 + int(binary.BigEndian.Uint16(data))
+		if len(data) < n {
+			return nil, fmt.Errorf("tpmpqc: truncated duplication bundle")
+		}
+		parts[i], data = data[:n], data[n:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("tpmpqc: trailing data after duplication bundle")
+	}
+	name, err := tpm2.Unmarshal[tpm2.TPM2BName](parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal parent name %v", err)
+	}
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal public %v", err)
+	}
+	dup, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal duplicate %v", err)
+	}
+	seed, err := tpm2.Unmarshal[tpm2.TPM2BEncryptedSecret](parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal seed %v", err)
+	}
+	return &DuplicationBundle{
+		NewParentName: *name,
+		Public:        *public,
+		Duplicate:     *dup,
+		InSymSeed:     *seed,
+	}, nil
+}
+
+// ImportDuplicate runs TPM2_Import for the bundle under parent and returns the new key blobs.
+// parent must be the storage key the bundle was created for.
+func ImportDuplicate(rwr transport.TPM, parent tpm2.NamedHandle, b *DuplicationBundle) (tpm2.TPM2BPublic, tpm2.TPM2BPrivate, error) {
+	if len(b.NewParentName.Buffer) != 0 && string(b.NewParentName.Buffer) != string(parent.Name.Buffer) {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: bundle was wrapped for a different parent")
+	}
+	importResponse, err := tpm2.Import{
+		ParentHandle: tpm2.AuthHandle{
+			Handle: parent.Handle,
+			Name:   parent.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		ObjectPublic: b.Public,
+		Duplicate:    b.Duplicate,
+		InSymSeed:    b.InSymSeed,
+		Symmetric: tpm2.TPMTSymDef{
+			Algorithm: tpm2.TPMAlgNull,
+		},
+	}.Execute(rwr)
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't import duplicate %v", err)
+	}
+	return b.Public, importResponse.OutPrivate, nil
+}
@@ -0,0 +1,166 @@
+package tpmpqc
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// ekPolicy is PolicySecret(TPM_RH_ENDORSEMENT), policy A of the TCG EK Credential Profile (sha256).
+var ekPolicy = []byte{
+	0x83, 0x71, 0x97, 0x67, 0x44, 0x84, 0xB3, 0xF8,
+	0x1A, 0x90, 0xCC, 0x8D, 0x46, 0xA5, 0xD7, 0x24,
+	0xFD, 0x52, 0xD7, 0x6E, 0x06, 0x52, 0x0B, 0x64,
+	0xF2, 0xA1, 0xDA, 0x1B, 0x33, 0x14, 0x69, 0xAA,
+}
+
+// MLKEMEKTemplate returns an ML-KEM endorsement key template.
+//
+// The TCG EK Credential Profile doesn't assign PQC templates yet, so this follows the RSA and ECC low range
+// templates (policy A, adminWithPolicy, restricted decrypt, empty unique) with an AES-256 CFB symmetric.
+// ML-KEM-512 EKs can't be used with MakeCredential, which relies on crypto/mlkem.
+func MLKEMEKTemplate(parameterSet tpm2.TPMMLKEMParameter) tpm2.TPMTPublic {
+	return tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgMLKEM,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			AdminWithPolicy:     true,
+			Restricted:          true,
+			Decrypt:             true,
+		},
+		AuthPolicy: tpm2.TPM2BDigest{
+			Buffer: ekPolicy,
+		},
+		Parameters: tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgMLKEM,
+			&tpm2.TPMSMLKEMParms{
+				Symmetric: tpm2.TPMTSymDefObject{
+					Algorithm: tpm2.TPMAlgAES,
+					KeyBits: tpm2.NewTPMUSymKeyBits(
+						tpm2.TPMAlgAES,
+						tpm2.TPMKeyBits(256),
+					),
+					Mode: tpm2.NewTPMUSymMode(
+						tpm2.TPMAlgAES,
+						tpm2.TPMAlgCFB,
+					),
+				},
+				ParameterSet: tpm2.TPMIMLKEMParam(parameterSet),
+			},
+		),
+	}
+}
+
+// EndorsementKey is a loaded ML-KEM EK.
+type EndorsementKey struct {
+	rwr    transport.TPM
+	handle tpm2.TPMHandle
+	name   tpm2.TPM2BName
+
+	// Public is the EK public area, what the enrollment server needs for MakeCredential.
+	Public tpm2.TPM2BPublic
+}
+
+// CreateMLKEMEK creates the ML-KEM EK from MLKEMEKTemplate in the endorsement hierarchy.  Like the RSA
+// and ECC EKs it's derived from the endorsement seed, so it is the same key every time.
+func CreateMLKEMEK(rwr transport.TPM, parameterSet tpm2.TPMMLKEMParameter) (*EndorsementKey, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHEndorsement,
+		InPublic:      tpm2.New2B(MLKEMEKTemplate(parameterSet)),
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't create EK %v", err)
+	}
+	return &EndorsementKey{
+		rwr:    rwr,
+		handle: rsp.ObjectHandle,
+		name:   rsp.Name,
+		Public: rsp.OutPublic,
+	}, nil
+}
+
+// Handle returns the loaded handle and name of the EK.
+func (e *EndorsementKey) Handle() tpm2.NamedHandle {
+	return tpm2.NamedHandle{
+		Handle: e.handle,
+		Name:   e.name,
+	}
+}
+
+// Close flushes the EK.
+func (e *EndorsementKey) Close() error {
+	_, err := tpm2.FlushContext{
+		FlushHandle: e.handle,
+	}.Execute(e.rwr)
+	return err
+}
+
+// policySession satisfies the EK policy, PolicySecret with the (empty) endorsement auth.
+func (e *EndorsementKey) policySession() tpm2.Session {
+	return tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(rwr transport.TPM, handle tpm2.TPMISHPolicy, nonceTPM tpm2.TPM2BNonce) error {
+		_, err := tpm2.PolicySecret{
+			AuthHandle: tpm2.AuthHandle{
+				Handle: tpm2.TPMRHEndorsement,
+				Auth:   tpm2.PasswordAuth(nil),
+			},
+			PolicySession: handle,
+			NonceTPM:      nonceTPM,
+		}.Execute(rwr)
+		return err
+	})
+}
+
+// ActivateCredential recovers the credential made by MakeCredential for ak and this EK.  The TPM only
+// releases it if ak is loaded on the same TPM as the EK.
+func (e *EndorsementKey) ActivateCredential(ak *SigningKey, idObject, encSecret []byte) ([]byte, error) {
+	rsp, err := tpm2.ActivateCredential{
+		ActivateHandle: ak.authHandle(),
+		KeyHandle: tpm2.AuthHandle{
+			Handle: e.handle,
+			Name:   e.name,
+			Auth:   e.policySession(),
+		},
+		CredentialBlob: tpm2.TPM2BIDObject{
+			Buffer: idObject,
+		},
+		Secret: tpm2.TPM2BEncryptedSecret{
+			Buffer: encSecret,
+		},
+	}.Execute(e.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't activate credential %v", err)
+	}
+	return rsp.CertInfo.Buffer, nil
+}
+
+// MakeCredential protects credential for the key named name on the TPM with the ML-KEM EK ekPublic, the
+// software side of TPM2_MakeCredential.  The credential seed is the output of an ML-KEM encapsulation to
+// the EK, so unlike with RSA and ECC EKs nothing in the exchange relies on a classical algorithm.
+//
+// idObject and encSecret are the credentialBlob and secret of TPM2_ActivateCredential.
+func MakeCredential(ekPublic tpm2.TPM2BPublic, name tpm2.TPM2BName, credential []byte) (idObject, encSecret []byte, err error) {
+	pub, err := ekPublic.Contents()
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpmpqc: can't read EK public %v", err)
+	}
+	if pub.Type != tpm2.TPMAlgMLKEM {
+		return nil, nil, fmt.Errorf("tpmpqc: EK is %v, not ML-KEM", pub.Type)
+	}
+	if !pub.ObjectAttributes.Restricted || !pub.ObjectAttributes.Decrypt {
+		return nil, nil, fmt.Errorf("tpmpqc: EK is not a restricted decryption key")
+	}
+	ek, err := tpm2.ImportEncapsulationKey(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpmpqc: can't import EK %v", err)
+	}
+	idObject, encSecret, err = tpm2.CreateCredential(rand.Reader, ek, name.Buffer, credential)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpmpqc: can't make credential %v", err)
+	}
+	return idObject, encSecret, nil
+}
@@ -0,0 +1,292 @@
+package tpmpqc
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// oidDescription is id-at-description.  The sources a private key's seed was mixed from are kept in a
+// PKCS#8 attribute of that type as "Entropy-Sources: crypto/rand,tpm": unlike a PEM header, an
+// attribute doesn't stop openssl or x509.ParsePKCS8PrivateKey from reading the key.
+var oidDescription = asn1.ObjectIdentifier{2, 5, 4, 13}
+
+const entropySourcesPrefix = "Entropy-Sources: "
+
+// Names of the entropy sources accepted by ParseEntropySources, file sources are "file:" and a path.
+const (
+	EntropySystem = "crypto/rand"
+	EntropyTPM    = "tpm"
+	entropyFile   = "file:"
+)
+
+// EntropySource is one input of an EntropyMixer.
+type EntropySource interface {
+	io.Reader
+	// Name identifies the source in key metadata
+	Name() string
+}
+
+type systemEntropy struct{}
+
+func (systemEntropy) Read(b []byte) (int, error) { return rand.Read(b) }
+func (systemEntropy) Name() string               { return EntropySystem }
+
+// SystemEntropy reads from crypto/rand.
+func SystemEntropy() EntropySource {
+	return systemEntropy{}
+}
+
+type tpmEntropy struct {
+	rwr transport.TPM
+}
+
+// TPMEntropy reads from the TPM's RNG with TPM2_GetRandom.
+func TPMEntropy(rwr transport.TPM) EntropySource {
+	return &tpmEntropy{rwr: rwr}
+}
+
+func (t *tpmEntropy) Name() string { return EntropyTPM }
+
+// Read fills b with as many GetRandom calls as needed, a TPM returns at most a digest's worth per call.
+func (t *tpmEntropy) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		rsp, err := tpm2.GetRandom{
+			BytesRequested: uint16(min(len(b)-n, 64)),
+		}.Execute(t.rwr)
+		if err != nil {
+			return n, fmt.Errorf("tpmpqc: can't get random bytes from the TPM: %v", err)
+		}
+		if len(rsp.RandomBytes.Buffer) == 0 {
+			return n, fmt.Errorf("tpmpqc: TPM returned no random bytes")
+		}
+		n += copy(b[n:], rsp.RandomBytes.Buffer)
+	}
+	return n, nil
+}
+
+type fileEntropy struct {
+	name string
+	f    *os.File
+}
+
+// FileEntropy reads from a file, a stand-in for an external RNG such as an HSM: a device like
+// /dev/hwrng or a FIFO the HSM's tooling writes to.  The file stays open until the mixer is closed.
+func FileEntropy(path string) (EntropySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't open entropy source %v", err)
+	}
+	return &fileEntropy{name: entropyFile + path, f: f}, nil
+}
+
+func (e *fileEntropy) Name() string { return e.name }
+
+func (e *fileEntropy) Read(b []byte) (int, error) {
+	n, err := io.ReadFull(e.f, b)
+	if err != nil {
+		return n, fmt.Errorf("tpmpqc: can't read from %s: %v", e.name, err)
+	}
+	return n, nil
+}
+
+func (e *fileEntropy) Close() error {
+	return e.f.Close()
+}
+
+// ParseEntropySources opens the comma separated sources in spec, eg "crypto/rand,tpm,file:/dev/hwrng".
+// rwr is only used by the tpm source.
+func ParseEntropySources(rwr transport.TPM, spec string) ([]EntropySource, error) {
+	var sources []EntropySource
+	for name := range strings.SplitSeq(spec, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == EntropySystem:
+			sources = append(sources, SystemEntropy())
+		case name == EntropyTPM:
+			if rwr == nil {
+				closeSources(sources)
+				return nil, fmt.Errorf("tpmpqc: entropy source %q needs a TPM", name)
+			}
+			sources = append(sources, TPMEntropy(rwr))
+		case strings.HasPrefix(name, entropyFile):
+			s, err := FileEntropy(strings.TrimPrefix(name, entropyFile))
+			if err != nil {
+				closeSources(sources)
+				return nil, err
+			}
+			sources = append(sources, s)
+		default:
+			closeSources(sources)
+			return nil, fmt.Errorf("tpmpqc: unknown entropy source %q", name)
+		}
+	}
+	return sources, nil
+}
+
+func closeSources(sources []EntropySource) error {
+	var errs []error
+	for _, s := range sources {
+		if c, ok := s.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+const (
+	// bytes read from every source for each block of output, the strength of the mixer is that of the
+	// strongest source up to 256 bits
+	entropyInputSize = 32
+	// the most HKDF-SHA256 expands from one extract
+	entropyBlockSize = 255 * sha256.Size
+)
+
+var entropySalt = []byte("tpmpqc entropy mixer v1")
+
+// EntropyMixer is an io.Reader that combines its sources with HKDF-SHA256.  Every block of output is
+// extracted from fresh input of all the sources, so it's unpredictable as long as any one of them is.
+// A source that fails fails the read, the mixer doesn't fall back to the others.
+//
+// Use it wherever a key seed or signing randomness is read: the seed of ML-KEM and ML-DSA keys in
+// GenerateExternalKey or the opt_rand of hedged SLH-DSA signatures.
+type EntropyMixer struct {
+	sources []EntropySource
+	mu      sync.Mutex
+	counter uint64
+}
+
+// NewEntropyMixer returns a mixer of sources, which it owns: Close closes those that are io.Closers.
+func NewEntropyMixer(sources ...EntropySource) (*EntropyMixer, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("tpmpqc: no entropy sources")
+	}
+	seen := map[string]bool{}
+	for _, s := range sources {
+		if seen[s.Name()] {
+			return nil, fmt.Errorf("tpmpqc: duplicate entropy source %q", s.Name())
+		}
+		seen[s.Name()] = true
+	}
+	return &EntropyMixer{sources: sources}, nil
+}
+
+// Sources returns the names of the sources in the order they're mixed.
+func (m *EntropyMixer) Sources() []string {
+	names := make([]string, len(m.sources))
+	for i, s := range m.sources {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+func (m *EntropyMixer) Read(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		block, err := m.block(min(len(b)-n, entropyBlockSize))
+		if err != nil {
+			return n, err
+		}
+		n += copy(b[n:], block)
+	}
+	return n, nil
+}
+
+// block extracts a key from entropyInputSize bytes of every source, each prefixed with the source's
+// name, and expands it to size bytes.  The counter keeps the info of the blocks distinct.
+func (m *EntropyMixer) block(size int) ([]byte, error) {
+	var ikm []byte
+	input := make([]byte, entropyInputSize)
+	for _, s := range m.sources {
+		if _, err := io.ReadFull(s, input); err != nil {
+			return nil, fmt.Errorf("tpmpqc: entropy source %s failed: %v", s.Name(), err)
+		}
+		ikm = binary.BigEndian.AppendUint16(ikm, uint16(len(s.Name())))
+		ikm = append(ikm, s.Name()...)
+		ikm = append(ikm, input...)
+	}
+	m.counter++
+	info := binary.BigEndian.AppendUint64([]byte(strings.Join(m.Sources(), ",")), m.counter)
+	prk, err := hkdf.Extract(sha256.New, ikm, entropySalt)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't mix entropy %v", err)
+	}
+	out, err := hkdf.Expand(sha256.New, prk, string(info), size)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't mix entropy %v", err)
+	}
+	return out, nil
+}
+
+// Close closes the sources that need it.
+func (m *EntropyMixer) Close() error {
+	return closeSources(m.sources)
+}
+
+// AddEntropySources records sources in the attributes of the PKCS#8 PrivateKeyInfo der.
+func AddEntropySources(der []byte, sources []string) ([]byte, error) {
+	var p pkcs8
+	if rest, err := asn1.Unmarshal(der, &p); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal PKCS#8 %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("tpmpqc: trailing data after PKCS#8")
+	}
+	v, err := asn1.MarshalWithParams(entropySourcesPrefix+strings.Join(sources, ","), "utf8")
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal entropy sources %v", err)
+	}
+	p.Attributes = append(p.Attributes, pkcs8Attribute{
+		Type: oidDescription,
+		Values: []asn1.RawValue{
+			{FullBytes: v},
+		},
+	})
+	der, err = asn1.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal PKCS#8 %v", err)
+	}
+	return der, nil
+}
+
+// EntropySources returns the sources recorded in the attributes of p, nil if there are none.
+func (p *pkcs8) EntropySources() []string {
+	for _, a := range p.Attributes {
+		if !a.Type.Equal(oidDescription) {
+			continue
+		}
+		for _, v := range a.Values {
+			var d string
+			if _, err := asn1.Unmarshal(v.FullBytes, &d); err != nil {
+				continue
+			}
+			if sources, ok := strings.CutPrefix(d, entropySourcesPrefix); ok {
+				return strings.Split(sources, ",")
+			}
+		}
+	}
+	return nil
+}
+
+// PKCS8EntropySources returns the sources recorded in the PKCS#8 PrivateKeyInfo der by AddEntropySources,
+// nil if there are none.
+func PKCS8EntropySources(der []byte) ([]string, error) {
+	var p pkcs8
+	if _, err := asn1.Unmarshal(der, &p); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal PKCS#8 %v", err)
+	}
+	return p.EntropySources(), nil
+}
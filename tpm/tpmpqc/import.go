@@ -0,0 +1,408 @@
+package tpmpqc
+
+import (
+	"crypto/mldsa"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem512"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// ExternalKey is a seed format ML-DSA or ML-KEM private key generated outside the TPM.
+type ExternalKey struct {
+	// Type is TPMAlgMLDSA or TPMAlgMLKEM
+	Type tpm2.TPMAlgID
+	// ParameterSet is a tpm2.TPMMLDSAParameter or tpm2.TPMMLKEMParameter depending on Type
+	ParameterSet uint16
+	// Seed is xi (32 bytes) for ML-DSA or d || z (64 bytes) for ML-KEM
+	Seed []byte
+	// PublicKey is the encoded verification or encapsulation key derived from Seed
+	PublicKey []byte
+	// EntropySources names the sources the seed was mixed from, if it was generated with an
+	// EntropyMixer.  It's kept in a PKCS#8 attribute, see AddEntropySources.
+	EntropySources []string
+}
+
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+	Attributes []pkcs8Attribute `asn1:"optional,tag:0,set"`
+}
+
+//	Attribute ::= SEQUENCE {
+//	  attrType   OBJECT IDENTIFIER,
+//	  attrValues SET OF AttributeValue }
+type pkcs8Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// ParseExternalKey parses a PKCS#8 "PRIVATE KEY" PEM holding the seed only form of an ML-DSA or ML-KEM key
+//
+//	ML-DSA-PrivateKey ::= CHOICE { seed [0] OCTET STRING (SIZE (32)), ... }
+//	ML-KEM-PrivateKey ::= CHOICE { seed [0] OCTET STRING (SIZE (64)), ... }
+func ParseExternalKey(pemBytes []byte) (*ExternalKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("tpmpqc: no PRIVATE KEY PEM block found")
+	}
+	var p pkcs8
+	if _, err := asn1.Unmarshal(block.Bytes, &p); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal PKCS#8 %v", err)
+	}
+
+	switch {
+	case p.Algo.Algorithm.Equal(mldsa44OID), p.Algo.Algorithm.Equal(mldsa65OID), p.Algo.Algorithm.Equal(mldsa87OID):
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse mldsa key, only the seed format is supported: %v", err)
+		}
+		sk, ok := k.(*mldsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("tpmpqc: unexpected key type %T", k)
+		}
+		var ps tpm2.TPMMLDSAParameter
+		switch {
+		case p.Algo.Algorithm.Equal(mldsa44OID):
+			ps = tpm2.TPMMLDSA44
+		case p.Algo.Algorithm.Equal(mldsa65OID):
+			ps = tpm2.TPMMLDSA65
+		default:
+			ps = tpm2.TPMMLDSA87
+		}
+		return &ExternalKey{
+			Type:           tpm2.TPMAlgMLDSA,
+			ParameterSet:   uint16(ps),
+			Seed:           sk.Bytes(),
+			PublicKey:      sk.PublicKey().Bytes(),
+			EntropySources: p.EntropySources(),
+		}, nil
+	case p.Algo.Algorithm.Equal(mlkem512OID), p.Algo.Algorithm.Equal(mlkem768OID), p.Algo.Algorithm.Equal(mlkem1024OID):
+		// seed [0] IMPLICIT OCTET STRING
+		if len(p.PrivateKey) != 2+mlkem.SeedSize || p.PrivateKey[0] != 0x80 || p.PrivateKey[1] != mlkem.SeedSize {
+			return nil, fmt.Errorf("tpmpqc: can't parse mlkem key, only the seed format is supported")
+		}
+		var ps tpm2.TPMMLKEMParameter
+		switch {
+		case p.Algo.Algorithm.Equal(mlkem512OID):
+			ps = tpm2.TPMMLKEM512
+		case p.Algo.Algorithm.Equal(mlkem768OID):
+			ps = tpm2.TPMMLKEM768
+		default:
+			ps = tpm2.TPMMLKEM1024
+		}
+		seed := p.PrivateKey[2:]
+		pub, err := mlkemPublicKey(ps, seed)
+		if err != nil {
+			return nil, err
+		}
+		return &ExternalKey{
+			Type:           tpm2.TPMAlgMLKEM,
+			ParameterSet:   uint16(ps),
+			Seed:           seed,
+			PublicKey:      pub,
+			EntropySources: p.EntropySources(),
+		}, nil
+	}
+	return nil, fmt.Errorf("tpmpqc: unsupported key algorithm %v", p.Algo.Algorithm)
+}
+
+// mlkemPublicKey derives the encapsulation key of an ML-KEM seed.
+func mlkemPublicKey(ps tpm2.TPMMLKEMParameter, seed []byte) ([]byte, error) {
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		pk, _ := mlkem512.NewKeyFromSeed(seed)
+		b, err := pk.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't marshal mlkem512 key %v", err)
+		}
+		return b, nil
+	case tpm2.TPMMLKEM768:
+		dk, err := mlkem.NewDecapsulationKey768(seed)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't create mlkem768 key %v", err)
+		}
+		return dk.EncapsulationKey().Bytes(), nil
+	case tpm2.TPMMLKEM1024:
+		dk, err := mlkem.NewDecapsulationKey1024(seed)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't create mlkem1024 key %v", err)
+		}
+		return dk.EncapsulationKey().Bytes(), nil
+	}
+	return nil, fmt.Errorf("tpmpqc: unsupported mlkem parameter set %v", ps)
+}
+
+// GenerateExternalKey generates an ML-DSA or ML-KEM key, of any parameter set, from a seed read from
+// the mixer and records the mixer's sources in the key.
+func GenerateExternalKey(m *EntropyMixer, alg tpm2.TPMAlgID, parameterSet uint16) (*ExternalKey, error) {
+	e := &ExternalKey{
+		Type:           alg,
+		ParameterSet:   parameterSet,
+		EntropySources: m.Sources(),
+	}
+	switch alg {
+	case tpm2.TPMAlgMLDSA:
+		params, err := mldsaParameters(tpm2.TPMMLDSAParameter(parameterSet))
+		if err != nil {
+			return nil, err
+		}
+		e.Seed = make([]byte, mldsa.PrivateKeySize)
+		if _, err := io.ReadFull(m, e.Seed); err != nil {
+			return nil, err
+		}
+		sk, err := mldsa.NewPrivateKey(params, e.Seed)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't create mldsa key %v", err)
+		}
+		e.PublicKey = sk.PublicKey().Bytes()
+	case tpm2.TPMAlgMLKEM:
+		e.Seed = make([]byte, mlkem.SeedSize)
+		if _, err := io.ReadFull(m, e.Seed); err != nil {
+			return nil, err
+		}
+		var err error
+		if e.PublicKey, err = mlkemPublicKey(tpm2.TPMMLKEMParameter(parameterSet), e.Seed); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("tpmpqc: unsupported key type %v", alg)
+	}
+	return e, nil
+}
+
+// MarshalPEM returns the key as a seed only PKCS#8 "PRIVATE KEY" PEM that ParseExternalKey and
+// x509.ParsePKCS8PrivateKey read.  The entropy sources, if any, go in a PKCS#8 attribute.
+func (e *ExternalKey) MarshalPEM() ([]byte, error) {
+	var oid asn1.ObjectIdentifier
+	switch {
+	case e.Type == tpm2.TPMAlgMLDSA && e.ParameterSet == uint16(tpm2.TPMMLDSA44):
+		oid = mldsa44OID
+	case e.Type == tpm2.TPMAlgMLDSA && e.ParameterSet == uint16(tpm2.TPMMLDSA65):
+		oid = mldsa65OID
+	case e.Type == tpm2.TPMAlgMLDSA && e.ParameterSet == uint16(tpm2.TPMMLDSA87):
+		oid = mldsa87OID
+	case e.Type == tpm2.TPMAlgMLKEM && e.ParameterSet == uint16(tpm2.TPMMLKEM512):
+		oid = mlkem512OID
+	case e.Type == tpm2.TPMAlgMLKEM && e.ParameterSet == uint16(tpm2.TPMMLKEM768):
+		oid = mlkem768OID
+	case e.Type == tpm2.TPMAlgMLKEM && e.ParameterSet == uint16(tpm2.TPMMLKEM1024):
+		oid = mlkem1024OID
+	default:
+		return nil, fmt.Errorf("tpmpqc: unsupported key type %v parameter set %d", e.Type, e.ParameterSet)
+	}
+	// seed [0] IMPLICIT OCTET STRING
+	der, err := asn1.Marshal(pkcs8{
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oid},
+		PrivateKey: append([]byte{0x80, byte(len(e.Seed))}, e.Seed...),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal PKCS#8 %v", err)
+	}
+	if len(e.EntropySources) > 0 {
+		if der, err = AddEntropySources(der, e.EntropySources); err != nil {
+			return nil, err
+		}
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+// Template returns the public area of the key.  Imported keys can't be fixedTPM, fixedParent or
+// sensitiveDataOrigin since the TPM did not generate them.
+func (e *ExternalKey) Template() (tpm2.TPMTPublic, error) {
+	var t tpm2.TPMTPublic
+	switch e.Type {
+	case tpm2.TPMAlgMLDSA:
+		t = MLDSATemplate(tpm2.TPMMLDSAParameter(e.ParameterSet))
+	case tpm2.TPMAlgMLKEM:
+		t = MLKEMTemplate(tpm2.TPMMLKEMParameter(e.ParameterSet))
+	default:
+		return tpm2.TPMTPublic{}, fmt.Errorf("tpmpqc: unsupported key type %v", e.Type)
+	}
+	t.ObjectAttributes.FixedTPM = false
+	t.ObjectAttributes.FixedParent = false
+	t.ObjectAttributes.SensitiveDataOrigin = false
+	t.Unique = tpm2.NewTPMUPublicID(e.Type, &tpm2.TPM2BData{Buffer: e.PublicKey})
+	return t, nil
+}
+
+// Sensitive returns the TPMT_SENSITIVE of the key with a random obfuscation value.
+func (e *ExternalKey) Sensitive(authValue []byte) (tpm2.TPMTSensitive, error) {
+	seedValue := make([]byte, 32)
+	if _, err := rand.Read(seedValue); err != nil {
+		return tpm2.TPMTSensitive{}, fmt.Errorf("tpmpqc: can't read random %v", err)
+	}
+	s := tpm2.TPMTSensitive{
+		SensitiveType: e.Type,
+		AuthValue:     tpm2.TPM2BAuth{Buffer: authValue},
+		SeedValue:     tpm2.TPM2BDigest{Buffer: seedValue},
+	}
+	switch e.Type {
+	case tpm2.TPMAlgMLDSA:
+		s.Sensitive = tpm2.NewTPMUSensitiveComposite(e.Type, &tpm2.TPM2BPrivateKeyMLDSA{Buffer: e.Seed})
+	case tpm2.TPMAlgMLKEM:
+		s.Sensitive = tpm2.NewTPMUSensitiveComposite(e.Type, &tpm2.TPM2BPrivateKeyMLKEM{Buffer: e.Seed})
+	default:
+		return tpm2.TPMTSensitive{}, fmt.Errorf("tpmpqc: unsupported key type %v", e.Type)
+	}
+	return s, nil
+}
+
+// Import wraps the key for parent with an outer duplication wrapper and runs TPM2_Import.
+// parent must be an RSA or ECC storage key.  The returned blobs can be loaded (LoadKEMKey,
+// LoadSigningKey), saved with SaveFiles or written to a TSS2 key file like any other key.
+//
+// policy is optional; if set the key can only be used through a session that satisfies it.
+func Import(rwr transport.TPM, parent tpm2.NamedHandle, e *ExternalKey, policy *KeyPolicy) (tpm2.TPM2BPublic, tpm2.TPM2BPrivate, error) {
+	template, err := e.Template()
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, err
+	}
+	var authValue []byte
+	if policy != nil {
+		sens, err := policy.apply(&template)
+		if err != nil {
+			return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, err
+		}
+		authValue = sens.Sensitive.UserAuth.Buffer
+	}
+	sensitive, err := e.Sensitive(authValue)
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, err
+	}
+	name, err := tpm2.ObjectName(&template)
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't compute name %v", err)
+	}
+
+	parentPub, err := tpm2.ReadPublic{
+		ObjectHandle: parent.Handle,
+	}.Execute(rwr)
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't read parent public %v", err)
+	}
+	pp, err := parentPub.OutPublic.Contents()
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't read parent public %v", err)
+	}
+	ek, err := tpm2.ImportEncapsulationKey(pp)
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't use parent for import %v", err)
+	}
+	duplicate, seed, err := tpm2.CreateDuplicate(rand.Reader, ek, name.Buffer, tpm2.Marshal(sensitive))
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't create duplicate %v", err)
+	}
+
+	public := tpm2.New2B(template)
+	importResponse, err := tpm2.Import{
+		ParentHandle: tpm2.AuthHandle{
+			Handle: parent.Handle,
+			Name:   parent.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		ObjectPublic: public,
+		Duplicate:    tpm2.TPM2BPrivate{Buffer: duplicate},
+		InSymSeed:    tpm2.TPM2BEncryptedSecret{Buffer: seed},
+		Symmetric: tpm2.TPMTSymDef{
+			Algorithm: tpm2.TPMAlgNull,
+		},
+	}.Execute(rwr)
+	if err != nil {
+		return tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fmt.Errorf("tpmpqc: can't import key %v", err)
+	}
+	return public, importResponse.OutPrivate, nil
+}
+
+// ImportKEMKey imports an external ML-KEM key under parent and loads it.
+func ImportKEMKey(rwr transport.TPM, parent tpm2.NamedHandle, e *ExternalKey, policy *KeyPolicy) (*KEMKey, error) {
+	public, private, err := Import(rwr, parent, e, policy)
+	if err != nil {
+		return nil, err
+	}
+	k, err := loadKey(rwr, parent, public, private, tpm2.TPMAlgMLKEM)
+	if err != nil {
+		return nil, err
+	}
+	k.Policy = policy
+	return &KEMKey{k}, nil
+}
+
+// ImportSigningKey imports an external ML-DSA key under parent and loads it.
+func ImportSigningKey(rwr transport.TPM, parent tpm2.NamedHandle, e *ExternalKey, policy *KeyPolicy) (*SigningKey, error) {
+	public, private, err := Import(rwr, parent, e, policy)
+	if err != nil {
+		return nil, err
+	}
+	k, err := loadKey(rwr, parent, public, private, tpm2.TPMAlgMLDSA)
+	if err != nil {
+		return nil, err
+	}
+	k.Policy = policy
+	return &SigningKey{k}, nil
+}
+
+// loadExternal loads the key in the null hierarchy with TPM2_LoadExternal.  The key is not bound to
+// this TPM and has no private blob, so it can't be saved or persisted.
+func loadExternal(rwr transport.TPM, e *ExternalKey) (*key, error) {
+	template, err := e.Template()
+	if err != nil {
+		return nil, err
+	}
+	sensitive, err := e.Sensitive(nil)
+	if err != nil {
+		return nil, err
+	}
+	public := tpm2.New2B(template)
+	rsp, err := tpm2.LoadExternal{
+		InPrivate: tpm2.New2B(sensitive),
+		InPublic:  public,
+		Hierarchy: tpm2.TPMRHNull,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't load external key %v", err)
+	}
+	return &key{
+		rwr:    rwr,
+		handle: rsp.ObjectHandle,
+		name:   rsp.Name,
+		public: &template,
+		Public: public,
+	}, nil
+}
+
+// LoadExternalKEMKey loads an external ML-KEM key with TPM2_LoadExternal.
+func LoadExternalKEMKey(rwr transport.TPM, e *ExternalKey) (*KEMKey, error) {
+	if e.Type != tpm2.TPMAlgMLKEM {
+		return nil, fmt.Errorf("tpmpqc: expected key type %v, got %v", tpm2.TPMAlgMLKEM, e.Type)
+	}
+	k, err := loadExternal(rwr, e)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// LoadExternalSigningKey loads an external ML-DSA key with TPM2_LoadExternal.
+func LoadExternalSigningKey(rwr transport.TPM, e *ExternalKey) (*SigningKey, error) {
+	if e.Type != tpm2.TPMAlgMLDSA {
+		return nil, fmt.Errorf("tpmpqc: expected key type %v, got %v", tpm2.TPMAlgMLDSA, e.Type)
+	}
+	k, err := loadExternal(rwr, e)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
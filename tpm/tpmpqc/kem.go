@@ -0,0 +1,271 @@
+package tpmpqc
+
+import (
+	"crypto"
+	"crypto/mlkem"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/mlkem/mlkem512"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	mlkem512OID  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 1}
+	mlkem768OID  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 2}
+	mlkem1024OID = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 3}
+)
+
+// MLKEMParameterSet maps the bit size used on the command line (512, 768, 1024) to the TPM parameter set.
+func MLKEMParameterSet(size int) (tpm2.TPMMLKEMParameter, error) {
+	switch size {
+	case 512:
+		return tpm2.TPMMLKEM512, nil
+	case 768:
+		return tpm2.TPMMLKEM768, nil
+	case 1024:
+		return tpm2.TPMMLKEM1024, nil
+	}
+	return 0, fmt.Errorf("tpmpqc: unsupported mlkem parameter set %d", size)
+}
+
+// MLKEMTemplate returns the template for an unrestricted ML-KEM decryption key.
+func MLKEMTemplate(parameterSet tpm2.TPMMLKEMParameter) tpm2.TPMTPublic {
+	return tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgMLKEM,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			Decrypt:             true,
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        true,
+		},
+		AuthPolicy: tpm2.TPM2BDigest{},
+		Parameters: tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgMLKEM,
+			&tpm2.TPMSMLKEMParms{
+				ParameterSet: tpm2.TPMIMLKEMParam(parameterSet),
+			},
+		),
+	}
+}
+
+// MLKEMStorageTemplate returns the template for a restricted decryption ML-KEM key, a storage parent
+// for other keys.  Children are protected with AES-256 and the parent's ML-KEM key so, unlike under the
+// RSA and ECC SRKs, no part of the protection chain relies on a classical asymmetric algorithm.
+func MLKEMStorageTemplate(parameterSet tpm2.TPMMLKEMParameter) tpm2.TPMTPublic {
+	return tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgMLKEM,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        true,
+			NoDA:                true,
+			Restricted:          true,
+			Decrypt:             true,
+		},
+		AuthPolicy: tpm2.TPM2BDigest{},
+		Parameters: tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgMLKEM,
+			&tpm2.TPMSMLKEMParms{
+				Symmetric: tpm2.TPMTSymDefObject{
+					Algorithm: tpm2.TPMAlgAES,
+					KeyBits: tpm2.NewTPMUSymKeyBits(
+						tpm2.TPMAlgAES,
+						tpm2.TPMKeyBits(256),
+					),
+					Mode: tpm2.NewTPMUSymMode(
+						tpm2.TPMAlgAES,
+						tpm2.TPMAlgCFB,
+					),
+				},
+				ParameterSet: tpm2.TPMIMLKEMParam(parameterSet),
+			},
+		),
+	}
+}
+
+// MLKEMSRKTemplate is the ML-KEM-1024 storage primary used for the "mlkem" SRK type.  It follows the
+// TCG SRK templates: an empty auth value, no policy and an empty unique field.
+var MLKEMSRKTemplate = MLKEMStorageTemplate(tpm2.TPMMLKEM1024)
+
+// CreateKEMStorageKey creates a new ML-KEM storage parent under parent and loads it.  The returned key
+// can't decapsulate, it only parents other keys.
+func CreateKEMStorageKey(rwr transport.TPM, parent tpm2.NamedHandle, parameterSet tpm2.TPMMLKEMParameter) (*KEMKey, error) {
+	k, err := createKey(rwr, parent, MLKEMStorageTemplate(parameterSet), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// KEMKey is a loaded TPM ML-KEM key.  It implements crypto.Decapsulator.
+type KEMKey struct {
+	*key
+}
+
+var _ crypto.Decapsulator = (*KEMKey)(nil)
+
+// CreateKEMKey creates a new ML-KEM key under parent and loads it.
+// policy is optional; if set the key can only be used through a session that satisfies it.
+func CreateKEMKey(rwr transport.TPM, parent tpm2.NamedHandle, parameterSet tpm2.TPMMLKEMParameter, policy *KeyPolicy) (*KEMKey, error) {
+	k, err := createKey(rwr, parent, MLKEMTemplate(parameterSet), policy)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// LoadKEMKey loads previously saved ML-KEM key blobs under parent.
+func LoadKEMKey(rwr transport.TPM, parent tpm2.NamedHandle, public tpm2.TPM2BPublic, private tpm2.TPM2BPrivate) (*KEMKey, error) {
+	k, err := loadKey(rwr, parent, public, private, tpm2.TPMAlgMLKEM)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// LoadKEMKeyFiles loads the key blobs written by SaveFiles.
+func LoadKEMKeyFiles(rwr transport.TPM, parent tpm2.NamedHandle, publicFile, privateFile string) (*KEMKey, error) {
+	k, err := loadKeyFiles(rwr, parent, publicFile, privateFile, tpm2.TPMAlgMLKEM)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// OpenPersistentKEMKey uses an ML-KEM key previously stored with Persist.
+func OpenPersistentKEMKey(rwr transport.TPM, handle tpm2.TPMHandle) (*KEMKey, error) {
+	k, err := openPersistentKey(rwr, handle, tpm2.TPMAlgMLKEM)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{k}, nil
+}
+
+// ParameterSet returns the ML-KEM parameter set of the key.
+func (k *KEMKey) ParameterSet() (tpm2.TPMMLKEMParameter, error) {
+	kemDetail, err := k.public.Parameters.MLKEMDetail()
+	if err != nil {
+		return 0, fmt.Errorf("tpmpqc: can't get mlkem details %v", err)
+	}
+	return tpm2.TPMMLKEMParameter(kemDetail.ParameterSet), nil
+}
+
+// EncapsulationKeyBytes returns the raw FIPS 203 encapsulation key.
+func (k *KEMKey) EncapsulationKeyBytes() ([]byte, error) {
+	kemu, err := k.public.Unique.KEM()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get mlkem unique %v", err)
+	}
+	return kemu.Buffer, nil
+}
+
+// MarshalPKIXPublicKey returns the encapsulation key as a DER SubjectPublicKeyInfo.
+func (k *KEMKey) MarshalPKIXPublicKey() ([]byte, error) {
+	ps, err := k.ParameterSet()
+	if err != nil {
+		return nil, err
+	}
+	ek, err := k.EncapsulationKeyBytes()
+	if err != nil {
+		return nil, err
+	}
+	var oid asn1.ObjectIdentifier
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		oid = mlkem512OID
+	case tpm2.TPMMLKEM768:
+		oid = mlkem768OID
+	case tpm2.TPMMLKEM1024:
+		oid = mlkem1024OID
+	default:
+		return nil, fmt.Errorf("tpmpqc: unsupported mlkem parameter set %v", ps)
+	}
+	return marshalPKIXPublicKey(oid, ek)
+}
+
+// Encapsulator returns a software encapsulation key for the TPM key.
+// ML-KEM-512 isn't available in crypto/mlkem so circl is used for that parameter set.
+//
+// It returns nil if the public area can't be parsed.
+func (k *KEMKey) Encapsulator() crypto.Encapsulator {
+	ps, err := k.ParameterSet()
+	if err != nil {
+		return nil
+	}
+	ek, err := k.EncapsulationKeyBytes()
+	if err != nil {
+		return nil
+	}
+	e, err := newEncapsulator(ps, ek)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// newEncapsulator returns a software encapsulation key for the raw FIPS 203 key ek.
+func newEncapsulator(ps tpm2.TPMMLKEMParameter, ek []byte) (crypto.Encapsulator, error) {
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		pk, err := mlkem512.Scheme().UnmarshalBinaryPublicKey(ek)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse mlkem512 encapsulation key %v", err)
+		}
+		return &circlEncapsulator{pk: pk}, nil
+	case tpm2.TPMMLKEM768:
+		e, err := mlkem.NewEncapsulationKey768(ek)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse mlkem768 encapsulation key %v", err)
+		}
+		return e, nil
+	case tpm2.TPMMLKEM1024:
+		e, err := mlkem.NewEncapsulationKey1024(ek)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't parse mlkem1024 encapsulation key %v", err)
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("tpmpqc: unsupported mlkem parameter set %v", ps)
+}
+
+// Decapsulate recovers the shared secret for ciphertext using the TPM.
+// If Salt is set the shared secret is encrypted on its way back from the TPM.
+func (k *KEMKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	keyHandle, sessions := k.encryptedAuthHandle()
+	dcapResp, err := tpm2.Decapsulate{
+		KeyHandle: keyHandle,
+		CipherText: tpm2.TPM2BKEMCipherText{
+			Buffer: ciphertext,
+		},
+	}.Execute(k.rwr, sessions...)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't decapsulate %v", err)
+	}
+	return dcapResp.SharedSecret.Buffer, nil
+}
+
+// circlEncapsulator adapts a circl public key to crypto.Encapsulator.
+type circlEncapsulator struct {
+	pk kem.PublicKey
+}
+
+func (c *circlEncapsulator) Bytes() []byte {
+	b, _ := c.pk.MarshalBinary()
+	return b
+}
+
+func (c *circlEncapsulator) Encapsulate() (sharedKey, ciphertext []byte) {
+	ciphertext, sharedKey, err := c.pk.Scheme().Encapsulate(c.pk)
+	if err != nil {
+		// only fails if crypto/rand fails
+		panic(err)
+	}
+	return sharedKey, ciphertext
+}
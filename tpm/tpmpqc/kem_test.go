@@ -0,0 +1,154 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"testing"
+
+	"main/faketpm"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// openFakeTPM returns a faketpm with parameterSets and the ECC SRK.  Both are closed when the test ends.
+func openFakeTPM(t *testing.T, parameterSets tpm2.TPMAMLParameterSet) (transport.TPM, tpm2.NamedHandle) {
+	t.Helper()
+	return openFakeTPMWithConfig(t, faketpm.Config{
+		ParameterSets: parameterSets,
+	})
+}
+
+// openFakeTPMWithConfig is openFakeTPM for a faketpm set up with cfg.
+func openFakeTPMWithConfig(t *testing.T, cfg faketpm.Config) (transport.TPM, tpm2.NamedHandle) {
+	t.Helper()
+	rwc := faketpm.NewWithConfig(cfg)
+	t.Cleanup(func() {
+		rwc.Close()
+	})
+	rwr := transport.FromReadWriter(rwc)
+	srk, closer, err := SRK(rwr, SRKTypeECC, 0)
+	if err != nil {
+		t.Fatalf("SRK() = %v", err)
+	}
+	t.Cleanup(func() {
+		closer()
+	})
+	return rwr, srk
+}
+
+func TestKEMKey(t *testing.T) {
+	rwr, srk := openFakeTPM(t, faketpm.DefaultParameterSets)
+	for _, ps := range []tpm2.TPMMLKEMParameter{tpm2.TPMMLKEM512, tpm2.TPMMLKEM768, tpm2.TPMMLKEM1024} {
+		k, err := CreateKEMKey(rwr, srk, ps, nil)
+		if err != nil {
+			t.Fatalf("CreateKEMKey(%v) = %v", ps, err)
+		}
+		if got, err := k.ParameterSet(); err != nil || got != ps {
+			t.Errorf("ParameterSet() = %v, %v, want %v", got, err, ps)
+		}
+
+		ek := k.Encapsulator()
+		if ek == nil {
+			t.Fatalf("parameter set %v: Encapsulator() = nil", ps)
+		}
+		sharedKey, ciphertext := ek.Encapsulate()
+		got, err := k.Decapsulate(ciphertext)
+		if err != nil {
+			t.Fatalf("parameter set %v: Decapsulate() = %v", ps, err)
+		}
+		if !bytes.Equal(got, sharedKey) {
+			t.Errorf("parameter set %v: decapsulated %x, encapsulated %x", ps, got, sharedKey)
+		}
+
+		// the blobs load again and decapsulate to the same key
+		public, private := k.Public, k.Private
+		if err := k.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		k, err = LoadKEMKey(rwr, srk, public, private)
+		if err != nil {
+			t.Fatalf("parameter set %v: LoadKEMKey() = %v", ps, err)
+		}
+		got, err = k.Decapsulate(ciphertext)
+		if err != nil {
+			t.Fatalf("parameter set %v: Decapsulate() after load = %v", ps, err)
+		}
+		if !bytes.Equal(got, sharedKey) {
+			t.Errorf("parameter set %v: decapsulated %x after load, encapsulated %x", ps, got, sharedKey)
+		}
+
+		// ML-KEM rejects implicitly: a changed ciphertext gives another key, not an error
+		ciphertext[0] ^= 1
+		got, err = k.Decapsulate(ciphertext)
+		if err != nil {
+			t.Fatalf("parameter set %v: Decapsulate() of a changed ciphertext = %v", ps, err)
+		}
+		if bytes.Equal(got, sharedKey) {
+			t.Errorf("parameter set %v: changed ciphertext decapsulated to the shared key", ps)
+		}
+		k.Close()
+	}
+}
+
+// TestKEMStorageParent creates children under the ML-KEM SRK and checks that their blobs only load
+// under it, not under the classical SRKs or another ML-KEM storage key.
+func TestKEMStorageParent(t *testing.T) {
+	rwr, _ := openFakeTPM(t, faketpm.DefaultParameterSets)
+	parent, closeParent, err := SRK(rwr, SRKTypeMLKEM, 0)
+	if err != nil {
+		t.Fatalf("SRK(%s) = %v", SRKTypeMLKEM, err)
+	}
+	defer closeParent()
+
+	kk, err := CreateKEMKey(rwr, parent, tpm2.TPMMLKEM768, nil)
+	if err != nil {
+		t.Fatalf("CreateKEMKey() = %v", err)
+	}
+	kemPublic, kemPrivate := kk.Public, kk.Private
+	kk.Close()
+	sk, err := CreateSigningKey(rwr, parent, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	dsaPublic, dsaPrivate := sk.TPMPublic(), sk.Private
+	sk.Close()
+
+	kk, err = LoadKEMKey(rwr, parent, kemPublic, kemPrivate)
+	if err != nil {
+		t.Fatalf("LoadKEMKey() under the ML-KEM SRK = %v", err)
+	}
+	kk.Close()
+	sk, err = LoadSigningKey(rwr, parent, dsaPublic, dsaPrivate)
+	if err != nil {
+		t.Fatalf("LoadSigningKey() under the ML-KEM SRK = %v", err)
+	}
+	sk.Close()
+
+	for _, other := range []string{SRKTypeECC, SRKTypeRSA, "mlkem-child"} {
+		t.Run(other, func(t *testing.T) {
+			var p tpm2.NamedHandle
+			var closeOther func() error
+			if other == "mlkem-child" {
+				sp, err := CreateKEMStorageKey(rwr, parent, tpm2.TPMMLKEM768)
+				if err != nil {
+					t.Fatalf("CreateKEMStorageKey() = %v", err)
+				}
+				p, closeOther = sp.Handle(), sp.Close
+			} else {
+				p, closeOther, err = SRK(rwr, other, 0)
+				if err != nil {
+					t.Fatalf("SRK(%s) = %v", other, err)
+				}
+			}
+			defer closeOther()
+			if k, err := LoadKEMKey(rwr, p, kemPublic, kemPrivate); err == nil {
+				k.Close()
+				t.Errorf("mlkem child loaded under the %s parent", other)
+			}
+			if k, err := LoadSigningKey(rwr, p, dsaPublic, dsaPrivate); err == nil {
+				k.Close()
+				t.Errorf("mldsa child loaded under the %s parent", other)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package tpmpqc
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// key is the part common to the loaded ML-KEM and ML-DSA keys.
+type key struct {
+	rwr    transport.TPM
+	handle tpm2.TPMHandle
+	name   tpm2.TPM2BName
+	public *tpm2.TPMTPublic
+
+	// Public and Private are the blobs returned by TPM2_Create.  Private is empty for keys
+	// opened from a persistent handle.
+	Public  tpm2.TPM2BPublic
+	Private tpm2.TPM2BPrivate
+
+	// Policy authorizes use of the key.  If nil, the key is used with an empty auth value.
+	Policy *KeyPolicy
+
+	// Salt, if set, salts the key's HMAC sessions and enables response encryption for secrets
+	// returned by the TPM.
+	Salt *SessionSalt
+}
+
+func createKey(rwr transport.TPM, parent tpm2.NamedHandle, template tpm2.TPMTPublic, policy *KeyPolicy) (*key, error) {
+	var inSensitive tpm2.TPM2BSensitiveCreate
+	if policy != nil {
+		var err error
+		inSensitive, err = policy.apply(&template)
+		if err != nil {
+			return nil, err
+		}
+	}
+	createResponse, err := tpm2.Create{
+		ParentHandle: tpm2.AuthHandle{
+			Handle: parent.Handle,
+			Name:   parent.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		InPublic:    tpm2.New2B(template),
+		InSensitive: inSensitive,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't create key %v", err)
+	}
+	k, err := loadKey(rwr, parent, createResponse.OutPublic, createResponse.OutPrivate, template.Type)
+	if err != nil {
+		return nil, err
+	}
+	k.Policy = policy
+	return k, nil
+}
+
+func loadKey(rwr transport.TPM, parent tpm2.NamedHandle, public tpm2.TPM2BPublic, private tpm2.TPM2BPrivate, alg tpm2.TPMAlgID) (*key, error) {
+	pub, err := public.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	if pub.Type != alg {
+		return nil, fmt.Errorf("tpmpqc: expected key type %v, got %v", alg, pub.Type)
+	}
+
+	loadResponse, err := tpm2.Load{
+		ParentHandle: parent,
+		InPrivate:    private,
+		InPublic:     public,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't load key %v", err)
+	}
+	return &key{
+		rwr:     rwr,
+		handle:  loadResponse.ObjectHandle,
+		name:    loadResponse.Name,
+		public:  pub,
+		Public:  public,
+		Private: private,
+	}, nil
+}
+
+func loadKeyFiles(rwr transport.TPM, parent tpm2.NamedHandle, publicFile, privateFile string, alg tpm2.TPMAlgID) (*key, error) {
+	pubBytes, err := os.ReadFile(publicFile)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read public file %v", err)
+	}
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](pubBytes)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal public %v", err)
+	}
+	privBytes, err := os.ReadFile(privateFile)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read private file %v", err)
+	}
+	private, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](privBytes)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal private %v", err)
+	}
+	return loadKey(rwr, parent, *public, *private, alg)
+}
+
+func openPersistentKey(rwr transport.TPM, handle tpm2.TPMHandle, alg tpm2.TPMAlgID) (*key, error) {
+	rsp, err := tpm2.ReadPublic{
+		ObjectHandle: handle,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read persistent key %#x: %v", handle, err)
+	}
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	if pub.Type != alg {
+		return nil, fmt.Errorf("tpmpqc: expected key type %v, got %v", alg, pub.Type)
+	}
+	return &key{
+		rwr:    rwr,
+		handle: handle,
+		name:   rsp.Name,
+		public: pub,
+		Public: rsp.OutPublic,
+	}, nil
+}
+
+// SaveFiles writes the public and private blobs in the same layout as tpm2_create -u/-r.
+func (k *key) SaveFiles(publicFile, privateFile string) error {
+	if len(k.Private.Buffer) == 0 {
+		return fmt.Errorf("tpmpqc: key has no private blob, it was opened from a persistent handle")
+	}
+	if err := os.WriteFile(publicFile, tpm2.Marshal(k.Public), 0644); err != nil {
+		return fmt.Errorf("tpmpqc: can't write public file %v", err)
+	}
+	if err := os.WriteFile(privateFile, tpm2.Marshal(k.Private), 0600); err != nil {
+		return fmt.Errorf("tpmpqc: can't write private file %v", err)
+	}
+	return nil
+}
+
+// Persist makes the key persistent at handle using owner authorization.  The transient copy is flushed.
+func (k *key) Persist(handle tpm2.TPMHandle) error {
+	_, err := tpm2.EvictControl{
+		Auth: tpm2.TPMRHOwner,
+		ObjectHandle: &tpm2.NamedHandle{
+			Handle: k.handle,
+			Name:   k.name,
+		},
+		PersistentHandle: handle,
+	}.Execute(k.rwr)
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't persist key %v", err)
+	}
+	if err := k.Close(); err != nil {
+		return err
+	}
+	k.handle = handle
+	return nil
+}
+
+// Close flushes transient keys.  Persistent keys are left in place.
+func (k *key) Close() error {
+	if isPersistent(k.handle) {
+		return nil
+	}
+	_, err := tpm2.FlushContext{
+		FlushHandle: k.handle,
+	}.Execute(k.rwr)
+	return err
+}
+
+// authHandle returns the key handle with the session that satisfies its policy.  Keys without a
+// policy use the empty password, or a salted HMAC session if Salt is set.
+func (k *key) authHandle() tpm2.AuthHandle {
+	auth := tpm2.PasswordAuth(nil)
+	switch {
+	case k.Policy != nil:
+		auth = k.Policy.Session()
+	case k.Salt != nil:
+		auth = tpm2.HMAC(tpm2.TPMAlgSHA256, 16, k.Salt.options(tpm2.Auth(nil))...)
+	}
+	return tpm2.AuthHandle{
+		Handle: k.handle,
+		Name:   k.name,
+		Auth:   auth,
+	}
+}
+
+// encryptedAuthHandle is authHandle for commands returning a secret as the first response parameter.
+// With Salt set the response is encrypted, by the key's own HMAC session or, for policy keys, by an
+// extra session that must be passed to Execute.
+func (k *key) encryptedAuthHandle() (tpm2.AuthHandle, []tpm2.Session) {
+	a := k.authHandle()
+	switch {
+	case k.Salt == nil:
+		return a, nil
+	case k.Policy != nil:
+		return a, []tpm2.Session{k.Salt.encryptSession(responseEncryption)}
+	}
+	a.Auth = tpm2.HMAC(tpm2.TPMAlgSHA256, 16, k.Salt.options(tpm2.Auth(nil), responseEncryption)...)
+	return a, nil
+}
+
+// Handle returns the loaded handle and name of the key.
+func (k *key) Handle() tpm2.NamedHandle {
+	return tpm2.NamedHandle{
+		Handle: k.handle,
+		Name:   k.name,
+	}
+}
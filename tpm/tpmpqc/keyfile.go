@@ -0,0 +1,225 @@
+package tpmpqc
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// TSS2 PRIVATE KEY format used by the tpm2-openssl provider and openssl_tpm2_engine
+//
+//	https://www.hansenpartnership.com/draft-bottomley-tpm2-keys.html
+const TSS2PEMType = "TSS2 PRIVATE KEY"
+
+var (
+	OIDLoadableKey   = asn1.ObjectIdentifier{2, 23, 133, 10, 1, 3}
+	OIDImportableKey = asn1.ObjectIdentifier{2, 23, 133, 10, 1, 4}
+	OIDSealedKey     = asn1.ObjectIdentifier{2, 23, 133, 10, 1, 5}
+)
+
+//	TPMPolicy ::= SEQUENCE {
+//	  commandCode   [0] EXPLICIT INTEGER,
+//	  commandPolicy [1] EXPLICIT OCTET STRING }
+//
+// commandPolicy holds the marshalled command parameters that follow the policy session handle.
+type TPMPolicy struct {
+	CommandCode   int    `asn1:"explicit,tag:0"`
+	CommandPolicy []byte `asn1:"explicit,tag:1"`
+}
+
+//	TPMAuthPolicy ::= SEQUENCE {
+//	  name    [0] EXPLICIT UTF8String OPTIONAL,
+//	  policy  [1] EXPLICIT SEQUENCE OF TPMPolicy }
+type TPMAuthPolicy struct {
+	Name   string      `asn1:"utf8,optional,explicit,tag:0"`
+	Policy []TPMPolicy `asn1:"explicit,tag:1"`
+}
+
+//	TPMKey ::= SEQUENCE {
+//	  type        OBJECT IDENTIFIER,
+//	  emptyAuth   [0] EXPLICIT BOOLEAN OPTIONAL,
+//	  policy      [1] EXPLICIT SEQUENCE OF TPMPolicy OPTIONAL,
+//	  secret      [2] EXPLICIT OCTET STRING OPTIONAL,
+//	  authPolicy  [3] EXPLICIT SEQUENCE OF TPMAuthPolicy OPTIONAL,
+//	  description [4] EXPLICIT UTF8String OPTIONAL,
+//	  rsaParent   [5] EXPLICIT BOOLEAN OPTIONAL,
+//	  parent      INTEGER,
+//	  pubkey      OCTET STRING,
+//	  privkey     OCTET STRING }
+//
+// pubkey and privkey are the marshalled TPM2B_PUBLIC and TPM2B_PRIVATE.
+type TPMKey struct {
+	Type        asn1.ObjectIdentifier
+	EmptyAuth   bool            `asn1:"optional,explicit,tag:0"`
+	Policy      []TPMPolicy     `asn1:"optional,explicit,tag:1"`
+	Secret      []byte          `asn1:"optional,explicit,tag:2"`
+	AuthPolicy  []TPMAuthPolicy `asn1:"optional,explicit,tag:3"`
+	Description string          `asn1:"utf8,optional,explicit,tag:4"`
+	RSAParent   bool            `asn1:"optional,explicit,tag:5"`
+	Parent      int
+	PubKey      []byte
+	PrivKey     []byte
+}
+
+// NewTPMKey wraps the blobs of an ML-KEM or ML-DSA key as a loadable TPMKey.
+//
+// parent is either a persistent handle or tpm2.TPMRHOwner, in which case the loader recreates the
+// ECC SRK (or the RSA SRK if srkType is rsa).
+func NewTPMKey(public tpm2.TPM2BPublic, private tpm2.TPM2BPrivate, parent tpm2.TPMHandle, srkType string, emptyAuth bool) (*TPMKey, error) {
+	pub, err := public.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	if pub.Type != tpm2.TPMAlgMLKEM && pub.Type != tpm2.TPMAlgMLDSA {
+		return nil, fmt.Errorf("tpmpqc: unsupported key type %v", pub.Type)
+	}
+	if parent == tpm2.TPMRHOwner && srkType == SRKTypeMLKEM {
+		// the key file format only names the RSA and ECC SRKs
+		return nil, fmt.Errorf("tpmpqc: keys under the mlkem srk need a persistent parent handle")
+	}
+	return &TPMKey{
+		Type:      OIDLoadableKey,
+		EmptyAuth: emptyAuth,
+		RSAParent: parent == tpm2.TPMRHOwner && srkType == SRKTypeRSA,
+		Parent:    int(parent),
+		PubKey:    tpm2.Marshal(public),
+		PrivKey:   tpm2.Marshal(private),
+	}, nil
+}
+
+// DecodeTPMKey parses a TSS2 PRIVATE KEY PEM block.
+func DecodeTPMKey(pemBytes []byte) (*TPMKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != TSS2PEMType {
+		return nil, fmt.Errorf("tpmpqc: no %s PEM block found", TSS2PEMType)
+	}
+	var k TPMKey
+	if rest, err := asn1.Unmarshal(block.Bytes, &k); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't unmarshal TPMKey %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("tpmpqc: trailing data after TPMKey")
+	}
+	if !k.Type.Equal(OIDLoadableKey) {
+		return nil, fmt.Errorf("tpmpqc: unsupported TPMKey type %v", k.Type)
+	}
+	return &k, nil
+}
+
+// EncodePEM returns the key as a TSS2 PRIVATE KEY PEM block.
+func (k *TPMKey) EncodePEM() ([]byte, error) {
+	b, err := asn1.Marshal(*k)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal TPMKey %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  TSS2PEMType,
+		Bytes: b,
+	}), nil
+}
+
+// Blobs returns the TPM2B_PUBLIC and TPM2B_PRIVATE held in the key.
+func (k *TPMKey) Blobs() (*tpm2.TPM2BPublic, *tpm2.TPM2BPrivate, error) {
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](k.PubKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpmpqc: can't unmarshal public %v", err)
+	}
+	private, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](k.PrivKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpmpqc: can't unmarshal private %v", err)
+	}
+	return public, private, nil
+}
+
+// KeyType returns TPMAlgMLKEM or TPMAlgMLDSA.
+func (k *TPMKey) KeyType() (tpm2.TPMAlgID, error) {
+	public, _, err := k.Blobs()
+	if err != nil {
+		return 0, err
+	}
+	pub, err := public.Contents()
+	if err != nil {
+		return 0, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	return pub.Type, nil
+}
+
+// ParentHandle recreates or opens the parent named in the key.  See SRK for the closer.
+func (k *TPMKey) ParentHandle(rwr transport.TPM) (tpm2.NamedHandle, func() error, error) {
+	if tpm2.TPMHandle(k.Parent) == tpm2.TPMRHOwner {
+		srkType := SRKTypeECC
+		if k.RSAParent {
+			srkType = SRKTypeRSA
+		}
+		return SRK(rwr, srkType, 0)
+	}
+	if !isPersistent(tpm2.TPMHandle(k.Parent)) {
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("tpmpqc: unsupported parent handle %#x", k.Parent)
+	}
+	return SRK(rwr, "", uint32(k.Parent))
+}
+
+// LoadKEMKeyFromTPMKey loads an ML-KEM TPMKey under parent.
+// If the key file carries a policy, password is used for its PolicyAuthValue branch.
+func LoadKEMKeyFromTPMKey(rwr transport.TPM, parent tpm2.NamedHandle, k *TPMKey, password []byte) (*KEMKey, error) {
+	public, private, err := k.Blobs()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := KeyPolicyFromTPMKey(k)
+	if err != nil {
+		return nil, err
+	}
+	kk, err := LoadKEMKey(rwr, parent, *public, *private)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		policy.Password = password
+		kk.Policy = policy
+	}
+	return kk, nil
+}
+
+// LoadSigningKeyFromTPMKey loads an ML-DSA TPMKey under parent.
+// If the key file carries a policy, password is used for its PolicyAuthValue branch.
+func LoadSigningKeyFromTPMKey(rwr transport.TPM, parent tpm2.NamedHandle, k *TPMKey, password []byte) (*SigningKey, error) {
+	public, private, err := k.Blobs()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := KeyPolicyFromTPMKey(k)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := LoadSigningKey(rwr, parent, *public, *private)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		policy.Password = password
+		sk.Policy = policy
+	}
+	return sk, nil
+}
+
+// TPMKey returns the loaded key, including its policy, as a TPMKey for parent.
+func (k *key) TPMKey(parent tpm2.TPMHandle, srkType string) (*TPMKey, error) {
+	if len(k.Private.Buffer) == 0 {
+		return nil, fmt.Errorf("tpmpqc: key has no private blob, it was opened from a persistent handle")
+	}
+	emptyAuth := k.Policy == nil || len(k.Policy.Password) == 0
+	tk, err := NewTPMKey(k.Public, k.Private, parent, srkType, emptyAuth)
+	if err != nil {
+		return nil, err
+	}
+	if k.Policy != nil {
+		tk.Policy, err = k.Policy.TPMPolicies()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tk, nil
+}
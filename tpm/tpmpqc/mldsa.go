@@ -0,0 +1,479 @@
+package tpmpqc
+
+import (
+	"crypto"
+	"crypto/mldsa"
+	"crypto/sha3"
+	"encoding/asn1"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const (
+	maxInputBuffer = 1024
+)
+
+var (
+	mldsa44OID = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 17}
+	mldsa65OID = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 18}
+	mldsa87OID = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 19}
+)
+
+// MLDSAParameterSet maps the security category used on the command line (44, 65, 87) to the TPM parameter set.
+func MLDSAParameterSet(size int) (tpm2.TPMMLDSAParameter, error) {
+	switch size {
+	case 44:
+		return tpm2.TPMMLDSA44, nil
+	case 65:
+		return tpm2.TPMMLDSA65, nil
+	case 87:
+		return tpm2.TPMMLDSA87, nil
+	}
+	return 0, fmt.Errorf("tpmpqc: unsupported mldsa parameter set %d", size)
+}
+
+// MLDSATemplate returns the template for an unrestricted ML-DSA signing key.
+func MLDSATemplate(parameterSet tpm2.TPMMLDSAParameter) tpm2.TPMTPublic {
+	return tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgMLDSA,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			SignEncrypt:         true,
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        true,
+		},
+		AuthPolicy: tpm2.TPM2BDigest{},
+		Parameters: tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgMLDSA,
+			&tpm2.TPMSMLDSAParms{
+				ParameterSet:    tpm2.TPMIMLDSAParam(parameterSet),
+				AllowExternalMu: false,
+			},
+		),
+	}
+}
+
+// SigningKey is a loaded TPM ML-DSA key.  It implements crypto.Signer by streaming
+// the message through SignSequenceStart, SequenceUpdate and SignSequenceComplete, or, for keys
+// with allowExternalMu, by computing mu locally and calling SignDigest.
+type SigningKey struct {
+	*key
+}
+
+var _ crypto.Signer = (*SigningKey)(nil)
+
+// CreateSigningKey creates a new ML-DSA key under parent and loads it.  If the TPM supports it
+// the key is created with allowExternalMu.
+// policy is optional; if set the key can only be used through a session that satisfies it.
+func CreateSigningKey(rwr transport.TPM, parent tpm2.NamedHandle, parameterSet tpm2.TPMMLDSAParameter, policy *KeyPolicy) (*SigningKey, error) {
+	template := MLDSATemplate(parameterSet)
+	extMu, err := SupportsExternalMu(rwr)
+	if err != nil {
+		return nil, err
+	}
+	if extMu {
+		template.Parameters = tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgMLDSA,
+			&tpm2.TPMSMLDSAParms{
+				ParameterSet:    tpm2.TPMIMLDSAParam(parameterSet),
+				AllowExternalMu: true,
+			},
+		)
+	}
+	k, err := createKey(rwr, parent, template, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
+
+// LoadSigningKey loads previously saved ML-DSA key blobs under parent.
+func LoadSigningKey(rwr transport.TPM, parent tpm2.NamedHandle, public tpm2.TPM2BPublic, private tpm2.TPM2BPrivate) (*SigningKey, error) {
+	k, err := loadKey(rwr, parent, public, private, tpm2.TPMAlgMLDSA)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
+
+// LoadSigningKeyFiles loads the key blobs written by SaveFiles.
+func LoadSigningKeyFiles(rwr transport.TPM, parent tpm2.NamedHandle, publicFile, privateFile string) (*SigningKey, error) {
+	k, err := loadKeyFiles(rwr, parent, publicFile, privateFile, tpm2.TPMAlgMLDSA)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
+
+// OpenPersistentSigningKey uses an ML-DSA key previously stored with Persist.
+func OpenPersistentSigningKey(rwr transport.TPM, handle tpm2.TPMHandle) (*SigningKey, error) {
+	k, err := openPersistentKey(rwr, handle, tpm2.TPMAlgMLDSA)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{k}, nil
+}
+
+// ParameterSet returns the ML-DSA parameter set of the key.
+func (k *SigningKey) ParameterSet() (tpm2.TPMMLDSAParameter, error) {
+	mldsaDetail, err := k.public.Parameters.MLDSADetail()
+	if err != nil {
+		return 0, fmt.Errorf("tpmpqc: can't get mldsa details %v", err)
+	}
+	return tpm2.TPMMLDSAParameter(mldsaDetail.ParameterSet), nil
+}
+
+// AllowsExternalMu reports whether the key was created with allowExternalMu and can be used with
+// SignDigest and VerifyDigestSignature.
+func (k *SigningKey) AllowsExternalMu() bool {
+	mldsaDetail, err := k.public.Parameters.MLDSADetail()
+	if err != nil {
+		return false
+	}
+	return bool(mldsaDetail.AllowExternalMu)
+}
+
+// PublicKey returns the key as a crypto/mldsa public key.
+func (k *SigningKey) PublicKey() (*mldsa.PublicKey, error) {
+	ps, err := k.ParameterSet()
+	if err != nil {
+		return nil, err
+	}
+	mldsaPubKey, err := k.public.Unique.MLDSA()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get mldsa unique %v", err)
+	}
+	params, err := mldsaParameters(ps)
+	if err != nil {
+		return nil, err
+	}
+	return mldsa.NewPublicKey(params, mldsaPubKey.Buffer)
+}
+
+// mldsaParameters maps a TPM parameter set to crypto/mldsa's.
+func mldsaParameters(ps tpm2.TPMMLDSAParameter) (mldsa.Parameters, error) {
+	switch ps {
+	case tpm2.TPMMLDSA44:
+		return mldsa.MLDSA44(), nil
+	case tpm2.TPMMLDSA65:
+		return mldsa.MLDSA65(), nil
+	case tpm2.TPMMLDSA87:
+		return mldsa.MLDSA87(), nil
+	}
+	return mldsa.Parameters{}, fmt.Errorf("tpmpqc: unsupported mldsa parameter set %v", ps)
+}
+
+// Public implements crypto.Signer.  It returns nil if the public area can't be parsed.
+func (k *SigningKey) Public() crypto.PublicKey {
+	pub, err := k.PublicKey()
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+// MarshalPKIXPublicKey returns the verification key as a DER SubjectPublicKeyInfo.
+func (k *SigningKey) MarshalPKIXPublicKey() ([]byte, error) {
+	ps, err := k.ParameterSet()
+	if err != nil {
+		return nil, err
+	}
+	mldsaPubKey, err := k.public.Unique.MLDSA()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get mldsa unique %v", err)
+	}
+	var oid asn1.ObjectIdentifier
+	switch ps {
+	case tpm2.TPMMLDSA44:
+		oid = mldsa44OID
+	case tpm2.TPMMLDSA65:
+		oid = mldsa65OID
+	case tpm2.TPMMLDSA87:
+		oid = mldsa87OID
+	default:
+		return nil, fmt.Errorf("tpmpqc: unsupported mldsa parameter set %v", ps)
+	}
+	return marshalPKIXPublicKey(oid, mldsaPubKey.Buffer)
+}
+
+// Sign implements crypto.Signer.  opts may be nil, crypto.Hash(0) or *mldsa.Options to set the context string.
+// The TPM generates its own hedging randomness so rand is ignored.
+func (k *SigningKey) Sign(_ io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	context, err := signatureContext(opts)
+	if err != nil {
+		return nil, err
+	}
+	var sig *tpm2.TPMTSignature
+	if k.AllowsExternalMu() {
+		pub, err := k.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		mu, err := ComputeMu(pub, message, context)
+		if err != nil {
+			return nil, err
+		}
+		sig, err = k.signDigest(mu)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sig, err = k.signSequence(message, context)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := sig.Signature.MLDSA()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get signature %v", err)
+	}
+	return s.Buffer, nil
+}
+
+// maxContextSize is the longest ML-DSA context string, its length is encoded in one byte.
+const maxContextSize = 255
+
+func checkContext(context string) error {
+	if len(context) > maxContextSize {
+		return fmt.Errorf("tpmpqc: mldsa context is %d bytes, at most %d are allowed", len(context), maxContextSize)
+	}
+	return nil
+}
+
+func signatureContext(opts crypto.SignerOpts) (string, error) {
+	if opts == nil {
+		return "", nil
+	}
+	if o, ok := opts.(*mldsa.Options); ok {
+		if err := checkContext(o.Context); err != nil {
+			return "", err
+		}
+		return o.Context, nil
+	}
+	if opts.HashFunc() != 0 {
+		return "", fmt.Errorf("tpmpqc: mldsa signs the message directly, got hash %v", opts.HashFunc())
+	}
+	return "", nil
+}
+
+// ComputeMu computes the message representative mu as specified in FIPS 204.
+// mu = SHAKE256(tr || 0x00 || len(ctx) || ctx || msg), where tr = SHAKE256(publicKeyBytes) is 64 bytes.
+// context can be at most 255 bytes.
+func ComputeMu(pk *mldsa.PublicKey, msg []byte, context string) ([]byte, error) {
+	if err := checkContext(context); err != nil {
+		return nil, err
+	}
+	H := sha3.NewSHAKE256()
+	H.Write(pk.Bytes())
+	var tr [64]byte
+	H.Read(tr[:])
+
+	H.Reset()
+	H.Write(tr[:])
+	H.Write([]byte{0x00}) // ML-DSA domain separator
+	H.Write([]byte{byte(len(context))})
+	H.Write([]byte(context))
+	H.Write(msg)
+	mu := make([]byte, 64)
+	H.Read(mu)
+	return mu, nil
+}
+
+// signDigest signs an externally computed mu with a single SignDigest call.
+func (k *SigningKey) signDigest(mu []byte) (*tpm2.TPMTSignature, error) {
+	rsp, err := tpm2.SignDigest{
+		KeyHandle: k.authHandle(),
+		Digest: tpm2.TPM2BDigest{
+			Buffer: mu,
+		},
+		Validation: tpm2.TPMTTKHashCheck{
+			Tag:       tpm2.TPMSTHashCheck,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't sign digest %v", err)
+	}
+	return &rsp.Signature, nil
+}
+
+// sequenceAuth returns the key handle for SignSequenceStart and VerifySequenceStart.  Keys without
+// a policy use an HMAC session with the empty auth value, salted if Salt is set.
+func (k *SigningKey) sequenceAuth() (tpm2.AuthHandle, func() error, error) {
+	keyAuth := k.authHandle()
+	if k.Policy != nil {
+		return keyAuth, func() error { return nil }, nil
+	}
+	opts := []tpm2.AuthOption{tpm2.Auth([]byte(""))}
+	if k.Salt != nil {
+		opts = k.Salt.options(opts...)
+	}
+	sess, closer, err := tpm2.HMACSession(k.rwr, tpm2.TPMAlgSHA256, 16, opts...)
+	if err != nil {
+		return tpm2.AuthHandle{}, nil, fmt.Errorf("tpmpqc: can't start session %v", err)
+	}
+	keyAuth.Auth = sess
+	return keyAuth, closer, nil
+}
+
+// updateSequence sends all but the last maxInputBuffer bytes of data and returns the rest.
+func (k *SigningKey) updateSequence(seq tpm2.AuthHandle, data []byte) ([]byte, error) {
+	for len(data) > maxInputBuffer {
+		_, err := tpm2.SequenceUpdate{
+			SequenceHandle: seq,
+			Buffer: tpm2.TPM2BMaxBuffer{
+				Buffer: data[:maxInputBuffer],
+			},
+		}.Execute(k.rwr)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't update sequence %v", err)
+		}
+		data = data[maxInputBuffer:]
+	}
+	return data, nil
+}
+
+// signSequence streams data through SignSequenceStart + SequenceUpdate + SignSequenceComplete.
+func (k *SigningKey) signSequence(data []byte, context string) (*tpm2.TPMTSignature, error) {
+	objAuth := &tpm2.TPM2BAuth{
+		Buffer: []byte(""),
+	}
+
+	keyAuth, closer, err := k.sequenceAuth()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = closer()
+	}()
+
+	sSeqStart, err := tpm2.SignSequenceStart{
+		KeyHandle: keyAuth,
+		Auth:      *objAuth,
+		Context: tpm2.TPM2BSignatureContext{
+			Buffer: []byte(context),
+		},
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't start sequence %v", err)
+	}
+
+	authHandle := tpm2.AuthHandle{
+		Name:   k.name,
+		Handle: sSeqStart.SequenceHandle,
+		Auth:   tpm2.PasswordAuth(objAuth.Buffer),
+	}
+
+	data, err = k.updateSequence(authHandle, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key handle of SignSequenceComplete needs USER authorization as well
+	sSeqComplete, err := tpm2.SignSequenceComplete{
+		SequenceHandle: authHandle,
+		KeyHandle:      k.authHandle(),
+		Buffer: tpm2.TPM2BMaxBuffer{
+			Buffer: data,
+		},
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't complete sequence %v", err)
+	}
+	return &sSeqComplete.Signature, nil
+}
+
+// Verify checks signature over message on the TPM.  opts may be nil or *mldsa.Options to set the context string.
+// Keys with allowExternalMu use a single VerifyDigestSignature call, others a verify sequence.
+func (k *SigningKey) Verify(message, signature []byte, opts *mldsa.Options) error {
+	context := ""
+	if opts != nil {
+		context = opts.Context
+	}
+	if err := checkContext(context); err != nil {
+		return err
+	}
+	sig := mldsaSignature(signature)
+
+	if k.AllowsExternalMu() {
+		pub, err := k.PublicKey()
+		if err != nil {
+			return err
+		}
+		mu, err := ComputeMu(pub, message, context)
+		if err != nil {
+			return err
+		}
+		_, err = tpm2.VerifyDigestSignature{
+			KeyHandle: k.Handle(),
+			Digest: tpm2.TPM2BDigest{
+				Buffer: mu,
+			},
+			Signature: sig,
+		}.Execute(k.rwr)
+		if err != nil {
+			return fmt.Errorf("tpmpqc: can't verify digest signature %v", err)
+		}
+		return nil
+	}
+
+	objAuth := &tpm2.TPM2BAuth{
+		Buffer: []byte(""),
+	}
+	keyAuth, closer, err := k.sequenceAuth()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = closer()
+	}()
+
+	verifySeqStart, err := tpm2.VerifySequenceStart{
+		KeyHandle: keyAuth,
+		Auth:      *objAuth,
+		Hint:      tpm2.TPM2BData{},
+		Context: tpm2.TPM2BSignatureContext{
+			Buffer: []byte(context),
+		},
+	}.Execute(k.rwr)
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't start verify sequence %v", err)
+	}
+	authHandle := tpm2.AuthHandle{
+		Name:   k.name,
+		Handle: verifySeqStart.SequenceHandle,
+		Auth:   tpm2.PasswordAuth(objAuth.Buffer),
+	}
+
+	// VerifySequenceComplete has no buffer, everything goes through SequenceUpdate
+	rest, err := k.updateSequence(authHandle, message)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		_, err = tpm2.SequenceUpdate{
+			SequenceHandle: authHandle,
+			Buffer: tpm2.TPM2BMaxBuffer{
+				Buffer: rest,
+			},
+		}.Execute(k.rwr)
+		if err != nil {
+			return fmt.Errorf("tpmpqc: can't update sequence %v", err)
+		}
+	}
+
+	_, err = tpm2.VerifySequenceComplete{
+		SequenceHandle: authHandle,
+		KeyHandle:      k.Handle(),
+		Signature:      sig,
+	}.Execute(k.rwr)
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't verify sequence %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"strings"
+	"testing"
+
+	"main/faketpm"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// signAndVerify signs a message larger than the TPM input buffer with k and checks the signature in Go
+// and on the TPM.
+func signAndVerify(t *testing.T, k *SigningKey, context string) {
+	t.Helper()
+	message := bytes.Repeat([]byte("tpmpqc"), 1000)
+	sig, err := k.Sign(nil, message, &mldsa.Options{Context: context})
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() = %v", err)
+	}
+	if err := mldsa.Verify(pub, message, sig, &mldsa.Options{Context: context}); err != nil {
+		t.Errorf("mldsa.Verify() = %v", err)
+	}
+	if err := mldsa.Verify(pub, message, sig, &mldsa.Options{Context: context + "x"}); err == nil {
+		t.Errorf("mldsa.Verify() with another context succeeded")
+	}
+	if !k.AllowsExternalMu() {
+		// the fake has no TPM2_VerifyDigestSignature, keys with allowExternalMu are only checked in Go
+		if err := k.Verify(message, sig, &mldsa.Options{Context: context}); err != nil {
+			t.Errorf("Verify() = %v", err)
+		}
+		message[0] ^= 1
+		if err := k.Verify(message, sig, &mldsa.Options{Context: context}); err == nil {
+			t.Errorf("Verify() of a changed message succeeded")
+		}
+	}
+}
+
+func TestSigningKeySignSequence(t *testing.T) {
+	rwr, srk := openFakeTPM(t, faketpm.DefaultParameterSets)
+	for _, ps := range []tpm2.TPMMLDSAParameter{tpm2.TPMMLDSA44, tpm2.TPMMLDSA65, tpm2.TPMMLDSA87} {
+		k, err := CreateSigningKey(rwr, srk, ps, nil)
+		if err != nil {
+			t.Fatalf("CreateSigningKey(%v) = %v", ps, err)
+		}
+		if k.AllowsExternalMu() {
+			t.Fatalf("parameter set %v: key allows external mu on a TPM without it", ps)
+		}
+		signAndVerify(t, k, "")
+		signAndVerify(t, k, "tpmpqc test")
+
+		// the blobs load again and sign for the same public key
+		public, private := k.TPMPublic(), k.Private
+		if err := k.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		k, err = LoadSigningKey(rwr, srk, public, private)
+		if err != nil {
+			t.Fatalf("parameter set %v: LoadSigningKey() = %v", ps, err)
+		}
+		signAndVerify(t, k, "")
+		k.Close()
+	}
+}
+
+func TestSigningKeySignDigest(t *testing.T) {
+	sets := faketpm.DefaultParameterSets
+	sets.ExtMu = true
+	rwr, srk := openFakeTPM(t, sets)
+	for _, ps := range []tpm2.TPMMLDSAParameter{tpm2.TPMMLDSA44, tpm2.TPMMLDSA65, tpm2.TPMMLDSA87} {
+		k, err := CreateSigningKey(rwr, srk, ps, nil)
+		if err != nil {
+			t.Fatalf("CreateSigningKey(%v) = %v", ps, err)
+		}
+		if !k.AllowsExternalMu() {
+			t.Fatalf("parameter set %v: key doesn't allow external mu", ps)
+		}
+		signAndVerify(t, k, "")
+		signAndVerify(t, k, "tpmpqc test")
+		k.Close()
+	}
+}
+
+func TestSigningKeyContextTooLong(t *testing.T) {
+	rwr, srk := openFakeTPM(t, faketpm.DefaultParameterSets)
+	k, err := CreateSigningKey(rwr, srk, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	defer k.Close()
+	context := strings.Repeat("c", maxContextSize+1)
+	if _, err := k.Sign(nil, []byte("message"), &mldsa.Options{Context: context}); err == nil {
+		t.Errorf("Sign() with a %d byte context succeeded", len(context))
+	}
+	if _, err := k.NewSignStream(context); err == nil {
+		t.Errorf("NewSignStream() with a %d byte context succeeded", len(context))
+	}
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() = %v", err)
+	}
+	if _, err := ComputeMu(pub, []byte("message"), context); err == nil {
+		t.Errorf("ComputeMu() with a %d byte context succeeded", len(context))
+	}
+}
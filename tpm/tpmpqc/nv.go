@@ -0,0 +1,354 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// MLDSA87CertificateSize is room for an ML-DSA-87 certificate from an ML-DSA-87 CA: a 2592 byte public
+// key, a 4627 byte signature and about 1 KB for names and extensions.
+const MLDSA87CertificateSize = 8192
+
+// NVAuth protects the NV indices of a certificate.
+//
+// Without a Policy the indices have authRead/authWrite and Password is their auth value.  With a Policy
+// they have policyRead/policyWrite and the policy's digest as authPolicy, Policy.Password becomes the
+// auth value for PolicyAuthValue.  ownerRead is always set: a certificate isn't secret, so it can also be
+// read with owner authorization, eg tpm2_nvread -C o.
+type NVAuth struct {
+	Password []byte
+	Policy   *KeyPolicy
+}
+
+func (a *NVAuth) authValue() []byte {
+	if a == nil {
+		return nil
+	}
+	if a.Policy != nil {
+		return a.Policy.Password
+	}
+	return a.Password
+}
+
+func (a *NVAuth) session() tpm2.Session {
+	if a == nil {
+		return tpm2.PasswordAuth(nil)
+	}
+	if a.Policy != nil {
+		return a.Policy.Session()
+	}
+	return tpm2.PasswordAuth(a.Password)
+}
+
+// nvLimits returns TPM_PT_NV_INDEX_MAX, the largest NV index, and TPM_PT_NV_BUFFER_MAX, the most
+// TPM2_NV_Read and TPM2_NV_Write take at once.  The minimums of the PC client profile are used if the
+// TPM doesn't report them.
+func nvLimits(rwr transport.TPM) (indexMax int, bufferMax int, err error) {
+	indexMax, bufferMax = 2048, 512
+	for _, p := range []struct {
+		pt tpm2.TPMPT
+		v  *int
+	}{
+		{tpm2.TPMPTNVIndexMax, &indexMax},
+		{tpm2.TPMPTNVBufferMax, &bufferMax},
+	} {
+		getRsp, err := tpm2.GetCapability{
+			Capability:    tpm2.TPMCapTPMProperties,
+			Property:      uint32(p.pt),
+			PropertyCount: 1,
+		}.Execute(rwr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("tpmpqc: can't get capabilities %v", err)
+		}
+		tp, err := getRsp.CapabilityData.Data.TPMProperties()
+		if err != nil {
+			return 0, 0, fmt.Errorf("tpmpqc: can't read capabilities %v", err)
+		}
+		if len(tp.TPMProperty) > 0 && tp.TPMProperty[0].Property == p.pt && tp.TPMProperty[0].Value > 0 {
+			*p.v = int(tp.TPMProperty[0].Value)
+		}
+	}
+	return indexMax, bufferMax, nil
+}
+
+// nvIndices returns the indices and their sizes that hold size bytes: the first ones are
+// TPM_PT_NV_INDEX_MAX large, the last one takes the rest.
+func nvIndices(rwr transport.TPM, index tpm2.TPMHandle, size int) ([]tpm2.TPMHandle, []int, error) {
+	if size <= 0 {
+		return nil, nil, fmt.Errorf("tpmpqc: invalid NV size %d", size)
+	}
+	indexMax, _, err := nvLimits(rwr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var handles []tpm2.TPMHandle
+	var sizes []int
+	for h := index; size > 0; h++ {
+		if h>>24 != tpm2.TPMHandle(tpm2.TPMHTNVIndex) {
+			return nil, nil, fmt.Errorf("tpmpqc: NV index %#x out of range", h)
+		}
+		n := min(size, indexMax)
+		handles = append(handles, h)
+		sizes = append(sizes, n)
+		size -= n
+	}
+	return handles, sizes, nil
+}
+
+func nvReadPublic(rwr transport.TPM, index tpm2.TPMHandle) (*tpm2.TPMSNVPublic, tpm2.TPM2BName, error) {
+	rsp, err := tpm2.NVReadPublic{
+		NVIndex: index,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't read NV index %#x: %v", index, err)
+	}
+	pub, err := rsp.NVPublic.Contents()
+	if err != nil {
+		return nil, tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't read NV public %v", err)
+	}
+	return pub, rsp.NVName, nil
+}
+
+// DefineNVCertificate defines consecutive NV indices starting at index with room for size bytes, eg
+// MLDSA87CertificateSize, and returns how many it used.  Each index holds up to TPM_PT_NV_INDEX_MAX
+// bytes, often 2 KB, so an ML-DSA certificate usually takes several.
+func DefineNVCertificate(rwr transport.TPM, index tpm2.TPMHandle, size int, auth *NVAuth) (int, error) {
+	handles, sizes, err := nvIndices(rwr, index, size)
+	if err != nil {
+		return 0, err
+	}
+	attrs := tpm2.TPMANV{
+		NT:        tpm2.TPMNTOrdinary,
+		OwnerRead: true,
+		AuthRead:  true,
+		AuthWrite: true,
+	}
+	var authPolicy tpm2.TPM2BDigest
+	if auth != nil && auth.Policy != nil {
+		if authPolicy, err = auth.Policy.Digest(); err != nil {
+			return 0, err
+		}
+		attrs.AuthRead, attrs.AuthWrite = false, false
+		attrs.PolicyRead, attrs.PolicyWrite = true, true
+	}
+	for i, h := range handles {
+		_, err := tpm2.NVDefineSpace{
+			AuthHandle: tpm2.TPMRHOwner,
+			Auth: tpm2.TPM2BAuth{
+				Buffer: auth.authValue(),
+			},
+			PublicInfo: tpm2.New2B(tpm2.TPMSNVPublic{
+				NVIndex:    h,
+				NameAlg:    tpm2.TPMAlgSHA256,
+				Attributes: attrs,
+				AuthPolicy: authPolicy,
+				DataSize:   uint16(sizes[i]),
+			}),
+		}.Execute(rwr)
+		if err != nil {
+			// don't leave a partial set behind
+			for _, d := range handles[:i] {
+				undefineNV(rwr, d)
+			}
+			return 0, fmt.Errorf("tpmpqc: can't define NV index %#x: %v", h, err)
+		}
+	}
+	return len(handles), nil
+}
+
+// UndefineNVCertificate removes the indices DefineNVCertificate defined for size bytes.
+func UndefineNVCertificate(rwr transport.TPM, index tpm2.TPMHandle, size int) error {
+	handles, _, err := nvIndices(rwr, index, size)
+	if err != nil {
+		return err
+	}
+	for _, h := range handles {
+		if err := undefineNV(rwr, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func undefineNV(rwr transport.TPM, index tpm2.TPMHandle) error {
+	_, name, err := nvReadPublic(rwr, index)
+	if err != nil {
+		return err
+	}
+	_, err = tpm2.NVUndefineSpace{
+		AuthHandle: tpm2.TPMRHOwner,
+		NVIndex: tpm2.NamedHandle{
+			Handle: index,
+			Name:   name,
+		},
+	}.Execute(rwr)
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't undefine NV index %#x: %v", index, err)
+	}
+	return nil
+}
+
+// WriteNVCertificate writes a DER certificate, or any other DER encoded structure like the public key
+// from MarshalPKIXPublicKey, to the indices defined by DefineNVCertificate.
+func WriteNVCertificate(rwr transport.TPM, index tpm2.TPMHandle, der []byte, auth *NVAuth) error {
+	if _, err := derLength(der); err != nil {
+		return err
+	}
+	_, bufferMax, err := nvLimits(rwr)
+	if err != nil {
+		return err
+	}
+	// check there is room before writing anything
+	var sizes []int
+	for h, room := index, 0; room < len(der); h++ {
+		pub, _, err := nvReadPublic(rwr, h)
+		if err != nil {
+			return fmt.Errorf("tpmpqc: %d bytes don't fit in the NV indices: %v", len(der), err)
+		}
+		sizes = append(sizes, int(pub.DataSize))
+		room += int(pub.DataSize)
+	}
+	rest := der
+	for i, size := range sizes {
+		h := index + tpm2.TPMHandle(i)
+		chunk := rest[:min(len(rest), size)]
+		for off := 0; off < len(chunk); off += bufferMax {
+			// the name changes when the index is first written
+			_, name, err := nvReadPublic(rwr, h)
+			if err != nil {
+				return err
+			}
+			_, err = tpm2.NVWrite{
+				AuthHandle: tpm2.AuthHandle{
+					Handle: h,
+					Name:   name,
+					Auth:   auth.session(),
+				},
+				NVIndex: tpm2.NamedHandle{
+					Handle: h,
+					Name:   name,
+				},
+				Data: tpm2.TPM2BMaxNVBuffer{
+					Buffer: chunk[off:min(off+bufferMax, len(chunk))],
+				},
+				Offset: uint16(off),
+			}.Execute(rwr)
+			if err != nil {
+				return fmt.Errorf("tpmpqc: can't write NV index %#x: %v", h, err)
+			}
+		}
+		rest = rest[len(chunk):]
+	}
+	return nil
+}
+
+// ReadNVCertificate reads the DER structure written by WriteNVCertificate.  Its length comes from the
+// DER header, so indices defined larger than needed are fine.  A nil auth reads with owner
+// authorization.
+func ReadNVCertificate(rwr transport.TPM, index tpm2.TPMHandle, auth *NVAuth) ([]byte, error) {
+	_, bufferMax, err := nvLimits(rwr)
+	if err != nil {
+		return nil, err
+	}
+	var der []byte
+	// the total length is known from the DER header after the first read
+	total := -1
+	for h := index; total < 0 || len(der) < total; h++ {
+		pub, name, err := nvReadPublic(rwr, h)
+		if err != nil {
+			return nil, err
+		}
+		authHandle := tpm2.AuthHandle{
+			Handle: tpm2.TPMRHOwner,
+			Auth:   tpm2.PasswordAuth(nil),
+		}
+		if auth != nil {
+			authHandle = tpm2.AuthHandle{
+				Handle: h,
+				Name:   name,
+				Auth:   auth.session(),
+			}
+		}
+		size := int(pub.DataSize)
+		for off := 0; off < size && (total < 0 || len(der) < total); {
+			n := min(bufferMax, size-off)
+			if total >= 0 {
+				n = min(n, total-len(der))
+			}
+			rsp, err := tpm2.NVRead{
+				AuthHandle: authHandle,
+				NVIndex: tpm2.NamedHandle{
+					Handle: h,
+					Name:   name,
+				},
+				Size:   uint16(n),
+				Offset: uint16(off),
+			}.Execute(rwr)
+			if err != nil {
+				return nil, fmt.Errorf("tpmpqc: can't read NV index %#x: %v", h, err)
+			}
+			der = append(der, rsp.Data.Buffer...)
+			off += n
+			if total < 0 {
+				if total, err = derLength(der); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return der[:total], nil
+}
+
+// derLength returns the length of the DER SEQUENCE at the start of b, header included.
+func derLength(b []byte) (int, error) {
+	if len(b) < 2 || b[0] != 0x30 {
+		return 0, fmt.Errorf("tpmpqc: NV data isn't a DER SEQUENCE")
+	}
+	if b[1] < 0x80 {
+		return 2 + int(b[1]), nil
+	}
+	n := int(b[1] & 0x7f)
+	if n == 0 || n > 4 || len(b) < 2+n {
+		return 0, fmt.Errorf("tpmpqc: unsupported DER length")
+	}
+	l := 0
+	for _, c := range b[2 : 2+n] {
+		l = l<<8 | int(c)
+	}
+	return 2 + n + l, nil
+}
+
+// LoadTLSCertificate pairs the certificate at certIndex with the persistent ML-DSA key at keyHandle.
+// The certificate must be for that key.  The tls.Certificate signs through the TPM, so rwr has to stay
+// open while it's in use.
+func LoadTLSCertificate(rwr transport.TPM, keyHandle, certIndex tpm2.TPMHandle, auth *NVAuth) (*tls.Certificate, error) {
+	k, err := OpenPersistentSigningKey(rwr, keyHandle)
+	if err != nil {
+		return nil, err
+	}
+	der, err := ReadNVCertificate(rwr, certIndex, auth)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse certificate from NV index %#x: %v", certIndex, err)
+	}
+	spki, err := k.MarshalPKIXPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(spki, cert.RawSubjectPublicKeyInfo) {
+		return nil, fmt.Errorf("tpmpqc: certificate in NV index %#x isn't for key %#x", certIndex, keyHandle)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  k,
+		Leaf:        cert,
+	}, nil
+}
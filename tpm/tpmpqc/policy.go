@@ -0,0 +1,312 @@
+package tpmpqc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const (
+	// PolicyTypePCR binds the key to the current values of a set of sha256 PCRs (TPM2_PolicyPCR)
+	PolicyTypePCR = "pcr"
+	// PolicyTypePassword requires the key's auth value (TPM2_PolicyAuthValue)
+	PolicyTypePassword = "password"
+	// PolicyTypePCROrPassword accepts either of the above (TPM2_PolicyOR).  It can't be stored in a key
+	// file either, see TPMPolicies.
+	PolicyTypePCROrPassword = "pcr_or_password"
+	// PolicyTypeDigest uses a precomputed AuthPolicy, eg PolicySignedDigest or PolicyAuthorizeDigest,
+	// satisfied by AuthSession.  It can't be stored in a key file.
+	PolicyTypeDigest = "digest"
+)
+
+// KeyPolicy describes the authorization policy of a TPM PQC key.
+//
+// Keys created with a KeyPolicy have userWithAuth cleared, so every use of the key (SignSequenceStart,
+// SignSequenceComplete, Decapsulate) has to go through a policy session that satisfies AuthPolicy.
+type KeyPolicy struct {
+	Type string
+	// PCRs in the sha256 bank the key is bound to
+	PCRs []uint
+	// PCRDigest is sha256 over the selected PCR values at the time the key was created.
+	PCRDigest []byte
+	// Password is the key's auth value.  For PolicyTypePCROrPassword, setting it selects the password
+	// branch when the key is used, otherwise the PCR branch is used.
+	Password []byte
+
+	// AuthPolicy and AuthSession are used for PolicyTypeDigest
+	AuthPolicy  tpm2.TPM2BDigest
+	AuthSession tpm2.Session
+}
+
+// NewPCRPolicy reads the current values of pcrs and returns a policy bound to them.  PCRs holds them
+// sorted and without duplicates.
+func NewPCRPolicy(rwr transport.TPM, pcrs []uint) (*KeyPolicy, error) {
+	pcrs = normalizePCRs(pcrs)
+	d, err := ReadPCRDigest(rwr, pcrs)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPolicy{
+		Type:      PolicyTypePCR,
+		PCRs:      pcrs,
+		PCRDigest: d,
+	}, nil
+}
+
+// ReadPCRDigest returns sha256 over the concatenated sha256 bank values of pcrs, as used by TPM2_PolicyPCR.
+// The TPM concatenates the values in the order of the selection bitmap, so pcrs are taken in ascending
+// order and each one once, whatever order they are given in.
+func ReadPCRDigest(rwr transport.TPM, pcrs []uint) ([]byte, error) {
+	h := sha256.New()
+	// read them one by one, the TPM returns at most 8 digests per call
+	for _, pcr := range normalizePCRs(pcrs) {
+		pcrReadRsp, err := tpm2.PCRRead{
+			PCRSelectionIn: pcrSelection([]uint{pcr}),
+		}.Execute(rwr)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't read pcr %d: %v", pcr, err)
+		}
+		if len(pcrReadRsp.PCRValues.Digests) != 1 {
+			return nil, fmt.Errorf("tpmpqc: pcr %d not returned by the TPM", pcr)
+		}
+		h.Write(pcrReadRsp.PCRValues.Digests[0].Buffer)
+	}
+	return h.Sum(nil), nil
+}
+
+// normalizePCRs returns pcrs sorted and without duplicates, the order of a TPMS_PCR_SELECTION bitmap.
+func normalizePCRs(pcrs []uint) []uint {
+	return slices.Compact(slices.Sorted(slices.Values(pcrs)))
+}
+
+func pcrSelection(pcrs []uint) tpm2.TPMLPCRSelection {
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{
+			{
+				Hash:      tpm2.TPMAlgSHA256,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+			},
+		},
+	}
+}
+
+func (p *KeyPolicy) pcrPolicy() tpm2.PolicyPCR {
+	return tpm2.PolicyPCR{
+		PolicySession: tpm2.TPMRHNull,
+		PcrDigest: tpm2.TPM2BDigest{
+			Buffer: p.PCRDigest,
+		},
+		Pcrs: pcrSelection(p.PCRs),
+	}
+}
+
+func branchDigest(update func(*tpm2.PolicyCalculator) error) (tpm2.TPM2BDigest, error) {
+	pol, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	if err != nil {
+		return tpm2.TPM2BDigest{}, err
+	}
+	if err := update(pol); err != nil {
+		return tpm2.TPM2BDigest{}, err
+	}
+	return tpm2.TPM2BDigest{Buffer: pol.Hash().Digest}, nil
+}
+
+func (p *KeyPolicy) pcrDigest() (tpm2.TPM2BDigest, error) {
+	return branchDigest(p.pcrPolicy().Update)
+}
+
+func (p *KeyPolicy) passwordDigest() (tpm2.TPM2BDigest, error) {
+	return branchDigest(tpm2.PolicyAuthValue{}.Update)
+}
+
+func (p *KeyPolicy) branches() (tpm2.TPMLDigest, error) {
+	pcrDigest, err := p.pcrDigest()
+	if err != nil {
+		return tpm2.TPMLDigest{}, err
+	}
+	passwordDigest, err := p.passwordDigest()
+	if err != nil {
+		return tpm2.TPMLDigest{}, err
+	}
+	return tpm2.TPMLDigest{
+		Digests: []tpm2.TPM2BDigest{pcrDigest, passwordDigest},
+	}, nil
+}
+
+// Digest computes the authPolicy for the key template.
+func (p *KeyPolicy) Digest() (tpm2.TPM2BDigest, error) {
+	switch p.Type {
+	case PolicyTypePCR:
+		return p.pcrDigest()
+	case PolicyTypePassword:
+		return p.passwordDigest()
+	case PolicyTypePCROrPassword:
+		b, err := p.branches()
+		if err != nil {
+			return tpm2.TPM2BDigest{}, err
+		}
+		return branchDigest(tpm2.PolicyOr{PHashList: b}.Update)
+	case PolicyTypeDigest:
+		return p.AuthPolicy, nil
+	}
+	return tpm2.TPM2BDigest{}, fmt.Errorf("tpmpqc: unsupported policy type %q", p.Type)
+}
+
+// apply sets the policy on a key template and returns the sensitive area carrying the auth value.
+func (p *KeyPolicy) apply(template *tpm2.TPMTPublic) (tpm2.TPM2BSensitiveCreate, error) {
+	d, err := p.Digest()
+	if err != nil {
+		return tpm2.TPM2BSensitiveCreate{}, err
+	}
+	template.AuthPolicy = d
+	template.ObjectAttributes.UserWithAuth = false
+	return tpm2.TPM2BSensitiveCreate{
+		Sensitive: &tpm2.TPMSSensitiveCreate{
+			UserAuth: tpm2.TPM2BAuth{
+				Buffer: p.Password,
+			},
+		},
+	}, nil
+}
+
+func (p *KeyPolicy) usePassword() bool {
+	return p.Type == PolicyTypePassword || (p.Type == PolicyTypePCROrPassword && len(p.Password) > 0)
+}
+
+// Session returns a just-in-time policy session which satisfies the policy for one command.
+func (p *KeyPolicy) Session() tpm2.Session {
+	if p.Type == PolicyTypeDigest {
+		return p.AuthSession
+	}
+	var opts []tpm2.AuthOption
+	if p.usePassword() {
+		opts = append(opts, tpm2.Auth(p.Password))
+	}
+	return tpm2.Policy(tpm2.TPMAlgSHA256, 16, p.Callback(), opts...)
+}
+
+// Callback runs the policy commands in an existing policy session, eg as the approved policy of
+// PolicyAuthorizeSession.
+func (p *KeyPolicy) Callback() tpm2.PolicyCallback {
+	return func(rwr transport.TPM, handle tpm2.TPMISHPolicy, _ tpm2.TPM2BNonce) error {
+		if p.usePassword() {
+			_, err := tpm2.PolicyAuthValue{
+				PolicySession: handle,
+			}.Execute(rwr)
+			if err != nil {
+				return err
+			}
+		} else {
+			// an empty digest makes the TPM use the current PCR values, which
+			// only reproduces the authPolicy if they are unchanged
+			_, err := tpm2.PolicyPCR{
+				PolicySession: handle,
+				Pcrs:          pcrSelection(p.PCRs),
+			}.Execute(rwr)
+			if err != nil {
+				return err
+			}
+		}
+		if p.Type != PolicyTypePCROrPassword {
+			return nil
+		}
+		b, err := p.branches()
+		if err != nil {
+			return err
+		}
+		_, err = tpm2.PolicyOr{
+			PolicySession: handle,
+			PHashList:     b,
+		}.Execute(rwr)
+		return err
+	}
+}
+
+// TPMPolicies returns the policy in the form stored in a TSS2 PRIVATE KEY file.
+//
+// The key file draft keeps authPolicy for PolicyAuthorize (signed) policies, so tpm2-openssl and
+// openssl_tpm2_engine can't satisfy a PolicyOR written there.  PolicyTypePCROrPassword keys are
+// refused instead of written to a file only this package can load.
+func (p *KeyPolicy) TPMPolicies() ([]TPMPolicy, error) {
+	switch p.Type {
+	case PolicyTypePCR:
+		return []TPMPolicy{{
+			CommandCode:   int(tpm2.TPMCCPolicyPCR),
+			CommandPolicy: append(tpm2.Marshal(tpm2.TPM2BDigest{Buffer: p.PCRDigest}), tpm2.Marshal(pcrSelection(p.PCRs))...),
+		}}, nil
+	case PolicyTypePassword:
+		return []TPMPolicy{{
+			CommandCode:   int(tpm2.TPMCCPolicyAuthValue),
+			CommandPolicy: []byte{},
+		}}, nil
+	case PolicyTypePCROrPassword:
+		return nil, fmt.Errorf("tpmpqc: %s policies can't be stored in a TSS2 key file", p.Type)
+	}
+	return nil, fmt.Errorf("tpmpqc: unsupported policy type %q", p.Type)
+}
+
+// KeyPolicyFromTPMKey reconstructs the policy written by TPMPolicies.  It returns nil if the key has none.
+// The password is not stored in the key file and has to be set by the caller.
+//
+// Only the policies TPMPolicies writes are accepted: a single PolicyPCR over the sha256 bank or a single
+// PolicyAuthValue.  Anything else, eg PolicyPCR followed by PolicyAuthValue as tpm2-openssl writes it or
+// a sha1 or sha384 selection, is an error rather than a policy session that can never match the key.
+func KeyPolicyFromTPMKey(k *TPMKey) (*KeyPolicy, error) {
+	if len(k.Policy) == 0 {
+		return nil, nil
+	}
+	if len(k.AuthPolicy) != 0 {
+		return nil, fmt.Errorf("tpmpqc: signed policies (authPolicy) are not supported")
+	}
+	if len(k.Policy) != 1 {
+		return nil, fmt.Errorf("tpmpqc: policies of %d commands are not supported, only a single PolicyPCR or PolicyAuthValue", len(k.Policy))
+	}
+	e := k.Policy[0]
+	switch tpm2.TPMCC(e.CommandCode) {
+	case tpm2.TPMCCPolicyPCR:
+		// pcrDigest (TPM2B_DIGEST) followed by pcrs (TPML_PCR_SELECTION)
+		d, err := tpm2.Unmarshal[tpm2.TPM2BDigest](e.CommandPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't unmarshal PolicyPCR digest %v", err)
+		}
+		if len(d.Buffer) != sha256.Size {
+			return nil, fmt.Errorf("tpmpqc: PolicyPCR digest is %d bytes, want a sha256 digest", len(d.Buffer))
+		}
+		rest := e.CommandPolicy[2+len(d.Buffer):]
+		sel, err := tpm2.Unmarshal[tpm2.TPMLPCRSelection](rest)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't unmarshal PolicyPCR selection %v", err)
+		}
+		if len(tpm2.Marshal(sel)) != len(rest) {
+			return nil, fmt.Errorf("tpmpqc: trailing data after PolicyPCR selection")
+		}
+		if len(sel.PCRSelections) != 1 || sel.PCRSelections[0].Hash != tpm2.TPMAlgSHA256 {
+			return nil, fmt.Errorf("tpmpqc: only PolicyPCR over the sha256 bank is supported")
+		}
+		var pcrs []uint
+		for i, b := range sel.PCRSelections[0].PCRSelect {
+			for bit := 0; bit < 8; bit++ {
+				if b&(1<<bit) != 0 {
+					pcrs = append(pcrs, uint(i*8+bit))
+				}
+			}
+		}
+		if len(pcrs) == 0 {
+			return nil, fmt.Errorf("tpmpqc: PolicyPCR selects no PCRs")
+		}
+		return &KeyPolicy{
+			Type:      PolicyTypePCR,
+			PCRs:      pcrs,
+			PCRDigest: d.Buffer,
+		}, nil
+	case tpm2.TPMCCPolicyAuthValue:
+		if len(e.CommandPolicy) != 0 {
+			return nil, fmt.Errorf("tpmpqc: PolicyAuthValue has no parameters")
+		}
+		return &KeyPolicy{Type: PolicyTypePassword}, nil
+	}
+	return nil, fmt.Errorf("tpmpqc: unsupported policy command %#x", e.CommandCode)
+}
@@ -0,0 +1,77 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"slices"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestKeyPolicyFromTPMKey(t *testing.T) {
+	// the fake has no TPM2_PCR_Read, the digest only has to survive the round trip
+	pcrPolicy := &KeyPolicy{
+		Type:      PolicyTypePCR,
+		PCRs:      []uint{0, 7, 23},
+		PCRDigest: bytes.Repeat([]byte{0x5a}, sha256.Size),
+	}
+	for _, p := range []*KeyPolicy{pcrPolicy, {Type: PolicyTypePassword}} {
+		t.Run(p.Type, func(t *testing.T) {
+			policies, err := p.TPMPolicies()
+			if err != nil {
+				t.Fatalf("TPMPolicies() = %v", err)
+			}
+			got, err := KeyPolicyFromTPMKey(&TPMKey{Policy: policies})
+			if err != nil {
+				t.Fatalf("KeyPolicyFromTPMKey() = %v", err)
+			}
+			if got.Type != p.Type || !slices.Equal(got.PCRs, p.PCRs) || !bytes.Equal(got.PCRDigest, p.PCRDigest) {
+				t.Errorf("KeyPolicyFromTPMKey() = %+v, want %+v", got, p)
+			}
+			want, err := p.Digest()
+			if err != nil {
+				t.Fatalf("Digest() = %v", err)
+			}
+			d, err := got.Digest()
+			if err != nil {
+				t.Fatalf("Digest() = %v", err)
+			}
+			if !bytes.Equal(d.Buffer, want.Buffer) {
+				t.Errorf("Digest() after the round trip = %x, want %x", d.Buffer, want.Buffer)
+			}
+		})
+	}
+
+	pcr, err := pcrPolicy.TPMPolicies()
+	if err != nil {
+		t.Fatalf("TPMPolicies() = %v", err)
+	}
+	authValue := TPMPolicy{CommandCode: int(tpm2.TPMCCPolicyAuthValue), CommandPolicy: []byte{}}
+	bank := func(hash tpm2.TPMIAlgHash) TPMPolicy {
+		sel := pcrSelection(pcrPolicy.PCRs)
+		sel.PCRSelections[0].Hash = hash
+		return TPMPolicy{
+			CommandCode:   int(tpm2.TPMCCPolicyPCR),
+			CommandPolicy: append(tpm2.Marshal(tpm2.TPM2BDigest{Buffer: pcrPolicy.PCRDigest}), tpm2.Marshal(sel)...),
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		policy []TPMPolicy
+	}{
+		{"pcr and authvalue", []TPMPolicy{pcr[0], authValue}},
+		{"authvalue and pcr", []TPMPolicy{authValue, pcr[0]}},
+		{"two pcr", []TPMPolicy{pcr[0], pcr[0]}},
+		{"sha1 bank", []TPMPolicy{bank(tpm2.TPMAlgSHA1)}},
+		{"sha384 bank", []TPMPolicy{bank(tpm2.TPMAlgSHA384)}},
+		{"trailing data", []TPMPolicy{{CommandCode: pcr[0].CommandCode, CommandPolicy: append(slices.Clone(pcr[0].CommandPolicy), 0)}}},
+		{"policy or", []TPMPolicy{{CommandCode: int(tpm2.TPMCCPolicyOR)}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if p, err := KeyPolicyFromTPMKey(&TPMKey{Policy: tc.policy}); err == nil {
+				t.Errorf("KeyPolicyFromTPMKey() = %+v, want an error", p)
+			}
+		})
+	}
+}
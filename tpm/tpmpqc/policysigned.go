@@ -0,0 +1,212 @@
+package tpmpqc
+
+import (
+	"crypto"
+	"crypto/mldsa"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// ML-DSA is a message signing scheme, so instead of signing the aHash digests used with RSA and ECC the
+// approver signs the unhashed data:
+//
+//	PolicySigned:    nonceTPM || expiration || cpHashA || policyRef
+//	PolicyAuthorize: approvedPolicy || policyRef
+
+// PolicySignedMessage returns the data an approver signs for TPM2_PolicySigned.
+func PolicySignedMessage(nonceTPM []byte, expiration int32, cpHashA, policyRef []byte) []byte {
+	m := append([]byte{}, nonceTPM...)
+	m = binary.BigEndian.AppendUint32(m, uint32(expiration))
+	m = append(m, cpHashA...)
+	return append(m, policyRef...)
+}
+
+// PolicyAuthorizeMessage returns the data an approver signs for TPM2_PolicyAuthorize.
+func PolicyAuthorizeMessage(approvedPolicy, policyRef []byte) []byte {
+	return append(append([]byte{}, approvedPolicy...), policyRef...)
+}
+
+// SignPolicySigned approves a policy session with any ML-DSA signer (*mldsa.PrivateKey, *SigningKey, KMS...).
+func SignPolicySigned(signer crypto.Signer, nonceTPM []byte, expiration int32, cpHashA, policyRef []byte) ([]byte, error) {
+	sig, err := signer.Sign(nil, PolicySignedMessage(nonceTPM, expiration, cpHashA, policyRef), &mldsa.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't sign policy %v", err)
+	}
+	return sig, nil
+}
+
+// SignApprovedPolicy signs approvedPolicy for TPM2_PolicyAuthorize with any ML-DSA signer.
+func SignApprovedPolicy(signer crypto.Signer, approvedPolicy, policyRef []byte) ([]byte, error) {
+	sig, err := signer.Sign(nil, PolicyAuthorizeMessage(approvedPolicy, policyRef), &mldsa.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't sign policy %v", err)
+	}
+	return sig, nil
+}
+
+// MLDSAPublicTemplate returns the public area of an ML-DSA verification key.
+func MLDSAPublicTemplate(pub *mldsa.PublicKey) (tpm2.TPMTPublic, error) {
+	var ps tpm2.TPMMLDSAParameter
+	switch pub.Parameters() {
+	case mldsa.MLDSA44():
+		ps = tpm2.TPMMLDSA44
+	case mldsa.MLDSA65():
+		ps = tpm2.TPMMLDSA65
+	case mldsa.MLDSA87():
+		ps = tpm2.TPMMLDSA87
+	default:
+		return tpm2.TPMTPublic{}, fmt.Errorf("tpmpqc: unsupported mldsa parameters %v", pub.Parameters())
+	}
+	t := MLDSATemplate(ps)
+	t.ObjectAttributes.FixedTPM = false
+	t.ObjectAttributes.FixedParent = false
+	t.ObjectAttributes.SensitiveDataOrigin = false
+	t.ObjectAttributes.UserWithAuth = false
+	t.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgMLDSA, &tpm2.TPM2BData{Buffer: pub.Bytes()})
+	return t, nil
+}
+
+// MLDSAPublicName returns the TPM name of an ML-DSA verification key, used in the PolicySigned and
+// PolicyAuthorize policy digests.
+func MLDSAPublicName(pub *mldsa.PublicKey) (tpm2.TPM2BName, error) {
+	t, err := MLDSAPublicTemplate(pub)
+	if err != nil {
+		return tpm2.TPM2BName{}, err
+	}
+	return publicName(tpm2.New2B(t))
+}
+
+// LoadVerificationKey loads an ML-DSA public key with TPM2_LoadExternal in the owner hierarchy.  A key in
+// the null hierarchy would only produce null tickets which TPM2_PolicyAuthorize rejects.
+func LoadVerificationKey(rwr transport.TPM, pub *mldsa.PublicKey) (tpm2.NamedHandle, func() error, error) {
+	t, err := MLDSAPublicTemplate(pub)
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, err
+	}
+	rsp, err := tpm2.LoadExternal{
+		InPublic:  tpm2.New2B(t),
+		Hierarchy: tpm2.TPMRHOwner,
+	}.Execute(rwr)
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("tpmpqc: can't load verification key %v", err)
+	}
+	closer := func() error {
+		_, err := tpm2.FlushContext{FlushHandle: rsp.ObjectHandle}.Execute(rwr)
+		return err
+	}
+	return tpm2.NamedHandle{Handle: rsp.ObjectHandle, Name: rsp.Name}, closer, nil
+}
+
+// PolicySignedDigest returns the authPolicy satisfied by TPM2_PolicySigned from the key named authName.
+func PolicySignedDigest(authName tpm2.TPM2BName, policyRef []byte) (tpm2.TPM2BDigest, error) {
+	return branchDigest(tpm2.PolicySigned{
+		AuthObject: tpm2.NamedHandle{Name: authName},
+		PolicyRef:  tpm2.TPM2BNonce{Buffer: policyRef},
+	}.Update)
+}
+
+// PolicyAuthorizeDigest returns the authPolicy satisfied by any policy the key named authName approves.
+func PolicyAuthorizeDigest(authName tpm2.TPM2BName, policyRef []byte) (tpm2.TPM2BDigest, error) {
+	return branchDigest(tpm2.PolicyAuthorize{
+		PolicyRef: tpm2.TPM2BDigest{Buffer: policyRef},
+		KeySign:   authName,
+	}.Update)
+}
+
+// PolicySignedSession returns a just-in-time policy session satisfied by TPM2_PolicySigned.  approve
+// receives the message to sign for each session (it includes the fresh nonceTPM) and returns the ML-DSA
+// signature, eg by calling a remote approver.
+func PolicySignedSession(authKey tpm2.NamedHandle, policyRef []byte, approve func(message []byte) ([]byte, error)) tpm2.Session {
+	return tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(rwr transport.TPM, handle tpm2.TPMISHPolicy, nonceTPM tpm2.TPM2BNonce) error {
+		sig, err := approve(PolicySignedMessage(nonceTPM.Buffer, 0, nil, policyRef))
+		if err != nil {
+			return err
+		}
+		_, err = tpm2.PolicySigned{
+			AuthObject:    authKey,
+			PolicySession: handle,
+			NonceTPM:      nonceTPM,
+			PolicyRef:     tpm2.TPM2BNonce{Buffer: policyRef},
+			Expiration:    0,
+			Auth:          mldsaSignature(sig),
+		}.Execute(rwr)
+		return err
+	})
+}
+
+// VerificationTicket verifies an ML-DSA signature over message with the loaded key and returns the
+// TPM's verification ticket.
+func VerificationTicket(rwr transport.TPM, key tpm2.NamedHandle, message, signature []byte) (*tpm2.TPMTTKVerified, error) {
+	verifySeqStart, err := tpm2.VerifySequenceStart{
+		KeyHandle: key,
+		Auth:      tpm2.TPM2BAuth{},
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't start verify sequence %v", err)
+	}
+	seq := tpm2.AuthHandle{
+		Name:   key.Name,
+		Handle: verifySeqStart.SequenceHandle,
+		Auth:   tpm2.PasswordAuth(nil),
+	}
+	for len(message) > 0 {
+		n := min(len(message), maxInputBuffer)
+		_, err = tpm2.SequenceUpdate{
+			SequenceHandle: seq,
+			Buffer: tpm2.TPM2BMaxBuffer{
+				Buffer: message[:n],
+			},
+		}.Execute(rwr)
+		if err != nil {
+			return nil, fmt.Errorf("tpmpqc: can't update sequence %v", err)
+		}
+		message = message[n:]
+	}
+	rsp, err := tpm2.VerifySequenceComplete{
+		SequenceHandle: seq,
+		KeyHandle:      key,
+		Signature:      mldsaSignature(signature),
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't verify signature %v", err)
+	}
+	return &rsp.Validation, nil
+}
+
+// PolicyAuthorizeSession returns a just-in-time policy session for a key whose authPolicy is
+// PolicyAuthorizeDigest(authKey.Name, policyRef).  approved runs the approved policy's commands, the
+// signature over approvedPolicy is checked by the TPM and turned into the ticket for TPM2_PolicyAuthorize.
+func PolicyAuthorizeSession(authKey tpm2.NamedHandle, policyRef, approvedPolicy, signature []byte, approved tpm2.PolicyCallback) tpm2.Session {
+	return tpm2.Policy(tpm2.TPMAlgSHA256, 16, func(rwr transport.TPM, handle tpm2.TPMISHPolicy, nonceTPM tpm2.TPM2BNonce) error {
+		if err := approved(rwr, handle, nonceTPM); err != nil {
+			return err
+		}
+		ticket, err := VerificationTicket(rwr, authKey, PolicyAuthorizeMessage(approvedPolicy, policyRef), signature)
+		if err != nil {
+			return err
+		}
+		_, err = tpm2.PolicyAuthorize{
+			PolicySession:  handle,
+			ApprovedPolicy: tpm2.TPM2BDigest{Buffer: approvedPolicy},
+			PolicyRef:      tpm2.TPM2BDigest{Buffer: policyRef},
+			KeySign:        authKey.Name,
+			CheckTicket:    *ticket,
+		}.Execute(rwr)
+		return err
+	})
+}
+
+func mldsaSignature(sig []byte) tpm2.TPMTSignature {
+	return tpm2.TPMTSignature{
+		SigAlg: tpm2.TPMAlgMLDSA,
+		Signature: tpm2.NewTPMUSignature(
+			tpm2.TPMAlgMLDSA,
+			&tpm2.TPM2BSignatureMLDSA{
+				Buffer: sig,
+			},
+		),
+	}
+}
@@ -0,0 +1,268 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// SealedSecretPEMType is the PEM block type of an encoded SealedSecret.
+const SealedSecretPEMType = "TPM MLKEM SEALED SECRET"
+
+var (
+	oidAES256GCM  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+	oidHKDFSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 3, 28}
+)
+
+// sealInfo is the HKDF info prefix, the key name is appended so the AEAD key is bound to one TPM key.
+const sealInfo = "tpmpqc seal"
+
+//	SealedSecret ::= SEQUENCE {
+//	  version          INTEGER (0),
+//	  kem              AlgorithmIdentifier,   -- id-alg-ml-kem-512/768/1024
+//	  keyName          OCTET STRING,          -- TPM name of the decapsulation key
+//	  kemCiphertext    OCTET STRING,
+//	  kdf              AlgorithmIdentifier,   -- id-alg-hkdf-with-sha256
+//	  kdfSalt          OCTET STRING,
+//	  aead             AlgorithmIdentifier,   -- aes256-GCM
+//	  nonce            OCTET STRING,
+//	  encryptedContent OCTET STRING }
+//
+// The AEAD key is HKDF-SHA256(sharedSecret, kdfSalt, "tpmpqc seal" || keyName) and keyName is the
+// additional data.
+type SealedSecret struct {
+	Version          int
+	KEM              pkix.AlgorithmIdentifier
+	KeyName          []byte
+	KEMCiphertext    []byte
+	KDF              pkix.AlgorithmIdentifier
+	KDFSalt          []byte
+	AEAD             pkix.AlgorithmIdentifier
+	Nonce            []byte
+	EncryptedContent []byte
+}
+
+// KEMPublicKey is an ML-KEM encapsulation key read from a PKIX "PUBLIC KEY" PEM.
+type KEMPublicKey struct {
+	ParameterSet tpm2.TPMMLKEMParameter
+	// Bytes is the raw FIPS 203 encapsulation key.
+	Bytes []byte
+}
+
+// ParseKEMPublicKey parses the PKIX public key written by the kem sample.
+func ParseKEMPublicKey(pemBytes []byte) (*KEMPublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("tpmpqc: no PUBLIC KEY PEM block found")
+	}
+	var info SubjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse public key %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("tpmpqc: trailing data after public key")
+	}
+	ps, err := mlkemParameterSetFromOID(info.Algorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &KEMPublicKey{
+		ParameterSet: ps,
+		Bytes:        info.PublicKey.Bytes,
+	}, nil
+}
+
+// Name returns the TPM name of the key assuming it was created from MLKEMTemplate without a policy,
+// as the kem sample does.  Keys created from another template need the name of their TPM2B_PUBLIC.
+func (p *KEMPublicKey) Name() (tpm2.TPM2BName, error) {
+	pub := MLKEMTemplate(p.ParameterSet)
+	pub.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgMLKEM, &tpm2.TPM2BData{
+		Buffer: p.Bytes,
+	})
+	name, err := tpm2.ObjectName(&pub)
+	if err != nil {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't compute key name %v", err)
+	}
+	return *name, nil
+}
+
+// Encapsulator returns a software encapsulation key for p.
+func (p *KEMPublicKey) Encapsulator() (crypto.Encapsulator, error) {
+	return newEncapsulator(p.ParameterSet, p.Bytes)
+}
+
+// KEMPublicKeyFromPublic reads the encapsulation key and name from the TPM2B_PUBLIC of an ML-KEM key.
+func KEMPublicKeyFromPublic(public tpm2.TPM2BPublic) (*KEMPublicKey, tpm2.TPM2BName, error) {
+	pub, err := public.Contents()
+	if err != nil {
+		return nil, tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't read public %v", err)
+	}
+	kemDetail, err := pub.Parameters.MLKEMDetail()
+	if err != nil {
+		return nil, tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't get mlkem details %v", err)
+	}
+	kemu, err := pub.Unique.KEM()
+	if err != nil {
+		return nil, tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't get mlkem unique %v", err)
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return nil, tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't compute key name %v", err)
+	}
+	return &KEMPublicKey{
+		ParameterSet: tpm2.TPMMLKEMParameter(kemDetail.ParameterSet),
+		Bytes:        kemu.Buffer,
+	}, *name, nil
+}
+
+func mlkemParameterSetFromOID(oid asn1.ObjectIdentifier) (tpm2.TPMMLKEMParameter, error) {
+	switch {
+	case oid.Equal(mlkem512OID):
+		return tpm2.TPMMLKEM512, nil
+	case oid.Equal(mlkem768OID):
+		return tpm2.TPMMLKEM768, nil
+	case oid.Equal(mlkem1024OID):
+		return tpm2.TPMMLKEM1024, nil
+	}
+	return 0, fmt.Errorf("tpmpqc: unsupported kem algorithm %v", oid)
+}
+
+func mlkemOID(ps tpm2.TPMMLKEMParameter) (asn1.ObjectIdentifier, error) {
+	switch ps {
+	case tpm2.TPMMLKEM512:
+		return mlkem512OID, nil
+	case tpm2.TPMMLKEM768:
+		return mlkem768OID, nil
+	case tpm2.TPMMLKEM1024:
+		return mlkem1024OID, nil
+	}
+	return nil, fmt.Errorf("tpmpqc: unsupported mlkem parameter set %v", ps)
+}
+
+// sealAEAD derives the AES-256-GCM key from the ML-KEM shared secret.
+func sealAEAD(sharedSecret, salt, keyName []byte) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, sharedSecret, salt, sealInfo+string(keyName), 32)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't derive key %v", err)
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't create cipher %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext so only the TPM holding the ML-KEM key p, named keyName, can decrypt it.
+// No TPM is needed to seal.
+func Seal(p *KEMPublicKey, keyName tpm2.TPM2BName, plaintext []byte) (*SealedSecret, error) {
+	oid, err := mlkemOID(p.ParameterSet)
+	if err != nil {
+		return nil, err
+	}
+	ek, err := p.Encapsulator()
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't generate salt %v", err)
+	}
+	aead, err := sealAEAD(sharedSecret, salt, keyName.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't generate nonce %v", err)
+	}
+	return &SealedSecret{
+		KEM:              pkix.AlgorithmIdentifier{Algorithm: oid},
+		KeyName:          keyName.Buffer,
+		KEMCiphertext:    ciphertext,
+		KDF:              pkix.AlgorithmIdentifier{Algorithm: oidHKDFSHA256},
+		KDFSalt:          salt,
+		AEAD:             pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM},
+		Nonce:            nonce,
+		EncryptedContent: aead.Seal(nil, nonce, plaintext, keyName.Buffer),
+	}, nil
+}
+
+// EncodePEM returns the sealed secret as a PEM block.
+func (s *SealedSecret) EncodePEM() ([]byte, error) {
+	der, err := asn1.Marshal(*s)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't marshal sealed secret %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  SealedSecretPEMType,
+		Bytes: der,
+	}), nil
+}
+
+// DecodeSealedSecret parses a sealed secret PEM block.
+func DecodeSealedSecret(pemBytes []byte) (*SealedSecret, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != SealedSecretPEMType {
+		return nil, fmt.Errorf("tpmpqc: no %s PEM block found", SealedSecretPEMType)
+	}
+	var s SealedSecret
+	if rest, err := asn1.Unmarshal(block.Bytes, &s); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse sealed secret %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("tpmpqc: trailing data after sealed secret")
+	}
+	if s.Version != 0 {
+		return nil, fmt.Errorf("tpmpqc: unsupported sealed secret version %d", s.Version)
+	}
+	if !s.KDF.Algorithm.Equal(oidHKDFSHA256) || !s.AEAD.Algorithm.Equal(oidAES256GCM) {
+		return nil, fmt.Errorf("tpmpqc: unsupported sealed secret algorithms %v %v", s.KDF.Algorithm, s.AEAD.Algorithm)
+	}
+	if _, err := mlkemParameterSetFromOID(s.KEM.Algorithm); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Unseal decapsulates the sealed secret with the TPM and decrypts it.  It fails before using the TPM
+// if s was sealed to a different key.
+func (k *KEMKey) Unseal(s *SealedSecret) ([]byte, error) {
+	if !bytes.Equal(s.KeyName, k.name.Buffer) {
+		return nil, fmt.Errorf("tpmpqc: secret is sealed to key %x, not %x", s.KeyName, k.name.Buffer)
+	}
+	ps, err := mlkemParameterSetFromOID(s.KEM.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if kps, err := k.ParameterSet(); err != nil {
+		return nil, err
+	} else if kps != ps {
+		return nil, fmt.Errorf("tpmpqc: secret is sealed with mlkem parameter set %v, key has %v", ps, kps)
+	}
+	sharedSecret, err := k.Decapsulate(s.KEMCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(sharedSecret, s.KDFSalt, s.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("tpmpqc: bad nonce size %d", len(s.Nonce))
+	}
+	plaintext, err := aead.Open(nil, s.Nonce, s.EncryptedContent, s.KeyName)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't decrypt sealed secret %v", err)
+	}
+	return plaintext, nil
+}
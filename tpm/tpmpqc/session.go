@@ -0,0 +1,138 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// SessionSalt is a loaded decrypt key used to salt the HMAC sessions of a key.  The session salt is
+// encrypted to it (RSA-OAEP, ECDH or ML-KEM) so someone watching the TPM bus or socket can't derive the
+// session key, and with parameter encryption the shared secret of TPM2_Decapsulate never crosses it in
+// the clear.
+//
+// That only holds if the salt key is the TPM's.  Its public area is read over the same bus, so an
+// interposer could hand back a key of its own and read the salt; every constructor checks the key
+// against something recorded at provisioning, a name or the EK certificate.
+type SessionSalt struct {
+	Handle tpm2.TPMHandle
+	Public tpm2.TPMTPublic
+}
+
+// NewSessionSalt reads the public area of a loaded key, eg the SRK, and checks its name is name, the one
+// recorded when the TPM was provisioned.
+func NewSessionSalt(rwr transport.TPM, handle tpm2.TPMHandle, name tpm2.TPM2BName) (*SessionSalt, error) {
+	rsp, err := tpm2.ReadPublic{
+		ObjectHandle: handle,
+	}.Execute(rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read salt key %v", err)
+	}
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read salt key %v", err)
+	}
+	s := &SessionSalt{
+		Handle: handle,
+		Public: *pub,
+	}
+	if err := s.checkName(name); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Name returns the name of the salt key, what to record at provisioning.
+func (s *SessionSalt) Name() (tpm2.TPM2BName, error) {
+	name, err := tpm2.ObjectName(&s.Public)
+	if err != nil {
+		return tpm2.TPM2BName{}, fmt.Errorf("tpmpqc: can't compute salt key name %v", err)
+	}
+	return *name, nil
+}
+
+// checkName compares the name computed from the public area, not the one the TPM returned, with name.
+func (s *SessionSalt) checkName(name tpm2.TPM2BName) error {
+	got, err := s.Name()
+	if err != nil {
+		return err
+	}
+	if len(name.Buffer) == 0 || !bytes.Equal(got.Buffer, name.Buffer) {
+		return fmt.Errorf("tpmpqc: salt key name %x is not the expected %x", got.Buffer, name.Buffer)
+	}
+	return nil
+}
+
+// EKSessionSalt creates the RSA endorsement key from the default template and returns it as a salt if its
+// public key is the one in ekCert.  The caller checks that ekCert chains to the TPM manufacturer.
+func EKSessionSalt(rwr transport.TPM, ekCert *x509.Certificate) (*SessionSalt, func() error, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHEndorsement,
+		InPublic:      tpm2.New2B(tpm2.RSAEKTemplate),
+	}.Execute(rwr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tpmpqc: can't create EK %v", err)
+	}
+	closer := func() error {
+		_, err := tpm2.FlushContext{FlushHandle: rsp.ObjectHandle}.Execute(rwr)
+		return err
+	}
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		closer()
+		return nil, nil, fmt.Errorf("tpmpqc: can't read EK %v", err)
+	}
+	ekPub, err := tpm2.Pub(*pub)
+	if err != nil {
+		closer()
+		return nil, nil, fmt.Errorf("tpmpqc: can't read EK %v", err)
+	}
+	if k, ok := ekCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(ekPub) {
+		closer()
+		return nil, nil, fmt.Errorf("tpmpqc: EK is not the key of the EK certificate")
+	}
+	return &SessionSalt{
+		Handle: rsp.ObjectHandle,
+		Public: *pub,
+	}, closer, nil
+}
+
+// SessionSalt returns the ML-KEM key as a session salt if its name is name, recorded when the key was
+// created: the salt is the labeled ML-KEM encapsulation from the patched go-tpm.  Only TPMs that accept
+// ML-KEM keys in TPM2_StartAuthSession can use it, see Check.
+func (k *KEMKey) SessionSalt(name tpm2.TPM2BName) (*SessionSalt, error) {
+	s := &SessionSalt{
+		Handle: k.handle,
+		Public: *k.public,
+	}
+	if err := s.checkName(name); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check starts and flushes a salted session to see if the TPM accepts the salt key.
+func (s *SessionSalt) Check(rwr transport.TPM) error {
+	_, closer, err := tpm2.HMACSession(rwr, tpm2.TPMAlgSHA256, 16, tpm2.Salted(s.Handle, s.Public))
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't start salted session %v", err)
+	}
+	return closer()
+}
+
+func (s *SessionSalt) options(opts ...tpm2.AuthOption) []tpm2.AuthOption {
+	return append([]tpm2.AuthOption{tpm2.Salted(s.Handle, s.Public)}, opts...)
+}
+
+// encryptSession returns a one-shot salted session that only encrypts parameters.  It is added next to
+// policy sessions, which authorize the key but aren't salted.
+func (s *SessionSalt) encryptSession(dir tpm2.AuthOption) tpm2.Session {
+	return tpm2.HMAC(tpm2.TPMAlgSHA256, 16, s.options(dir)...)
+}
+
+// responseEncryption encrypts the first response parameter with AES-128-CFB.
+var responseEncryption = tpm2.AESEncryption(128, tpm2.EncryptOut)
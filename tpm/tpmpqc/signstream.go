@@ -0,0 +1,327 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// SignStatePEMType is the PEM block type of a SignStream checkpoint.
+const SignStatePEMType = "TPM MLDSA SIGN STATE"
+
+// signStateKeyTemplate is the HMAC primary that authenticates checkpoints.  Like the SRK it's derived
+// from the owner seed, so it's the same key after every restart and only exists in this TPM.
+var signStateKeyTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgKeyedHash,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		NoDA:                true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(
+		tpm2.TPMAlgKeyedHash,
+		&tpm2.TPMSKeyedHashParms{
+			Scheme: tpm2.TPMTKeyedHashScheme{
+				Scheme: tpm2.TPMAlgHMAC,
+				Details: tpm2.NewTPMUSchemeKeyedHash(
+					tpm2.TPMAlgHMAC,
+					&tpm2.TPMSSchemeHMAC{
+						HashAlg: tpm2.TPMAlgSHA256,
+					},
+				),
+			},
+		},
+	),
+	Unique: tpm2.NewTPMUPublicID(
+		tpm2.TPMAlgKeyedHash,
+		&tpm2.TPM2BDigest{
+			Buffer: []byte("tpmpqc sign state"),
+		},
+	),
+}
+
+//	SignState ::= SEQUENCE {
+//	  version         INTEGER (0),
+//	  keyName         OCTET STRING,  -- TPM name of the ML-DSA key
+//	  context         UTF8String,    -- ML-DSA context string
+//	  offset          INTEGER,       -- message bytes absorbed by the sequence
+//	  prefixDigest    OCTET STRING,  -- SHA-256 of those bytes
+//	  sequenceContext OCTET STRING,  -- TPMS_CONTEXT of the sequence object
+//	  mac             OCTET STRING } -- TPM2_HMAC over SHA-256 of the fields above
+type SignState struct {
+	Version         int
+	KeyName         []byte
+	Context         string `asn1:"utf8"`
+	Offset          int64
+	PrefixDigest    []byte
+	SequenceContext []byte
+	MAC             []byte
+}
+
+// signedFields is the DER of the state without the MAC.
+func (s *SignState) signedFields() ([]byte, error) {
+	u := *s
+	u.MAC = nil
+	return asn1.Marshal(u)
+}
+
+// SignStream signs a message too large to hold in memory with a TPM sign sequence, and can save its
+// progress so signing can continue after the process restarts.
+//
+// Checkpoint returns a state that holds the ContextSave of the sequence and how much of the message it
+// has absorbed.  The TPM keeps nothing for it: after a restart ResumeSignStream loads the sequence
+// context again and the caller continues writing from Offset.  Saved contexts don't survive a TPM
+// reset, so after a reboot signing has to start over.
+type SignStream struct {
+	k       *SigningKey
+	seq     tpm2.TPMHandle
+	context string
+	// offset counts the bytes sent to the TPM, pending holds the rest until there is a full chunk
+	offset  int64
+	pending []byte
+	prefix  hash.Hash
+	done    bool
+}
+
+var _ io.WriteCloser = (*SignStream)(nil)
+
+// NewSignStream starts a sign sequence with the ML-DSA context string context.
+func (k *SigningKey) NewSignStream(context string) (*SignStream, error) {
+	if err := checkContext(context); err != nil {
+		return nil, err
+	}
+	keyAuth, closer, err := k.sequenceAuth()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = closer()
+	}()
+	rsp, err := tpm2.SignSequenceStart{
+		KeyHandle: keyAuth,
+		Auth: tpm2.TPM2BAuth{
+			Buffer: []byte(""),
+		},
+		Context: tpm2.TPM2BSignatureContext{
+			Buffer: []byte(context),
+		},
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't start sequence %v", err)
+	}
+	return &SignStream{
+		k:       k,
+		seq:     rsp.SequenceHandle,
+		context: context,
+		prefix:  sha256.New(),
+	}, nil
+}
+
+// ResumeSignStream continues the sign sequence saved in the PEM encoded state.  message must read the
+// message from the start: its first Offset bytes are checked against the state and it's left positioned
+// at Offset, ready to copy the rest into the stream.
+func (k *SigningKey) ResumeSignStream(state []byte, message io.Reader) (*SignStream, error) {
+	block, _ := pem.Decode(state)
+	if block == nil || block.Type != SignStatePEMType {
+		return nil, fmt.Errorf("tpmpqc: no %s PEM block found", SignStatePEMType)
+	}
+	var s SignState
+	if rest, err := asn1.Unmarshal(block.Bytes, &s); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse sign state %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("tpmpqc: trailing data after sign state")
+	}
+	if s.Version != 0 {
+		return nil, fmt.Errorf("tpmpqc: unsupported sign state version %d", s.Version)
+	}
+	fields, err := s.signedFields()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't encode sign state %v", err)
+	}
+	mac, err := k.signStateMAC(fields)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, s.MAC) {
+		return nil, fmt.Errorf("tpmpqc: sign state integrity check failed")
+	}
+	if !bytes.Equal(s.KeyName, k.name.Buffer) {
+		return nil, fmt.Errorf("tpmpqc: sign state is for key %x, not %x", s.KeyName, k.name.Buffer)
+	}
+
+	prefix := sha256.New()
+	if n, err := io.CopyN(prefix, message, s.Offset); err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't read the first %d bytes of the message, got %d: %v", s.Offset, n, err)
+	}
+	if !bytes.Equal(prefix.Sum(nil), s.PrefixDigest) {
+		return nil, fmt.Errorf("tpmpqc: the message changed since the sign state was saved")
+	}
+
+	ctx, err := tpm2.Unmarshal[tpm2.TPMSContext](s.SequenceContext)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse sequence context %v", err)
+	}
+	rsp, err := tpm2.ContextLoad{
+		Context: *ctx,
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't load sequence context %v", err)
+	}
+	return &SignStream{
+		k:       k,
+		seq:     rsp.LoadedHandle,
+		context: s.Context,
+		offset:  s.Offset,
+		prefix:  prefix,
+	}, nil
+}
+
+// signStateMAC is TPM2_HMAC(signStateKeyTemplate, SHA-256(fields)).
+func (k *SigningKey) signStateMAC(fields []byte) ([]byte, error) {
+	primary, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(signStateKeyTemplate),
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't create sign state key %v", err)
+	}
+	defer func() {
+		_, _ = tpm2.FlushContext{
+			FlushHandle: primary.ObjectHandle,
+		}.Execute(k.rwr)
+	}()
+	digest := sha256.Sum256(fields)
+	rsp, err := tpm2.Hmac{
+		Handle: tpm2.AuthHandle{
+			Handle: primary.ObjectHandle,
+			Name:   primary.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Buffer: tpm2.TPM2BMaxBuffer{
+			Buffer: digest[:],
+		},
+		HashAlg: tpm2.TPMAlgNull,
+	}.Execute(k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't authenticate sign state %v", err)
+	}
+	return rsp.OutHMAC.Buffer, nil
+}
+
+// Offset is how much of the message the TPM has absorbed, where a resumed stream continues.  It
+// trails the bytes written by less than one TPM input buffer.
+func (s *SignStream) Offset() int64 {
+	return s.offset
+}
+
+// Write sends p to the sign sequence in TPM input buffer sized chunks.
+func (s *SignStream) Write(p []byte) (int, error) {
+	if s.done {
+		return 0, fmt.Errorf("tpmpqc: sign stream is closed")
+	}
+	s.pending = append(s.pending, p...)
+	rest, err := s.k.updateSequence(tpm2.AuthHandle{
+		Handle: s.seq,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, s.pending)
+	if err != nil {
+		// a failed update leaves the sequence in an unknown state
+		s.Close()
+		return 0, err
+	}
+	sent := s.pending[:len(s.pending)-len(rest)]
+	s.prefix.Write(sent)
+	s.offset += int64(len(sent))
+	s.pending = append(s.pending[:0], rest...)
+	return len(p), nil
+}
+
+// Checkpoint saves the sequence and returns the PEM encoded state for ResumeSignStream.  The sequence
+// stays loaded so the stream can be used on.  Bytes written after Offset aren't part of the state.
+func (s *SignStream) Checkpoint() ([]byte, error) {
+	if s.done {
+		return nil, fmt.Errorf("tpmpqc: sign stream is closed")
+	}
+	rsp, err := tpm2.ContextSave{
+		SaveHandle: s.seq,
+	}.Execute(s.k.rwr)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't save sequence context %v", err)
+	}
+	state := SignState{
+		KeyName:         s.k.name.Buffer,
+		Context:         s.context,
+		Offset:          s.offset,
+		PrefixDigest:    s.prefix.Sum(nil),
+		SequenceContext: tpm2.Marshal(rsp.Context),
+	}
+	fields, err := state.signedFields()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't encode sign state %v", err)
+	}
+	if state.MAC, err = s.k.signStateMAC(fields); err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't encode sign state %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  SignStatePEMType,
+		Bytes: der,
+	}), nil
+}
+
+// Sign completes the sequence with the buffered bytes and returns the ML-DSA signature.
+func (s *SignStream) Sign() ([]byte, error) {
+	if s.done {
+		return nil, fmt.Errorf("tpmpqc: sign stream is closed")
+	}
+	s.done = true
+	rsp, err := tpm2.SignSequenceComplete{
+		SequenceHandle: tpm2.AuthHandle{
+			Handle: s.seq,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		KeyHandle: s.k.authHandle(),
+		Buffer: tpm2.TPM2BMaxBuffer{
+			Buffer: s.pending,
+		},
+	}.Execute(s.k.rwr)
+	if err != nil {
+		s.flush()
+		return nil, fmt.Errorf("tpmpqc: can't complete sequence %v", err)
+	}
+	sig, err := rsp.Signature.Signature.MLDSA()
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't get signature %v", err)
+	}
+	return sig.Buffer, nil
+}
+
+// Close flushes the sequence if it wasn't completed.  Saved checkpoints stay valid.
+func (s *SignStream) Close() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	return s.flush()
+}
+
+func (s *SignStream) flush() error {
+	_, err := tpm2.FlushContext{
+		FlushHandle: s.seq,
+	}.Execute(s.k.rwr)
+	return err
+}
@@ -0,0 +1,132 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"crypto/mldsa"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"strings"
+	"testing"
+
+	"main/faketpm"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// TestSignStreamResume checkpoints a stream, drops the TPM and finishes signing on a new faketpm with the
+// same seed, like a process restart against the same TPM.
+func TestSignStreamResume(t *testing.T) {
+	cfg := faketpm.Config{
+		ParameterSets: faketpm.DefaultParameterSets,
+		Seed:          []byte("tpmpqc sign stream test"),
+	}
+	message := bytes.Repeat([]byte("0123456789abcdef"), 4*maxInputBuffer/16+5)
+	const context = "sign stream"
+
+	rwr, srk := openFakeTPMWithConfig(t, cfg)
+	k, err := CreateSigningKey(rwr, srk, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	public, private := k.TPMPublic(), k.Private
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() = %v", err)
+	}
+	s, err := k.NewSignStream(context)
+	if err != nil {
+		t.Fatalf("NewSignStream() = %v", err)
+	}
+	if _, err := s.Write(message[:len(message)/2]); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	state, err := s.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint() = %v", err)
+	}
+	if s.Offset() == 0 {
+		t.Fatalf("Offset() = 0 after writing %d bytes", len(message)/2)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	k.Close()
+
+	rwr, srk = openFakeTPMWithConfig(t, cfg)
+	k, err = LoadSigningKey(rwr, srk, public, private)
+	if err != nil {
+		t.Fatalf("LoadSigningKey() = %v", err)
+	}
+	defer k.Close()
+
+	t.Run("resume", func(t *testing.T) {
+		r := bytes.NewReader(message)
+		s, err := k.ResumeSignStream(state, r)
+		if err != nil {
+			t.Fatalf("ResumeSignStream() = %v", err)
+		}
+		if _, err := io.Copy(s, r); err != nil {
+			t.Fatalf("io.Copy() = %v", err)
+		}
+		sig, err := s.Sign()
+		if err != nil {
+			t.Fatalf("Sign() = %v", err)
+		}
+		if err := mldsa.Verify(pub, message, sig, &mldsa.Options{Context: context}); err != nil {
+			t.Fatalf("mldsa.Verify() = %v", err)
+		}
+	})
+
+	other, err := CreateSigningKey(rwr, srk, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	defer other.Close()
+
+	changed := bytes.Clone(message)
+	changed[0] ^= 1
+	for _, tc := range []struct {
+		name    string
+		k       *SigningKey
+		state   []byte
+		message []byte
+		wantErr string
+	}{
+		{"tampered mac", k, editState(t, state, func(s *SignState) { s.MAC[0] ^= 1 }), message, "integrity check failed"},
+		{"tampered offset", k, editState(t, state, func(s *SignState) { s.Offset -= maxInputBuffer }), message, "integrity check failed"},
+		{"changed prefix", k, state, changed, "message changed"},
+		{"other key", other, state, message, "sign state is for key"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := tc.k.ResumeSignStream(tc.state, bytes.NewReader(tc.message))
+			if err == nil {
+				s.Close()
+				t.Fatalf("ResumeSignStream() succeeded")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("ResumeSignStream() = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// editState decodes the PEM encoded state, applies edit and encodes it again without updating the MAC.
+func editState(t *testing.T, state []byte, edit func(*SignState)) []byte {
+	t.Helper()
+	block, _ := pem.Decode(state)
+	if block == nil {
+		t.Fatalf("no PEM block in the state")
+	}
+	var s SignState
+	if _, err := asn1.Unmarshal(block.Bytes, &s); err != nil {
+		t.Fatalf("asn1.Unmarshal() = %v", err)
+	}
+	s.MAC = bytes.Clone(s.MAC)
+	edit(&s)
+	der, err := asn1.Marshal(s)
+	if err != nil {
+		t.Fatalf("asn1.Marshal() = %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: SignStatePEMType, Bytes: der})
+}
@@ -0,0 +1,93 @@
+// Package tpmpqc contains the TPM backed ML-KEM and ML-DSA helpers shared by the samples in this folder.
+//
+// It relies on the patched go-tpm (see ../pqctpm.diff) for the v1.85 PQC structures and commands.
+package tpmpqc
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const (
+	SRKTypeRSA   = "rsa"
+	SRKTypeECC   = "ecc"
+	SRKTypeMLKEM = "mlkem"
+)
+
+// SRK returns the storage parent for the PQC keys.
+//
+// If persistentHandle is set, the key already at that handle is used.  Otherwise a transient
+// SRK is created from the TCG reference template for srkType ("rsa" or "ecc"), or from
+// MLKEMSRKTemplate for "mlkem".  Since the templates are deterministic, the same parent is recreated
+// after every reboot so saved key blobs remain loadable.
+//
+// The returned closer flushes the transient SRK; it is a no-op for persistent parents.
+func SRK(rwr transport.TPM, srkType string, persistentHandle uint32) (tpm2.NamedHandle, func() error, error) {
+	if persistentHandle != 0 {
+		pub, err := tpm2.ReadPublic{
+			ObjectHandle: tpm2.TPMHandle(persistentHandle),
+		}.Execute(rwr)
+		if err != nil {
+			return tpm2.NamedHandle{}, nil, fmt.Errorf("tpmpqc: can't read persistent parent %#x: %v", persistentHandle, err)
+		}
+		return tpm2.NamedHandle{
+			Handle: tpm2.TPMHandle(persistentHandle),
+			Name:   pub.Name,
+		}, func() error { return nil }, nil
+	}
+
+	var template tpm2.TPMTPublic
+	switch srkType {
+	case SRKTypeRSA:
+		template = tpm2.RSASRKTemplate
+	case SRKTypeECC:
+		template = tpm2.ECCSRKTemplate
+	case SRKTypeMLKEM:
+		template = MLKEMSRKTemplate
+	default:
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("tpmpqc: unsupported srk type %q", srkType)
+	}
+
+	primaryKey, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(template),
+	}.Execute(rwr)
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("tpmpqc: can't create primary %v", err)
+	}
+	return tpm2.NamedHandle{
+		Handle: primaryKey.ObjectHandle,
+		Name:   primaryKey.Name,
+	}, func() error {
+		_, err := tpm2.FlushContext{
+			FlushHandle: primaryKey.ObjectHandle,
+		}.Execute(rwr)
+		return err
+	}, nil
+}
+
+func isPersistent(h tpm2.TPMHandle) bool {
+	return tpm2.TPMHT(h>>24) == tpm2.TPMHTPersistent
+}
+
+//	SubjectPublicKeyInfo  ::=  SEQUENCE  {
+//	     algorithm            AlgorithmIdentifier,
+//	     subjectPublicKey     BIT STRING  }
+type SubjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func marshalPKIXPublicKey(oid asn1.ObjectIdentifier, key []byte) ([]byte, error) {
+	return asn1.Marshal(SubjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oid},
+		PublicKey: asn1.BitString{
+			Bytes:     key,
+			BitLength: len(key) * 8,
+		},
+	})
+}
@@ -0,0 +1,337 @@
+package tpmpqc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpmutil"
+
+	"main/faketpm"
+)
+
+// FakeTPM is the --tpm-path that runs the samples against the in-process faketpm instead of a TPM.
+// It always uses the same seed so key blobs saved by one run load in the next.
+const FakeTPM = "fake"
+
+// OpenTPM opens the TPM at path, which is one of
+//
+//	fake                                  the in-process faketpm
+//	/dev/tpmrm0, /dev/tpm0, /path/sock     a TPM character device or a raw unix socket
+//	host:port, tcp://host:port             raw TPM commands over TCP
+//	mssim://host:port[?platform=host:port] the MS simulator protocol (ibmswtpm2, ms-tpm-20-ref)
+//	swtpm://host:port[?ctrl=host:port]     swtpm over TCP with its control channel
+//	swtpm:///path/sock[?ctrl=/path/ctrl]   swtpm over unix sockets
+//
+// The platform port of mssim defaults to port+1; OpenTPM signals power on and NV on there.  The swtpm
+// control channel also defaults to port+1 and is used to initialise the TPM if it hasn't been yet.  For
+// both simulators OpenTPM then sends TPM2_Startup(CLEAR), a TPM that was already started is left as
+// it is.  Add startup=none to the query to skip all of that.
+func OpenTPM(path string) (io.ReadWriteCloser, error) {
+	if path == FakeTPM {
+		return faketpm.NewWithConfig(faketpm.Config{
+			ParameterSets: faketpm.DefaultParameterSets,
+			Seed:          []byte(FakeTPM),
+		}), nil
+	}
+	if strings.HasPrefix(path, "/") {
+		return tpmutil.OpenTPM(path)
+	}
+	if !strings.Contains(path, "://") {
+		return dialTPM("tcp", path)
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("tpmpqc: can't parse TPM path %q: %v", path, err)
+	}
+	q := u.Query()
+	startup := q.Get("startup") != "none"
+	switch u.Scheme {
+	case "tcp":
+		return dialTPM("tcp", u.Host)
+	case "mssim":
+		platform := q.Get("platform")
+		if platform == "" {
+			if platform, err = nextPort(u.Host); err != nil {
+				return nil, err
+			}
+		}
+		return openMSSim(u.Host, platform, startup)
+	case "swtpm":
+		network, address := "tcp", u.Host
+		if u.Host == "" {
+			network, address = "unix", u.Path
+		}
+		ctrl := q.Get("ctrl")
+		if ctrl == "" && network == "tcp" {
+			if ctrl, err = nextPort(u.Host); err != nil {
+				return nil, err
+			}
+		}
+		return openSWTPM(network, address, ctrl, startup)
+	default:
+		return nil, fmt.Errorf("tpmpqc: unsupported TPM path %q", path)
+	}
+}
+
+// nextPort returns host:port+1, where simulators listen for platform and control commands.
+func nextPort(hostport string) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", fmt.Errorf("tpmpqc: can't parse TPM address %q: %v", hostport, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("tpmpqc: can't parse TPM port %q: %v", port, err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+1)), nil
+}
+
+// socketTPM sends each command written to it as one exchange with a simulator and returns the
+// response on the next Read, like a TPM character device.  tpmutil.RunCommandRaw reads the
+// response with a single Read, which a stream socket doesn't guarantee to fill.
+type socketTPM struct {
+	conn net.Conn
+	// mssim frames the commands and has a platform port
+	mssim    bool
+	platform net.Conn
+	rsp      []byte
+}
+
+// MS simulator commands, see ms-tpm-20-ref TpmTcpProtocol.h
+const (
+	mssimSignalPowerOn uint32 = 1
+	mssimSendCommand   uint32 = 8
+	mssimSignalNVOn    uint32 = 11
+	mssimSessionEnd    uint32 = 20
+)
+
+// swtpm control channel commands, see swtpm's tpm_ioctl.h
+const (
+	swtpmCmdInit uint32 = 2
+)
+
+const (
+	// tag, responseSize, responseCode
+	responseHeaderSize = 10
+	// the largest response read from a simulator, tpmutil's maxTPMResponse with the go-tpm patch
+	maxResponseSize = 8192
+)
+
+// checkResponseSize rejects response sizes that can't hold a header or that are larger than any TPM response.
+func checkResponseSize(size uint32) error {
+	if size < responseHeaderSize {
+		return fmt.Errorf("tpmpqc: TPM response size %d too small", size)
+	}
+	if size > maxResponseSize {
+		return fmt.Errorf("tpmpqc: TPM response size %d larger than %d", size, maxResponseSize)
+	}
+	return nil
+}
+
+func dialTPM(network, address string) (*socketTPM, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &socketTPM{
+		conn: conn,
+	}, nil
+}
+
+func openMSSim(address, platform string, startup bool) (*socketTPM, error) {
+	t, err := dialTPM("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	t.mssim = true
+	if t.platform, err = net.Dial("tcp", platform); err != nil {
+		t.conn.Close()
+		return nil, fmt.Errorf("tpmpqc: can't connect to the simulator platform port: %v", err)
+	}
+	if startup {
+		for _, c := range []uint32{mssimSignalPowerOn, mssimSignalNVOn} {
+			if err := t.platformCommand(c); err != nil {
+				t.Close()
+				return nil, err
+			}
+		}
+		if err := t.startup(); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func openSWTPM(network, address, ctrl string, startup bool) (*socketTPM, error) {
+	t, err := dialTPM(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if !startup {
+		return t, nil
+	}
+	// swtpm answers every command with TPM_RC_FAILURE until it's initialised with CMD_INIT
+	err = t.startup()
+	if errors.Is(err, tpm2.TPMRCFailure) && ctrl != "" {
+		if err = swtpmInit(ctrl); err == nil {
+			err = t.startup()
+		}
+	}
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// swtpmInit sends CMD_INIT on the control channel, a unix socket if ctrl is a path.  swtpm takes one
+// command per connection.
+func swtpmInit(ctrl string) error {
+	network := "tcp"
+	if strings.HasPrefix(ctrl, "/") {
+		network = "unix"
+	}
+	conn, err := net.Dial(network, ctrl)
+	if err != nil {
+		return fmt.Errorf("tpmpqc: can't connect to the swtpm control channel: %v", err)
+	}
+	defer conn.Close()
+	// struct ptm_init { uint32 init_flags }, no flags
+	cmd := binary.BigEndian.AppendUint32(nil, swtpmCmdInit)
+	cmd = binary.BigEndian.AppendUint32(cmd, 0)
+	if _, err := conn.Write(cmd); err != nil {
+		return fmt.Errorf("tpmpqc: can't send swtpm CMD_INIT: %v", err)
+	}
+	var result uint32
+	if err := binary.Read(conn, binary.BigEndian, &result); err != nil {
+		return fmt.Errorf("tpmpqc: can't read swtpm CMD_INIT result: %v", err)
+	}
+	if result != 0 {
+		return fmt.Errorf("tpmpqc: swtpm CMD_INIT failed with %#x", result)
+	}
+	return nil
+}
+
+// startup sends TPM2_Startup(CLEAR), TPM_RC_INITIALIZE means the TPM is already running.
+func (t *socketTPM) startup() error {
+	_, err := tpm2.Startup{
+		StartupType: tpm2.TPMSUClear,
+	}.Execute(transport.FromReadWriter(t))
+	if err != nil && !errors.Is(err, tpm2.TPMRCInitialize) {
+		return fmt.Errorf("tpmpqc: can't start the TPM %w", err)
+	}
+	return nil
+}
+
+func (t *socketTPM) platformCommand(c uint32) error {
+	if err := binary.Write(t.platform, binary.BigEndian, c); err != nil {
+		return fmt.Errorf("tpmpqc: can't send platform command %d: %v", c, err)
+	}
+	var ack uint32
+	if err := binary.Read(t.platform, binary.BigEndian, &ack); err != nil {
+		return fmt.Errorf("tpmpqc: can't read platform command %d result: %v", c, err)
+	}
+	if ack != 0 {
+		return fmt.Errorf("tpmpqc: platform command %d failed with %#x", c, ack)
+	}
+	return nil
+}
+
+func (t *socketTPM) Write(cmd []byte) (int, error) {
+	var err error
+	if t.mssim {
+		t.rsp, err = t.mssimCommand(cmd)
+	} else {
+		t.rsp, err = t.rawCommand(cmd)
+	}
+	if err != nil {
+		t.rsp = nil
+		return 0, err
+	}
+	return len(cmd), nil
+}
+
+func (t *socketTPM) Read(b []byte) (int, error) {
+	if len(t.rsp) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, t.rsp)
+	t.rsp = t.rsp[n:]
+	return n, nil
+}
+
+// rawCommand sends cmd as is and reads the response by the size in its header.
+func (t *socketTPM) rawCommand(cmd []byte) ([]byte, error) {
+	if _, err := t.conn.Write(cmd); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, responseHeaderSize)
+	if _, err := io.ReadFull(t.conn, hdr); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[2:])
+	if err := checkResponseSize(size); err != nil {
+		return nil, err
+	}
+	rsp := make([]byte, size)
+	copy(rsp, hdr)
+	if _, err := io.ReadFull(t.conn, rsp[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// mssimCommand sends TPM_SEND_COMMAND, locality 0, the command size and the command, and reads back the
+// response size, the response and an acknowledgement.
+func (t *socketTPM) mssimCommand(cmd []byte) ([]byte, error) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, mssimSendCommand)
+	b.WriteByte(0)
+	binary.Write(&b, binary.BigEndian, uint32(len(cmd)))
+	b.Write(cmd)
+	if _, err := t.conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	var size uint32
+	if err := binary.Read(t.conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if err := checkResponseSize(size); err != nil {
+		return nil, err
+	}
+	rsp := make([]byte, size)
+	if _, err := io.ReadFull(t.conn, rsp); err != nil {
+		return nil, err
+	}
+	var ack uint32
+	if err := binary.Read(t.conn, binary.BigEndian, &ack); err != nil {
+		return nil, err
+	}
+	if ack != 0 {
+		return nil, fmt.Errorf("tpmpqc: simulator command failed with %#x", ack)
+	}
+	return rsp, nil
+}
+
+// Close ends the simulator sessions, it doesn't power the TPM off.
+func (t *socketTPM) Close() error {
+	if t.mssim {
+		binary.Write(t.conn, binary.BigEndian, mssimSessionEnd)
+		if t.platform != nil {
+			binary.Write(t.platform, binary.BigEndian, mssimSessionEnd)
+			t.platform.Close()
+		}
+	}
+	return t.conn.Close()
+}
@@ -0,0 +1,45 @@
+package tpmpqc
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestResponseSize answers a command with a response size that is too small or too large and checks
+// both framings refuse it before allocating.
+func TestResponseSize(t *testing.T) {
+	cmd := []byte{0x80, 0x01, 0, 0, 0, 12, 0, 0, 0x01, 0x44, 0, 0}
+	for _, mssim := range []bool{false, true} {
+		for _, size := range []uint32{0, responseHeaderSize - 1, maxResponseSize + 1, 0xffffffff} {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				// the command, with the mssim framing in front of it
+				n := len(cmd)
+				if mssim {
+					n += 9
+				}
+				if _, err := io.ReadFull(server, make([]byte, n)); err != nil {
+					return
+				}
+				var rsp []byte
+				if mssim {
+					rsp = binary.BigEndian.AppendUint32(rsp, size)
+				}
+				// tag, responseSize, responseCode
+				rsp = binary.BigEndian.AppendUint16(rsp, 0x8001)
+				rsp = binary.BigEndian.AppendUint32(rsp, size)
+				rsp = binary.BigEndian.AppendUint32(rsp, 0)
+				server.Write(rsp)
+			}()
+			tpm := &socketTPM{conn: client, mssim: mssim}
+			if _, err := tpm.Write(cmd); err == nil || !strings.Contains(err.Error(), "response size") {
+				t.Errorf("mssim %t: response size %d: Write() = %v", mssim, size, err)
+			}
+			client.Close()
+		}
+	}
+}
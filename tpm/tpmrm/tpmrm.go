@@ -0,0 +1,603 @@
+// Package tpmrm is an in-process resource manager that shares one TPM transport between goroutines, what
+// /dev/tpmrm0 or tpm2-abrmd do for processes.
+//
+//	rm, err := tpmrm.New(transport.FromReadWriter(rwc), tpmrm.Config{})
+//	k, err := tpmpqc.LoadSigningKey(rm, parent, public, private)
+//	// k.Sign can now be called from any number of goroutines
+//
+// Commands are run one at a time.  Transient objects (keys and sequences) get virtual handles that stay
+// valid while the object is swapped out: when more objects or sessions are in use than the TPM has slots
+// for, the least recently used ones are saved with TPM2_ContextSave and loaded again with
+// TPM2_ContextLoad the next time a command references them.  Session handles don't change across a
+// context save so only objects are virtualized.
+//
+// The handle layout of each command comes from TPM_CAP_COMMANDS, so commands the TPM implements but
+// go-tpm doesn't know about work too.  Not handled: TPM_RC_CONTEXT_GAP for long lived saved sessions,
+// TPM2_GetCapability(TPM_CAP_HANDLES) which lists the real handles, and sessions or objects that were
+// created through the transport before the manager.
+package tpmrm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// Config sets up the manager.
+type Config struct {
+	// MaxObjects and MaxSessions are how many transient objects and sessions the manager keeps loaded at
+	// once.  Zero uses TPM_PT_HR_TRANSIENT_MIN and TPM_PT_HR_LOADED_MIN, or 3, the minimum of the PC Client
+	// profile, if the TPM doesn't report them.
+	MaxObjects  int
+	MaxSessions int
+}
+
+const (
+	// virtual handles are allocated from the top of the transient range, real TPMs count up from 0x80000000
+	firstVirtual = 0x80ff0000
+	lastVirtual  = 0x80ffffff
+
+	defaultSlots = 3
+
+	tagNoSessions = 0x8001
+	tagSessions   = 0x8002
+	headerSize    = 10
+
+	// TPMA_SESSION continueSession
+	sessionContinue = 0x01
+)
+
+// sequenceComplete lists the commands that flush the sequence object in their first handle when they
+// succeed.
+var sequenceComplete = map[tpm2.TPMCC]bool{
+	tpm2.TPMCCSequenceComplete:       true,
+	tpm2.TPMCCEventSequenceComplete:  true,
+	tpm2.TPMCCSignSequenceComplete:   true,
+	tpm2.TPMCCVerifySequenceComplete: true,
+}
+
+// object is a transient object known by its virtual handle.  Exactly one of handle and context is set.
+type object struct {
+	handle   tpm2.TPMHandle
+	context  *tpm2.TPMSContext
+	lastUsed uint64
+}
+
+// session is an HMAC or policy session.  context is set while it's saved.
+type session struct {
+	context  *tpm2.TPMSContext
+	lastUsed uint64
+}
+
+// Manager is a transport.TPM that is safe for concurrent use.
+type Manager struct {
+	mu sync.Mutex
+
+	tpm         transport.TPM
+	commands    map[tpm2.TPMCC]tpm2.TPMACC
+	maxObjects  int
+	maxSessions int
+
+	objects     map[tpm2.TPMHandle]*object
+	sessions    map[tpm2.TPMHandle]*session
+	nextVirtual tpm2.TPMHandle
+	clock       uint64
+	closed      bool
+}
+
+var _ transport.TPM = (*Manager)(nil)
+
+// New returns a manager for tpm.  Only the manager may send commands to tpm from now on.
+func New(tpm transport.TPM, cfg Config) (*Manager, error) {
+	m := &Manager{
+		tpm:         tpm,
+		commands:    map[tpm2.TPMCC]tpm2.TPMACC{},
+		maxObjects:  cfg.MaxObjects,
+		maxSessions: cfg.MaxSessions,
+		objects:     map[tpm2.TPMHandle]*object{},
+		sessions:    map[tpm2.TPMHandle]*session{},
+		nextVirtual: firstVirtual,
+	}
+
+	// TPM_CC_FIRST
+	for first := uint32(tpm2.TPMCCNVUndefineSpaceSpecial); ; {
+		rsp, err := tpm2.GetCapability{
+			Capability:    tpm2.TPMCapCommands,
+			Property:      first,
+			PropertyCount: 256,
+		}.Execute(tpm)
+		if err != nil {
+			return nil, fmt.Errorf("tpmrm: can't read commands %v", err)
+		}
+		ccs, err := rsp.CapabilityData.Data.Command()
+		if err != nil {
+			return nil, fmt.Errorf("tpmrm: can't read commands %v", err)
+		}
+		for _, a := range ccs.CommandAttributes {
+			cc := tpm2.TPMCC(a.CommandIndex)
+			if a.V {
+				cc |= 1 << 29
+			}
+			m.commands[cc] = a
+			first = uint32(a.CommandIndex) + 1
+		}
+		if !rsp.MoreData || len(ccs.CommandAttributes) == 0 {
+			break
+		}
+	}
+
+	for _, p := range []struct {
+		pt  tpm2.TPMPT
+		max *int
+	}{
+		{tpm2.TPMPTHRTransientMin, &m.maxObjects},
+		{tpm2.TPMPTHRLoadedMin, &m.maxSessions},
+	} {
+		if *p.max > 0 {
+			continue
+		}
+		*p.max = defaultSlots
+		rsp, err := tpm2.GetCapability{
+			Capability:    tpm2.TPMCapTPMProperties,
+			Property:      uint32(p.pt),
+			PropertyCount: 1,
+		}.Execute(tpm)
+		if err != nil {
+			return nil, fmt.Errorf("tpmrm: can't read TPM properties %v", err)
+		}
+		props, err := rsp.CapabilityData.Data.TPMProperties()
+		if err != nil {
+			return nil, fmt.Errorf("tpmrm: can't read TPM properties %v", err)
+		}
+		if len(props.TPMProperty) == 1 && props.TPMProperty[0].Property == p.pt && props.TPMProperty[0].Value > 0 {
+			*p.max = int(props.TPMProperty[0].Value)
+		}
+	}
+	return m, nil
+}
+
+// Close flushes every object and session the manager still tracks.  It doesn't close the transport.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var errs []error
+	for _, o := range m.objects {
+		// saved object contexts hold nothing in the TPM
+		if o.context == nil {
+			errs = append(errs, m.flush(o.handle))
+		}
+	}
+	for h := range m.sessions {
+		errs = append(errs, m.flush(h))
+	}
+	m.objects = nil
+	m.sessions = nil
+	return errors.Join(errs...)
+}
+
+func (m *Manager) flush(h tpm2.TPMHandle) error {
+	_, err := tpm2.FlushContext{
+		FlushHandle: h,
+	}.Execute(m.tpm)
+	return err
+}
+
+func isVirtual(h tpm2.TPMHandle) bool {
+	return h >= firstVirtual && h <= lastVirtual
+}
+
+func isSession(h tpm2.TPMHandle) bool {
+	ht := tpm2.TPMHT(h >> 24)
+	return ht == tpm2.TPMHTHMACSession || ht == tpm2.TPMHTPolicySession
+}
+
+func isTransient(h tpm2.TPMHandle) bool {
+	return tpm2.TPMHT(h>>24) == tpm2.TPMHTTransient
+}
+
+func response(rc tpm2.TPMRC) []byte {
+	out := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(out[0:2], tagNoSessions)
+	binary.BigEndian.PutUint32(out[2:6], headerSize)
+	binary.BigEndian.PutUint32(out[6:10], uint32(rc))
+	return out
+}
+
+func responseCode(rsp []byte) tpm2.TPMRC {
+	if len(rsp) < headerSize {
+		return tpm2.TPMRCFailure
+	}
+	return tpm2.TPMRC(binary.BigEndian.Uint32(rsp[6:10]))
+}
+
+// handleError is TPM_RC_HANDLE for the i'th handle of the command.
+func handleError(i int) tpm2.TPMRC {
+	return tpm2.TPMRCHandle + tpm2.TPMRC((i+1)<<8)
+}
+
+// Send implements transport.TPM.
+func (m *Manager) Send(cmd []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, os.ErrClosed
+	}
+	if len(cmd) < headerSize || int(binary.BigEndian.Uint32(cmd[2:6])) != len(cmd) {
+		return response(tpm2.TPMRCCommandSize), nil
+	}
+	tag := binary.BigEndian.Uint16(cmd[0:2])
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(cmd[6:10]))
+	if cc == tpm2.TPMCCFlushContext {
+		return m.flushContext(cmd)
+	}
+	attrs, ok := m.commands[cc]
+	if !ok {
+		return response(tpm2.TPMRCCommandCode), nil
+	}
+
+	// the command is rewritten in place, keep the caller's copy
+	cmd = append([]byte(nil), cmd...)
+	c := &call{
+		cc:     cc,
+		pinned: map[tpm2.TPMHandle]bool{},
+	}
+	handles := cmd[headerSize:]
+	if len(handles) < 4*int(attrs.CHandles) {
+		return response(tpm2.TPMRCCommandSize), nil
+	}
+	for i := range int(attrs.CHandles) {
+		h := tpm2.TPMHandle(binary.BigEndian.Uint32(handles[4*i:]))
+		c.handles = append(c.handles, h)
+		c.pinned[h] = true
+	}
+	if tag == tagSessions {
+		auths := handles[4*int(attrs.CHandles):]
+		if len(auths) < 4 || int(binary.BigEndian.Uint32(auths)) > len(auths)-4 {
+			return response(tpm2.TPMRCAuthSize), nil
+		}
+		area := auths[4 : 4+binary.BigEndian.Uint32(auths)]
+		for len(area) > 0 {
+			// sessionHandle || nonceCaller || sessionAttributes || hmac
+			var s authSession
+			if len(area) < 7 {
+				return response(tpm2.TPMRCAuthSize), nil
+			}
+			s.handle = tpm2.TPMHandle(binary.BigEndian.Uint32(area))
+			n := 6 + int(binary.BigEndian.Uint16(area[4:]))
+			if len(area) < n+3 {
+				return response(tpm2.TPMRCAuthSize), nil
+			}
+			s.continueSession = area[n]&sessionContinue != 0
+			n += 3 + int(binary.BigEndian.Uint16(area[n+1:]))
+			if len(area) < n {
+				return response(tpm2.TPMRCAuthSize), nil
+			}
+			area = area[n:]
+			c.sessions = append(c.sessions, s)
+			c.pinned[s.handle] = true
+		}
+	}
+
+	for i, h := range c.handles {
+		switch {
+		case isVirtual(h):
+			rh, err := m.loadObject(h, c.pinned)
+			if err != nil {
+				return nil, err
+			}
+			if rh == 0 {
+				return response(handleError(i)), nil
+			}
+			binary.BigEndian.PutUint32(handles[4*i:], uint32(rh))
+		case isSession(h):
+			if err := m.loadSession(h, c.pinned); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, s := range c.sessions {
+		if err := m.loadSession(s.handle, c.pinned); err != nil {
+			return nil, err
+		}
+	}
+
+	// make room for what the command creates
+	switch {
+	case cc == tpm2.TPMCCStartAuthSession:
+		if err := m.makeRoom(m.loadedSessions, m.maxSessions, m.evictSession, c.pinned); err != nil {
+			return nil, err
+		}
+	case attrs.RHandle:
+		if err := m.makeRoom(m.loadedObjects, m.maxObjects, m.evictObject, c.pinned); err != nil {
+			return nil, err
+		}
+	}
+
+	rsp, err := m.tpm.Send(cmd)
+	for err == nil {
+		// the TPM has fewer slots than we thought, or the command needs a scratch slot
+		var evict func(map[tpm2.TPMHandle]bool) (bool, error)
+		switch responseCode(rsp) {
+		case tpm2.TPMRCObjectMemory:
+			evict = m.evictObject
+		case tpm2.TPMRCSessionMemory:
+			evict = m.evictSession
+		}
+		if evict == nil {
+			break
+		}
+		ok, evictErr := evict(c.pinned)
+		if evictErr != nil {
+			return nil, evictErr
+		}
+		if !ok {
+			break
+		}
+		rsp, err = m.tpm.Send(cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.clock++
+	for h := range c.pinned {
+		if o, ok := m.objects[h]; ok {
+			o.lastUsed = m.clock
+		}
+		if s, ok := m.sessions[h]; ok {
+			s.lastUsed = m.clock
+		}
+	}
+	if responseCode(rsp) != tpm2.TPMRCSuccess {
+		return rsp, nil
+	}
+	return m.track(c, attrs, rsp)
+}
+
+// call is the part of a command the manager looks at.
+type call struct {
+	cc       tpm2.TPMCC
+	handles  []tpm2.TPMHandle
+	sessions []authSession
+	// pinned are the handles and sessions of the command, they are not evicted while it runs
+	pinned map[tpm2.TPMHandle]bool
+}
+
+type authSession struct {
+	handle          tpm2.TPMHandle
+	continueSession bool
+}
+
+// track records what a successful command created and flushed, and gives new objects a virtual handle.
+func (m *Manager) track(c *call, attrs tpm2.TPMACC, rsp []byte) ([]byte, error) {
+	for _, s := range c.sessions {
+		if !s.continueSession {
+			delete(m.sessions, s.handle)
+		}
+	}
+	if sequenceComplete[c.cc] && len(c.handles) > 0 {
+		delete(m.objects, c.handles[0])
+	}
+	if c.cc == tpm2.TPMCCContextSave && len(c.handles) > 0 && isSession(c.handles[0]) {
+		// the caller saved the session itself, it owns the context now
+		delete(m.sessions, c.handles[0])
+	}
+
+	if !attrs.RHandle || len(rsp) < headerSize+4 {
+		return rsp, nil
+	}
+	h := tpm2.TPMHandle(binary.BigEndian.Uint32(rsp[headerSize:]))
+	switch {
+	case isSession(h):
+		m.sessions[h] = &session{
+			lastUsed: m.clock,
+		}
+	case isTransient(h):
+		v, err := m.virtualHandle()
+		if err != nil {
+			m.flush(h)
+			return nil, err
+		}
+		m.objects[v] = &object{
+			handle:   h,
+			lastUsed: m.clock,
+		}
+		rsp = append([]byte(nil), rsp...)
+		binary.BigEndian.PutUint32(rsp[headerSize:], uint32(v))
+	}
+	return rsp, nil
+}
+
+func (m *Manager) virtualHandle() (tpm2.TPMHandle, error) {
+	for range lastVirtual - firstVirtual + 1 {
+		v := m.nextVirtual
+		m.nextVirtual++
+		if m.nextVirtual > lastVirtual {
+			m.nextVirtual = firstVirtual
+		}
+		if _, ok := m.objects[v]; !ok {
+			return v, nil
+		}
+	}
+	return 0, errors.New("tpmrm: out of virtual handles")
+}
+
+// flushContext flushes a virtual object, which only needs the TPM if it's loaded.  Sessions and other
+// handles are passed through.
+func (m *Manager) flushContext(cmd []byte) ([]byte, error) {
+	if len(cmd) != headerSize+4 {
+		return response(tpm2.TPMRCCommandSize), nil
+	}
+	h := tpm2.TPMHandle(binary.BigEndian.Uint32(cmd[headerSize:]))
+	if !isVirtual(h) {
+		rsp, err := m.tpm.Send(cmd)
+		if err == nil && responseCode(rsp) == tpm2.TPMRCSuccess {
+			delete(m.sessions, h)
+		}
+		return rsp, err
+	}
+	o, ok := m.objects[h]
+	if !ok {
+		return response(handleError(0)), nil
+	}
+	if o.context == nil {
+		if err := m.flush(o.handle); err != nil {
+			return nil, fmt.Errorf("tpmrm: can't flush %#x %v", o.handle, err)
+		}
+	}
+	delete(m.objects, h)
+	return response(tpm2.TPMRCSuccess), nil
+}
+
+func (m *Manager) loadedObjects() int {
+	n := 0
+	for _, o := range m.objects {
+		if o.context == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *Manager) loadedSessions() int {
+	n := 0
+	for _, s := range m.sessions {
+		if s.context == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// makeRoom evicts until fewer than max are loaded, or nothing else can be evicted.
+func (m *Manager) makeRoom(loaded func() int, max int, evict func(map[tpm2.TPMHandle]bool) (bool, error), pinned map[tpm2.TPMHandle]bool) error {
+	for loaded() >= max {
+		ok, err := evict(pinned)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// evictObject saves and flushes the least recently used loaded object that isn't pinned.  It returns
+// false if there is none.
+func (m *Manager) evictObject(pinned map[tpm2.TPMHandle]bool) (bool, error) {
+	var lru *object
+	for v, o := range m.objects {
+		if o.context == nil && !pinned[v] && (lru == nil || o.lastUsed < lru.lastUsed) {
+			lru = o
+		}
+	}
+	if lru == nil {
+		return false, nil
+	}
+	rsp, err := tpm2.ContextSave{
+		SaveHandle: lru.handle,
+	}.Execute(m.tpm)
+	if err != nil {
+		return false, fmt.Errorf("tpmrm: can't save object %#x %v", lru.handle, err)
+	}
+	if err := m.flush(lru.handle); err != nil {
+		return false, fmt.Errorf("tpmrm: can't flush object %#x %v", lru.handle, err)
+	}
+	lru.context = &rsp.Context
+	lru.handle = 0
+	return true, nil
+}
+
+// evictSession saves the least recently used loaded session that isn't pinned.  Saving a session
+// unloads it, it must not be flushed.
+func (m *Manager) evictSession(pinned map[tpm2.TPMHandle]bool) (bool, error) {
+	var lruHandle tpm2.TPMHandle
+	var lru *session
+	for h, s := range m.sessions {
+		if s.context == nil && !pinned[h] && (lru == nil || s.lastUsed < lru.lastUsed) {
+			lruHandle, lru = h, s
+		}
+	}
+	if lru == nil {
+		return false, nil
+	}
+	rsp, err := tpm2.ContextSave{
+		SaveHandle: lruHandle,
+	}.Execute(m.tpm)
+	if err != nil {
+		return false, fmt.Errorf("tpmrm: can't save session %#x %v", lruHandle, err)
+	}
+	lru.context = &rsp.Context
+	return true, nil
+}
+
+// loadObject returns the real handle of the virtual handle v, loading its context if it was evicted.  It
+// returns 0 if v is unknown.
+func (m *Manager) loadObject(v tpm2.TPMHandle, pinned map[tpm2.TPMHandle]bool) (tpm2.TPMHandle, error) {
+	o, ok := m.objects[v]
+	if !ok {
+		return 0, nil
+	}
+	if o.context == nil {
+		return o.handle, nil
+	}
+	if err := m.makeRoom(m.loadedObjects, m.maxObjects, m.evictObject, pinned); err != nil {
+		return 0, err
+	}
+	h, err := m.contextLoad(o.context, m.evictObject, pinned)
+	if err != nil {
+		return 0, fmt.Errorf("tpmrm: can't load object %v", err)
+	}
+	o.handle = h
+	o.context = nil
+	return h, nil
+}
+
+// loadSession loads the context of an evicted session.  Sessions the manager doesn't know are left to
+// the TPM.
+func (m *Manager) loadSession(h tpm2.TPMHandle, pinned map[tpm2.TPMHandle]bool) error {
+	s, ok := m.sessions[h]
+	if !ok || s.context == nil {
+		return nil
+	}
+	if err := m.makeRoom(m.loadedSessions, m.maxSessions, m.evictSession, pinned); err != nil {
+		return err
+	}
+	if _, err := m.contextLoad(s.context, m.evictSession, pinned); err != nil {
+		return fmt.Errorf("tpmrm: can't load session %#x %v", h, err)
+	}
+	s.context = nil
+	return nil
+}
+
+// contextLoad runs TPM2_ContextLoad, evicting more if the TPM is out of memory.
+func (m *Manager) contextLoad(ctx *tpm2.TPMSContext, evict func(map[tpm2.TPMHandle]bool) (bool, error), pinned map[tpm2.TPMHandle]bool) (tpm2.TPMHandle, error) {
+	for {
+		rsp, err := tpm2.ContextLoad{
+			Context: *ctx,
+		}.Execute(m.tpm)
+		if err == nil {
+			return rsp.LoadedHandle, nil
+		}
+		if !errors.Is(err, tpm2.TPMRCObjectMemory) && !errors.Is(err, tpm2.TPMRCSessionMemory) {
+			return 0, err
+		}
+		ok, evictErr := evict(pinned)
+		if evictErr != nil {
+			return 0, evictErr
+		}
+		if !ok {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package tpmrm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/mldsa"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"main/faketpm"
+	"main/tpmpqc"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// newManager returns a manager for a faketpm with two object slots and one session slot, and the ECC SRK
+// created through it.  cfg is passed to New.
+func newManager(t *testing.T, cfg Config) (*Manager, tpm2.NamedHandle) {
+	t.Helper()
+	rwc := faketpm.NewWithConfig(faketpm.Config{
+		ParameterSets:    faketpm.DefaultParameterSets,
+		TransientObjects: 2,
+		LoadedSessions:   1,
+	})
+	t.Cleanup(func() {
+		rwc.Close()
+	})
+	m, err := New(transport.FromReadWriter(rwc), cfg)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	t.Cleanup(func() {
+		m.Close()
+	})
+	srk, closer, err := tpmpqc.SRK(m, tpmpqc.SRKTypeECC, 0)
+	if err != nil {
+		t.Fatalf("SRK() = %v", err)
+	}
+	t.Cleanup(func() {
+		closer()
+	})
+	return m, srk
+}
+
+// evicted returns the virtual handles of the objects that are saved out of the TPM.
+func (m *Manager) evicted() []tpm2.TPMHandle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hs []tpm2.TPMHandle
+	for v, o := range m.objects {
+		if o.context != nil {
+			hs = append(hs, v)
+		}
+	}
+	return hs
+}
+
+func (m *Manager) tracked(v tpm2.TPMHandle) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.objects[v]
+	return ok
+}
+
+func TestNewReadsSlots(t *testing.T) {
+	m, _ := newManager(t, Config{})
+	if m.maxObjects != 2 || m.maxSessions != 1 {
+		t.Fatalf("maxObjects, maxSessions = %d, %d, want 2, 1", m.maxObjects, m.maxSessions)
+	}
+}
+
+func TestConcurrentSignDecapsulate(t *testing.T) {
+	m, srk := newManager(t, Config{})
+	// the SRK and the two keys don't fit in two slots, every command swaps something
+	sk, err := tpmpqc.CreateSigningKey(m, srk, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	defer sk.Close()
+	pub, err := sk.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() = %v", err)
+	}
+	kk, err := tpmpqc.CreateKEMKey(m, srk, tpm2.TPMMLKEM768, nil)
+	if err != nil {
+		t.Fatalf("CreateKEMKey() = %v", err)
+	}
+	defer kk.Close()
+	ek := kk.Encapsulator()
+	if ek == nil {
+		t.Fatalf("Encapsulator() = nil")
+	}
+
+	const workers, iterations = 4, 3
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				message := []byte(fmt.Sprintf("worker %d message %d", w, i))
+				sig, err := sk.Sign(nil, message, crypto.Hash(0))
+				if err != nil {
+					errs <- fmt.Errorf("worker %d: Sign() = %v", w, err)
+					return
+				}
+				if err := mldsa.Verify(pub, message, sig, &mldsa.Options{}); err != nil {
+					errs <- fmt.Errorf("worker %d: mldsa.Verify() = %v", w, err)
+					return
+				}
+				sharedSecret, ciphertext := ek.Encapsulate()
+				ss, err := kk.Decapsulate(ciphertext)
+				if err != nil {
+					errs <- fmt.Errorf("worker %d: Decapsulate() = %v", w, err)
+					return
+				}
+				if !bytes.Equal(ss, sharedSecret) {
+					errs <- fmt.Errorf("worker %d: shared secrets don't match", w)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := m.loadedObjects(); n > 2 {
+		t.Errorf("%d objects loaded, the TPM has 2 slots", n)
+	}
+	if n := m.loadedSessions(); n > 1 {
+		t.Errorf("%d sessions loaded, the TPM has 1 slot", n)
+	}
+}
+
+// TestSequenceOutlivesEviction swaps a sign sequence out between its commands and completes it.
+func TestSequenceOutlivesEviction(t *testing.T) {
+	m, srk := newManager(t, Config{})
+	sk, err := tpmpqc.CreateSigningKey(m, srk, tpm2.TPMMLDSA65, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	defer sk.Close()
+	pub, err := sk.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() = %v", err)
+	}
+	kh := sk.Handle()
+	keyAuth := tpm2.AuthHandle{
+		Handle: kh.Handle,
+		Name:   kh.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}
+
+	start, err := tpm2.SignSequenceStart{
+		KeyHandle: keyAuth,
+	}.Execute(m)
+	if err != nil {
+		t.Fatalf("SignSequenceStart() = %v", err)
+	}
+	seq := tpm2.AuthHandle{
+		Handle: start.SequenceHandle,
+		Name:   kh.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}
+	if !isVirtual(seq.Handle) {
+		t.Fatalf("sequence handle %#x is not virtual", seq.Handle)
+	}
+	if _, err := (tpm2.SequenceUpdate{
+		SequenceHandle: seq,
+		Buffer:         tpm2.TPM2BMaxBuffer{Buffer: []byte("hello ")},
+	}).Execute(m); err != nil {
+		t.Fatalf("SequenceUpdate() = %v", err)
+	}
+
+	// loading another key pushes out the least recently used objects, the SRK and then the sequence
+	kk, err := tpmpqc.CreateKEMKey(m, srk, tpm2.TPMMLKEM768, nil)
+	if err != nil {
+		t.Fatalf("CreateKEMKey() = %v", err)
+	}
+	defer kk.Close()
+	if _, err := kk.Decapsulate(make([]byte, 1088)); err != nil {
+		t.Fatalf("Decapsulate() = %v", err)
+	}
+	evicted := false
+	for _, v := range m.evicted() {
+		evicted = evicted || v == seq.Handle
+	}
+	if !evicted {
+		t.Fatalf("sequence %#x was not evicted", seq.Handle)
+	}
+
+	complete, err := tpm2.SignSequenceComplete{
+		SequenceHandle: seq,
+		KeyHandle:      keyAuth,
+		Buffer:         tpm2.TPM2BMaxBuffer{Buffer: []byte("world")},
+	}.Execute(m)
+	if err != nil {
+		t.Fatalf("SignSequenceComplete() = %v", err)
+	}
+	sig, err := complete.Signature.Signature.MLDSA()
+	if err != nil {
+		t.Fatalf("MLDSA() = %v", err)
+	}
+	if err := mldsa.Verify(pub, []byte("hello world"), sig.Buffer, &mldsa.Options{}); err != nil {
+		t.Fatalf("mldsa.Verify() = %v", err)
+	}
+	// the TPM flushed the sequence, the manager must forget it
+	if m.tracked(seq.Handle) {
+		t.Fatalf("completed sequence %#x is still tracked", seq.Handle)
+	}
+}
+
+// TestFlushContext flushes a loaded and a swapped out object and checks their handles are stale afterwards.
+func TestFlushContext(t *testing.T) {
+	m, srk := newManager(t, Config{})
+	var keys []*tpmpqc.KEMKey
+	for range 3 {
+		k, err := tpmpqc.CreateKEMKey(m, srk, tpm2.TPMMLKEM768, nil)
+		if err != nil {
+			t.Fatalf("CreateKEMKey() = %v", err)
+		}
+		keys = append(keys, k)
+	}
+	evicted := m.evicted()
+	if len(evicted) == 0 {
+		t.Fatalf("no object was evicted")
+	}
+
+	var swapped, loaded tpm2.TPMHandle
+	for _, k := range keys {
+		h := k.Handle().Handle
+		isEvicted := false
+		for _, v := range evicted {
+			isEvicted = isEvicted || v == h
+		}
+		if isEvicted && swapped == 0 {
+			swapped = h
+		}
+		if !isEvicted {
+			loaded = h
+		}
+	}
+	if swapped == 0 || loaded == 0 {
+		t.Fatalf("want a loaded and a swapped out key, evicted %x", evicted)
+	}
+
+	for _, h := range []tpm2.TPMHandle{swapped, loaded} {
+		if _, err := (tpm2.FlushContext{FlushHandle: h}).Execute(m); err != nil {
+			t.Fatalf("FlushContext(%#x) = %v", h, err)
+		}
+		if m.tracked(h) {
+			t.Fatalf("flushed %#x is still tracked", h)
+		}
+		_, err := tpm2.ReadPublic{ObjectHandle: h}.Execute(m)
+		if !errors.Is(err, tpm2.TPMRCHandle) {
+			t.Fatalf("ReadPublic(%#x) after flush = %v, want TPM_RC_HANDLE", h, err)
+		}
+		_, err = tpm2.FlushContext{FlushHandle: h}.Execute(m)
+		if !errors.Is(err, tpm2.TPMRCHandle) {
+			t.Fatalf("second FlushContext(%#x) = %v, want TPM_RC_HANDLE", h, err)
+		}
+	}
+
+	// the remaining key still works
+	for _, k := range keys {
+		h := k.Handle().Handle
+		if h == swapped || h == loaded {
+			continue
+		}
+		ek := k.Encapsulator()
+		if ek == nil {
+			t.Fatalf("Encapsulator() = nil")
+		}
+		sharedSecret, ciphertext := ek.Encapsulate()
+		ss, err := k.Decapsulate(ciphertext)
+		if err != nil {
+			t.Fatalf("Decapsulate() = %v", err)
+		}
+		if !bytes.Equal(ss, sharedSecret) {
+			t.Fatalf("shared secrets don't match")
+		}
+		k.Close()
+	}
+}
+
+// TestObjectMemoryRetry lets the manager think the TPM has more slots than it has, so commands fail with
+// TPM_RC_OBJECT_MEMORY and are retried after an eviction.
+func TestObjectMemoryRetry(t *testing.T) {
+	m, srk := newManager(t, Config{MaxObjects: 4})
+	sk, err := tpmpqc.CreateSigningKey(m, srk, tpm2.TPMMLDSA44, nil)
+	if err != nil {
+		t.Fatalf("CreateSigningKey() = %v", err)
+	}
+	defer sk.Close()
+	pub, err := sk.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey() = %v", err)
+	}
+	kk, err := tpmpqc.CreateKEMKey(m, srk, tpm2.TPMMLKEM512, nil)
+	if err != nil {
+		t.Fatalf("CreateKEMKey() = %v", err)
+	}
+	defer kk.Close()
+	if len(m.evicted()) == 0 {
+		t.Fatalf("no object was evicted")
+	}
+
+	message := []byte("retry")
+	sig, err := sk.Sign(nil, message, crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	if err := mldsa.Verify(pub, message, sig, &mldsa.Options{}); err != nil {
+		t.Fatalf("mldsa.Verify() = %v", err)
+	}
+	ek := kk.Encapsulator()
+	if ek == nil {
+		t.Fatalf("Encapsulator() = nil")
+	}
+	sharedSecret, ciphertext := ek.Encapsulate()
+	ss, err := kk.Decapsulate(ciphertext)
+	if err != nil {
+		t.Fatalf("Decapsulate() = %v", err)
+	}
+	if !bytes.Equal(ss, sharedSecret) {
+		t.Fatalf("shared secrets don't match")
+	}
+}